@@ -0,0 +1,70 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+)
+
+var ackMetrics = expvar.NewMap("ack")
+
+// AckConfig: Mode is when the data packets are acked. "received" (default) acks a packet as soon as it's decoded,
+// "accepted" once the stages and the sinks took it, a packet a sink failed is acked with 0 records and the device
+// sends it again (the stages run in the connection goroutines then, not with the pipeline section). "none" never
+// acks, the devices resend their records until another server takes them
+type AckConfig struct {
+	Mode string `json:"mode"`
+}
+
+// AckPolicy decides the ack of a data packet after it's handled (TCPServer.Acknowledge)
+type AckPolicy struct {
+	mode   string
+	logger *Logger
+	// Dedup is the deduplicator of the stages, in "accepted" mode it's deferred and the fingerprints of a packet
+	// are committed when it's acked, the records of a rejected packet aren't dropped when the device resends them
+	Dedup *Deduplicator
+}
+
+// NewAckPolicy checks the mode, "accepted" needs the sink errors so it doesn't go with the pipeline workers nor
+// with the reorder stage (the records it holds back reach the sinks after the ack)
+func NewAckPolicy(config *AckConfig, pipelined bool, reordered bool, logger *Logger) (*AckPolicy, error) {
+	switch config.Mode {
+	case "", "received", "none":
+	case "accepted":
+		if pipelined {
+			return nil, fmt.Errorf("ack mode accepted requires no pipeline section")
+		}
+		if reordered {
+			return nil, fmt.Errorf("ack mode accepted requires no reorder section")
+		}
+	default:
+		return nil, fmt.Errorf("unknown ack mode %q", config.Mode)
+	}
+	return &AckPolicy{mode: config.Mode, logger: logger}, nil
+}
+
+// Accepted tells if the packets are acked once the sinks took them
+func (a *AckPolicy) Accepted() bool {
+	return a.mode == "accepted"
+}
+
+// Deferred tells if the policy needs the result of the handling, the acks are written by the server otherwise
+func (a *AckPolicy) Deferred() bool {
+	return a.mode == "accepted" || a.mode == "none"
+}
+
+// Acknowledge returns the ack of the packet, nil for no ack
+func (a *AckPolicy) Acknowledge(imei string, pkt *teltonika.Packet, response []byte, err error) []byte {
+	switch {
+	case a.mode == "none":
+		ackMetrics.Add("suppressed", 1)
+		return nil
+	case a.mode == "accepted" && err != nil:
+		ackMetrics.Add("rejected", 1)
+		a.logger.Error.Printf("[%s]: %d records rejected, the device sends them again (%v)", imei, len(pkt.Data), err)
+		return make([]byte, len(response))
+	case a.mode == "accepted" && a.Dedup != nil:
+		a.Dedup.Commit(imei, pkt)
+	}
+	ackMetrics.Add("acked", 1)
+	return response
+}
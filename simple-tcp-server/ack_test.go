@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestNewAckPolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		mode      string
+		pipelined bool
+		reordered bool
+		err       bool
+	}{
+		{"received", "", true, true, false},
+		{"none", "none", true, true, false},
+		{"accepted", "accepted", false, false, false},
+		{"accepted pipelined", "accepted", true, false, true},
+		{"accepted reordered", "accepted", false, true, true},
+		{"unknown", "later", false, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewAckPolicy(&AckConfig{Mode: tt.mode}, tt.pipelined, tt.reordered, testLogger())
+			if (err != nil) != tt.err {
+				t.Errorf("NewAckPolicy() error %v, want error %v", err, tt.err)
+			}
+		})
+	}
+}
+
+// TestAckAcceptedDedup sends a packet a sink fails, the device resends it after the nack and its records are
+// delivered then, a resend after the ack is dropped
+func TestAckAcceptedDedup(t *testing.T) {
+	dedup, err := NewDeduplicator(nil, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack, err := NewAckPolicy(&AckConfig{Mode: "accepted"}, false, false, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dedup.Deferred = true
+	ack.Dedup = dedup
+
+	fail := true
+	var delivered []int
+	pipeline := NewPipeline([]Sink{sinkFunc(func(imei string, pkt *AnnotatedPacket) error {
+		if fail {
+			fail = false
+			return errors.New("hook unreachable")
+		}
+		delivered = append(delivered, len(pkt.Data))
+		return nil
+	})}, testLogger())
+	pipeline.Stages = []Stage{dedup}
+
+	tests := []struct {
+		name      string
+		ack       string
+		delivered []int
+	}{
+		{"sink failed", "00 00 00 00", nil},
+		{"resent after the nack", "00 00 00 03", []int{3}},
+		{"resent after the ack", "00 00 00 03", []int{3}},
+	}
+	for _, tt := range tests {
+		pkt := testPacket(3)
+		err := pipeline.Handle("352093081452251", pkt)
+		if got := ack.Acknowledge("352093081452251", pkt, dataResponse(pkt), err); !bytes.Equal(got, unhex(t, tt.ack)) {
+			t.Errorf("%s: ack % x, want %s", tt.name, got, tt.ack)
+		}
+		if !reflect.DeepEqual(delivered, tt.delivered) {
+			t.Errorf("%s: delivered %v, want %v", tt.name, delivered, tt.delivered)
+		}
+	}
+}
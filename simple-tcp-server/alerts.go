@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AlertsConfig holds the built-in alert rules, for every device the first rule matching its imei applies,
+// and the condition rules (all matching ones apply)
+type AlertsConfig struct {
+	Overspeed []*OverspeedRule `json:"overspeed"`
+	Idle      []*IdleRule      `json:"idle"`
+	Rules     []*ConditionRule `json:"rules"`
+}
+
+// DeviceSelector selects devices by imei, imei prefix or group (all devices if all are empty)
+type DeviceSelector struct {
+	Imeis        []string `json:"imeis"`
+	ImeiPrefixes []string `json:"imeiPrefixes"`
+	Groups       []string `json:"groups"`
+}
+
+// OverspeedRule: the alert starts after the speed stays over LimitKmh for MinSeconds
+// and ends once the speed drops HysteresisKmh (default 5) under the limit
+type OverspeedRule struct {
+	DeviceSelector
+	Group         string  `json:"group"`
+	LimitKmh      float64 `json:"limitKmh"`
+	MinSeconds    int     `json:"minSeconds"`
+	HysteresisKmh float64 `json:"hysteresisKmh"`
+}
+
+// ConditionRule raises the alert when Condition (see CompileCondition) holds for MinSeconds,
+// the alert ends when ClearCondition holds (when Condition stops holding if empty)
+type ConditionRule struct {
+	DeviceSelector
+	Name           string `json:"name"`
+	Condition      string `json:"condition"`
+	ClearCondition string `json:"clearCondition"`
+	MinSeconds     int    `json:"minSeconds"`
+	raise          *Condition
+	clear          *Condition
+}
+
+// IdleRule: the alert starts after the device stands with the ignition on for ThresholdSeconds
+type IdleRule struct {
+	DeviceSelector
+	Group            string `json:"group"`
+	ThresholdSeconds int    `json:"thresholdSeconds"`
+}
+
+func (s *DeviceSelector) Match(imei string) bool {
+	if len(s.Imeis) == 0 && len(s.ImeiPrefixes) == 0 && len(s.Groups) == 0 {
+		return true
+	}
+	if containsString(s.Imeis, imei) || deviceGroups.Member(imei, s.Groups) {
+		return true
+	}
+	for _, prefix := range s.ImeiPrefixes {
+		if strings.HasPrefix(imei, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// alertState tracks a condition with start/end semantics: the alert starts when the raise condition
+// holds for the delay and ends when the clear condition is met
+type alertState struct {
+	active  bool
+	pending time.Time
+	since   time.Time
+	peak    float64
+}
+
+func (a *alertState) update(t time.Time, raise bool, clear bool, delay time.Duration) (started bool, ended bool) {
+	if a.active {
+		if clear {
+			a.active = false
+			return false, true
+		}
+		return false, false
+	}
+	if !raise {
+		a.pending = time.Time{}
+		return false, false
+	}
+	if a.pending.IsZero() {
+		a.pending = t
+	}
+	if t.Sub(a.pending) < delay {
+		return false, false
+	}
+	a.active, a.since, a.pending = true, a.pending, time.Time{}
+	return true, false
+}
+
+// alertEvent builds alert.<name>.start / alert.<name>.end events, end events have the alert duration
+func alertEvent(name string, started bool, imei string, record *teltonika.Data, state *alertState, data map[string]any) *Event {
+	if data == nil {
+		data = make(map[string]any)
+	}
+	data["since"] = state.since.UTC().Format(time.RFC3339)
+	phase := "start"
+	if !started {
+		phase = "end"
+		data["durationSeconds"] = int64(time.UnixMilli(int64(record.TimestampMs)).Sub(state.since).Seconds())
+	}
+	return NewEvent("alert."+name+"."+phase, imei, record, data)
+}
+
+// AlertRules evaluates the overspeed, idle and condition rules
+type AlertRules struct {
+	config  *AlertsConfig
+	devices sync.Map
+}
+
+type alertDevice struct {
+	mutex     sync.Mutex
+	overspeed alertState
+	idle      alertState
+	rules     map[string]*alertState
+}
+
+func NewAlertRules(config *AlertsConfig) (*AlertRules, error) {
+	if config == nil {
+		config = &AlertsConfig{}
+	}
+	for _, rule := range config.Rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("alert rule '%s' has no name", rule.Condition)
+		}
+		var err error
+		if rule.raise, err = CompileCondition(rule.Condition); err != nil {
+			return nil, fmt.Errorf("alert rule '%s': %v", rule.Name, err)
+		}
+		if rule.ClearCondition != "" {
+			if rule.clear, err = CompileCondition(rule.ClearCondition); err != nil {
+				return nil, fmt.Errorf("alert rule '%s': %v", rule.Name, err)
+			}
+		}
+	}
+	return &AlertRules{config: config}, nil
+}
+
+func (a *AlertRules) overspeedRule(imei string) *OverspeedRule {
+	for _, rule := range a.config.Overspeed {
+		if rule.Match(imei) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (a *AlertRules) idleRule(imei string) *IdleRule {
+	for _, rule := range a.config.Idle {
+		if rule.Match(imei) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (a *AlertRules) Process(imei string, pkt *teltonika.Packet) []*Event {
+	overspeed, idle := a.overspeedRule(imei), a.idleRule(imei)
+	if overspeed == nil && idle == nil && len(a.config.Rules) == 0 {
+		return nil
+	}
+	value, _ := a.devices.LoadOrStore(imei, &alertDevice{rules: make(map[string]*alertState)})
+	device := value.(*alertDevice)
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	var events []*Event
+	for i := range pkt.Data {
+		record := &pkt.Data[i]
+		recordTime := time.UnixMilli(int64(record.TimestampMs))
+		speed := float64(record.Speed)
+
+		if overspeed != nil {
+			hysteresis := overspeed.HysteresisKmh
+			if hysteresis <= 0 {
+				hysteresis = 5
+			}
+			state := &device.overspeed
+			started, ended := state.update(recordTime, speed > overspeed.LimitKmh, speed <= overspeed.LimitKmh-hysteresis,
+				time.Duration(overspeed.MinSeconds)*time.Second)
+			if started {
+				state.peak = 0
+			}
+			if state.active && speed > state.peak {
+				state.peak = speed
+			}
+			if started || ended {
+				events = append(events, alertEvent("overspeed", started, imei, record, state, map[string]any{
+					"group":    overspeed.Group,
+					"limitKmh": overspeed.LimitKmh,
+					"maxSpeed": state.peak,
+				}))
+			}
+		}
+
+		var index *IOIndex
+		for _, rule := range a.config.Rules {
+			if !rule.Match(imei) {
+				continue
+			}
+			if index == nil {
+				index = NewIOIndex(record)
+			}
+			state, ok := device.rules[rule.Name]
+			if !ok {
+				state = &alertState{}
+				device.rules[rule.Name] = state
+			}
+			raise := rule.raise.EvalIndexed(record, index)
+			clear := !raise
+			if rule.clear != nil {
+				clear = rule.clear.EvalIndexed(record, index)
+			}
+			started, ended := state.update(recordTime, raise, clear, time.Duration(rule.MinSeconds)*time.Second)
+			if started || ended {
+				events = append(events, alertEvent(rule.Name, started, imei, record, state, map[string]any{"condition": rule.Condition}))
+			}
+		}
+
+		if idle != nil {
+			ignition, ok := ioUint(record, ioNames["ignition"])
+			if !ok {
+				continue
+			}
+			threshold := idle.ThresholdSeconds
+			if threshold <= 0 {
+				threshold = 300
+			}
+			idling := ignition != 0 && record.Speed == 0
+			state := &device.idle
+			started, ended := state.update(recordTime, idling, !idling, time.Duration(threshold)*time.Second)
+			if started || ended {
+				events = append(events, alertEvent("idle", started, imei, record, state, map[string]any{"group": idle.Group}))
+			}
+		}
+	}
+	return events
+}
+
+// Purge forgets the device (a Purger)
+func (a *AlertRules) Purge(imei string) (int, error) {
+	return purgeSyncMap(&a.devices, imei), nil
+}
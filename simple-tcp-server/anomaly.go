@@ -0,0 +1,229 @@
+package main
+
+import (
+	"expvar"
+	"sort"
+	"sync"
+	"time"
+)
+
+var anomalyMetrics = expvar.NewMap("anomalies")
+
+// AnomaliesConfig: the reporting behavior of every device is learned from its first LearnRecords (default 100)
+// records: the packet rate (a moving average of the arrival interval) and the IO elements it sends (the typical
+// ones are in at least TypicalPercent, default 90, of the records). Then the detector emits anomaly.flood when a
+// device sends more than FloodFactor (default 5) times its usual packets in a minute (at least MinFloodPackets,
+// default 20), anomaly.io_missing when a typical element (the ignition of a rewired device, ...) is missing from
+// MissingRecords (default 20) records in a row and anomaly.io_new when an element the device never sent appears
+type AnomaliesConfig struct {
+	LearnRecords    int     `json:"learnRecords"`
+	TypicalPercent  float64 `json:"typicalPercent"`
+	FloodFactor     float64 `json:"floodFactor"`
+	MinFloodPackets int     `json:"minFloodPackets"`
+	MissingRecords  int     `json:"missingRecords"`
+}
+
+// AnomalyDetector tracks the baselines of the devices, Seen is called for every packet at its receive time,
+// Publish delivers the events
+type AnomalyDetector struct {
+	learnRecords int
+	typical      float64
+	floodFactor  float64
+	minFlood     int
+	missing      int
+	mutex        sync.Mutex
+	devices      map[string]*anomalyDevice
+	Publish      func(events ...*Event)
+}
+
+type anomalyDevice struct {
+	interval      time.Duration
+	lastSeen      time.Time
+	window        time.Time
+	windowPackets int
+	flooding      bool
+	records       int
+	counts        map[uint16]int
+	known         map[uint16]bool
+	typical       map[uint16]int
+}
+
+// Baseline is what the detector learned of a device, served by the api. TypicalIO are the elements expected in
+// every record, MissingIO the typical elements missing for too long
+type Baseline struct {
+	Learned         bool     `json:"learned"`
+	Records         int      `json:"records"`
+	IntervalSeconds float64  `json:"intervalSeconds"`
+	Flooding        bool     `json:"flooding"`
+	KnownIO         []string `json:"knownIo"`
+	TypicalIO       []string `json:"typicalIo"`
+	MissingIO       []string `json:"missingIo"`
+}
+
+func NewAnomalyDetector(config *AnomaliesConfig) *AnomalyDetector {
+	a := &AnomalyDetector{learnRecords: 100, typical: 90, floodFactor: 5, minFlood: 20, missing: 20,
+		devices: make(map[string]*anomalyDevice)}
+	if config.LearnRecords > 0 {
+		a.learnRecords = config.LearnRecords
+	}
+	if config.TypicalPercent > 0 {
+		a.typical = config.TypicalPercent
+	}
+	if config.FloodFactor > 0 {
+		a.floodFactor = config.FloodFactor
+	}
+	if config.MinFloodPackets > 0 {
+		a.minFlood = config.MinFloodPackets
+	}
+	if config.MissingRecords > 0 {
+		a.missing = config.MissingRecords
+	}
+	return a
+}
+
+// Seen updates the baseline of the device with the packet, or compares the packet with it once learned
+func (a *AnomalyDetector) Seen(imei string, pkt *teltonika.Packet) {
+	now := time.Now()
+	a.mutex.Lock()
+	device, ok := a.devices[imei]
+	if !ok {
+		device = &anomalyDevice{window: now, counts: make(map[uint16]int)}
+		a.devices[imei] = device
+	}
+	var events []*Event
+	event := func(eventType string, data map[string]any) {
+		e := &Event{Type: eventType, Imei: imei, Time: now.UTC(), Data: data}
+		if len(pkt.Data) > 0 {
+			e.Lat, e.Lng = pkt.Data[len(pkt.Data)-1].Lat, pkt.Data[len(pkt.Data)-1].Lng
+		}
+		events = append(events, e)
+		anomalyMetrics.Add(eventType, 1)
+	}
+
+	if now.Sub(device.window) >= time.Minute {
+		if device.flooding && float64(device.windowPackets) <= a.floodThreshold(device) {
+			device.flooding = false
+			event("anomaly.flood_ended", map[string]any{"packets": device.windowPackets})
+		}
+		device.window, device.windowPackets = now, 0
+	}
+	device.windowPackets++
+	if !device.lastSeen.IsZero() && !device.flooding {
+		// the flood doesn't become the baseline
+		gap := now.Sub(device.lastSeen)
+		if device.interval == 0 {
+			device.interval = gap
+		} else {
+			device.interval = (device.interval*9 + gap) / 10
+		}
+	}
+	device.lastSeen = now
+	if device.typical != nil && !device.flooding && device.windowPackets >= a.minFlood &&
+		float64(device.windowPackets) > a.floodThreshold(device) {
+		device.flooding = true
+		event("anomaly.flood", map[string]any{"packets": device.windowPackets, "windowSeconds": 60,
+			"usualPackets": a.usualPackets(device)})
+	}
+
+	for i := range pkt.Data {
+		record := &pkt.Data[i]
+		if device.typical == nil {
+			a.learn(device, record)
+			continue
+		}
+		for _, el := range record.Elements {
+			if !device.known[el.Id] {
+				device.known[el.Id] = true
+				event("anomaly.io_new", map[string]any{"io": el.Id, "name": ioName(el.Id)})
+			}
+		}
+		for id, missing := range device.typical {
+			if _, ok := findElement(record, id); ok {
+				device.typical[id] = 0
+				continue
+			}
+			device.typical[id] = missing + 1
+			if missing+1 == a.missing {
+				event("anomaly.io_missing", map[string]any{"io": id, "name": ioName(id), "records": a.missing})
+			}
+		}
+	}
+	a.mutex.Unlock()
+	if len(events) > 0 && a.Publish != nil {
+		a.Publish(events...)
+	}
+}
+
+// learn counts the elements of the record, the baseline is set after learnRecords records
+func (a *AnomalyDetector) learn(device *anomalyDevice, record *teltonika.Data) {
+	seen := make(map[uint16]bool, len(record.Elements))
+	for _, el := range record.Elements {
+		if !seen[el.Id] {
+			seen[el.Id] = true
+			device.counts[el.Id]++
+		}
+	}
+	device.records++
+	if device.records < a.learnRecords {
+		return
+	}
+	device.known = make(map[uint16]bool, len(device.counts))
+	device.typical = make(map[uint16]int)
+	for id, count := range device.counts {
+		device.known[id] = true
+		if float64(count)*100 >= a.typical*float64(device.records) {
+			device.typical[id] = 0
+		}
+	}
+	device.counts = nil
+	anomalyMetrics.Add("learned", 1)
+}
+
+// usualPackets is the packets of a minute at the learned rate
+func (a *AnomalyDetector) usualPackets(device *anomalyDevice) float64 {
+	if device.interval <= 0 {
+		return 0
+	}
+	return float64(time.Minute) / float64(device.interval)
+}
+
+func (a *AnomalyDetector) floodThreshold(device *anomalyDevice) float64 {
+	return a.usualPackets(device) * a.floodFactor
+}
+
+// Baseline returns the baseline of the device, nil if it sent nothing yet
+func (a *AnomalyDetector) Baseline(imei string) *Baseline {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	device, ok := a.devices[imei]
+	if !ok {
+		return nil
+	}
+	baseline := &Baseline{Learned: device.typical != nil, Records: device.records,
+		IntervalSeconds: device.interval.Seconds(), Flooding: device.flooding,
+		KnownIO: make([]string, 0), TypicalIO: make([]string, 0), MissingIO: make([]string, 0)}
+	for id := range device.known {
+		baseline.KnownIO = append(baseline.KnownIO, ioName(id))
+	}
+	for id, missing := range device.typical {
+		baseline.TypicalIO = append(baseline.TypicalIO, ioName(id))
+		if missing >= a.missing {
+			baseline.MissingIO = append(baseline.MissingIO, ioName(id))
+		}
+	}
+	sort.Strings(baseline.KnownIO)
+	sort.Strings(baseline.TypicalIO)
+	sort.Strings(baseline.MissingIO)
+	return baseline
+}
+
+// Purge forgets the baseline of the device (a Purger)
+func (a *AnomalyDetector) Purge(imei string) (int, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if _, ok := a.devices[imei]; !ok {
+		return 0, nil
+	}
+	delete(a.devices, imei)
+	return 1, nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditConfig: every command sent to the devices and every response is appended to File (json lines).
+// ApiKeys maps the api keys (X-Api-Key header or bearer token) to the operator names recorded with the commands
+// sent through the api, with RequireApiKey the command endpoints (commands, immobilize, shadow, firmware update,
+// campaigns, schedules) and the audit reject requests without a known key
+type AuditConfig struct {
+	File          string            `json:"file"`
+	ApiKeys       map[string]string `json:"apiKeys"`
+	RequireApiKey bool              `json:"requireApiKey"`
+}
+
+// AuditEntry is a command ("command", Text is the command) or its outcome ("response", Text is the response,
+// LatencyMs the time since the command was sent), CommandId links them
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	Kind      string    `json:"kind"`
+	CommandId string    `json:"commandId"`
+	Imei      string    `json:"imei"`
+	Operator  string    `json:"operator"`
+	Channel   string    `json:"channel"`
+	Status    string    `json:"status"`
+	Text      string    `json:"text,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	LatencyMs int64     `json:"latencyMs,omitempty"`
+}
+
+type AuditLog struct {
+	config *AuditConfig
+	logger *Logger
+	mutex  sync.Mutex
+}
+
+func NewAuditLog(config *AuditConfig, logger *Logger) (*AuditLog, error) {
+	if config.File == "" {
+		return nil, fmt.Errorf("audit requires file")
+	}
+	return &AuditLog{config: config, logger: logger}, nil
+}
+
+// Operator returns the operator of the api request, "" for an anonymous request,
+// false if the request must be rejected
+func (a *AuditLog) Operator(r *http.Request) (string, bool) {
+	key := r.Header.Get("X-Api-Key")
+	if key == "" {
+		key = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if operator, ok := a.config.ApiKeys[key]; ok && key != "" {
+		return operator, true
+	}
+	return "", !a.config.RequireApiKey
+}
+
+// Write appends the entry to the file
+func (a *AuditLog) Write(entry *AuditEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		a.logger.Error.Printf("audit marshaling error (%v)", err)
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	file, err := os.OpenFile(a.config.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		a.logger.Error.Printf("audit write error (%v)", err)
+		return
+	}
+	defer file.Close()
+	if _, err = file.Write(append(data, '\n')); err != nil {
+		a.logger.Error.Printf("audit write error (%v)", err)
+	}
+}
+
+// AuditQuery selects entries, the empty fields match all entries
+type AuditQuery struct {
+	Imei     string
+	Operator string
+	From     time.Time
+	To       time.Time
+	Limit    int
+}
+
+func (q *AuditQuery) match(entry *AuditEntry) bool {
+	return (q.Imei == "" || entry.Imei == q.Imei) && (q.Operator == "" || entry.Operator == q.Operator) &&
+		(q.From.IsZero() || !entry.Time.Before(q.From)) && (q.To.IsZero() || entry.Time.Before(q.To))
+}
+
+// Query returns the matching entries, oldest first, the latest Limit ones if Limit is set
+func (a *AuditLog) Query(query *AuditQuery) ([]*AuditEntry, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	file, err := os.Open(a.config.File)
+	if os.IsNotExist(err) {
+		return []*AuditEntry{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("audit read error (%v)", err)
+	}
+	defer file.Close()
+	entries := make([]*AuditEntry, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		entry := &AuditEntry{}
+		if err = json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			return nil, fmt.Errorf("audit parse error (%v)", err)
+		}
+		if query.match(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("audit read error (%v)", err)
+	}
+	if query.Limit > 0 && len(entries) > query.Limit {
+		entries = entries[len(entries)-query.Limit:]
+	}
+	return entries, nil
+}
+
+// ServeHTTP handles GET /audit?imei=...&operator=...&from=...&to=...&limit=..., from and to are RFC 3339 times,
+// with format=csv the entries are exported as csv
+func (a *AuditLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := authorize(w, r, a.Operator); !ok {
+		return
+	}
+	params := r.URL.Query()
+	query := &AuditQuery{Imei: params.Get("imei"), Operator: params.Get("operator")}
+	var err error
+	for name, t := range map[string]*time.Time{"from": &query.From, "to": &query.To} {
+		if value := params.Get(name); value != "" {
+			if *t, err = time.Parse(time.RFC3339, value); err != nil {
+				http.Error(w, "invalid "+name+" ("+err.Error()+")", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if value := params.Get("limit"); value != "" {
+		if query.Limit, err = strconv.Atoi(value); err != nil {
+			http.Error(w, "invalid limit ("+err.Error()+")", http.StatusBadRequest)
+			return
+		}
+	}
+	entries, err := a.Query(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if params.Get("format") != "csv" {
+		writeJson(w, http.StatusOK, entries)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", "attachment; filename=audit.csv")
+	writer := csv.NewWriter(w)
+	_ = writer.Write([]string{"time", "kind", "commandId", "imei", "operator", "channel", "status", "latencyMs", "text", "error"})
+	for _, entry := range entries {
+		_ = writer.Write([]string{entry.Time.Format(time.RFC3339Nano), entry.Kind, entry.CommandId, entry.Imei,
+			entry.Operator, entry.Channel, entry.Status, strconv.FormatInt(entry.LatencyMs, 10), entry.Text, entry.Error})
+	}
+	writer.Flush()
+}
+
+// ExpireBefore removes the entries older than the time (an Expirer). The audit isn't purged with the data of a
+// device, it records the purge
+func (a *AuditLog) ExpireBefore(before time.Time) (int, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return rewriteJsonLines(a.config.File, func(line []byte) bool {
+		entry := &AuditEntry{}
+		return json.Unmarshal(line, entry) == nil && entry.Time.Before(before)
+	})
+}
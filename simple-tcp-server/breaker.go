@@ -0,0 +1,123 @@
+package main
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+var breakersMetrics = expvar.NewMap("breakers")
+
+// BreakerConfig: the delivery of a sink stops after Failures (default 5) consecutive failed attempts (the
+// circuit opens) for OpenSeconds (default 30), then a single attempt probes the endpoint: a success closes the
+// circuit, a failure opens it again. While the circuit is open the queued payloads wait instead of burning their
+// attempts into the dead letters, the hooks without queueDir spill the new payloads to SpillDir (a disk queue by
+// hook) so the memory queue doesn't overflow
+type BreakerConfig struct {
+	Failures    int    `json:"failures"`
+	OpenSeconds int    `json:"openSeconds"`
+	SpillDir    string `json:"spillDir"`
+}
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "halfOpen"
+)
+
+// CircuitBreaker guards the deliveries of a sink, the workers call Wait before an attempt and Done with its result.
+// A nil breaker lets everything through
+type CircuitBreaker struct {
+	name     string
+	failures int
+	openFor  time.Duration
+	logger   *Logger
+	metrics  *expvar.Map
+	mutex    sync.Mutex
+	state    string
+	failed   int
+	openedAt time.Time
+}
+
+// NewCircuitBreaker returns nil if config is nil
+func NewCircuitBreaker(name string, config *BreakerConfig, logger *Logger) *CircuitBreaker {
+	if config == nil {
+		return nil
+	}
+	b := &CircuitBreaker{name: name, failures: 5, openFor: time.Second * 30, logger: logger, state: breakerClosed}
+	if config.Failures > 0 {
+		b.failures = config.Failures
+	}
+	if config.OpenSeconds > 0 {
+		b.openFor = time.Duration(config.OpenSeconds) * time.Second
+	}
+	b.metrics = new(expvar.Map).Init()
+	b.metrics.Set("state", expvar.Func(func() any {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		return b.state
+	}))
+	breakersMetrics.Set(name, b.metrics)
+	return b
+}
+
+// Wait blocks while the circuit is open, the first caller after OpenSeconds makes the probe attempt, the others
+// wait for its result
+func (b *CircuitBreaker) Wait() {
+	if b == nil {
+		return
+	}
+	for {
+		b.mutex.Lock()
+		if b.state == breakerClosed {
+			b.mutex.Unlock()
+			return
+		}
+		wait := time.Until(b.openedAt.Add(b.openFor))
+		if b.state == breakerOpen && wait <= 0 {
+			b.state = breakerHalfOpen
+			b.metrics.Add("probes", 1)
+			b.mutex.Unlock()
+			return
+		}
+		b.mutex.Unlock()
+		if wait <= 0 {
+			wait = time.Second
+		}
+		time.Sleep(wait)
+	}
+}
+
+// Done records the result of an attempt
+func (b *CircuitBreaker) Done(err error) {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err == nil {
+		if b.state != breakerClosed {
+			b.logger.Info.Printf("'%s' circuit closed", b.name)
+		}
+		b.state, b.failed = breakerClosed, 0
+		return
+	}
+	b.failed++
+	if b.state == breakerHalfOpen || b.state == breakerClosed && b.failed >= b.failures {
+		if b.state == breakerClosed {
+			b.logger.Error.Printf("'%s' circuit open after %d failures (%v)", b.name, b.failed, err)
+		}
+		b.state, b.openedAt = breakerOpen, time.Now()
+		b.metrics.Add("opened", 1)
+	}
+}
+
+// Open tells if the deliveries are stopped (open or probing)
+func (b *CircuitBreaker) Open() bool {
+	if b == nil {
+		return false
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state != breakerClosed
+}
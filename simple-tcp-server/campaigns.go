@@ -0,0 +1,428 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CampaignsConfig: campaigns are kept in File (resumed after a restart) if set. Concurrency (default 5) is the
+// default number of devices a campaign works on at once, MaxAttempts (default 3) the attempts per device,
+// RetrySeconds (default 60) the wait before a retry (and between the checks of offline devices)
+type CampaignsConfig struct {
+	File         string `json:"file"`
+	Concurrency  int    `json:"concurrency"`
+	MaxAttempts  int    `json:"maxAttempts"`
+	RetrySeconds int    `json:"retrySeconds"`
+}
+
+// Campaign rolls a command or a parameter set out to devices on behalf of Operator, Status is running, paused,
+// cancelled or done
+type Campaign struct {
+	Id          string                     `json:"id"`
+	Name        string                     `json:"name"`
+	Command     *CampaignCommand           `json:"command,omitempty"`
+	Parameters  map[string]any             `json:"parameters,omitempty"`
+	Concurrency int                        `json:"concurrency"`
+	MaxAttempts int                        `json:"maxAttempts"`
+	Status      string                     `json:"status"`
+	Created     time.Time                  `json:"created"`
+	Operator    string                     `json:"operator"`
+	Devices     map[string]*CampaignDevice `json:"devices"`
+	commands    []string
+	active      bool
+}
+
+type CampaignCommand struct {
+	Name string   `json:"name"`
+	Args []string `json:"args"`
+}
+
+// CampaignDevice is the progress of a device, Status is pending, running, done or failed
+type CampaignDevice struct {
+	Status    string    `json:"status"`
+	Attempts  int       `json:"attempts"`
+	Response  string    `json:"response,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Updated   time.Time `json:"updated"`
+	retryTime time.Time
+}
+
+// CampaignProgress counts the devices of a campaign by status
+type CampaignProgress struct {
+	Id       string         `json:"id"`
+	Name     string         `json:"name"`
+	Status   string         `json:"status"`
+	Devices  int            `json:"devices"`
+	Statuses map[string]int `json:"statuses"`
+}
+
+// CampaignManager runs the campaigns, Execute sends a command and waits for the response, Online tells
+// the connected devices, Authorize returns the operator of an api request (set by the caller)
+type CampaignManager struct {
+	Execute     func(imei string, cmd string, timeout time.Duration, operator string) (string, error)
+	Online      func(imei string) bool
+	Authorize   func(r *http.Request) (string, bool)
+	file        string
+	concurrency int
+	maxAttempts int
+	retry       time.Duration
+	logger      *Logger
+	mutex       sync.Mutex
+	campaigns   map[string]*Campaign
+	nextId      int
+}
+
+func NewCampaignManager(config *CampaignsConfig, logger *Logger) (*CampaignManager, error) {
+	if config == nil {
+		config = &CampaignsConfig{}
+	}
+	m := &CampaignManager{
+		file:        config.File,
+		concurrency: 5,
+		maxAttempts: 3,
+		retry:       time.Minute,
+		logger:      logger,
+		campaigns:   make(map[string]*Campaign),
+	}
+	if config.Concurrency > 0 {
+		m.concurrency = config.Concurrency
+	}
+	if config.MaxAttempts > 0 {
+		m.maxAttempts = config.MaxAttempts
+	}
+	if config.RetrySeconds > 0 {
+		m.retry = time.Duration(config.RetrySeconds) * time.Second
+	}
+	if m.file == "" {
+		return m, nil
+	}
+	data, err := os.ReadFile(m.file)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("campaigns read error (%v)", err)
+	}
+	if err = json.Unmarshal(data, &m.campaigns); err != nil {
+		return nil, fmt.Errorf("campaigns parse error (%v)", err)
+	}
+	for id, campaign := range m.campaigns {
+		if campaign.commands, err = campaign.build(); err != nil {
+			return nil, fmt.Errorf("campaign '%s': %v", id, err)
+		}
+		for _, device := range campaign.Devices {
+			// interrupted by the restart
+			if device.Status == "running" {
+				device.Status = "pending"
+			}
+		}
+		if n, err := strconv.Atoi(id); err == nil && n > m.nextId {
+			m.nextId = n
+		}
+	}
+	return m, nil
+}
+
+// Start runs the campaigns left running before a restart, it must be called once Execute and Online are set
+func (m *CampaignManager) Start() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, campaign := range m.campaigns {
+		if campaign.Status == "running" {
+			go m.run(campaign)
+		}
+	}
+}
+
+// build turns the campaign into command texts, a parameter set is split into several setparam commands
+func (c *Campaign) build() ([]string, error) {
+	if c.Command != nil {
+		command, err := NewCommand(c.Command.Name, c.Command.Args...)
+		if err != nil {
+			return nil, err
+		}
+		return []string{command.Text()}, nil
+	}
+	if len(c.Parameters) == 0 {
+		return nil, fmt.Errorf("campaign has no command or parameters")
+	}
+	desired, err := desiredParameters(c.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	commands := make([]string, 0)
+	for _, batch := range idBatches(sortedIds(desired)) {
+		params := make(map[uint16]string, len(batch))
+		for _, id := range batch {
+			n, _ := strconv.Atoi(id)
+			params[uint16(n)] = desired[id]
+		}
+		command, err := SetParamCommand(params)
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, command.Text())
+	}
+	return commands, nil
+}
+
+// Create validates and starts a campaign for the devices
+func (m *CampaignManager) Create(campaign *Campaign, imeis []string) (*Campaign, error) {
+	if len(imeis) == 0 {
+		return nil, fmt.Errorf("campaign has no devices")
+	}
+	commands, err := campaign.build()
+	if err != nil {
+		return nil, err
+	}
+	campaign.commands = commands
+	if campaign.Concurrency <= 0 {
+		campaign.Concurrency = m.concurrency
+	}
+	if campaign.MaxAttempts <= 0 {
+		campaign.MaxAttempts = m.maxAttempts
+	}
+	campaign.Status, campaign.Created = "running", time.Now().UTC()
+	campaign.Devices = make(map[string]*CampaignDevice, len(imeis))
+	for _, imei := range imeis {
+		campaign.Devices[imei] = &CampaignDevice{Status: "pending", Updated: campaign.Created}
+	}
+
+	m.mutex.Lock()
+	m.nextId++
+	campaign.Id = strconv.Itoa(m.nextId)
+	m.campaigns[campaign.Id] = campaign
+	m.saveLocked()
+	m.mutex.Unlock()
+	go m.run(campaign)
+	return campaign, nil
+}
+
+// run works on the pending devices of the campaign until all are done or failed (or the campaign is paused
+// or cancelled), offline devices are checked again after the retry time without using an attempt
+func (m *CampaignManager) run(campaign *Campaign) {
+	m.mutex.Lock()
+	if campaign.active {
+		// resumed before the previous run noticed the pause
+		m.mutex.Unlock()
+		return
+	}
+	campaign.active = true
+	m.mutex.Unlock()
+
+	slots := make(chan struct{}, campaign.Concurrency)
+	var wg sync.WaitGroup
+	for {
+		m.mutex.Lock()
+		if campaign.Status != "running" {
+			campaign.active = false
+			m.mutex.Unlock()
+			break
+		}
+		now := time.Now()
+		ready := make([]string, 0)
+		remaining := 0
+		for imei, device := range campaign.Devices {
+			switch device.Status {
+			case "pending":
+				remaining++
+				if now.After(device.retryTime) {
+					ready = append(ready, imei)
+				}
+			case "running":
+				remaining++
+			}
+		}
+		if remaining == 0 {
+			campaign.Status, campaign.active = "done", false
+			m.saveLocked()
+			m.mutex.Unlock()
+			m.logger.Info.Printf("campaign '%s' done", campaign.Id)
+			break
+		}
+		sort.Strings(ready)
+		started := false
+		for _, imei := range ready {
+			device := campaign.Devices[imei]
+			if m.Online != nil && !m.Online(imei) {
+				device.retryTime = now.Add(m.retry)
+				continue
+			}
+			select {
+			case slots <- struct{}{}:
+			default:
+				continue
+			}
+			device.Status, device.Updated = "running", now.UTC()
+			started = true
+			wg.Add(1)
+			go func(imei string, device *CampaignDevice) {
+				defer wg.Done()
+				defer func() { <-slots }()
+				m.execute(campaign, imei, device)
+			}(imei, device)
+		}
+		if started {
+			m.saveLocked()
+		}
+		m.mutex.Unlock()
+		time.Sleep(time.Second)
+	}
+	wg.Wait()
+}
+
+func (m *CampaignManager) execute(campaign *Campaign, imei string, device *CampaignDevice) {
+	responses := make([]string, 0, len(campaign.commands))
+	var err error
+	for _, command := range campaign.commands {
+		var response string
+		if response, err = m.Execute(imei, command, time.Minute, campaign.Operator); err != nil {
+			break
+		}
+		responses = append(responses, response)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	device.Attempts++
+	device.Updated = time.Now().UTC()
+	device.Response = strings.Join(responses, "\n")
+	switch {
+	case err == nil:
+		device.Status, device.Error = "done", ""
+	case device.Attempts >= campaign.MaxAttempts:
+		device.Status, device.Error = "failed", err.Error()
+		m.logger.Error.Printf("[%s]: campaign '%s' failed (%v)", imei, campaign.Id, err)
+	default:
+		device.Status, device.Error = "pending", err.Error()
+		device.retryTime = time.Now().Add(m.retry)
+	}
+	m.saveLocked()
+}
+
+// saveLocked writes the campaigns to the file, the mutex must be held
+func (m *CampaignManager) saveLocked() {
+	if m.file == "" {
+		return
+	}
+	data, err := json.Marshal(m.campaigns)
+	if err == nil {
+		err = os.WriteFile(m.file+".tmp", data, 0o644)
+	}
+	if err == nil {
+		err = os.Rename(m.file+".tmp", m.file)
+	}
+	if err != nil {
+		m.logger.Error.Printf("campaigns save error (%v)", err)
+	}
+}
+
+// SetStatus pauses, resumes or cancels a campaign
+func (m *CampaignManager) SetStatus(id string, action string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	campaign, ok := m.campaigns[id]
+	if !ok {
+		return fmt.Errorf("campaign '%s' not found", id)
+	}
+	switch {
+	case action == "pause" && campaign.Status == "running":
+		campaign.Status = "paused"
+	case action == "resume" && campaign.Status == "paused":
+		campaign.Status = "running"
+		go m.run(campaign)
+	case action == "cancel" && (campaign.Status == "running" || campaign.Status == "paused"):
+		campaign.Status = "cancelled"
+	default:
+		return fmt.Errorf("can't %s a %s campaign", action, campaign.Status)
+	}
+	m.saveLocked()
+	return nil
+}
+
+func (c *Campaign) progress() *CampaignProgress {
+	progress := &CampaignProgress{Id: c.Id, Name: c.Name, Status: c.Status, Devices: len(c.Devices), Statuses: make(map[string]int)}
+	for _, device := range c.Devices {
+		progress.Statuses[device.Status]++
+	}
+	return progress
+}
+
+// ServeHTTP handles /campaigns: GET lists the campaigns progress, POST creates a campaign
+// ({"name": "apn", "imeis": [...] and/or "groups": [...], "parameters": {"apn": "internet"}} or "command": {"name": "cpureset"}),
+// GET /campaigns/{id} returns the campaign with the devices, POST /campaigns/{id}?action=pause|resume|cancel.
+// The commands of a campaign are sent on behalf of the operator who created it
+func (m *CampaignManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	operator, ok := authorize(w, r, m.Authorize)
+	if !ok {
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/campaigns"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		m.mutex.Lock()
+		list := make([]*CampaignProgress, 0, len(m.campaigns))
+		for _, campaign := range m.campaigns {
+			list = append(list, campaign.progress())
+		}
+		m.mutex.Unlock()
+		sort.Slice(list, func(i, j int) bool {
+			a, _ := strconv.Atoi(list[i].Id)
+			b, _ := strconv.Atoi(list[j].Id)
+			return a < b
+		})
+		writeJson(w, http.StatusOK, list)
+	case id == "" && r.Method == http.MethodPost:
+		var req struct {
+			Campaign
+			Imeis  []string `json:"imeis"`
+			Groups []string `json:"groups"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid campaign ("+err.Error()+")", http.StatusBadRequest)
+			return
+		}
+		imeis := req.Imeis
+		if len(req.Groups) > 0 {
+			for _, imei := range deviceGroups.Members(req.Groups...) {
+				if !containsString(imeis, imei) {
+					imeis = append(imeis, imei)
+				}
+			}
+		}
+		req.Campaign.Operator = operator
+		campaign, err := m.Create(&req.Campaign, imeis)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m.mutex.Lock()
+		progress := campaign.progress()
+		m.mutex.Unlock()
+		writeJson(w, http.StatusCreated, progress)
+	case r.Method == http.MethodGet:
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		campaign, ok := m.campaigns[id]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeJson(w, http.StatusOK, campaign)
+	case r.Method == http.MethodPost:
+		if err := m.SetStatus(id, r.URL.Query().Get("action")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
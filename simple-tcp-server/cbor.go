@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+const (
+	cborUint   = 0 << 5
+	cborNegInt = 1 << 5
+	cborBytes  = 2 << 5
+	cborText   = 3 << 5
+	cborArray  = 4 << 5
+	cborMap    = 5 << 5
+)
+
+// MarshalCBOR encodes the same value types as MarshalMsgpack (RFC 8949, definite lengths, sorted keys)
+func MarshalCBOR(v any) ([]byte, error) {
+	return appendCBOR(nil, v)
+}
+
+func appendCBOR(buf []byte, v any) ([]byte, error) {
+	switch value := v.(type) {
+	case nil:
+		return append(buf, 0xf6), nil
+	case bool:
+		if value {
+			return append(buf, 0xf5), nil
+		}
+		return append(buf, 0xf4), nil
+	case float64:
+		return binary.BigEndian.AppendUint64(append(buf, 0xfb), math.Float64bits(value)), nil
+	case float32:
+		return binary.BigEndian.AppendUint64(append(buf, 0xfb), math.Float64bits(float64(value))), nil
+	case string:
+		return append(appendCBORHead(buf, cborText, uint64(len(value))), value...), nil
+	case []byte:
+		return append(appendCBORHead(buf, cborBytes, uint64(len(value))), value...), nil
+	case []any:
+		buf = appendCBORHead(buf, cborArray, uint64(len(value)))
+		var err error
+		for _, item := range value {
+			if buf, err = appendCBOR(buf, item); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case map[string]any:
+		keys := sortedKeys(value)
+		buf = appendCBORHead(buf, cborMap, uint64(len(keys)))
+		var err error
+		for _, key := range keys {
+			buf = append(appendCBORHead(buf, cborText, uint64(len(key))), key...)
+			if buf, err = appendCBOR(buf, value[key]); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	}
+
+	if u, ok := asUint64(v); ok {
+		return appendCBORHead(buf, cborUint, u), nil
+	}
+	if i, ok := asInt64(v); ok {
+		if i >= 0 {
+			return appendCBORHead(buf, cborUint, uint64(i)), nil
+		}
+		return appendCBORHead(buf, cborNegInt, uint64(-1-i)), nil
+	}
+	return nil, fmt.Errorf("cbor: unsupported type %T", v)
+}
+
+func appendCBORHead(buf []byte, major byte, value uint64) []byte {
+	switch {
+	case value < 24:
+		return append(buf, major|byte(value))
+	case value <= math.MaxUint8:
+		return append(buf, major|24, byte(value))
+	case value <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, major|25), uint16(value))
+	case value <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buf, major|26), uint32(value))
+	default:
+		return binary.BigEndian.AppendUint64(append(buf, major|27), value)
+	}
+}
+
+// joinCBOR builds an array from encoded values
+func joinCBOR(payloads [][]byte) []byte {
+	buf := appendCBORHead(nil, cborArray, uint64(len(payloads)))
+	for _, p := range payloads {
+		buf = append(buf, p...)
+	}
+	return buf
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// the expected encodings are the examples of RFC 8949 appendix A
+func TestMarshalCBOR(t *testing.T) {
+	tests := []struct {
+		name  string
+		value any
+		want  string
+	}{
+		{"0", 0, "00"},
+		{"23", 23, "17"},
+		{"24", 24, "18 18"},
+		{"100", uint8(100), "18 64"},
+		{"1000", 1000, "19 03 e8"},
+		{"1000000", uint32(1000000), "1a 00 0f 42 40"},
+		{"1000000000000", int64(1000000000000), "1b 00 00 00 e8 d4 a5 10 00"},
+		{"-1", -1, "20"},
+		{"-10", int8(-10), "29"},
+		{"-100", -100, "38 63"},
+		{"-1000", int16(-1000), "39 03 e7"},
+		{"1.1", 1.1, "fb 3f f1 99 99 99 99 99 9a"},
+		{"false", false, "f4"},
+		{"true", true, "f5"},
+		{"null", nil, "f6"},
+		{"empty text", "", "60"},
+		{"text", "IETF", "64 49 45 54 46"},
+		{"bytes", []byte{1, 2, 3, 4}, "44 01 02 03 04"},
+		{"array", []any{1, 2, 3}, "83 01 02 03"},
+		{"map", map[string]any{"a": 1, "b": []any{2, 3}}, "a2 61 61 01 61 62 82 02 03"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MarshalCBOR(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := unhex(t, tt.want); !bytes.Equal(got, want) {
+				t.Errorf("got % x, want % x", got, want)
+			}
+		})
+	}
+}
+
+func TestMarshalCBORUnsupported(t *testing.T) {
+	for _, value := range []any{struct{}{}, map[string]any{"a": []any{complex(1, 2)}}, map[int]any{}} {
+		if _, err := MarshalCBOR(value); err == nil {
+			t.Errorf("no error for %T", value)
+		}
+	}
+}
+
+func TestJoinCBOR(t *testing.T) {
+	if got, want := joinCBOR([][]byte{{0x01}, {0x61, 0x61}}), unhex(t, "82 01 61 61"); !bytes.Equal(got, want) {
+		t.Errorf("got % x, want % x", got, want)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+var clockMetrics = expvar.NewMap("clock")
+
+// ClockSkewConfig: the clock of a device is compared with the server clock on every data packet, the skew is the
+// smallest delay (receive time minus the newest record timestamp) over the last Window (default 32) packets, the
+// buffered records of a device that was offline don't count that way. A device is skewed when its skew is over
+// MaxSkewSeconds (default 60) either way, Annotate adds the skew to every record (clockSkewMs)
+type ClockSkewConfig struct {
+	Window         int  `json:"window"`
+	MaxSkewSeconds int  `json:"maxSkewSeconds"`
+	Annotate       bool `json:"annotate"`
+}
+
+// ClockSkew is the clock of a device, served by the api. SkewMs is positive for a device clock behind the server
+// clock, LastDelayMs is the delay of the newest record of the last packet
+type ClockSkew struct {
+	SkewMs      int64     `json:"skewMs"`
+	LastDelayMs int64     `json:"lastDelayMs"`
+	MinSkewMs   int64     `json:"minSkewMs"`
+	MaxSkewMs   int64     `json:"maxSkewMs"`
+	Skewed      bool      `json:"skewed"`
+	Packets     int64     `json:"packets"`
+	Updated     time.Time `json:"updated"`
+}
+
+// ClockMonitor measures the clock skew of the devices, Seen is called for every packet at its receive time
+type ClockMonitor struct {
+	window  int
+	maxSkew int64
+	mutex   sync.Mutex
+	devices map[string]*clockDevice
+}
+
+type clockDevice struct {
+	delays []int64
+	next   int
+	skew   ClockSkew
+}
+
+func NewClockMonitor(config *ClockSkewConfig) *ClockMonitor {
+	c := &ClockMonitor{window: 32, maxSkew: 60 * 1000, devices: make(map[string]*clockDevice)}
+	if config != nil {
+		if config.Window > 0 {
+			c.window = config.Window
+		}
+		if config.MaxSkewSeconds > 0 {
+			c.maxSkew = int64(config.MaxSkewSeconds) * 1000
+		}
+	}
+	clockMetrics.Set("skewedDevices", expvar.Func(func() any {
+		return c.skewedDevices()
+	}))
+	return c
+}
+
+// Seen measures the delay of the newest record of the packet
+func (c *ClockMonitor) Seen(imei string, pkt *teltonika.Packet) {
+	if len(pkt.Data) == 0 {
+		return
+	}
+	now := time.Now()
+	newest := pkt.Data[0].TimestampMs
+	for i := range pkt.Data {
+		if pkt.Data[i].TimestampMs > newest {
+			newest = pkt.Data[i].TimestampMs
+		}
+	}
+	delay := now.UnixMilli() - int64(newest)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	device, ok := c.devices[imei]
+	if !ok {
+		device = &clockDevice{delays: make([]int64, 0, c.window)}
+		c.devices[imei] = device
+	}
+	if len(device.delays) < c.window {
+		device.delays = append(device.delays, delay)
+	} else {
+		device.delays[device.next] = delay
+		device.next = (device.next + 1) % c.window
+	}
+	skew := device.delays[0]
+	for _, d := range device.delays[1:] {
+		if d < skew {
+			skew = d
+		}
+	}
+
+	s := &device.skew
+	if s.Packets == 0 || skew < s.MinSkewMs {
+		s.MinSkewMs = skew
+	}
+	if s.Packets == 0 || skew > s.MaxSkewMs {
+		s.MaxSkewMs = skew
+	}
+	s.SkewMs, s.LastDelayMs, s.Updated = skew, delay, now
+	s.Skewed = skew > c.maxSkew || skew < -c.maxSkew
+	s.Packets++
+	clockMetrics.Add("packets", 1)
+	if s.Skewed {
+		clockMetrics.Add("skewedPackets", 1)
+	}
+}
+
+// Skew returns the clock skew of the device, nil if it sent no records yet
+func (c *ClockMonitor) Skew(imei string) *ClockSkew {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	device, ok := c.devices[imei]
+	if !ok {
+		return nil
+	}
+	skew := device.skew
+	return &skew
+}
+
+// EnrichRecord adds the skew of the device to the record (a RecordEnricher)
+func (c *ClockMonitor) EnrichRecord(imei string, _ *teltonika.Data) (map[string]any, error) {
+	skew := c.Skew(imei)
+	if skew == nil {
+		return nil, nil
+	}
+	return map[string]any{"clockSkewMs": skew.SkewMs}, nil
+}
+
+func (c *ClockMonitor) skewedDevices() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	n := 0
+	for _, device := range c.devices {
+		if device.skew.Skewed {
+			n++
+		}
+	}
+	return n
+}
+
+// Purge forgets the clock of the device (a Purger)
+func (c *ClockMonitor) Purge(imei string) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.devices[imei]; !ok {
+		return 0, nil
+	}
+	delete(c.devices, imei)
+	return 1, nil
+}
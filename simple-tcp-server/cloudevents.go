@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+const (
+	cloudEventPacketType = "com.teltonika.packet"
+	cloudEventRecordType = "com.teltonika.record"
+	cloudEventTypePrefix = "com.teltonika."
+)
+
+// cloudEvent is a CloudEvents 1.0 event in the structured json format,
+// json payloads go to data, binary ones (protobuf) to data_base64
+type cloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	Type            string          `json:"type"`
+	Source          string          `json:"source"`
+	Id              string          `json:"id"`
+	Time            string          `json:"time,omitempty"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+	DataBase64      []byte          `json:"data_base64,omitempty"`
+}
+
+func newCloudEvent(eventType string, source string, t time.Time, contentType string, data []byte) *cloudEvent {
+	event := &cloudEvent{
+		SpecVersion:     "1.0",
+		Type:            eventType,
+		Source:          source,
+		Id:              cloudEventId(),
+		Time:            t.UTC().Format(time.RFC3339Nano),
+		DataContentType: contentType,
+	}
+	if json.Valid(data) {
+		event.Data = data
+	} else {
+		event.DataBase64 = data
+	}
+	return event
+}
+
+// CloudEventsEncoder wraps the payloads of the encoder in CloudEvents envelopes (source is the imei)
+func CloudEventsEncoder(inner *PacketEncoder) *PacketEncoder {
+	encoder := &PacketEncoder{
+		ContentType:      "application/cloudevents+json",
+		BatchContentType: "application/cloudevents-batch+json",
+		Encode: func(imei string, pkt *AnnotatedPacket) ([]byte, error) {
+			data, err := inner.Encode(imei, pkt)
+			if err != nil || data == nil {
+				return data, err
+			}
+			return json.Marshal(newCloudEvent(cloudEventPacketType, imei, packetTime(pkt.Packet), inner.ContentType, data))
+		},
+		Join: joinJson,
+	}
+	if inner.EncodeEvent != nil {
+		encoder.EncodeEvent = func(event *Event) ([]byte, error) {
+			data, err := inner.EncodeEvent(event)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(newCloudEvent(cloudEventTypePrefix+event.Type, event.Imei, event.Time, inner.ContentType, data))
+		}
+	}
+	return encoder
+}
+
+func packetTime(pkt *teltonika.Packet) time.Time {
+	if len(pkt.Data) > 0 {
+		return time.UnixMilli(int64(pkt.Data[0].TimestampMs))
+	}
+	return time.Now()
+}
+
+func cloudEventId() string {
+	buf := make([]byte, 16)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,8 @@
+//go:build !reprocess
+
+package main
+
+// the tcp server, teltonika-reprocess is built from the same sources with the reprocess tag
+func main() {
+	runServer()
+}
@@ -0,0 +1,8 @@
+//go:build reprocess
+
+package main
+
+// teltonika-reprocess: go build -tags reprocess -o teltonika-reprocess ./simple-tcp-server
+func main() {
+	runReprocess()
+}
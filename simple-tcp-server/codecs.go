@@ -0,0 +1,150 @@
+package main
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+var codecMetrics = expvar.NewMap("codecs")
+
+// CodecsConfig: Pins are the expected data codecs ("8", "8E", "16") of the devices, the first pin matching a
+// device applies. A device sending records with another codec emits device.codec_mismatch (once until it's back
+// to an expected codec), a misconfigured Data Protocol setting usually
+type CodecsConfig struct {
+	Pins []*CodecPin `json:"pins"`
+}
+
+type CodecPin struct {
+	DeviceSelector
+	Codecs []string `json:"codecs"`
+}
+
+// DeviceCodec is the data codec a device uses, served by the api. Expected are the codecs of its pin
+type DeviceCodec struct {
+	Codec     string           `json:"codec"`
+	Expected  []string         `json:"expected,omitempty"`
+	Mismatch  bool             `json:"mismatch"`
+	FirstSeen time.Time        `json:"firstSeen"`
+	LastSeen  time.Time        `json:"lastSeen"`
+	Changed   *time.Time       `json:"changed,omitempty"`
+	Previous  string           `json:"previous,omitempty"`
+	Packets   map[string]int64 `json:"packets"`
+}
+
+// CodecMonitor detects the data codec of the devices on their packets with records (the command codecs don't
+// count) and emits device.codec_changed when a device switches, Publish delivers the events. Expected tells the
+// codecs of the devices no pin matches (the device directory, optional)
+type CodecMonitor struct {
+	pins     []*CodecPin
+	logger   *Logger
+	mutex    sync.Mutex
+	devices  map[string]*DeviceCodec
+	Publish  func(events ...*Event)
+	Expected func(imei string) []string
+}
+
+func NewCodecMonitor(config *CodecsConfig, logger *Logger) *CodecMonitor {
+	c := &CodecMonitor{logger: logger, devices: make(map[string]*DeviceCodec)}
+	if config != nil {
+		c.pins = config.Pins
+	}
+	codecMetrics.Set("mismatchedDevices", expvar.Func(func() any {
+		return c.mismatchedDevices()
+	}))
+	return c
+}
+
+// expected returns the pinned codecs of the device, nil if it isn't pinned and Expected doesn't tell
+func (c *CodecMonitor) expected(imei string) []string {
+	for _, pin := range c.pins {
+		if pin.Match(imei) {
+			return pin.Codecs
+		}
+	}
+	if c.Expected != nil {
+		return c.Expected(imei)
+	}
+	return nil
+}
+
+func (c *CodecMonitor) Seen(imei string, pkt *teltonika.Packet) {
+	if len(pkt.Data) == 0 {
+		return
+	}
+	codec := codecName(pkt.CodecID)
+	codecMetrics.Add(codec, 1)
+	now := time.Now().UTC()
+	var events []*Event
+	event := func(eventType string, data map[string]any) {
+		record := &pkt.Data[len(pkt.Data)-1]
+		events = append(events, &Event{Type: eventType, Imei: imei, Time: now, Lat: record.Lat, Lng: record.Lng,
+			Data: data})
+	}
+
+	expected := c.expected(imei)
+	c.mutex.Lock()
+	device, ok := c.devices[imei]
+	if !ok {
+		device = &DeviceCodec{Codec: codec, FirstSeen: now, Packets: make(map[string]int64)}
+		c.devices[imei] = device
+		c.logger.Info.Printf("[%s]: codec %s detected", imei, codec)
+	}
+	device.Expected, device.LastSeen = expected, now
+	device.Packets[codec]++
+	allowed := len(expected) == 0 || containsString(expected, codec)
+	if device.Codec != codec {
+		c.logger.Error.Printf("[%s]: codec changed from %s to %s", imei, device.Codec, codec)
+		event("device.codec_changed", map[string]any{"from": device.Codec, "to": codec, "expected": allowed})
+		device.Previous, device.Codec, device.Changed = device.Codec, codec, &now
+	}
+	if !allowed && !device.Mismatch {
+		codecMetrics.Add("mismatches", 1)
+		c.logger.Error.Printf("[%s]: codec %s isn't one of the pinned codecs %v", imei, codec, expected)
+		event("device.codec_mismatch", map[string]any{"codec": codec, "expected": expected})
+	}
+	device.Mismatch = !allowed
+	c.mutex.Unlock()
+	if len(events) > 0 && c.Publish != nil {
+		c.Publish(events...)
+	}
+}
+
+// Codec returns the codec of the device, nil if it sent no records yet
+func (c *CodecMonitor) Codec(imei string) *DeviceCodec {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	device, ok := c.devices[imei]
+	if !ok {
+		return nil
+	}
+	codec := *device
+	codec.Packets = make(map[string]int64, len(device.Packets))
+	for name, packets := range device.Packets {
+		codec.Packets[name] = packets
+	}
+	return &codec
+}
+
+func (c *CodecMonitor) mismatchedDevices() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	n := 0
+	for _, device := range c.devices {
+		if device.Mismatch {
+			n++
+		}
+	}
+	return n
+}
+
+// Purge forgets the codec of the device (a Purger)
+func (c *CodecMonitor) Purge(imei string) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.devices[imei]; !ok {
+		return 0, nil
+	}
+	delete(c.devices, imei)
+	return 1, nil
+}
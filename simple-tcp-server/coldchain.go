@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ColdChainConfig: Beacons maps the BLE sensor slots (1-4, as configured on the device) of a device to
+// the sensor MAC addresses, for rules selecting sensors by MAC (trailer sensors move between trucks)
+type ColdChainConfig struct {
+	Beacons map[string]map[string]int `json:"beacons"`
+	Rules   []*ColdChainRule          `json:"rules"`
+}
+
+// ColdChainRule: the alarm starts when the Measure ("temperature" in °C, default, or "humidity" in %)
+// of a sensor stays under Min or over Max for MinSeconds and clears once it's back by Hysteresis
+// (default 0.5). The rule applies to the selected devices (all sensors) or only to the sensors of Macs
+type ColdChainRule struct {
+	DeviceSelector
+	Name       string   `json:"name"`
+	Macs       []string `json:"macs"`
+	Measure    string   `json:"measure"`
+	Min        *float64 `json:"min"`
+	Max        *float64 `json:"max"`
+	MinSeconds int      `json:"minSeconds"`
+	Hysteresis float64  `json:"hysteresis"`
+}
+
+// SensorReading is the latest value of a BLE sensor, served by the api
+type SensorReading struct {
+	Slot        int       `json:"slot"`
+	Mac         string    `json:"mac,omitempty"`
+	Temperature *float64  `json:"temperature,omitempty"`
+	Humidity    *float64  `json:"humidity,omitempty"`
+	Alarms      []string  `json:"alarms"`
+	Updated     time.Time `json:"updated"`
+}
+
+var bleTemperatureIds = [4]string{"bleTemperature1", "bleTemperature2", "bleTemperature3", "bleTemperature4"}
+var bleHumidityIds = [4]string{"bleHumidity1", "bleHumidity2", "bleHumidity3", "bleHumidity4"}
+
+// ColdChainMonitor evaluates the rules on the BLE sensor readings and emits coldchain.alarm /
+// coldchain.clear events
+type ColdChainMonitor struct {
+	config  *ColdChainConfig
+	devices sync.Map
+}
+
+type coldChainDevice struct {
+	mutex    sync.Mutex
+	readings [4]*SensorReading
+	alarms   map[string]*alertState
+}
+
+func NewColdChainMonitor(config *ColdChainConfig) (*ColdChainMonitor, error) {
+	if config == nil {
+		config = &ColdChainConfig{}
+	}
+	for _, rule := range config.Rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("cold chain rule without name")
+		}
+		if rule.Measure == "" {
+			rule.Measure = "temperature"
+		}
+		if rule.Measure != "temperature" && rule.Measure != "humidity" {
+			return nil, fmt.Errorf("cold chain rule '%s': unknown measure '%s'", rule.Name, rule.Measure)
+		}
+		if rule.Min == nil && rule.Max == nil {
+			return nil, fmt.Errorf("cold chain rule '%s' has no min or max", rule.Name)
+		}
+		if rule.Hysteresis <= 0 {
+			rule.Hysteresis = 0.5
+		}
+		for i, mac := range rule.Macs {
+			rule.Macs[i] = normalizeMac(mac)
+		}
+	}
+	for imei, beacons := range config.Beacons {
+		normalized := make(map[string]int, len(beacons))
+		for mac, slot := range beacons {
+			if slot < 1 || slot > 4 {
+				return nil, fmt.Errorf("cold chain beacon %s of %s: invalid slot %d", mac, imei, slot)
+			}
+			normalized[normalizeMac(mac)] = slot
+		}
+		config.Beacons[imei] = normalized
+	}
+	return &ColdChainMonitor{config: config}, nil
+}
+
+func normalizeMac(mac string) string {
+	return strings.ToUpper(strings.NewReplacer(":", "", "-", "").Replace(mac))
+}
+
+// bleTemperature decodes the temperature of the sensor slot (0.01 °C, signed), the sensor error codes
+// (2000 parsing failed, 3000 not found, 4000 abnormal state) are no reading
+func bleTemperature(record *teltonika.Data, slot int) (float64, bool) {
+	value, ok := findElement(record, ioNames[bleTemperatureIds[slot-1]])
+	if !ok || len(value) != 2 {
+		return 0, false
+	}
+	raw := int16(binary.BigEndian.Uint16(value))
+	if raw == 2000 || raw == 3000 || raw == 4000 {
+		return 0, false
+	}
+	return float64(raw) / 100, true
+}
+
+// bleHumidity decodes the humidity of the sensor slot (0.1 %)
+func bleHumidity(record *teltonika.Data, slot int) (float64, bool) {
+	raw, ok := ioUint(record, ioNames[bleHumidityIds[slot-1]])
+	if !ok || raw > 1000 {
+		return 0, false
+	}
+	return float64(raw) / 10, true
+}
+
+func (c *ColdChainMonitor) mac(imei string, slot int) string {
+	for mac, s := range c.config.Beacons[imei] {
+		if s == slot {
+			return mac
+		}
+	}
+	return ""
+}
+
+func (r *ColdChainRule) applies(imei string, mac string) bool {
+	if len(r.Macs) > 0 {
+		return mac != "" && containsString(r.Macs, mac)
+	}
+	return r.Match(imei)
+}
+
+func (c *ColdChainMonitor) Process(imei string, pkt *teltonika.Packet) []*Event {
+	if len(c.config.Rules) == 0 && len(c.config.Beacons) == 0 {
+		return nil
+	}
+	value, _ := c.devices.LoadOrStore(imei, &coldChainDevice{alarms: make(map[string]*alertState)})
+	device := value.(*coldChainDevice)
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	var events []*Event
+	for i := range pkt.Data {
+		record := &pkt.Data[i]
+		recordTime := time.UnixMilli(int64(record.TimestampMs)).UTC()
+		for slot := 1; slot <= 4; slot++ {
+			temperature, hasTemperature := bleTemperature(record, slot)
+			humidity, hasHumidity := bleHumidity(record, slot)
+			if !hasTemperature && !hasHumidity {
+				continue
+			}
+			reading := device.readings[slot-1]
+			if reading == nil {
+				reading = &SensorReading{Slot: slot}
+				device.readings[slot-1] = reading
+			}
+			if recordTime.Before(reading.Updated) {
+				continue
+			}
+			reading.Mac, reading.Updated = c.mac(imei, slot), recordTime
+			if hasTemperature {
+				reading.Temperature = &temperature
+			}
+			if hasHumidity {
+				reading.Humidity = &humidity
+			}
+
+			for _, rule := range c.config.Rules {
+				measured, ok := temperature, hasTemperature
+				if rule.Measure == "humidity" {
+					measured, ok = humidity, hasHumidity
+				}
+				if !ok || !rule.applies(imei, reading.Mac) {
+					continue
+				}
+				key := fmt.Sprintf("%s/%d", rule.Name, slot)
+				state, ok := device.alarms[key]
+				if !ok {
+					state = &alertState{}
+					device.alarms[key] = state
+				}
+				raise := rule.Min != nil && measured < *rule.Min || rule.Max != nil && measured > *rule.Max
+				clear := (rule.Min == nil || measured >= *rule.Min+rule.Hysteresis) &&
+					(rule.Max == nil || measured <= *rule.Max-rule.Hysteresis)
+				started, ended := state.update(recordTime, raise, clear, time.Duration(rule.MinSeconds)*time.Second)
+				if !started && !ended {
+					continue
+				}
+				data := map[string]any{
+					"rule":    rule.Name,
+					"measure": rule.Measure,
+					"value":   measured,
+					"slot":    slot,
+					"since":   state.since.UTC().Format(time.RFC3339),
+				}
+				if reading.Mac != "" {
+					data["mac"] = reading.Mac
+				}
+				if rule.Min != nil {
+					data["min"] = *rule.Min
+				}
+				if rule.Max != nil {
+					data["max"] = *rule.Max
+				}
+				eventType := "coldchain.alarm"
+				if ended {
+					eventType = "coldchain.clear"
+					data["durationSeconds"] = int64(recordTime.Sub(state.since).Seconds())
+				}
+				events = append(events, NewEvent(eventType, imei, record, data))
+			}
+		}
+	}
+	return events
+}
+
+// Sensors returns the latest readings of the BLE sensors of the device with their active alarms
+func (c *ColdChainMonitor) Sensors(imei string) []*SensorReading {
+	value, ok := c.devices.Load(imei)
+	if !ok {
+		return nil
+	}
+	device := value.(*coldChainDevice)
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+	sensors := make([]*SensorReading, 0, 4)
+	for _, reading := range device.readings {
+		if reading == nil {
+			continue
+		}
+		sensor := *reading
+		sensor.Alarms = make([]string, 0)
+		for _, rule := range c.config.Rules {
+			if state, ok := device.alarms[fmt.Sprintf("%s/%d", rule.Name, reading.Slot)]; ok && state.active {
+				sensor.Alarms = append(sensor.Alarms, rule.Name)
+			}
+		}
+		sensors = append(sensors, &sensor)
+	}
+	return sensors
+}
+
+// ServeHTTP handles GET /devices/{imei}/sensors
+func (c *ColdChainMonitor) ServeHTTP(w http.ResponseWriter, r *http.Request, imei string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	sensors := c.Sensors(imei)
+	if len(sensors) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	writeJson(w, http.StatusOK, sensors)
+}
+
+// Purge forgets the device (a Purger)
+func (c *ColdChainMonitor) Purge(imei string) (int, error) {
+	return purgeSyncMap(&c.devices, imei), nil
+}
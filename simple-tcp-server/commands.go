@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Command is a GPRS command sent to the device as Codec 12 text
+type Command struct {
+	Name string
+	Args []string
+}
+
+// Text is the command line sent to the device
+func (c *Command) Text() string {
+	if len(c.Args) == 0 {
+		return c.Name
+	}
+	return c.Name + " " + strings.Join(c.Args, " ")
+}
+
+// commandBuilders builds the catalog commands from api arguments
+var commandBuilders = map[string]func(args []string) (*Command, error){
+	"getinfo":     noArgsCommand("getinfo"),
+	"getver":      noArgsCommand("getver"),
+	"getgps":      noArgsCommand("getgps"),
+	"cpureset":    noArgsCommand("cpureset"),
+	"battery":     noArgsCommand("battery"),
+	"web_connect": noArgsCommand("web_connect"),
+	"getparam": func(args []string) (*Command, error) {
+		ids := make([]uint16, 0, len(args))
+		for _, arg := range args {
+			id, err := parameterId(arg)
+			if err != nil {
+				return nil, fmt.Errorf("getparam: %v", err)
+			}
+			ids = append(ids, id)
+		}
+		return GetParamCommand(ids...)
+	},
+	"setparam": func(args []string) (*Command, error) {
+		values := make(map[string]any, len(args))
+		for _, arg := range args {
+			key, value, _ := strings.Cut(arg, ":")
+			values[key] = value
+		}
+		return SetParamCommandFromMap(values)
+	},
+	"setdigout": func(args []string) (*Command, error) {
+		if len(args) == 0 {
+			return nil, fmt.Errorf("setdigout: missing output states")
+		}
+		timeouts := make([]int, 0, len(args)-1)
+		for _, arg := range args[1:] {
+			timeout, err := strconv.Atoi(arg)
+			if err != nil {
+				return nil, fmt.Errorf("setdigout: invalid timeout '%s'", arg)
+			}
+			timeouts = append(timeouts, timeout)
+		}
+		return SetDigoutCommand(args[0], timeouts...)
+	},
+}
+
+func noArgsCommand(name string) func(args []string) (*Command, error) {
+	return func(args []string) (*Command, error) {
+		if len(args) > 0 {
+			return nil, fmt.Errorf("%s takes no arguments", name)
+		}
+		return &Command{Name: name}, nil
+	}
+}
+
+// NewCommand builds a catalog command from its arguments (as they appear in the command text,
+// setparam takes id:value pairs), getparam and setparam take parameter names too
+func NewCommand(name string, args ...string) (*Command, error) {
+	builder, ok := commandBuilders[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown command '%s'", name)
+	}
+	return builder(args)
+}
+
+func GetInfoCommand() *Command {
+	return &Command{Name: "getinfo"}
+}
+
+func GetVerCommand() *Command {
+	return &Command{Name: "getver"}
+}
+
+func GetGpsCommand() *Command {
+	return &Command{Name: "getgps"}
+}
+
+func CpuResetCommand() *Command {
+	return &Command{Name: "cpureset"}
+}
+
+func BatteryCommand() *Command {
+	return &Command{Name: "battery"}
+}
+
+func WebConnectCommand() *Command {
+	return &Command{Name: "web_connect"}
+}
+
+// GetParamCommand reads parameters, getparam 2001;2002
+func GetParamCommand(ids ...uint16) (*Command, error) {
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("getparam: no parameter ids")
+	}
+	parts := make([]string, 0, len(ids))
+	for _, id := range ids {
+		parts = append(parts, strconv.Itoa(int(id)))
+	}
+	return &Command{Name: "getparam", Args: []string{strings.Join(parts, ";")}}, nil
+}
+
+// SetParamCommand writes parameters, setparam 2001:internet;2002:user (ordered by id).
+// Values can't contain ';' (the pair separator) or line breaks
+func SetParamCommand(values map[uint16]string) (*Command, error) {
+	if len(values) == 0 {
+		return nil, fmt.Errorf("setparam: no parameters")
+	}
+	ids := make([]int, 0, len(values))
+	for id, value := range values {
+		if strings.ContainsAny(value, ";\r\n") {
+			return nil, fmt.Errorf("setparam: invalid value of parameter %d", id)
+		}
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	parts := make([]string, 0, len(ids))
+	for _, id := range ids {
+		parts = append(parts, strconv.Itoa(id)+":"+values[uint16(id)])
+	}
+	return &Command{Name: "setparam", Args: []string{strings.Join(parts, ";")}}, nil
+}
+
+// SetDigoutCommand sets the digital outputs, states has a character per output: '1' on, '0' off,
+// '?' unchanged (e.g. "1?0"), the optional timeouts (seconds, 0 for none) revert the outputs
+func SetDigoutCommand(states string, timeouts ...int) (*Command, error) {
+	if states == "" || len(states) > 4 || strings.Trim(states, "01?") != "" {
+		return nil, fmt.Errorf("setdigout: invalid output states '%s'", states)
+	}
+	if len(timeouts) > len(states) {
+		return nil, fmt.Errorf("setdigout: more timeouts than outputs")
+	}
+	args := []string{states}
+	for _, timeout := range timeouts {
+		if timeout < 0 {
+			return nil, fmt.Errorf("setdigout: invalid timeout %d", timeout)
+		}
+		args = append(args, strconv.Itoa(timeout))
+	}
+	return &Command{Name: "setdigout", Args: args}, nil
+}
+
+// CommandStatus tracks a command sent over a channel ("gprs" or "sms"): "pending" while a gprs command waits
+// for the response, "sent" once the sms gateway accepted the message, then "responded", "timeout" or "failed"
+type CommandStatus struct {
+	Id       string    `json:"id"`
+	Imei     string    `json:"imei"`
+	Channel  string    `json:"channel"`
+	Operator string    `json:"operator"`
+	Command  string    `json:"command"`
+	Status   string    `json:"status"`
+	Response string    `json:"response,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+}
+
+// CommandTracker keeps the status of the latest commands (50) of every device, the commands and the responses
+// are written to Audit if set
+type CommandTracker struct {
+	Audit   *AuditLog
+	mutex   sync.Mutex
+	devices map[string][]*CommandStatus
+	nextId  int
+}
+
+const trackedCommands = 50
+
+func NewCommandTracker() *CommandTracker {
+	return &CommandTracker{devices: make(map[string][]*CommandStatus)}
+}
+
+// Start records a command being sent by the operator ("system" for the server itself), status is the initial status
+func (t *CommandTracker) Start(imei string, channel string, text string, status string, operator string) *CommandStatus {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.nextId++
+	now := time.Now().UTC()
+	command := &CommandStatus{Id: strconv.Itoa(t.nextId), Imei: imei, Channel: channel, Operator: operator,
+		Command: text, Status: status, Created: now, Updated: now}
+	t.audit("command", command)
+	list := append(t.devices[imei], command)
+	if len(list) > trackedCommands {
+		list = list[len(list)-trackedCommands:]
+	}
+	t.devices[imei] = list
+	return command
+}
+
+// Finish sets the outcome of the command: the response, errCommandTimeout or another error
+func (t *CommandTracker) Finish(command *CommandStatus, response string, err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	switch {
+	case err == errCommandTimeout:
+		command.Status = "timeout"
+	case err != nil:
+		command.Status, command.Error = "failed", err.Error()
+	default:
+		command.Status, command.Response = "responded", response
+	}
+	command.Updated = time.Now().UTC()
+	t.audit("response", command)
+}
+
+// Respond completes the oldest command of the channel still waiting for a response, false if there's none
+func (t *CommandTracker) Respond(imei string, channel string, response string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, command := range t.devices[imei] {
+		if command.Channel == channel && (command.Status == "pending" || command.Status == "sent") {
+			command.Status, command.Response, command.Updated = "responded", response, time.Now().UTC()
+			t.audit("response", command)
+			return true
+		}
+	}
+	return false
+}
+
+// Expire times out the command if it still waits for its response
+func (t *CommandTracker) Expire(command *CommandStatus) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if command.Status != "pending" && command.Status != "sent" {
+		return
+	}
+	command.Status, command.Updated = "timeout", time.Now().UTC()
+	t.audit("response", command)
+}
+
+// List returns the tracked commands of the device, newest first
+func (t *CommandTracker) List(imei string) []CommandStatus {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	list := t.devices[imei]
+	result := make([]CommandStatus, 0, len(list))
+	for i := len(list) - 1; i >= 0; i-- {
+		result = append(result, *list[i])
+	}
+	return result
+}
+
+// audit writes the command or its outcome to the audit log, the mutex must be held
+func (t *CommandTracker) audit(kind string, command *CommandStatus) {
+	if t.Audit == nil {
+		return
+	}
+	entry := &AuditEntry{Time: command.Updated, Kind: kind, CommandId: command.Id, Imei: command.Imei,
+		Operator: command.Operator, Channel: command.Channel, Status: command.Status, Error: command.Error}
+	if kind == "command" {
+		entry.Text = command.Command
+	} else {
+		entry.Text = command.Response
+		entry.LatencyMs = command.Updated.Sub(command.Created).Milliseconds()
+	}
+	t.Audit.Write(entry)
+}
+
+// Purge forgets the commands of the device (a Purger)
+func (t *CommandTracker) Purge(imei string) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	n := len(t.devices[imei])
+	delete(t.devices, imei)
+	return n, nil
+}
+
+// ExpireBefore forgets the commands last updated before the time (an Expirer)
+func (t *CommandTracker) ExpireBefore(before time.Time) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	removed := 0
+	for imei, list := range t.devices {
+		kept := list[:0]
+		for _, command := range list {
+			if command.Updated.Before(before) {
+				removed++
+			} else {
+				kept = append(kept, command)
+			}
+		}
+		if len(kept) == 0 {
+			delete(t.devices, imei)
+		} else {
+			t.devices[imei] = kept
+		}
+	}
+	return removed, nil
+}
+
+// commandsSnapshot is the snapshot of the tracker
+type commandsSnapshot struct {
+	NextId  int                         `json:"nextId"`
+	Devices map[string][]*CommandStatus `json:"devices"`
+}
+
+// Snapshot returns the tracked commands (a Snapshotter)
+func (t *CommandTracker) Snapshot() ([]byte, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	data, err := json.Marshal(&commandsSnapshot{NextId: t.nextId, Devices: t.devices})
+	if err != nil {
+		return nil, fmt.Errorf("commands marshaling error (%v)", err)
+	}
+	return data, nil
+}
+
+// Restore replaces the tracked commands with the ones of a snapshot, the gprs commands waiting for their response
+// failed with the restart (the connections are gone), the sms ones may still get it
+func (t *CommandTracker) Restore(data []byte) error {
+	snapshot := &commandsSnapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return fmt.Errorf("commands parse error (%v)", err)
+	}
+	if snapshot.Devices == nil {
+		snapshot.Devices = make(map[string][]*CommandStatus)
+	}
+	now := time.Now().UTC()
+	for _, list := range snapshot.Devices {
+		for _, command := range list {
+			if command.Channel == "gprs" && command.Status == "pending" {
+				command.Status, command.Error, command.Updated = "failed", "server restarted", now
+			}
+		}
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.devices = snapshot.Devices
+	if snapshot.NextId > t.nextId {
+		t.nextId = snapshot.NextId
+	}
+	return nil
+}
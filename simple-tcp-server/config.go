@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+type Config struct {
+	Tenants      []*TenantConfig     `json:"tenants"`
+	Hooks        []*HookConfig       `json:"hooks"`
+	Routes       []*RouteConfig      `json:"routes"`
+	Geofencing   *GeofencingConfig   `json:"geofencing"`
+	Trips        *TripsConfig        `json:"trips"`
+	HarshDriving *HarshDrivingConfig `json:"harshDriving"`
+	Odometer     *OdometerConfig     `json:"odometer"`
+	Alerts       *AlertsConfig       `json:"alerts"`
+	Dedup        *DedupConfig        `json:"dedup"`
+	Reorder      *ReorderConfig      `json:"reorder"`
+	Timestamps   *TimestampsConfig   `json:"timestamps"`
+	Geocoding    *GeocodingConfig    `json:"geocoding"`
+	MapMatching  *MapMatchingConfig  `json:"mapMatching"`
+	State        *StateConfig        `json:"state"`
+	Downsample   *DownsampleConfig   `json:"downsample"`
+	Drivers      *DriversConfig      `json:"drivers"`
+	Towing       *TowingConfig       `json:"towing"`
+	GnssSecurity *GnssSecurityConfig `json:"gnssSecurity"`
+	Gaps         *GapsConfig         `json:"gaps"`
+	Fuel         *FuelConfig         `json:"fuel"`
+	Power        *PowerConfig        `json:"power"`
+	Crash        *CrashConfig        `json:"crash"`
+	ColdChain    *ColdChainConfig    `json:"coldChain"`
+	Shadow       *ShadowConfig       `json:"shadow"`
+	Campaigns    *CampaignsConfig    `json:"campaigns"`
+	Schedules    *SchedulesConfig    `json:"schedules"`
+	Firmware     *FirmwareConfig     `json:"firmware"`
+	Immobilizer  *ImmobilizerConfig  `json:"immobilizer"`
+	Provisioning *ProvisioningConfig `json:"provisioning"`
+	Groups       *GroupsConfig       `json:"groups"`
+	Sms          *SmsConfig          `json:"sms"`
+	Tls          *TlsConfig          `json:"tls"`
+	Audit        *AuditConfig        `json:"audit"`
+	SerialBridge *SerialBridgeConfig `json:"serialBridge"`
+	Proxy        *ProxyConfig        `json:"proxy"`
+	Recorder     *RecorderConfig     `json:"recorder"`
+	Limits       *LimitsConfig       `json:"limits"`
+	Pipeline     *PipelineConfig     `json:"pipeline"`
+	Ack          *AckConfig          `json:"ack"`
+	ClockSkew    *ClockSkewConfig    `json:"clockSkew"`
+	Retention    *RetentionConfig    `json:"retention"`
+	Records      *RecordStoreConfig  `json:"records"`
+	Breaker      *BreakerConfig      `json:"circuitBreaker"`
+	IOParsers    []*IOParserConfig   `json:"ioParsers"`
+	Script       *ScriptConfig       `json:"script"`
+	Anomalies    *AnomaliesConfig    `json:"anomalies"`
+	Stats        *StatsConfig        `json:"stats"`
+	Codecs       *CodecsConfig       `json:"codecs"`
+	Snapshots    *SnapshotConfig     `json:"snapshots"`
+	Failover     *FailoverConfig     `json:"failover"`
+	Directory    *DirectoryConfig    `json:"directory"`
+	Units        *UnitsConfig        `json:"units"`
+	Pseudonyms   *PseudonymsConfig   `json:"pseudonyms"`
+}
+
+type HookConfig struct {
+	Name         string            `json:"name"`
+	Url          string            `json:"url"`
+	QueueDir     string            `json:"queueDir"`
+	DeadLetter   string            `json:"deadLetter"`
+	Headers      map[string]string `json:"headers"`
+	BearerToken  string            `json:"bearerToken"`
+	Secret       string            `json:"secret"`
+	Encoding     string            `json:"encoding"`
+	CloudEvents  bool              `json:"cloudEvents"`
+	Template     string            `json:"template"`
+	TemplateFile string            `json:"templateFile"`
+	BatchSize    int               `json:"batchSize"`
+	BatchWaitMs  int               `json:"batchWaitMs"`
+	Gzip         bool              `json:"gzip"`
+	Events       bool              `json:"events"`
+	Filter       *FilterConfig     `json:"filter"`
+	Delta        *DeltaConfig      `json:"delta"`
+}
+
+type TenantConfig struct {
+	Name        string             `json:"name"`
+	Imeis       []string           `json:"imeis"`
+	Flespi      *FlespiConfig      `json:"flespi"`
+	ThingsBoard *ThingsBoardConfig `json:"thingsboard"`
+	Mqtt        *MqttConfig        `json:"mqtt"`
+}
+
+type FlespiConfig struct {
+	Url   string       `json:"url"`
+	Token string       `json:"token"`
+	Delta *DeltaConfig `json:"delta"`
+}
+
+type ThingsBoardConfig struct {
+	Url    string            `json:"url"`
+	Tokens map[string]string `json:"tokens"`
+	Delta  *DeltaConfig      `json:"delta"`
+}
+
+type MqttConfig struct {
+	Address         string `json:"address"`
+	ClientId        string `json:"clientId"`
+	Username        string `json:"username"`
+	Password        string `json:"password"`
+	TopicPrefix     string `json:"topicPrefix"`
+	HomeAssistant   bool   `json:"homeAssistant"`
+	DiscoveryPrefix string `json:"discoveryPrefix"`
+	CloudEvents     bool   `json:"cloudEvents"`
+	Encoding        string `json:"encoding"`
+}
+
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("config read error (%v)", err)
+	}
+	config := &Config{}
+	if err = json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("config parse error (%v)", err)
+	}
+	return config, nil
+}
+
+func (c *Config) Sinks(hookDefaults WebhookConfig, deadLetters DeadLetterQueue, logger *Logger) ([]Sink, error) {
+	sinks := make([]Sink, 0)
+	routed := routedHooks(c.Routes)
+	for _, hook := range c.Hooks {
+		if hook.Name != "" && routed[hook.Name] {
+			continue
+		}
+		sink, err := hook.Sink(hookDefaults, logger)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if len(c.Routes) > 0 {
+		router, err := NewRouter(c.Routes, c.Hooks, hookDefaults, logger)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, router)
+	}
+	tenantDefaults := hookDefaults
+	tenantDefaults.DeadLetters = deadLetters
+	for _, tenant := range c.Tenants {
+		if tenant.Flespi != nil {
+			sink, err := NewFlespiSink(tenant.Flespi.Url, tenant.Flespi.Token, tenantDefaults, logger)
+			if err != nil {
+				return nil, fmt.Errorf("tenant '%s': %v", tenant.Name, err)
+			}
+			sinks = append(sinks, NewTenantSink(tenant.Name, tenant.Imeis, withDelta(tenant.Flespi.Delta, sink)))
+		}
+		if tenant.ThingsBoard != nil {
+			sink := NewThingsBoardSink(tenant.ThingsBoard.Url, tenant.ThingsBoard.Tokens, tenantDefaults, logger)
+			sinks = append(sinks, NewTenantSink(tenant.Name, tenant.Imeis, withDelta(tenant.ThingsBoard.Delta, sink)))
+		}
+		if tenant.Mqtt != nil {
+			sink, err := tenant.Mqtt.Sink(logger)
+			if err != nil {
+				return nil, fmt.Errorf("tenant '%s': %v", tenant.Name, err)
+			}
+			sink.DeadLetters = deadLetters
+			sink.Pseudonyms = hookDefaults.Pseudonyms
+			sink.Breaker = NewCircuitBreaker(sink.Name(), c.Breaker, logger)
+			sinks = append(sinks, NewTenantSink(tenant.Name, tenant.Imeis, sink))
+		}
+	}
+	return sinks, nil
+}
+
+func (h *HookConfig) Sink(defaults WebhookConfig, logger *Logger) (Sink, error) {
+	if h.Filter != nil {
+		if err := h.Filter.Compile(); err != nil {
+			return nil, fmt.Errorf("hook '%s': %v", h.Name, err)
+		}
+	}
+	config := defaults
+	config.Name = h.Name
+	config.Url = h.Url
+	config.QueueDir = h.QueueDir
+	if h.DeadLetter != "" {
+		deadLetters, err := NewDeadLetterQueue(h.DeadLetter)
+		if err != nil {
+			return nil, fmt.Errorf("hook '%s': %v", h.Name, err)
+		}
+		config.DeadLetters = deadLetters
+	}
+	config.Headers = h.Headers
+	config.BearerToken = h.BearerToken
+	config.Secret = h.Secret
+	config.BatchSize = h.BatchSize
+	config.BatchWait = time.Duration(h.BatchWaitMs) * time.Millisecond
+	config.Gzip = h.Gzip
+	config.Events = h.Events
+	encoder, err := packetEncoder(h.Encoding)
+	if err != nil {
+		return nil, fmt.Errorf("hook '%s': %v", h.Name, err)
+	}
+	config.Encoder = encoder
+	if h.Template != "" || h.TemplateFile != "" {
+		var template *PayloadTemplate
+		if h.TemplateFile != "" {
+			template, err = LoadPayloadTemplate(h.TemplateFile)
+		} else {
+			template, err = NewPayloadTemplate(h.Template)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("hook '%s': %v", h.Name, err)
+		}
+		config.Encoder = template.Encoder()
+	}
+	if h.CloudEvents {
+		config.Encoder = CloudEventsEncoder(config.Encoder)
+	}
+
+	webhook, err := NewWebhookSink(config, logger)
+	if err != nil {
+		return nil, err
+	}
+	sink := withDelta(h.Delta, webhook)
+	if h.Filter == nil {
+		return sink, nil
+	}
+	return NewFilteredSink(h.Filter, sink), nil
+}
+
+// withDelta wraps the sink in a DeltaSink if the delta mode is configured
+func withDelta(delta *DeltaConfig, sink Sink) Sink {
+	if delta == nil {
+		return sink
+	}
+	return NewDeltaSink(delta, sink)
+}
+
+// Tenant returns the first tenant listing the imei, "" if none does
+func (c *Config) Tenant(imei string) string {
+	for _, tenant := range c.Tenants {
+		if containsString(tenant.Imeis, imei) {
+			return tenant.Name
+		}
+	}
+	return ""
+}
+
+func (m *MqttConfig) Sink(logger *Logger) (*MQTTSink, error) {
+	// MQTT 3.1.1 has no password flag without the user name flag
+	if m.Password != "" && m.Username == "" {
+		return nil, fmt.Errorf("mqtt: password requires username")
+	}
+	clientId := m.ClientId
+	if clientId == "" {
+		clientId = "teltonika-tcp-server"
+	}
+	topicPrefix := m.TopicPrefix
+	if topicPrefix == "" {
+		topicPrefix = "teltonika"
+	}
+	encoder, err := valueEncoder(m.Encoding)
+	if err != nil {
+		return nil, fmt.Errorf("mqtt: %v", err)
+	}
+	if m.HomeAssistant && encoder != valueEncoders["json"] {
+		return nil, fmt.Errorf("mqtt: home assistant discovery needs json encoding")
+	}
+	sink := NewMQTTSink(NewMQTTClient(m.Address, clientId, m.Username, m.Password), topicPrefix, logger)
+	sink.encoder = encoder
+	// Home Assistant reads the plain state json
+	sink.cloudEvents = m.CloudEvents && !m.HomeAssistant
+	if m.HomeAssistant {
+		discoveryPrefix := m.DiscoveryPrefix
+		if discoveryPrefix == "" {
+			discoveryPrefix = "homeassistant"
+		}
+		sink.discovery = NewHomeAssistantDiscovery(discoveryPrefix)
+	}
+	return sink, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+var crashMetrics = expvar.NewMap("crash")
+
+// CrashConfig: on a crash record (crashDetection IO) the Command (default "getrecord", the device sends
+// the records it holds, the crash trace included) is sent over Codec 12 and the records from BeforeSeconds
+// (default 30) before the crash to AfterSeconds (default 30) after it are collected with the trace records.
+// The crash event is delivered once the device reported past the after window, at the latest after
+// WaitSeconds (default 120), to the Hook (events are always posted) or to the event sinks without it
+type CrashConfig struct {
+	Command       string      `json:"command"`
+	BeforeSeconds int         `json:"beforeSeconds"`
+	AfterSeconds  int         `json:"afterSeconds"`
+	WaitSeconds   int         `json:"waitSeconds"`
+	Hook          *HookConfig `json:"hook"`
+}
+
+// CrashNotifier bundles crashes into single crash events (Processor), Command sends the trace request to
+// the device and Deliver publishes the crash events, both are set by the caller
+type CrashNotifier struct {
+	Command func(imei string, text string) error
+	Deliver func(events ...*Event)
+	command string
+	before  time.Duration
+	after   time.Duration
+	wait    time.Duration
+	logger  *Logger
+	mutex   sync.Mutex
+	devices map[string]*crashDevice
+}
+
+type crashDevice struct {
+	recent []teltonika.Data
+	crash  *crashBundle
+}
+
+type crashBundle struct {
+	record    teltonika.Data
+	started   time.Time
+	requested bool
+	records   []teltonika.Data
+	trace     []teltonika.Data
+	complete  bool
+}
+
+func NewCrashNotifier(config *CrashConfig, logger *Logger) *CrashNotifier {
+	c := &CrashNotifier{
+		command: "getrecord",
+		before:  time.Second * 30,
+		after:   time.Second * 30,
+		wait:    time.Minute * 2,
+		logger:  logger,
+		devices: make(map[string]*crashDevice),
+	}
+	if config.Command != "" {
+		c.command = config.Command
+	}
+	if config.BeforeSeconds > 0 {
+		c.before = time.Duration(config.BeforeSeconds) * time.Second
+	}
+	if config.AfterSeconds > 0 {
+		c.after = time.Duration(config.AfterSeconds) * time.Second
+	}
+	if config.WaitSeconds > 0 {
+		c.wait = time.Duration(config.WaitSeconds) * time.Second
+	}
+	go func() {
+		for range time.Tick(time.Second * 5) {
+			c.flush(time.Now())
+		}
+	}()
+	return c
+}
+
+// isCrashTrace tells the trace records: crash trace data or a limited/full crash trace value of crashDetection
+func isCrashTrace(record *teltonika.Data) bool {
+	for _, el := range record.Elements {
+		if el.Id == ioNames["crashTraceData"] {
+			return true
+		}
+	}
+	value, ok := ioUint(record, ioNames["crashDetection"])
+	return ok && value >= 2 && value <= 5
+}
+
+func (c *CrashNotifier) Process(imei string, pkt *teltonika.Packet) []*Event {
+	var requests []string
+	c.mutex.Lock()
+	device, ok := c.devices[imei]
+	if !ok {
+		device = &crashDevice{}
+		c.devices[imei] = device
+	}
+	for i := range pkt.Data {
+		record := &pkt.Data[i]
+		t := time.UnixMilli(int64(record.TimestampMs))
+		crash, _ := ioUint(record, ioNames["crashDetection"])
+		if device.crash == nil && crash > 0 {
+			bundle := &crashBundle{record: copyRecord(record), started: time.Now()}
+			for _, previous := range device.recent {
+				if !time.UnixMilli(int64(previous.TimestampMs)).Before(t.Add(-c.before)) {
+					bundle.records = append(bundle.records, previous)
+				}
+			}
+			device.crash = bundle
+			crashMetrics.Add("crashes", 1)
+			if c.Command != nil && !isCrashTrace(record) {
+				bundle.requested = true
+				requests = append(requests, c.command)
+			}
+		}
+		if bundle := device.crash; bundle != nil {
+			crashTime := time.UnixMilli(int64(bundle.record.TimestampMs))
+			switch {
+			case isCrashTrace(record):
+				bundle.trace = append(bundle.trace, copyRecord(record))
+			case t.After(crashTime.Add(c.after)):
+				bundle.complete = true
+			case !t.Before(crashTime.Add(-c.before)):
+				bundle.records = append(bundle.records, copyRecord(record))
+			}
+		}
+
+		device.recent = append(device.recent, copyRecord(record))
+		for len(device.recent) > 0 && time.UnixMilli(int64(device.recent[0].TimestampMs)).Before(t.Add(-c.before)) {
+			device.recent = device.recent[1:]
+		}
+	}
+	c.mutex.Unlock()
+
+	for _, text := range requests {
+		if err := c.Command(imei, text); err != nil {
+			c.logger.Error.Printf("[%s]: crash trace request error (%v)", imei, err)
+		}
+	}
+	c.flush(time.Now())
+	return nil
+}
+
+// flush delivers the complete crash bundles and the ones waiting for longer than the wait time
+func (c *CrashNotifier) flush(now time.Time) {
+	var events []*Event
+	c.mutex.Lock()
+	for imei, device := range c.devices {
+		bundle := device.crash
+		if bundle == nil || !bundle.complete && now.Sub(bundle.started) < c.wait {
+			continue
+		}
+		device.crash = nil
+		events = append(events, bundle.event(imei))
+	}
+	c.mutex.Unlock()
+	if len(events) > 0 && c.Deliver != nil {
+		c.Deliver(events...)
+	}
+}
+
+func (b *crashBundle) event(imei string) *Event {
+	crashType, _ := ioUint(&b.record, ioNames["crashDetection"])
+	records := packetValue(imei, &AnnotatedPacket{Packet: &teltonika.Packet{Data: b.records}})["data"]
+	trace := packetValue(imei, &AnnotatedPacket{Packet: &teltonika.Packet{Data: b.trace}})["data"]
+	if len(b.trace) == 0 {
+		crashMetrics.Add("withoutTrace", 1)
+	}
+	return NewEvent("crash", imei, &b.record, map[string]any{
+		"crashType":      crashType,
+		"speed":          b.record.Speed,
+		"traceRequested": b.requested,
+		"records":        records,
+		"trace":          trace,
+	})
+}
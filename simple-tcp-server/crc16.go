@@ -0,0 +1,31 @@
+package main
+
+// crc16Table holds the CRC-16/IBM of every byte value, crc16 processes a byte per lookup instead of a bit per step
+// (the same table as teltonika-decode). CRC-16/IBM has no hardware instruction, the CRC32 instructions Go uses are
+// for other polynomials, so the table is the fast path
+var crc16Table = makeCrc16Table()
+
+func makeCrc16Table() *[256]uint16 {
+	table := new([256]uint16)
+	for i := range table {
+		crc := uint16(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 != 0 {
+				crc = (crc >> 1) ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}
+
+// crc16 is CRC-16/IBM (polynomial 0xA001 reflected) of the tcp packet data, also the CRC of the Wialon IPS packets
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc = (crc >> 8) ^ crc16Table[byte(crc)^b]
+	}
+	return crc
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// crc16Bitwise is the bit by bit CRC-16/IBM the table is checked against
+func crc16Bitwise(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = (crc >> 1) ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+func TestCrc16(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want uint16
+	}{
+		{"empty", nil, 0},
+		// check value of CRC-16/ARC (same polynomial, init and reflection as the Teltonika CRC)
+		{"check string", []byte("123456789"), 0xBB3D},
+		// the codec 8 heartbeat: codec id and two record counts of 0
+		{"heartbeat", []byte{0x08, 0x00, 0x00}, 0xC281},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := crc16(tt.data); got != tt.want {
+				t.Errorf("crc16() = %04x, want %04x", got, tt.want)
+			}
+		})
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		data := make([]byte, rnd.Intn(1300))
+		rnd.Read(data)
+		if table, bitwise := crc16(data), crc16Bitwise(data); table != bitwise {
+			t.Fatalf("crc16 of %d bytes is %04x, bitwise %04x", len(data), table, bitwise)
+		}
+	}
+}
+
+// BenchmarkCrc16 compares the table and the bitwise CRC on the data sizes of a single record and a full packet
+func BenchmarkCrc16(b *testing.B) {
+	for _, size := range []int{64, 1280} {
+		data := make([]byte, size)
+		rand.New(rand.NewSource(1)).Read(data)
+		for _, impl := range []struct {
+			name string
+			fn   func([]byte) uint16
+		}{{"table", crc16}, {"bitwise", crc16Bitwise}} {
+			b.Run(fmt.Sprintf("%s/%d", impl.name, size), func(b *testing.B) {
+				b.SetBytes(int64(size))
+				for i := 0; i < b.N; i++ {
+					impl.fn(data)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+//go:embed dashboard.html
+var dashboardPage []byte
+
+// ServeDashboard serves GET /dashboard, a single page showing the devices of the live stream on a map with their
+// latest records and a console sending commands through the commands api (the map tiles load from OpenStreetMap)
+func ServeDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write(dashboardPage)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DeadLetter is a payload a sink gave up on, Payload is the encoded sink payload
+// (json kept as is, anything else base64 encoded in PayloadBase64)
+type DeadLetter struct {
+	Time          time.Time       `json:"time"`
+	Sink          string          `json:"sink"`
+	Imei          string          `json:"imei,omitempty"`
+	Target        string          `json:"target,omitempty"`
+	ContentType   string          `json:"contentType,omitempty"`
+	Attempts      int             `json:"attempts"`
+	Error         string          `json:"error"`
+	Payload       json.RawMessage `json:"payload,omitempty"`
+	PayloadBase64 []byte          `json:"payloadBase64,omitempty"`
+}
+
+func NewDeadLetter(sink string, imei string, target string, payload []byte, attempts int, cause error) *DeadLetter {
+	letter := &DeadLetter{
+		Time:     time.Now().UTC(),
+		Sink:     sink,
+		Imei:     imei,
+		Target:   target,
+		Attempts: attempts,
+		Error:    cause.Error(),
+	}
+	if json.Valid(payload) {
+		letter.Payload = payload
+	} else {
+		letter.PayloadBase64 = payload
+	}
+	return letter
+}
+
+func (d *DeadLetter) Bytes() []byte {
+	if d.Payload != nil {
+		return d.Payload
+	}
+	return d.PayloadBase64
+}
+
+type DeadLetterQueue interface {
+	Put(letter *DeadLetter) error
+}
+
+// DeadLetterSource is implemented by the queues the letters can be read back from for reprocessing,
+// Reprocess calls redeliver for every letter, delivered letters leave the queue, failed ones stay with
+// their attempts and error updated
+type DeadLetterSource interface {
+	Reprocess(redeliver func(letter *DeadLetter) error) error
+}
+
+// Redeliverer is implemented by sinks that can retry a dead letter synchronously (reprocessing)
+type Redeliverer interface {
+	Name() string
+	Redeliver(letter *DeadLetter) error
+}
+
+// NewDeadLetterQueue creates a queue from its spec: a file path (json lines),
+// s3://bucket/prefix (credentials from the AWS_* env vars) or "" to discard letters.
+// There's no Kafka backend: the server has no dependencies and a Kafka client (produce, plus fetch and
+// offsets for reprocessing) is far more than the s3 requests, other backends implement DeadLetterQueue
+func NewDeadLetterQueue(spec string) (DeadLetterQueue, error) {
+	switch {
+	case spec == "":
+		return discardDeadLetters{}, nil
+	case strings.HasPrefix(spec, "s3://"):
+		return NewS3DeadLetterQueue(spec)
+	default:
+		return NewFileDeadLetterQueue(spec), nil
+	}
+}
+
+type discardDeadLetters struct{}
+
+func (discardDeadLetters) Put(*DeadLetter) error {
+	return nil
+}
+
+type FileDeadLetterQueue struct {
+	path  string
+	mutex sync.Mutex
+}
+
+func NewFileDeadLetterQueue(path string) *FileDeadLetterQueue {
+	return &FileDeadLetterQueue{path: path}
+}
+
+func (f *FileDeadLetterQueue) Put(letter *DeadLetter) error {
+	line, err := json.Marshal(letter)
+	if err != nil {
+		return fmt.Errorf("dead letter marshaling error (%v)", err)
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("dead letter open error (%v)", err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	if _, err = file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("dead letter write error (%v)", err)
+	}
+	return nil
+}
+
+func putDeadLetter(queue DeadLetterQueue, letter *DeadLetter, logger *Logger) {
+	if queue == nil {
+		return
+	}
+	if err := queue.Put(letter); err != nil {
+		logger.Error.Printf("[%s]: dead letter from '%s' lost (%v)", letter.Imei, letter.Sink, err)
+	}
+}
+
+// ReprocessDeadLetters redelivers the letters of a dead letter queue (file or s3 spec) through the sinks
+// with the same name, at most rate letters a second (no limit if 0), letters that fail again (or have no
+// sink) stay in the queue
+func ReprocessDeadLetters(spec string, sinks []Sink, rate float64, logger *Logger) error {
+	redeliverers := make(map[string]Redeliverer)
+	for _, sink := range sinks {
+		collectRedeliverers(sink, redeliverers)
+	}
+
+	queue, err := NewDeadLetterQueue(spec)
+	if err != nil {
+		return err
+	}
+	source, ok := queue.(DeadLetterSource)
+	if !ok {
+		return fmt.Errorf("dead letters can't be read back from '%s'", spec)
+	}
+	limit := newRateLimit(rate)
+	delivered, failed := 0, 0
+	err = source.Reprocess(func(letter *DeadLetter) error {
+		limit.wait()
+		var err error
+		sink, ok := redeliverers[letter.Sink]
+		if !ok {
+			err = errors.New("no sink with this name in the current config")
+		} else {
+			err = sink.Redeliver(letter)
+		}
+		if err == nil {
+			delivered++
+			return nil
+		}
+		failed++
+		logger.Error.Printf("[%s]: redelivery to '%s' failed (%v)", letter.Imei, letter.Sink, err)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	logger.Info.Printf("reprocessed %s: %d delivered, %d failed", spec, delivered, failed)
+	return nil
+}
+
+// Reprocess reads the file, the letters that fail again are written to <path>.remaining
+func (f *FileDeadLetterQueue) Reprocess(redeliver func(letter *DeadLetter) error) error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return fmt.Errorf("dead letter file open error (%v)", err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	remaining := NewFileDeadLetterQueue(f.path + ".remaining")
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		letter := &DeadLetter{}
+		if err = json.Unmarshal(scanner.Bytes(), letter); err != nil {
+			return fmt.Errorf("dead letter parse error (%v)", err)
+		}
+		if err = redeliver(letter); err == nil {
+			continue
+		}
+		letter.Attempts++
+		letter.Error = err.Error()
+		if err = remaining.Put(letter); err != nil {
+			return err
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return fmt.Errorf("dead letter file read error (%v)", err)
+	}
+	return nil
+}
+
+func collectRedeliverers(sink Sink, into map[string]Redeliverer) {
+	if r, ok := sink.(Redeliverer); ok {
+		into[r.Name()] = r
+	}
+	if w, ok := sink.(interface{ Unwrap() Sink }); ok {
+		collectRedeliverers(w.Unwrap(), into)
+	}
+	if r, ok := sink.(interface{ Sinks() []Sink }); ok {
+		for _, s := range r.Sinks() {
+			collectRedeliverers(s, into)
+		}
+	}
+}
+
+// Purge removes the letters of the device (a Purger)
+func (f *FileDeadLetterQueue) Purge(imei string) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return rewriteJsonLines(f.path, lineOf(imei))
+}
+
+// ExpireBefore removes the letters older than the time (an Expirer)
+func (f *FileDeadLetterQueue) ExpireBefore(before time.Time) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return rewriteJsonLines(f.path, func(line []byte) bool {
+		letter := &DeadLetter{}
+		return json.Unmarshal(line, letter) == nil && letter.Time.Before(before)
+	})
+}
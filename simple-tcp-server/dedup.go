@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"hash/crc64"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+var dedupMetrics = expvar.NewMap("dedup")
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+// DedupConfig: Window is the number of record fingerprints remembered per device,
+// with File set the fingerprints are saved every SaveSeconds (and loaded at start) to survive restarts
+type DedupConfig struct {
+	Window      int    `json:"window"`
+	File        string `json:"file"`
+	SaveSeconds int    `json:"saveSeconds"`
+}
+
+// Deduplicator drops records already seen from the device, trackers resend records
+// that weren't acknowledged before a reconnect
+type Deduplicator struct {
+	window  int
+	file    string
+	mutex   sync.Mutex
+	devices map[string]*dedupWindow
+	logger  *Logger
+	// Deferred leaves the fingerprints of the records passed on out of the window until Commit (see AckPolicy)
+	Deferred bool
+}
+
+// dedupWindow is a ring of the last fingerprints with a set for lookups
+type dedupWindow struct {
+	ring []uint64
+	next int
+	seen map[uint64]bool
+}
+
+func NewDeduplicator(config *DedupConfig, logger *Logger) (*Deduplicator, error) {
+	d := &Deduplicator{window: 1000, devices: make(map[string]*dedupWindow), logger: logger}
+	if config == nil {
+		return d, nil
+	}
+	if config.Window > 0 {
+		d.window = config.Window
+	}
+	if config.File == "" {
+		return d, nil
+	}
+	d.file = config.File
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	interval := time.Duration(config.SaveSeconds) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if err := d.Save(); err != nil {
+				logger.Error.Printf("%v", err)
+			}
+		}
+	}()
+	return d, nil
+}
+
+func (d *Deduplicator) Apply(imei string, pkt *AnnotatedPacket) *AnnotatedPacket {
+	if len(pkt.Data) == 0 {
+		return pkt
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	w := d.device(imei)
+	var records []teltonika.Data
+	var indexes []int
+	// pending are the fingerprints of the packet passed on while deferred, for the copies within the packet
+	var pending map[uint64]bool
+	if d.Deferred {
+		pending = make(map[uint64]bool, len(pkt.Data))
+	}
+	for i := range pkt.Data {
+		fingerprint := recordFingerprint(&pkt.Data[i])
+		if w.seen[fingerprint] || pending[fingerprint] {
+			if records == nil {
+				records = append(make([]teltonika.Data, 0, len(pkt.Data)), pkt.Data[:i]...)
+				indexes = make([]int, i, len(pkt.Data))
+				for j := range indexes {
+					indexes[j] = j
+				}
+			}
+			dedupMetrics.Add("dropped", 1)
+			continue
+		}
+		if d.Deferred {
+			pending[fingerprint] = true
+		} else {
+			w.add(fingerprint, d.window)
+		}
+		if records != nil {
+			records = append(records, pkt.Data[i])
+			indexes = append(indexes, i)
+		}
+	}
+	if records == nil {
+		return pkt
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	return pkt.Derive(records, indexes)
+}
+
+// Commit adds the fingerprints of the records of the packet the sinks took to the window of the device, the ones
+// already in it are skipped
+func (d *Deduplicator) Commit(imei string, pkt *teltonika.Packet) {
+	if len(pkt.Data) == 0 {
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	w := d.device(imei)
+	for i := range pkt.Data {
+		if fingerprint := recordFingerprint(&pkt.Data[i]); !w.seen[fingerprint] {
+			w.add(fingerprint, d.window)
+		}
+	}
+}
+
+// device returns the window of the device, the mutex is held
+func (d *Deduplicator) device(imei string) *dedupWindow {
+	w, ok := d.devices[imei]
+	if !ok {
+		w = &dedupWindow{ring: make([]uint64, 0, d.window), seen: make(map[uint64]bool)}
+		d.devices[imei] = w
+	}
+	return w
+}
+
+func (w *dedupWindow) add(fingerprint uint64, size int) {
+	if len(w.ring) < size {
+		w.ring = append(w.ring, fingerprint)
+	} else {
+		delete(w.seen, w.ring[w.next])
+		w.ring[w.next] = fingerprint
+		w.next = (w.next + 1) % size
+	}
+	w.seen[fingerprint] = true
+}
+
+// recordFingerprint is CRC-64 of the record content (timestamp, position, event and IO elements)
+func recordFingerprint(record *teltonika.Data) uint64 {
+	buf := make([]byte, 0, 64)
+	buf = binary.BigEndian.AppendUint64(buf, record.TimestampMs)
+	buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(record.Lat))
+	buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(record.Lng))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(record.Altitude))
+	buf = binary.BigEndian.AppendUint16(buf, record.Angle)
+	buf = binary.BigEndian.AppendUint16(buf, record.Speed)
+	buf = binary.BigEndian.AppendUint16(buf, record.EventID)
+	buf = append(buf, record.Satellites, record.Priority)
+	for _, el := range record.Elements {
+		buf = binary.BigEndian.AppendUint16(buf, el.Id)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(el.Value)))
+		buf = append(buf, el.Value...)
+	}
+	return crc64.Checksum(buf, crc64Table)
+}
+
+// Snapshot returns the fingerprints of all devices, oldest first (a Snapshotter)
+func (d *Deduplicator) Snapshot() ([]byte, error) {
+	d.mutex.Lock()
+	state := make(map[string][]uint64, len(d.devices))
+	for imei, w := range d.devices {
+		state[imei] = append(append(make([]uint64, 0, len(w.ring)), w.ring[w.next:]...), w.ring[:w.next]...)
+	}
+	d.mutex.Unlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return nil, fmt.Errorf("dedup state marshaling error (%v)", err)
+	}
+	return data, nil
+}
+
+// Restore replaces the fingerprints with the ones of a snapshot
+func (d *Deduplicator) Restore(data []byte) error {
+	state := make(map[string][]uint64)
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("dedup state parse error (%v)", err)
+	}
+	devices := make(map[string]*dedupWindow, len(state))
+	for imei, fingerprints := range state {
+		w := &dedupWindow{ring: make([]uint64, 0, d.window), seen: make(map[uint64]bool)}
+		for _, fingerprint := range fingerprints {
+			w.add(fingerprint, d.window)
+		}
+		devices[imei] = w
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.devices = devices
+	return nil
+}
+
+// Save writes the fingerprints of all devices to the file
+func (d *Deduplicator) Save() error {
+	if d.file == "" {
+		return nil
+	}
+	data, err := d.Snapshot()
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(d.file+".tmp", data, 0o644); err != nil {
+		return fmt.Errorf("dedup state write error (%v)", err)
+	}
+	if err = os.Rename(d.file+".tmp", d.file); err != nil {
+		return fmt.Errorf("dedup state write error (%v)", err)
+	}
+	return nil
+}
+
+func (d *Deduplicator) load() error {
+	data, err := os.ReadFile(d.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("dedup state read error (%v)", err)
+	}
+	return d.Restore(data)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DeltaConfig: the sink gets only the IO elements that changed since the previous record of the device,
+// every KeyframeSeconds (default 600) a record goes out complete so consumers can resync
+type DeltaConfig struct {
+	KeyframeSeconds int `json:"keyframeSeconds"`
+}
+
+// DeltaSink drops the IO elements that didn't change the device state (AnnotatedPacket.Changes of the
+// StateService) from the records, the position is always sent. Records with unknown changes go out complete
+type DeltaSink struct {
+	keyframe  time.Duration
+	sink      Sink
+	mutex     sync.Mutex
+	keyframes map[string]time.Time
+}
+
+func NewDeltaSink(config *DeltaConfig, sink Sink) *DeltaSink {
+	keyframe := time.Duration(config.KeyframeSeconds) * time.Second
+	if keyframe <= 0 {
+		keyframe = time.Minute * 10
+	}
+	return &DeltaSink{keyframe: keyframe, sink: sink, keyframes: make(map[string]time.Time)}
+}
+
+func (s *DeltaSink) Unwrap() Sink {
+	return s.sink
+}
+
+func (s *DeltaSink) Send(imei string, pkt *AnnotatedPacket) error {
+	if len(pkt.Data) == 0 {
+		return s.sink.Send(imei, pkt)
+	}
+	now := time.Now()
+	records := make([]teltonika.Data, len(pkt.Data))
+	s.mutex.Lock()
+	for i := range pkt.Data {
+		record := pkt.Data[i]
+		changes, known := pkt.RecordChanges(i)
+		if !known || now.Sub(s.keyframes[imei]) >= s.keyframe {
+			s.keyframes[imei] = now
+			records[i] = record
+			continue
+		}
+		elements := make([]teltonika.IOElement, 0, len(record.Elements))
+		for _, el := range record.Elements {
+			if _, ok := changes["io_"+strconv.Itoa(int(el.Id))]; ok {
+				elements = append(elements, el)
+			}
+		}
+		record.Elements = elements
+		records[i] = record
+	}
+	s.mutex.Unlock()
+
+	return s.sink.Send(imei, pkt.Derive(records, nil))
+}
+
+func (s *DeltaSink) SendEvent(event *Event) error {
+	eventSink, ok := s.sink.(EventSink)
+	if !ok {
+		return nil
+	}
+	return eventSink.SendEvent(event)
+}
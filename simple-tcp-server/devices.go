@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// DeviceHandler serves a resource of the device, imei is taken from the path
+type DeviceHandler func(w http.ResponseWriter, r *http.Request, imei string)
+
+// DeviceAPI routes /devices/{imei}/{resource} to the handlers registered by the features (trips, ...)
+type DeviceAPI struct {
+	mutex     sync.RWMutex
+	resources map[string]DeviceHandler
+	details   map[string]func(imei string) any
+}
+
+func NewDeviceAPI() *DeviceAPI {
+	return &DeviceAPI{resources: make(map[string]DeviceHandler), details: make(map[string]func(imei string) any)}
+}
+
+// Detail registers a section of the device detail (GET /devices/{imei} when no handler is registered for it),
+// the provider returns nil when it has nothing on the device
+func (d *DeviceAPI) Detail(name string, provider func(imei string) any) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.details[name] = provider
+}
+
+// Handle registers the handler of /devices/{imei}/{resource}, an empty resource is /devices/{imei}
+func (d *DeviceAPI) Handle(resource string, handler DeviceHandler) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.resources[resource] = handler
+}
+
+func (d *DeviceAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	imei, resource, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/devices/"), "/"), "/")
+	if imei == "" {
+		http.NotFound(w, r)
+		return
+	}
+	d.mutex.RLock()
+	handler, ok := d.resources[resource]
+	d.mutex.RUnlock()
+	if !ok && resource == "" {
+		d.serveDetail(w, r, imei)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	handler(w, r, imei)
+}
+
+func (d *DeviceAPI) serveDetail(w http.ResponseWriter, r *http.Request, imei string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	detail := map[string]any{"imei": imei}
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	for name, provider := range d.details {
+		value := provider(imei)
+		// providers return typed nils
+		v := reflect.ValueOf(value)
+		if !v.IsValid() || (v.Kind() == reflect.Ptr || v.Kind() == reflect.Slice || v.Kind() == reflect.Map) && v.IsNil() {
+			continue
+		}
+		detail[name] = value
+	}
+	if len(detail) == 1 {
+		http.NotFound(w, r)
+		return
+	}
+	writeJson(w, http.StatusOK, detail)
+}
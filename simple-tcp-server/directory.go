@@ -0,0 +1,431 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+var directoryMetrics = expvar.NewMap("directory")
+
+// DirectoryConfig: the device directory tells the tenant, the vehicle, the sim and the expected codec of the
+// devices. Backend is "file" (File, a json object imei -> DirectoryEntry, reloaded when it changes), "http" (Http)
+// or "sql" (Sql). The devices are looked up when they connect, the entries are cached CacheSeconds (default 300).
+// Fields are the vehicle fields attached to the records and the events besides the tenant and the vehicle id and
+// name: plate, fleet, driver (the default driver, attached as defaultDriver), type (as vehicleType), vin, make,
+// model or the name of a custom field
+type DirectoryConfig struct {
+	Backend      string         `json:"backend"`
+	File         string         `json:"file"`
+	Http         *DirectoryHttp `json:"http"`
+	Sql          *DirectorySql  `json:"sql"`
+	CacheSeconds int            `json:"cacheSeconds"`
+	Fields       []string       `json:"fields"`
+}
+
+// DirectoryHttp: Url is requested with GET, {imei} replaced by the imei, the response is a DirectoryEntry, 404 for
+// an unknown device
+type DirectoryHttp struct {
+	Url         string `json:"url"`
+	BearerToken string `json:"bearerToken"`
+	TimeoutMs   int    `json:"timeoutMs"`
+}
+
+// DirectorySql: Query selects the device with the imei as its only argument (e.g. "select tenant, plate from
+// devices where imei = $1"), the columns are matched by name: tenant, vehicle_id, vehicle_name, plate, fleet,
+// vehicle_type, driver, vin, make, model, iccid, msisdn, operator, codec. The server has no dependencies besides the codec, the Driver ("postgres",
+// "mysql", ...) must be linked in by a file importing it (import _ "github.com/lib/pq")
+type DirectorySql struct {
+	Driver string `json:"driver"`
+	Dsn    string `json:"dsn"`
+	Query  string `json:"query"`
+}
+
+// DirectoryEntry is what the directory knows of a device, Codec is the expected data codec ("8", "8E", "16")
+type DirectoryEntry struct {
+	Imei    string       `json:"imei"`
+	Tenant  string       `json:"tenant,omitempty"`
+	Vehicle *VehicleInfo `json:"vehicle,omitempty"`
+	Sim     *SimInfo     `json:"sim,omitempty"`
+	Codec   string       `json:"codec,omitempty"`
+}
+
+// VehicleInfo is the vehicle of a device, Driver is its default driver, Custom the fields of the fleet system
+type VehicleInfo struct {
+	Id     string            `json:"id,omitempty"`
+	Name   string            `json:"name,omitempty"`
+	Plate  string            `json:"plate,omitempty"`
+	Fleet  string            `json:"fleet,omitempty"`
+	Type   string            `json:"type,omitempty"`
+	Driver string            `json:"driver,omitempty"`
+	Vin    string            `json:"vin,omitempty"`
+	Make   string            `json:"make,omitempty"`
+	Model  string            `json:"model,omitempty"`
+	Custom map[string]string `json:"custom,omitempty"`
+}
+
+// vehicleFields are the attribute names of the vehicle fields
+var vehicleFields = map[string]string{"plate": "plate", "fleet": "fleet", "driver": "defaultDriver",
+	"type": "vehicleType", "vin": "vin", "make": "make", "model": "model"}
+
+// field returns the value of a vehicle field (see DirectoryConfig.Fields) and its attribute name
+func (v *VehicleInfo) field(name string) (string, string) {
+	switch name {
+	case "plate":
+		return v.Plate, vehicleFields[name]
+	case "fleet":
+		return v.Fleet, vehicleFields[name]
+	case "driver":
+		return v.Driver, vehicleFields[name]
+	case "type":
+		return v.Type, vehicleFields[name]
+	case "vin":
+		return v.Vin, vehicleFields[name]
+	case "make":
+		return v.Make, vehicleFields[name]
+	case "model":
+		return v.Model, vehicleFields[name]
+	}
+	return v.Custom[name], name
+}
+
+type SimInfo struct {
+	Iccid    string `json:"iccid,omitempty"`
+	Msisdn   string `json:"msisdn,omitempty"`
+	Operator string `json:"operator,omitempty"`
+}
+
+// DeviceDirectory looks the devices up, nil if the device isn't in the directory
+type DeviceDirectory interface {
+	Lookup(imei string) (*DirectoryEntry, error)
+}
+
+func NewDeviceDirectory(config *DirectoryConfig) (DeviceDirectory, error) {
+	switch config.Backend {
+	case "file":
+		if config.File == "" {
+			return nil, fmt.Errorf("directory file backend requires file")
+		}
+		return NewFileDirectory(config.File)
+	case "http":
+		if config.Http == nil || config.Http.Url == "" {
+			return nil, fmt.Errorf("directory http backend requires http url")
+		}
+		return NewHttpDirectory(config.Http), nil
+	case "sql":
+		if config.Sql == nil || config.Sql.Query == "" {
+			return nil, fmt.Errorf("directory sql backend requires sql query")
+		}
+		return NewSqlDirectory(config.Sql)
+	}
+	return nil, fmt.Errorf("unknown directory backend '%s'", config.Backend)
+}
+
+// FileDirectory reads the directory from a json file, reloaded when the file changes (checked on the lookups,
+// every 10 seconds at most)
+type FileDirectory struct {
+	path     string
+	mutex    sync.Mutex
+	devices  map[string]*DirectoryEntry
+	modified time.Time
+	checked  time.Time
+}
+
+func NewFileDirectory(path string) (*FileDirectory, error) {
+	d := &FileDirectory{path: path}
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// load reads the file if it changed since the last load, the mutex must be held or d not shared yet
+func (d *FileDirectory) load() error {
+	d.checked = time.Now()
+	info, err := os.Stat(d.path)
+	if err != nil {
+		return fmt.Errorf("directory read error (%v)", err)
+	}
+	if info.ModTime().Equal(d.modified) {
+		return nil
+	}
+	data, err := os.ReadFile(d.path)
+	if err != nil {
+		return fmt.Errorf("directory read error (%v)", err)
+	}
+	devices := make(map[string]*DirectoryEntry)
+	if err = json.Unmarshal(data, &devices); err != nil {
+		return fmt.Errorf("directory parse error (%v)", err)
+	}
+	for imei, device := range devices {
+		device.Imei = imei
+	}
+	d.devices, d.modified = devices, info.ModTime()
+	return nil
+}
+
+func (d *FileDirectory) Lookup(imei string) (*DirectoryEntry, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	var err error
+	if time.Since(d.checked) > time.Second*10 {
+		// a broken file is reported, the previous entries stay
+		err = d.load()
+	}
+	return d.devices[imei], err
+}
+
+// HttpDirectory asks a directory service
+type HttpDirectory struct {
+	config *DirectoryHttp
+	client *http.Client
+}
+
+func NewHttpDirectory(config *DirectoryHttp) *HttpDirectory {
+	timeout := time.Duration(config.TimeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		timeout = time.Second * 5
+	}
+	return &HttpDirectory{config: config, client: &http.Client{Timeout: timeout}}
+}
+
+func (d *HttpDirectory) Lookup(imei string) (*DirectoryEntry, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.ReplaceAll(d.config.Url, "{imei}", url.PathEscape(imei)), nil)
+	if err != nil {
+		return nil, err
+	}
+	if d.config.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+d.config.BearerToken)
+	}
+	res, err := d.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("directory http error (%v)", err)
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	if res.StatusCode == http.StatusNotFound {
+		_, _ = io.Copy(io.Discard, res.Body)
+		return nil, nil
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		_, _ = io.Copy(io.Discard, res.Body)
+		return nil, fmt.Errorf("directory http status %d", res.StatusCode)
+	}
+	device := &DirectoryEntry{}
+	if err = json.NewDecoder(res.Body).Decode(device); err != nil {
+		return nil, fmt.Errorf("directory response parse error (%v)", err)
+	}
+	device.Imei = imei
+	return device, nil
+}
+
+// SqlDirectory queries a database through database/sql
+type SqlDirectory struct {
+	db    *sql.DB
+	query string
+}
+
+func NewSqlDirectory(config *DirectorySql) (*SqlDirectory, error) {
+	db, err := sql.Open(config.Driver, config.Dsn)
+	if err != nil {
+		return nil, fmt.Errorf("directory sql error (%v), is the %s driver linked in?", err, config.Driver)
+	}
+	return &SqlDirectory{db: db, query: config.Query}, nil
+}
+
+func (d *SqlDirectory) Lookup(imei string) (*DirectoryEntry, error) {
+	rows, err := d.db.Query(d.query, imei)
+	if err != nil {
+		return nil, fmt.Errorf("directory sql error (%v)", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, fmt.Errorf("directory sql error (%v)", err)
+	}
+	values := make([]sql.NullString, len(columns))
+	targets := make([]any, len(columns))
+	for i := range values {
+		targets[i] = &values[i]
+	}
+	if err = rows.Scan(targets...); err != nil {
+		return nil, fmt.Errorf("directory sql error (%v)", err)
+	}
+	device := &DirectoryEntry{Imei: imei, Vehicle: &VehicleInfo{}, Sim: &SimInfo{}}
+	fields := map[string]*string{"tenant": &device.Tenant, "codec": &device.Codec,
+		"vehicle_id": &device.Vehicle.Id, "vehicle_name": &device.Vehicle.Name, "plate": &device.Vehicle.Plate,
+		"fleet": &device.Vehicle.Fleet, "vehicle_type": &device.Vehicle.Type, "driver": &device.Vehicle.Driver,
+		"vin": &device.Vehicle.Vin, "make": &device.Vehicle.Make, "model": &device.Vehicle.Model,
+		"iccid": &device.Sim.Iccid, "msisdn": &device.Sim.Msisdn, "operator": &device.Sim.Operator}
+	for i, column := range columns {
+		if field, ok := fields[strings.ToLower(column)]; ok && values[i].Valid {
+			*field = values[i].String
+		}
+	}
+	if reflect.ValueOf(*device.Vehicle).IsZero() {
+		device.Vehicle = nil
+	}
+	if *device.Sim == (SimInfo{}) {
+		device.Sim = nil
+	}
+	return device, nil
+}
+
+// directoryCached is a cached lookup, device is nil for a device not in the directory
+type directoryCached struct {
+	device  *DirectoryEntry
+	fetched time.Time
+}
+
+// DirectoryService caches the directory lookups and enriches the records of the devices with their tenant and
+// vehicle (an Enricher)
+type DirectoryService struct {
+	directory DeviceDirectory
+	fields    []string
+	ttl       time.Duration
+	logger    *Logger
+	mutex     sync.Mutex
+	entries   map[string]*directoryCached
+}
+
+func NewDirectoryService(config *DirectoryConfig, logger *Logger) (*DirectoryService, error) {
+	directory, err := NewDeviceDirectory(config)
+	if err != nil {
+		return nil, err
+	}
+	s := &DirectoryService{directory: directory, fields: config.Fields, ttl: time.Minute * 5, logger: logger,
+		entries: make(map[string]*directoryCached)}
+	if config.CacheSeconds > 0 {
+		s.ttl = time.Duration(config.CacheSeconds) * time.Second
+	}
+	return s, nil
+}
+
+// Connected looks up a device that just connected (TCPServer.OnConnect), the cached entry is replaced
+func (s *DirectoryService) Connected(imei string) {
+	s.fetch(imei)
+}
+
+// Device returns the directory entry of the device, looked up when it isn't cached or expired. A failed lookup
+// keeps the cached entry
+func (s *DirectoryService) Device(imei string) *DirectoryEntry {
+	s.mutex.Lock()
+	entry, ok := s.entries[imei]
+	s.mutex.Unlock()
+	if ok && time.Since(entry.fetched) < s.ttl {
+		directoryMetrics.Add("hits", 1)
+		return entry.device
+	}
+	return s.fetch(imei)
+}
+
+func (s *DirectoryService) fetch(imei string) *DirectoryEntry {
+	directoryMetrics.Add("lookups", 1)
+	device, err := s.directory.Lookup(imei)
+	if err != nil {
+		// logged before locking, the log writer may look the tenant up (see Tenant)
+		directoryMetrics.Add("errors", 1)
+		s.logger.Error.Printf("[%s]: %v", imei, err)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err != nil {
+		if entry, ok := s.entries[imei]; ok {
+			return entry.device
+		}
+		return nil
+	}
+	if device == nil {
+		directoryMetrics.Add("unknown", 1)
+	}
+	s.entries[imei] = &directoryCached{device: device, fetched: time.Now()}
+	return device
+}
+
+// Codecs returns the expected codec of the device, nil if the directory doesn't tell (CodecMonitor.Expected)
+// Tenant returns the tenant of the cached entry of the device, it doesn't look the device up
+func (s *DirectoryService) Tenant(imei string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if entry, ok := s.entries[imei]; ok && entry.device != nil {
+		return entry.device.Tenant
+	}
+	return ""
+}
+
+func (s *DirectoryService) Codecs(imei string) []string {
+	if device := s.Device(imei); device != nil && device.Codec != "" {
+		return []string{device.Codec}
+	}
+	return nil
+}
+
+// Vehicle returns the tenant, vehicleId, vehicleName and the configured vehicle fields of the device, nil for a
+// device not in the directory (Pipeline.Vehicle)
+func (s *DirectoryService) Vehicle(imei string) map[string]any {
+	device := s.Device(imei)
+	if device == nil {
+		return nil
+	}
+	values := make(map[string]any, 3+len(s.fields))
+	if device.Tenant != "" {
+		values["tenant"] = device.Tenant
+	}
+	if vehicle := device.Vehicle; vehicle != nil {
+		if vehicle.Id != "" {
+			values["vehicleId"] = vehicle.Id
+		}
+		if vehicle.Name != "" {
+			values["vehicleName"] = vehicle.Name
+		}
+		for _, name := range s.fields {
+			if value, attribute := vehicle.field(name); value != "" {
+				values[attribute] = value
+			}
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	return values
+}
+
+// Enrich attaches the vehicle of the device (see Vehicle) to every record
+func (s *DirectoryService) Enrich(imei string, pkt *teltonika.Packet) ([]map[string]any, error) {
+	values := s.Vehicle(imei)
+	if values == nil {
+		return nil, nil
+	}
+	// the enrich stage copies the attributes, the same map serves all records
+	attributes := make([]map[string]any, len(pkt.Data))
+	for i := range attributes {
+		attributes[i] = values
+	}
+	return attributes, nil
+}
+
+// Purge forgets the cached entry of the device (a Purger)
+func (s *DirectoryService) Purge(imei string) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.entries[imei]; !ok {
+		return 0, nil
+	}
+	delete(s.entries, imei)
+	return 1, nil
+}
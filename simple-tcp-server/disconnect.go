@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+)
+
+var disconnectMetrics = expvar.NewMap("disconnects")
+
+// the reasons a device connection ends with (TCPServer.OnClose)
+const (
+	// CloseEOF: the device closed the connection (FIN)
+	CloseEOF = "closed"
+	// CloseReset: the connection was reset (RST) or broke
+	CloseReset = "reset"
+	// CloseTimeout: the device sent nothing within the read timeout
+	CloseTimeout = "timeout"
+	// CloseDecode: the device sent a packet that doesn't decode
+	CloseDecode = "decode"
+	// CloseLimit: the device exceeded a limit (see LimitsConfig)
+	CloseLimit = "limit"
+	// CloseError: any other error, writing to the device or the upstream failed
+	CloseError = "error"
+	// CloseShutdown: the server is shutting down (TCPServer.Shutdown)
+	CloseShutdown = "shutdown"
+	// CloseReplaced: the device connected again, the new connection replaced this one
+	CloseReplaced = "replaced"
+	// CloseKicked: the device was disconnected through the api (TCPServer.Kick)
+	CloseKicked = "kicked"
+)
+
+var errInvalidPreamble = errors.New("invalid preamble")
+
+// PartialFrameError is a connection ending in the middle of a packet: Read bytes of the packet were received, Size
+// is the declared size (0 if the header itself was cut). Err is the read error
+type PartialFrameError struct {
+	Read int
+	Size int
+	Err  error
+}
+
+func (e *PartialFrameError) Error() string {
+	if e.Size == 0 {
+		return fmt.Sprintf("partial packet header, %d bytes (%v)", e.Read, e.Err)
+	}
+	return fmt.Sprintf("partial packet, %d of %d bytes (%v)", e.Read, e.Size, e.Err)
+}
+
+func (e *PartialFrameError) Unwrap() error {
+	return e.Err
+}
+
+// closeReason classifies the error a connection ends with
+func closeReason(err error) string {
+	var limitErr *LimitError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &limitErr):
+		return CloseLimit
+	case errors.Is(err, errInvalidPreamble):
+		return CloseDecode
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return CloseEOF
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNABORTED), errors.Is(err, syscall.EPIPE):
+		return CloseReset
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return CloseTimeout
+	}
+	return CloseError
+}
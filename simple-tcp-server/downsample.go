@@ -0,0 +1,153 @@
+package main
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+var downsampleMetrics = expvar.NewMap("downsample")
+
+// DownsampleConfig: a record is dropped when it comes less than MinSeconds after the last passed record
+// of the device or moved less than MinMeters from it, a record is passed at least every MaxSeconds
+// (default 300) even if the vehicle stands. With SimplifyMeters the tracks of packets with several records
+// (history uploads) are simplified with Douglas-Peucker at that tolerance. Records with an event or priority
+// are always passed
+type DownsampleConfig struct {
+	MinSeconds     int     `json:"minSeconds"`
+	MinMeters      float64 `json:"minMeters"`
+	MaxSeconds     int     `json:"maxSeconds"`
+	SimplifyMeters float64 `json:"simplifyMeters"`
+}
+
+// Downsampler is a Stage thinning the records of stationary or slow vehicles
+type Downsampler struct {
+	minGap    time.Duration
+	maxGap    time.Duration
+	minMeters float64
+	tolerance float64
+	mutex     sync.Mutex
+	devices   map[string]*downsampleDevice
+}
+
+// downsampleDevice is the last passed record of the device
+type downsampleDevice struct {
+	time time.Time
+	lat  float64
+	lng  float64
+	fix  bool
+}
+
+func NewDownsampler(config *DownsampleConfig) *Downsampler {
+	d := &Downsampler{
+		minGap:    time.Duration(config.MinSeconds) * time.Second,
+		maxGap:    time.Duration(config.MaxSeconds) * time.Second,
+		minMeters: config.MinMeters,
+		tolerance: config.SimplifyMeters,
+		devices:   make(map[string]*downsampleDevice),
+	}
+	if d.maxGap <= 0 {
+		d.maxGap = time.Minute * 5
+	}
+	return d
+}
+
+func (d *Downsampler) Apply(imei string, pkt *AnnotatedPacket) *AnnotatedPacket {
+	if len(pkt.Data) == 0 {
+		return pkt
+	}
+	keep := make([]bool, len(pkt.Data))
+	d.mutex.Lock()
+	last := d.devices[imei]
+	for i := range pkt.Data {
+		record := &pkt.Data[i]
+		t := time.UnixMilli(int64(record.TimestampMs))
+		keep[i] = last == nil || downsampleImportant(record) || t.Sub(last.time) >= d.maxGap
+		if !keep[i] {
+			keep[i] = t.Sub(last.time) >= d.minGap
+			if keep[i] && d.minMeters > 0 && last.fix && hasFix(record) {
+				keep[i] = haversine(last.lat, last.lng, record.Lat, record.Lng) >= d.minMeters
+			}
+		}
+		if keep[i] {
+			last = &downsampleDevice{time: t, lat: record.Lat, lng: record.Lng, fix: hasFix(record)}
+		}
+	}
+	d.devices[imei] = last
+	d.mutex.Unlock()
+
+	if d.tolerance > 0 {
+		d.simplify(pkt.Data, keep)
+	}
+	records := make([]teltonika.Data, 0, len(pkt.Data))
+	indexes := make([]int, 0, len(pkt.Data))
+	for i := range pkt.Data {
+		if keep[i] {
+			records = append(records, pkt.Data[i])
+			indexes = append(indexes, i)
+		}
+	}
+	downsampleMetrics.Add("passed", int64(len(records)))
+	downsampleMetrics.Add("dropped", int64(len(pkt.Data)-len(records)))
+	if len(records) == len(pkt.Data) {
+		return pkt
+	}
+	if len(records) == 0 && len(pkt.Messages) == 0 {
+		return nil
+	}
+	return pkt.Derive(records, indexes)
+}
+
+func downsampleImportant(record *teltonika.Data) bool {
+	return record.EventID != 0 || record.Priority > 0
+}
+
+// simplify unmarks the kept records with a fix that Douglas-Peucker removes from the track,
+// important records split the track and are kept
+func (d *Downsampler) simplify(records []teltonika.Data, keep []bool) {
+	track := make([]int, 0, len(records))
+	flush := func() {
+		if len(track) > 2 {
+			retain := make([]bool, len(track))
+			retain[0], retain[len(track)-1] = true, true
+			d.douglasPeucker(records, track, 0, len(track)-1, retain)
+			for n, i := range track {
+				keep[i] = retain[n]
+			}
+		}
+		track = track[:0]
+	}
+	for i := range records {
+		if !keep[i] || !hasFix(&records[i]) {
+			continue
+		}
+		track = append(track, i)
+		if downsampleImportant(&records[i]) {
+			flush()
+			track = append(track, i)
+		}
+	}
+	flush()
+}
+
+func (d *Downsampler) douglasPeucker(records []teltonika.Data, track []int, first int, last int, retain []bool) {
+	if last-first < 2 {
+		return
+	}
+	origin := &records[track[first]]
+	ax, ay := 0.0, 0.0
+	bx, by := project(origin.Lat, origin.Lng, records[track[last]].Lat, records[track[last]].Lng)
+	farthest, distance := -1, 0.0
+	for n := first + 1; n < last; n++ {
+		px, py := project(origin.Lat, origin.Lng, records[track[n]].Lat, records[track[n]].Lng)
+		if dist := segmentDistance(px, py, ax, ay, bx, by); dist > distance {
+			farthest, distance = n, dist
+		}
+	}
+	if farthest < 0 || distance <= d.tolerance {
+		return
+	}
+	retain[farthest] = true
+	d.douglasPeucker(records, track, first, farthest, retain)
+	d.douglasPeucker(records, track, farthest, last, retain)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DriversConfig: the driver id is read from the IO elements in Ids (default iButton 78 and rfid 207),
+// Names maps driver ids (hex, as in the events) to names. A session ends when another driver identifies,
+// when the id reads 0 (key removed) or, with EndOnIgnitionOff, when the ignition turns off.
+// History is the number of finished sessions kept per device for the api (default 100)
+type DriversConfig struct {
+	Ids              []uint16          `json:"ids"`
+	Names            map[string]string `json:"names"`
+	EndOnIgnitionOff bool              `json:"endOnIgnitionOff"`
+	History          int               `json:"history"`
+}
+
+// DriverSession is a driver on a vehicle from Start to End
+type DriverSession struct {
+	Active          bool      `json:"active"`
+	Driver          string    `json:"driver"`
+	Name            string    `json:"name,omitempty"`
+	Imei            string    `json:"imei"`
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	DurationSeconds int64     `json:"durationSeconds"`
+	DistanceMeters  float64   `json:"distanceMeters"`
+}
+
+// DriverSessions combines the iButton/RFID readings into driver sessions, emitting
+// driver.session_start and driver.session_end events
+type DriverSessions struct {
+	ids     []uint16
+	names   map[string]string
+	endOff  bool
+	history int
+	devices sync.Map
+}
+
+type driverDevice struct {
+	mutex    sync.Mutex
+	current  *DriverSession
+	sessions []DriverSession
+	lastFix  *teltonika.Data
+}
+
+func NewDriverSessions(config *DriversConfig) *DriverSessions {
+	d := &DriverSessions{ids: []uint16{ioNames["iButton"], ioNames["rfid"]}, history: 100}
+	if config == nil {
+		return d
+	}
+	if len(config.Ids) > 0 {
+		d.ids = config.Ids
+	}
+	if config.History > 0 {
+		d.history = config.History
+	}
+	d.names = config.Names
+	d.endOff = config.EndOnIgnitionOff
+	return d
+}
+
+func (d *DriverSessions) device(imei string) *driverDevice {
+	value, _ := d.devices.LoadOrStore(imei, &driverDevice{})
+	return value.(*driverDevice)
+}
+
+// driverId reads the driver id of the record, present is false if the record has no driver IO
+func (d *DriverSessions) driverId(record *teltonika.Data) (id string, present bool) {
+	for _, ioId := range d.ids {
+		value, ok := ioUint(record, ioId)
+		if !ok {
+			continue
+		}
+		if value == 0 {
+			return "", true
+		}
+		return strconv.FormatUint(value, 16), true
+	}
+	return "", false
+}
+
+func (d *DriverSessions) Process(imei string, pkt *teltonika.Packet) []*Event {
+	device := d.device(imei)
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	var events []*Event
+	for i := range pkt.Data {
+		record := pkt.Data[i]
+		record.Elements = nil
+		recordTime := time.UnixMilli(int64(record.TimestampMs)).UTC()
+
+		if session := device.current; session != nil {
+			if hasFix(&record) {
+				if device.lastFix != nil {
+					session.DistanceMeters += haversine(device.lastFix.Lat, device.lastFix.Lng, record.Lat, record.Lng)
+				}
+				device.lastFix = &record
+			}
+			session.End = recordTime
+			session.DurationSeconds = int64(session.End.Sub(session.Start).Seconds())
+		}
+
+		driver, present := d.driverId(&pkt.Data[i])
+		end := present && device.current != nil && device.current.Driver != driver
+		if ignition, ok := ioUint(&pkt.Data[i], ioNames["ignition"]); ok && ignition == 0 && d.endOff {
+			end = device.current != nil
+		}
+		if end {
+			events = append(events, d.endSession(imei, device, &record))
+		}
+		if present && driver != "" && device.current == nil {
+			device.current = &DriverSession{Active: true, Driver: driver, Name: d.names[driver], Imei: imei,
+				Start: recordTime, End: recordTime}
+			device.lastFix = nil
+			if hasFix(&record) {
+				device.lastFix = &record
+			}
+			events = append(events, NewEvent("driver.session_start", imei, &record, map[string]any{
+				"driver": driver,
+				"name":   device.current.Name,
+			}))
+		}
+	}
+	return events
+}
+
+func (d *DriverSessions) endSession(imei string, device *driverDevice, record *teltonika.Data) *Event {
+	session := device.current
+	session.Active = false
+	device.sessions = append(device.sessions, *session)
+	if len(device.sessions) > d.history {
+		device.sessions = device.sessions[len(device.sessions)-d.history:]
+	}
+	device.current = nil
+	return NewEvent("driver.session_end", imei, record, map[string]any{
+		"driver":          session.Driver,
+		"name":            session.Name,
+		"start":           session.Start.Format(time.RFC3339),
+		"durationSeconds": session.DurationSeconds,
+		"distanceMeters":  session.DistanceMeters,
+	})
+}
+
+// Sessions returns the finished sessions of the device and the current one (last, active)
+func (d *DriverSessions) Sessions(imei string) []DriverSession {
+	device := d.device(imei)
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+	sessions := append(make([]DriverSession, 0, len(device.sessions)+1), device.sessions...)
+	if device.current != nil {
+		sessions = append(sessions, *device.current)
+	}
+	return sessions
+}
+
+// Active returns the active sessions of all devices (who drives what), ordered by driver
+func (d *DriverSessions) Active() []DriverSession {
+	sessions := make([]DriverSession, 0)
+	d.devices.Range(func(_, value any) bool {
+		device := value.(*driverDevice)
+		device.mutex.Lock()
+		if device.current != nil {
+			sessions = append(sessions, *device.current)
+		}
+		device.mutex.Unlock()
+		return true
+	})
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Driver < sessions[j].Driver
+	})
+	return sessions
+}
+
+// ServeHTTP handles GET /devices/{imei}/drivers
+func (d *DriverSessions) ServeHTTP(w http.ResponseWriter, r *http.Request, imei string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJson(w, http.StatusOK, d.Sessions(imei))
+}
+
+// ServeActive handles GET /drivers, the active sessions of all devices
+func (d *DriverSessions) ServeActive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJson(w, http.StatusOK, d.Active())
+}
+
+// Purge forgets the device (a Purger)
+func (d *DriverSessions) Purge(imei string) (int, error) {
+	return purgeSyncMap(&d.devices, imei), nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// PacketEncoder turns packets into sink payloads, Join combines several payloads into one batch payload
+// (BatchContentType, if set, describes the joined payload), EncodeEvent is nil if the encoding has no event form
+type PacketEncoder struct {
+	ContentType      string
+	BatchContentType string
+	Encode           func(imei string, pkt *AnnotatedPacket) ([]byte, error)
+	EncodeEvent      func(event *Event) ([]byte, error)
+	Join             func(payloads [][]byte) []byte
+}
+
+var jsonEncoder = &PacketEncoder{
+	ContentType: "application/json",
+	Encode: func(imei string, pkt *AnnotatedPacket) ([]byte, error) {
+		return buildJsonPacket(imei, pkt), nil
+	},
+	EncodeEvent: encodeJsonEvent,
+	Join:        joinJson,
+}
+
+// the messageType parameter tells a single Packet from a PacketBatch (hooks with batching)
+var protobufEncoder = &PacketEncoder{
+	ContentType:      "application/x-protobuf; messageType=teltonika.Packet",
+	BatchContentType: "application/x-protobuf; messageType=teltonika.PacketBatch",
+	Encode: func(imei string, pkt *AnnotatedPacket) ([]byte, error) {
+		return MarshalPacketProto(imei, pkt), nil
+	},
+	Join: JoinPacketsProto,
+}
+
+var msgpackEncoder = &PacketEncoder{
+	ContentType: "application/msgpack",
+	Encode: func(imei string, pkt *AnnotatedPacket) ([]byte, error) {
+		return MarshalMsgpack(packetValue(imei, pkt))
+	},
+	EncodeEvent: func(event *Event) ([]byte, error) {
+		return MarshalMsgpack(event.Value())
+	},
+	Join: joinMsgpack,
+}
+
+var cborEncoder = &PacketEncoder{
+	ContentType: "application/cbor",
+	Encode: func(imei string, pkt *AnnotatedPacket) ([]byte, error) {
+		return MarshalCBOR(packetValue(imei, pkt))
+	},
+	EncodeEvent: func(event *Event) ([]byte, error) {
+		return MarshalCBOR(event.Value())
+	},
+	Join: joinCBOR,
+}
+
+var packetEncoders = map[string]*PacketEncoder{
+	"json":     jsonEncoder,
+	"protobuf": protobufEncoder,
+	"msgpack":  msgpackEncoder,
+	"cbor":     cborEncoder,
+}
+
+// ValueEncoder serializes generic values (maps, slices, scalars), used by sinks with their own payload shape
+type ValueEncoder struct {
+	ContentType string
+	Marshal     func(v any) ([]byte, error)
+}
+
+var valueEncoders = map[string]*ValueEncoder{
+	"json":    {ContentType: "application/json", Marshal: json.Marshal},
+	"msgpack": {ContentType: "application/msgpack", Marshal: MarshalMsgpack},
+	"cbor":    {ContentType: "application/cbor", Marshal: MarshalCBOR},
+}
+
+func packetEncoder(name string) (*PacketEncoder, error) {
+	if name == "" {
+		return jsonEncoder, nil
+	}
+	encoder, ok := packetEncoders[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown encoding '%s'", name)
+	}
+	return encoder, nil
+}
+
+func valueEncoder(name string) (*ValueEncoder, error) {
+	if name == "" {
+		name = "json"
+	}
+	encoder, ok := valueEncoders[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown encoding '%s'", name)
+	}
+	return encoder, nil
+}
+
+// packetValue is the full packet as a generic value, same fields as teltonika.proto
+func packetValue(imei string, pkt *AnnotatedPacket) map[string]any {
+	data := make([]any, 0, len(pkt.Data))
+	for i, record := range pkt.Data {
+		elements := make([]any, 0, len(record.Elements))
+		for _, el := range record.Elements {
+			elements = append(elements, map[string]any{"id": el.Id, "value": el.Value})
+		}
+		value := map[string]any{
+			"timestampMs":    record.TimestampMs,
+			"lng":            record.Lng,
+			"lat":            record.Lat,
+			"altitude":       record.Altitude,
+			"angle":          record.Angle,
+			"eventId":        record.EventID,
+			"speed":          record.Speed,
+			"satellites":     record.Satellites,
+			"priority":       record.Priority,
+			"generationType": uint8(record.GenerationType),
+			"elements":       elements,
+		}
+		if attributes := pkt.RecordAttributes(i); attributes != nil {
+			value["attributes"] = attributes
+		}
+		data = append(data, value)
+	}
+	messages := make([]any, 0, len(pkt.Messages))
+	for _, msg := range pkt.Messages {
+		messages = append(messages, map[string]any{
+			"timestamp": msg.Timestamp,
+			"type":      uint8(msg.Type),
+			"imei":      msg.Imei,
+			"text":      msg.Text,
+		})
+	}
+	value := map[string]any{
+		"imei":     imei,
+		"codecId":  uint8(pkt.CodecID),
+		"data":     data,
+		"messages": messages,
+		"backfill": pkt.Backfill,
+	}
+	if pkt.Key != "" {
+		value["key"] = pkt.Key
+	}
+	return value
+}
+
+func encodeJsonEvent(event *Event) ([]byte, error) {
+	return json.Marshal(event)
+}
+
+func joinJson(payloads [][]byte) []byte {
+	buf := append([]byte{'['}, bytes.Join(payloads, []byte{','})...)
+	return append(buf, ']')
+}
@@ -0,0 +1,82 @@
+package main
+
+// Enricher is the enrichment plugin interface: it computes attributes of the records of a packet
+// (address, road, ...), the result has an entry per record (nil for none), the attributes are merged into
+// the record payloads of the sinks. With an error the returned attributes (if any) are still used.
+// It's called from the connection goroutines, so it must be safe for concurrent use and must not retain pkt
+type Enricher interface {
+	Enrich(imei string, pkt *teltonika.Packet) ([]map[string]any, error)
+}
+
+// RecordEnricher adapts a function enriching single records
+type RecordEnricher func(imei string, record *teltonika.Data) (map[string]any, error)
+
+func (f RecordEnricher) Enrich(imei string, pkt *teltonika.Packet) ([]map[string]any, error) {
+	attributes := make([]map[string]any, len(pkt.Data))
+	var firstErr error
+	for i := range pkt.Data {
+		values, err := f(imei, &pkt.Data[i])
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		attributes[i] = values
+	}
+	return attributes, firstErr
+}
+
+// EnrichStage runs the enrichers on every record and attaches the attributes to the packet,
+// an enricher error leaves the record without its attributes
+type EnrichStage struct {
+	Enrichers []Enricher
+	logger    *Logger
+}
+
+func NewEnrichStage(logger *Logger, enrichers ...Enricher) *EnrichStage {
+	return &EnrichStage{Enrichers: enrichers, logger: logger}
+}
+
+func (e *EnrichStage) Apply(imei string, pkt *AnnotatedPacket) *AnnotatedPacket {
+	if len(pkt.Data) == 0 || len(e.Enrichers) == 0 {
+		return pkt
+	}
+	attributes := make([]map[string]any, len(pkt.Data))
+	found := false
+	for _, enricher := range e.Enrichers {
+		results, err := enricher.Enrich(imei, pkt.Packet)
+		if err != nil {
+			e.logger.Error.Printf("[%s]: enrichment error (%v)", imei, err)
+		}
+		for i, values := range results {
+			if i >= len(attributes) || len(values) == 0 {
+				continue
+			}
+			if attributes[i] == nil {
+				attributes[i] = make(map[string]any, len(values))
+			}
+			for k, v := range values {
+				attributes[i][k] = v
+			}
+			found = true
+		}
+	}
+	if !found {
+		return pkt
+	}
+	// pkt may already carry attributes of an earlier enrich stage
+	for i := range attributes {
+		previous := pkt.RecordAttributes(i)
+		if attributes[i] == nil {
+			attributes[i] = previous
+			continue
+		}
+		for k, v := range previous {
+			if _, ok := attributes[i][k]; !ok {
+				attributes[i][k] = v
+			}
+		}
+	}
+	// the other annotations (backfill flag, changes, key) stay as they are
+	enriched := *pkt
+	enriched.Attributes = attributes
+	return &enriched
+}
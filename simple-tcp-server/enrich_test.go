@@ -0,0 +1,63 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+type testEnricher []map[string]any
+
+func (e testEnricher) Enrich(imei string, pkt *teltonika.Packet) ([]map[string]any, error) {
+	return e, nil
+}
+
+func TestEnrichStageKeepsAnnotations(t *testing.T) {
+	tests := []struct {
+		name      string
+		enricher  testEnricher
+		previous  []map[string]any
+		want      []map[string]any
+		unchanged bool
+	}{
+		{
+			name:     "attributes",
+			enricher: testEnricher{{"address": "Main St 1"}, nil},
+			want:     []map[string]any{{"address": "Main St 1"}, nil},
+		},
+		{
+			name:     "merged with an earlier stage",
+			enricher: testEnricher{{"address": "Main St 1", "tenant": "new"}},
+			previous: []map[string]any{{"tenant": "acme"}, {"tenant": "acme"}},
+			want:     []map[string]any{{"address": "Main St 1", "tenant": "new"}, {"tenant": "acme"}},
+		},
+		{
+			name:      "nothing found",
+			enricher:  testEnricher{},
+			unchanged: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkt := &AnnotatedPacket{
+				Packet:     &teltonika.Packet{Data: []teltonika.Data{{TimestampMs: 1}, {TimestampMs: 2}}},
+				Attributes: tt.previous,
+				Backfill:   true,
+				Changes:    []map[string]any{{"speed": 10}, nil},
+				Key:        "frame-1",
+			}
+			out := NewEnrichStage(testLogger(), tt.enricher).Apply("352093081452251", pkt)
+			if tt.unchanged {
+				if out != pkt {
+					t.Error("packet replaced")
+				}
+				return
+			}
+			if !reflect.DeepEqual(out.Attributes, tt.want) {
+				t.Errorf("attributes %v, want %v", out.Attributes, tt.want)
+			}
+			if out.Packet != pkt.Packet || !out.Backfill || out.Key != pkt.Key || !reflect.DeepEqual(out.Changes, pkt.Changes) {
+				t.Errorf("annotations lost: %+v", out)
+			}
+		})
+	}
+}
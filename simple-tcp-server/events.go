@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+)
+
+var eventsMetrics = expvar.NewMap("events")
+
+// Event is derived from the records of a device (geofence enter/exit, ...),
+// Type is dot separated, e.g. "geofence.enter", Data holds the event specific fields
+type Event struct {
+	Type string         `json:"type"`
+	Imei string         `json:"imei"`
+	Time time.Time      `json:"time"`
+	Lat  float64        `json:"lat"`
+	Lng  float64        `json:"lng"`
+	Data map[string]any `json:"data,omitempty"`
+	// Vehicle is the vehicle of the device in the directory (see DirectoryService.Vehicle)
+	Vehicle map[string]any `json:"vehicle,omitempty"`
+}
+
+func NewEvent(eventType string, imei string, record *teltonika.Data, data map[string]any) *Event {
+	return &Event{
+		Type: eventType,
+		Imei: imei,
+		Time: time.UnixMilli(int64(record.TimestampMs)).UTC(),
+		Lat:  record.Lat,
+		Lng:  record.Lng,
+		Data: data,
+	}
+}
+
+// NewDeviceMessageEvent is the "device.message" event of a message the device sent on its own (not a command
+// response), the time is the message timestamp (codec 13) or the receive time
+func NewDeviceMessageEvent(imei string, codec teltonika.CodecId, message *teltonika.Message) *Event {
+	eventTime := time.Now().UTC()
+	if message.Timestamp != 0 {
+		eventTime = time.Unix(int64(message.Timestamp), 0).UTC()
+	}
+	return &Event{
+		Type: "device.message",
+		Imei: imei,
+		Time: eventTime,
+		Data: map[string]any{"codec": codecName(codec), "type": uint8(message.Type), "text": message.Text},
+	}
+}
+
+// Value is the event as a generic value for the binary encodings
+func (e *Event) Value() map[string]any {
+	value := map[string]any{
+		"type":        e.Type,
+		"imei":        e.Imei,
+		"timestampMs": e.Time.UnixMilli(),
+		"lat":         e.Lat,
+		"lng":         e.Lng,
+	}
+	if e.Data != nil {
+		value["data"] = e.Data
+	}
+	if e.Vehicle != nil {
+		value["vehicle"] = e.Vehicle
+	}
+	return value
+}
+
+// EventSink is implemented by sinks that deliver events
+type EventSink interface {
+	SendEvent(event *Event) error
+}
+
+// Processor derives events from decoded packets, it's called from the connection goroutines
+// so it must be safe for concurrent use and must not retain pkt (same as Sink)
+type Processor interface {
+	Process(imei string, pkt *teltonika.Packet) []*Event
+}
+
+// Stage transforms packets before the processors and sinks (dedup, ...), a nil result drops the packet,
+// the result may share records with pkt but must not be retained either. A stage dropping or reordering
+// records keeps the annotations of the records (see AnnotatedPacket.Derive)
+type Stage interface {
+	Apply(imei string, pkt *AnnotatedPacket) *AnnotatedPacket
+}
+
+// Pipeline runs the stages and the processors on every packet, then hands the packet
+// and the derived events to the sinks, in the goroutine of the caller unless started (see PipelineConfig)
+type Pipeline struct {
+	Stages     []Stage
+	Processors []Processor
+	Sinks      []Sink
+	logger     *Logger
+	enrich     *pipelineStage
+	fanout     *pipelineStage
+	queued     sync.Map
+	pooled     bool
+	// OnError gets the panics recovered in the sinks (optional)
+	OnError func(imei string, err error)
+	// Vehicle returns the vehicle attached to the events of the device (optional)
+	Vehicle func(imei string) map[string]any
+}
+
+func NewPipeline(sinks []Sink, logger *Logger) *Pipeline {
+	return &Pipeline{Sinks: sinks, logger: logger}
+}
+
+// Handle runs the packet through the pipeline, the error is the first sink error (always nil once started, the
+// packet is only queued then)
+func (p *Pipeline) Handle(imei string, pkt *teltonika.Packet) error {
+	if p.enrich != nil {
+		p.enrich.push(imei, p.queuedCopy(pkt))
+		return nil
+	}
+	return p.run(0, imei, &AnnotatedPacket{Packet: pkt})
+}
+
+// After returns a function continuing the pipeline after the stage, used by stages that hold packets back
+func (p *Pipeline) After(stage Stage) func(imei string, pkt *AnnotatedPacket) {
+	return func(imei string, pkt *AnnotatedPacket) {
+		for i, s := range p.Stages {
+			if s == stage {
+				_ = p.run(i+1, imei, pkt)
+				return
+			}
+		}
+		_ = p.Process(imei, pkt)
+	}
+}
+
+func (p *Pipeline) run(from int, imei string, pkt *AnnotatedPacket) error {
+	for _, stage := range p.Stages[from:] {
+		if pkt = stage.Apply(imei, pkt); pkt == nil {
+			return nil
+		}
+	}
+	return p.Process(imei, pkt)
+}
+
+// Process runs the processors and the sinks, the error is the first sink error
+func (p *Pipeline) Process(imei string, pkt *AnnotatedPacket) error {
+	if p.fanout != nil {
+		p.fanout.push(imei, pkt)
+		return nil
+	}
+	return p.process(imei, pkt)
+}
+
+func (p *Pipeline) process(imei string, pkt *AnnotatedPacket) error {
+	var events []*Event
+	for _, processor := range p.Processors {
+		events = append(events, processor.Process(imei, pkt.Packet)...)
+	}
+	err := publish(p.Sinks, imei, pkt, p.logger)
+	p.reportPanic(imei, err)
+	p.Publish(events...)
+	return err
+}
+
+func (p *Pipeline) reportPanic(imei string, err error) {
+	var panicErr *PanicError
+	if errors.As(err, &panicErr) && p.OnError != nil {
+		p.OnError(imei, err)
+	}
+}
+
+// Publish sends events to the sinks that support them, it can be used by event sources outside of the packet flow
+func (p *Pipeline) Publish(events ...*Event) {
+	for _, event := range events {
+		eventsMetrics.Add(event.Type, 1)
+		if p.Vehicle != nil && event.Vehicle == nil && event.Imei != "" {
+			event.Vehicle = p.Vehicle(event.Imei)
+		}
+		if data, err := json.Marshal(event); err == nil {
+			p.logger.Info.Printf("[%s]: event: %s", event.Imei, data)
+		}
+		for _, sink := range p.Sinks {
+			eventSink, ok := sink.(EventSink)
+			if !ok {
+				continue
+			}
+			err := safeCall("eventSink", func() error {
+				return eventSink.SendEvent(event)
+			})
+			var panicErr *PanicError
+			if errors.As(err, &panicErr) {
+				p.logger.Error.Printf("[%s]: %T %v\n%s", event.Imei, sink, err, panicErr.Stack)
+				p.reportPanic(event.Imei, err)
+			} else if err != nil {
+				p.logger.Error.Printf("[%s]: event sink error (%v)", event.Imei, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Condition is a compiled boolean expression over a record, e.g.
+// io.externalVoltage < 11500 || io.bleTemperature1 > 800 && speed > 0
+//
+// Operands are numbers, true/false, record fields (timestamp, lat, lng, altitude, angle, speed,
+// satellites, priority, event_id) and IO elements (io.<name> or io.io_<id>). Operators, by precedence:
+// ! and unary -, * / %, + -, comparisons (< <= > >= == !=), &&, ||.
+// The signed IO elements (temperatures, accelerometer axes) are sign extended, == and != with true or false compare
+// the truth of the other side. A comparison with an IO element missing in the record is false
+type Condition struct {
+	source string
+	root   exprNode
+}
+
+type exprValue struct {
+	num     float64
+	boolean bool
+	isBool  bool
+	missing bool
+}
+
+type exprNode func(record *exprRecord) exprValue
+
+// exprRecord is the record a condition is evaluated on, the IO elements are looked up in the index if there's one
+type exprRecord struct {
+	*teltonika.Data
+	index *IOIndex
+}
+
+// io returns the value of the element, sign extended for the signed elements (see ioSigned)
+func (r *exprRecord) io(id uint16) (float64, bool) {
+	var value []byte
+	var ok bool
+	if r.index != nil {
+		value, ok = r.index.Get(id)
+	} else {
+		value, ok = findElement(r.Data, id)
+	}
+	if !ok {
+		return 0, false
+	}
+	return ioNumber(id, value)
+}
+
+func CompileCondition(source string) (*Condition, error) {
+	tokens, err := exprTokenize(source)
+	if err != nil {
+		return nil, fmt.Errorf("condition '%s': %v", source, err)
+	}
+	p := &exprParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected '%s'", p.tokens[p.pos])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("condition '%s': %v", source, err)
+	}
+	return &Condition{source: source, root: root}, nil
+}
+
+func (c *Condition) Eval(record *teltonika.Data) bool {
+	return exprTruthy(c.root(&exprRecord{Data: record}))
+}
+
+// EvalIndexed evaluates the condition with the IO elements looked up in the index of the record, for the records
+// several conditions are evaluated on
+func (c *Condition) EvalIndexed(record *teltonika.Data, index *IOIndex) bool {
+	return exprTruthy(c.root(&exprRecord{Data: record, index: index}))
+}
+
+// Value evaluates the expression as a number (a comparison is 1 or 0), false if an IO element it uses is missing
+func (c *Condition) Value(record *teltonika.Data) (float64, bool) {
+	value := c.root(&exprRecord{Data: record})
+	return value.num, !value.missing
+}
+
+func (c *Condition) String() string {
+	return c.source
+}
+
+func exprTokenize(source string) ([]string, error) {
+	tokens := make([]string, 0)
+	for i := 0; i < len(source); {
+		c := rune(source[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsDigit(c) || c == '.':
+			j := i
+			for j < len(source) && (unicode.IsDigit(rune(source[j])) || source[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, source[i:j])
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(source) && (unicode.IsLetter(rune(source[j])) || unicode.IsDigit(rune(source[j])) ||
+				source[j] == '_' || source[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, source[i:j])
+			i = j
+		default:
+			if i+1 < len(source) {
+				switch two := source[i : i+2]; two {
+				case "&&", "||", "<=", ">=", "==", "!=":
+					tokens = append(tokens, two)
+					i += 2
+					continue
+				}
+			}
+			if !strings.ContainsRune("()<>!+-*/%", c) {
+				return nil, fmt.Errorf("unexpected character '%c'", c)
+			}
+			tokens = append(tokens, string(c))
+			i++
+		}
+	}
+	return tokens, nil
+}
+
+type exprParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.peek() == "||" {
+		p.next()
+		var right exprNode
+		if right, err = p.parseAnd(); err != nil {
+			break
+		}
+		l := left
+		left = func(record *exprRecord) exprValue {
+			return exprBool(exprTruthy(l(record)) || exprTruthy(right(record)))
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseComparison()
+	for err == nil && p.peek() == "&&" {
+		p.next()
+		var right exprNode
+		if right, err = p.parseComparison(); err != nil {
+			break
+		}
+		l := left
+		left = func(record *exprRecord) exprValue {
+			return exprBool(exprTruthy(l(record)) && exprTruthy(right(record)))
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	left, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	op := p.peek()
+	switch op {
+	case "<", "<=", ">", ">=", "==", "!=":
+	default:
+		return left, nil
+	}
+	p.next()
+	right, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	return func(record *exprRecord) exprValue {
+		a, b := left(record), right(record)
+		if a.missing || b.missing {
+			return exprBool(false)
+		}
+		switch op {
+		case "<":
+			return exprBool(a.num < b.num)
+		case "<=":
+			return exprBool(a.num <= b.num)
+		case ">":
+			return exprBool(a.num > b.num)
+		case ">=":
+			return exprBool(a.num >= b.num)
+		case "==":
+			return exprBool(exprEqual(a, b))
+		default:
+			return exprBool(!exprEqual(a, b))
+		}
+	}, nil
+}
+
+func (p *exprParser) parseSum() (exprNode, error) {
+	return p.parseBinary(p.parseProduct, "+", "-")
+}
+
+func (p *exprParser) parseProduct() (exprNode, error) {
+	return p.parseBinary(p.parseUnary, "*", "/", "%")
+}
+
+func (p *exprParser) parseBinary(operand func() (exprNode, error), ops ...string) (exprNode, error) {
+	left, err := operand()
+	for err == nil && containsString(ops, p.peek()) {
+		op := p.next()
+		var right exprNode
+		if right, err = operand(); err != nil {
+			break
+		}
+		l := left
+		left = func(record *exprRecord) exprValue {
+			a, b := l(record), right(record)
+			if a.missing || b.missing {
+				return exprValue{missing: true}
+			}
+			switch op {
+			case "+":
+				return exprValue{num: a.num + b.num}
+			case "-":
+				return exprValue{num: a.num - b.num}
+			case "*":
+				return exprValue{num: a.num * b.num}
+			case "/":
+				if b.num == 0 {
+					return exprValue{missing: true}
+				}
+				return exprValue{num: a.num / b.num}
+			default:
+				if int64(b.num) == 0 {
+					return exprValue{missing: true}
+				}
+				return exprValue{num: float64(int64(a.num) % int64(b.num))}
+			}
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	switch p.peek() {
+	case "!":
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(record *exprRecord) exprValue {
+			return exprBool(!exprTruthy(operand(record)))
+		}, nil
+	case "-":
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(record *exprRecord) exprValue {
+			v := operand(record)
+			v.num = -v.num
+			return v
+		}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	token := p.next()
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case token == "(":
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing ')'")
+		}
+		return inner, nil
+	case token == "true" || token == "false":
+		value := exprBool(token == "true")
+		return func(*exprRecord) exprValue { return value }, nil
+	case unicode.IsDigit(rune(token[0])) || token[0] == '.':
+		num, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number '%s'", token)
+		}
+		return func(*exprRecord) exprValue { return exprValue{num: num} }, nil
+	case unicode.IsLetter(rune(token[0])) || token[0] == '_':
+		if strings.HasPrefix(token, "io.") {
+			name := strings.TrimPrefix(token, "io.")
+			id, ok := ioIdByName(name)
+			if !ok {
+				return nil, fmt.Errorf("unknown io element '%s'", name)
+			}
+			return func(record *exprRecord) exprValue {
+				value, ok := record.io(id)
+				return exprValue{num: value, missing: !ok}
+			}, nil
+		}
+		if _, ok := recordValue(&teltonika.Data{}, token); !ok {
+			return nil, fmt.Errorf("unknown field '%s'", token)
+		}
+		return func(record *exprRecord) exprValue {
+			value, ok := recordValue(record.Data, token)
+			return exprValue{num: value, missing: !ok}
+		}, nil
+	}
+	return nil, fmt.Errorf("unexpected '%s'", token)
+}
+
+func exprBool(b bool) exprValue {
+	value := exprValue{boolean: b, isBool: true}
+	if b {
+		value.num = 1
+	}
+	return value
+}
+
+// exprEqual compares the numbers, or the truth values when a side is a boolean (io.ignition == true)
+func exprEqual(a exprValue, b exprValue) bool {
+	if a.isBool || b.isBool {
+		return exprTruthy(a) == exprTruthy(b)
+	}
+	return a.num == b.num
+}
+
+func exprTruthy(v exprValue) bool {
+	if v.isBool {
+		return v.boolean
+	}
+	return !v.missing && v.num != 0
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// exprTestRecord has an unsigned element (externalVoltage 11000 mV), a flag (ignition on) and signed elements
+// (bleTemperature1 -5.50 °C, axisX -1000 mG)
+var exprTestRecord = teltonika.Data{Speed: 50, Satellites: 7, Elements: []teltonika.IOElement{
+	{Id: 66, Value: []byte{0x2a, 0xf8}},
+	{Id: 239, Value: []byte{1}},
+	{Id: 25, Value: []byte{0xfd, 0xda}},
+	{Id: 17, Value: []byte{0xfc, 0x18}},
+}}
+
+func TestConditionEval(t *testing.T) {
+	tests := []struct {
+		source string
+		want   bool
+	}{
+		{"speed > 40", true},
+		{"speed > 40 && satellites < 5", false},
+		{"1 + 2 * 3 == 7", true},
+		{"(1 + 2) * 3 == 9", true},
+		{"10 - 4 - 3 == 3", true},
+		{"-2 * -3 == 6", true},
+		{"7 % 4 == 3", true},
+		{"false || true && false", false},
+		{"!(speed > 40) || io.ignition == 1", true},
+		{"!speed", false},
+		{"io.ignition == true", true},
+		{"io.ignition != false", true},
+		{"io.ignition == false", false},
+		{"true == 1", true},
+		{"true == 0", false},
+		{"io.externalVoltage < 11500 || io.bleTemperature1 > 800", true},
+		{"io.externalVoltage", true},
+		{"io.bleTemperature1 < 0", true},
+		{"io.bleTemperature1 == -550", true},
+		{"io.axisX <= -1000", true},
+		{"io.io_66 == 11000", true},
+		{"io.io_9999 > 0", false},
+		{"!(io.io_9999 > 0)", true},
+		{"io.io_9999 + 1 > 0", false},
+		{"io.io_9999 == false", false},
+		{"speed / 0 > 0", false},
+		{"speed % 0 == 0", false},
+	}
+	index := NewIOIndex(&exprTestRecord)
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			condition, err := CompileCondition(tt.source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := condition.Eval(&exprTestRecord); got != tt.want {
+				t.Errorf("Eval() = %v, want %v", got, tt.want)
+			}
+			if got := condition.EvalIndexed(&exprTestRecord, index); got != tt.want {
+				t.Errorf("EvalIndexed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConditionValue(t *testing.T) {
+	tests := []struct {
+		source string
+		want   float64
+		ok     bool
+	}{
+		{"io.externalVoltage / 1000", 11, true},
+		{"io.bleTemperature1 / 100", -5.5, true},
+		{"speed > 1", 1, true},
+		{"io.io_9999 * 2", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			condition, err := CompileCondition(tt.source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, ok := condition.Value(&exprTestRecord); got != tt.want || ok != tt.ok {
+				t.Errorf("Value() = %v, %v, want %v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestCompileConditionErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		err    string
+	}{
+		{"", "unexpected end of expression"},
+		{"speed >", "unexpected end of expression"},
+		{"(speed > 1", "missing ')'"},
+		{"speed > 1)", "unexpected ')'"},
+		{"speed > 1 2", "unexpected '2'"},
+		{"io.nope > 1", "unknown io element 'nope'"},
+		{"nope > 1", "unknown field 'nope'"},
+		{"1.2.3 > 1", "invalid number '1.2.3'"},
+		{"speed # 1", "unexpected character '#'"},
+		{"speed > > 1", "unexpected '>'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			_, err := CompileCondition(tt.source)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error %v, want %s", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestIOElementInt(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+		ok    bool
+	}{
+		{"", 0, true},
+		{"7f", 127, true},
+		{"80", -128, true},
+		{"fdda", -550, true},
+		{"0bb8", 3000, true},
+		{"ffffffff", -1, true},
+		{"ffffffffffffffff", -1, true},
+		{"010203040506070809", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			if got, ok := ioElementInt(unhex(t, tt.value)); got != tt.want || ok != tt.ok {
+				t.Errorf("ioElementInt() = %d, %v, want %d, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var failoverMetrics = expvar.NewMap("failover")
+
+// FailoverConfig: two gateways in different regions share a redis (Redis, the state redis by default), the active
+// one holds a lease (LeaseSeconds, default 15) renewed every SyncSeconds (default 5) and publishes the tracked
+// commands, the shadows, the dedup fingerprints and the memory device states there. The "standby" Role follows
+// them; it takes over when the lease of the primary expires or when a device fails over to it (DNS or anycast), the
+// parts are restored once more then so the command queues are intact. An active gateway finding the lease held by
+// another one steps down to standby. Region names the gateway in the lease (the hostname by default)
+type FailoverConfig struct {
+	Role         string       `json:"role"`
+	Region       string       `json:"region"`
+	Redis        *RedisConfig `json:"redis"`
+	SyncSeconds  int          `json:"syncSeconds"`
+	LeaseSeconds int          `json:"leaseSeconds"`
+}
+
+// FailoverStatus is the failover state of the gateway, served by the api
+type FailoverStatus struct {
+	Region   string     `json:"region"`
+	Role     string     `json:"role"`
+	Active   bool       `json:"active"`
+	Leader   string     `json:"leader,omitempty"`
+	Synced   *time.Time `json:"synced,omitempty"`
+	Promoted *time.Time `json:"promoted,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// FailoverCoordinator publishes (active) or follows (standby) the registered parts of the state, Publish
+// delivers the failover.promoted and failover.demoted events
+type FailoverCoordinator struct {
+	client   *RedisClient
+	prefix   string
+	region   string
+	role     string
+	interval time.Duration
+	lease    time.Duration
+	logger   *Logger
+	mutex    sync.Mutex
+	parts    map[string]Snapshotter
+	active   bool
+	leader   string
+	synced   *time.Time
+	promoted *time.Time
+	err      error
+	Publish  func(events ...*Event)
+}
+
+func NewFailoverCoordinator(config *FailoverConfig, logger *Logger) (*FailoverCoordinator, error) {
+	if config.Redis == nil {
+		return nil, fmt.Errorf("failover requires redis")
+	}
+	f := &FailoverCoordinator{client: NewRedisClient(config.Redis), prefix: config.Redis.KeyPrefix,
+		region: config.Region, role: config.Role, interval: time.Second * 5, lease: time.Second * 15, logger: logger,
+		parts: make(map[string]Snapshotter)}
+	if f.prefix == "" {
+		f.prefix = "teltonika:failover:"
+	}
+	switch f.role {
+	case "", "primary":
+		f.role, f.active = "primary", true
+	case "standby":
+	default:
+		return nil, fmt.Errorf("unknown failover role '%s'", config.Role)
+	}
+	if f.region == "" {
+		f.region, _ = os.Hostname()
+	}
+	if config.SyncSeconds > 0 {
+		f.interval = time.Duration(config.SyncSeconds) * time.Second
+	}
+	if config.LeaseSeconds > 0 {
+		f.lease = time.Duration(config.LeaseSeconds) * time.Second
+	}
+	if f.lease <= f.interval {
+		return nil, fmt.Errorf("failover lease must be longer than the sync interval")
+	}
+	failoverMetrics.Set("active", expvar.Func(func() any {
+		return f.Active()
+	}))
+	return f, nil
+}
+
+// Register adds a part of the state, before Start
+func (f *FailoverCoordinator) Register(name string, part Snapshotter) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.parts[name] = part
+}
+
+// Start syncs the parts every interval, a standby restores them once before
+func (f *FailoverCoordinator) Start() {
+	if !f.Active() {
+		if err := f.follow(); err != nil {
+			f.logger.Error.Printf("%v", err)
+		}
+	}
+	go func() {
+		for range time.Tick(f.interval) {
+			f.sync()
+		}
+	}()
+}
+
+// Active tells if the gateway is the active one
+func (f *FailoverCoordinator) Active() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.active
+}
+
+func (f *FailoverCoordinator) sync() {
+	var err error
+	if f.Active() {
+		err = f.renew()
+	} else {
+		err = f.watch()
+	}
+	f.mutex.Lock()
+	f.err = err
+	if err == nil {
+		now := time.Now().UTC()
+		f.synced = &now
+	}
+	f.mutex.Unlock()
+	if err != nil {
+		failoverMetrics.Add("syncErrors", 1)
+		f.logger.Error.Printf("%v", err)
+		return
+	}
+	failoverMetrics.Add("syncs", 1)
+}
+
+// renew extends the lease of the active gateway and publishes the parts, it steps down if another gateway holds
+// the lease
+func (f *FailoverCoordinator) renew() error {
+	leader, err := f.acquire(false)
+	if err != nil {
+		return err
+	}
+	if leader != f.region {
+		f.demote(leader)
+		return nil
+	}
+	f.mutex.Lock()
+	f.leader = leader
+	f.mutex.Unlock()
+	return f.publish()
+}
+
+// watch follows the parts while the lease is held, it takes over when the lease expired
+func (f *FailoverCoordinator) watch() error {
+	leader, err := f.acquire(false)
+	if err != nil {
+		return err
+	}
+	if leader == f.region {
+		f.promote("lease of the active gateway expired")
+		return nil
+	}
+	f.mutex.Lock()
+	f.leader = leader
+	f.mutex.Unlock()
+	return f.follow()
+}
+
+// acquire takes the lease if nobody holds it (or anyway with force) and extends it if the gateway holds it, it
+// returns the leader
+func (f *FailoverCoordinator) acquire(force bool) (string, error) {
+	key, lease := f.prefix+"leader", strconv.FormatInt(f.lease.Milliseconds(), 10)
+	if force {
+		if _, err := f.client.Do("SET", key, f.region, "PX", lease); err != nil {
+			return "", fmt.Errorf("failover lease error (%v)", err)
+		}
+		return f.region, nil
+	}
+	_, err := f.client.Do("SET", key, f.region, "NX", "PX", lease)
+	if err == nil {
+		return f.region, nil
+	}
+	if err != errRedisNil {
+		return "", fmt.Errorf("failover lease error (%v)", err)
+	}
+	reply, err := f.client.Do("GET", key)
+	if err == errRedisNil {
+		// expired in between
+		return f.acquire(false)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failover lease error (%v)", err)
+	}
+	leader, _ := reply.(string)
+	if leader == f.region {
+		_, err = f.client.Do("PEXPIRE", key, lease)
+		if err != nil {
+			return "", fmt.Errorf("failover lease error (%v)", err)
+		}
+	}
+	return leader, nil
+}
+
+// publish writes the parts, each in its key
+func (f *FailoverCoordinator) publish() error {
+	for name, part := range f.registered() {
+		data, err := part.Snapshot()
+		if err != nil {
+			return fmt.Errorf("failover %s error (%v)", name, err)
+		}
+		if _, err = f.client.Do("SET", f.prefix+"part:"+name, string(data)); err != nil {
+			return fmt.Errorf("failover publish error (%v)", err)
+		}
+	}
+	return nil
+}
+
+// follow restores the published parts, the parts not published yet are left as they are
+func (f *FailoverCoordinator) follow() error {
+	for name, part := range f.registered() {
+		reply, err := f.client.Do("GET", f.prefix+"part:"+name)
+		if err == errRedisNil {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failover follow error (%v)", err)
+		}
+		data, _ := reply.(string)
+		if err = part.Restore([]byte(data)); err != nil {
+			return fmt.Errorf("failover %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (f *FailoverCoordinator) registered() map[string]Snapshotter {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	parts := make(map[string]Snapshotter, len(f.parts))
+	for name, part := range f.parts {
+		parts[name] = part
+	}
+	return parts
+}
+
+// Connected takes over on a standby when a device connects to it (TCPServer.OnConnect, before the other
+// callbacks): the device failed over, the parts published last are restored and the lease is taken
+func (f *FailoverCoordinator) Connected(imei string) {
+	if f.Active() {
+		return
+	}
+	if err := f.follow(); err != nil {
+		f.logger.Error.Printf("%v", err)
+	}
+	if _, err := f.acquire(true); err != nil {
+		f.logger.Error.Printf("%v", err)
+	}
+	f.promote(fmt.Sprintf("device %s failed over", imei))
+}
+
+func (f *FailoverCoordinator) promote(reason string) {
+	now := time.Now().UTC()
+	f.mutex.Lock()
+	if f.active {
+		f.mutex.Unlock()
+		return
+	}
+	previous := f.leader
+	f.active, f.leader, f.promoted = true, f.region, &now
+	f.mutex.Unlock()
+	failoverMetrics.Add("promotions", 1)
+	f.logger.Info.Printf("failover: %s active, %s", f.region, reason)
+	if f.Publish != nil {
+		f.Publish(&Event{Type: "failover.promoted", Time: now,
+			Data: map[string]any{"region": f.region, "previous": previous, "reason": reason}})
+	}
+}
+
+func (f *FailoverCoordinator) demote(leader string) {
+	now := time.Now().UTC()
+	f.mutex.Lock()
+	f.active, f.leader = false, leader
+	f.mutex.Unlock()
+	failoverMetrics.Add("demotions", 1)
+	f.logger.Error.Printf("failover: %s holds the lease, %s is standby", leader, f.region)
+	if f.Publish != nil {
+		f.Publish(&Event{Type: "failover.demoted", Time: now, Data: map[string]any{"region": f.region,
+			"leader": leader}})
+	}
+}
+
+// Status returns the failover state of the gateway
+func (f *FailoverCoordinator) Status() *FailoverStatus {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	status := &FailoverStatus{Region: f.region, Role: f.role, Active: f.active, Leader: f.leader, Synced: f.synced,
+		Promoted: f.promoted}
+	if f.err != nil {
+		status.Error = f.err.Error()
+	}
+	return status
+}
+
+// ServeHTTP handles GET /failover
+func (f *FailoverCoordinator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJson(w, http.StatusOK, f.Status())
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// FilterConfig selects what reaches a sink, all set conditions must match,
+// fields are matched per record, e.g. {"ignition": "1", "priority": "panic"},
+// event types are prefixes, e.g. ["alert.", "geofence.enter"]. Expression is a condition on the record (see
+// Condition), e.g. "speed > 5 || event_id == 240 || io.ignition == 1", compiled by Compile
+type FilterConfig struct {
+	Imeis        []string          `json:"imeis"`
+	ImeiPrefixes []string          `json:"imeiPrefixes"`
+	Groups       []string          `json:"groups"`
+	Codecs       []string          `json:"codecs"`
+	Fields       map[string]string `json:"fields"`
+	Expression   string            `json:"expression"`
+	EventTypes   []string          `json:"eventTypes"`
+
+	expression *Condition
+}
+
+type FilteredSink struct {
+	filter *FilterConfig
+	sink   Sink
+}
+
+func NewFilteredSink(filter *FilterConfig, sink Sink) *FilteredSink {
+	return &FilteredSink{filter: filter, sink: sink}
+}
+
+func (s *FilteredSink) Unwrap() Sink {
+	return s.sink
+}
+
+func (s *FilteredSink) Send(imei string, pkt *AnnotatedPacket) error {
+	if !s.filter.MatchDevice(imei, pkt.CodecID) {
+		return nil
+	}
+	if !s.filter.HasRecordConditions() {
+		return s.sink.Send(imei, pkt)
+	}
+	records := make([]teltonika.Data, 0, len(pkt.Data))
+	indexes := make([]int, 0, len(pkt.Data))
+	for i := range pkt.Data {
+		if s.filter.MatchRecord(&pkt.Data[i]) {
+			records = append(records, pkt.Data[i])
+			indexes = append(indexes, i)
+		}
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	filtered := pkt.Derive(records, indexes)
+	filtered.Messages = nil
+	return s.sink.Send(imei, filtered)
+}
+
+// SendEvent forwards events of the matching devices and types, codecs and fields apply to records only
+func (s *FilteredSink) SendEvent(event *Event) error {
+	eventSink, ok := s.sink.(EventSink)
+	if !ok || !s.filter.MatchImei(event.Imei) || !s.filter.MatchEventType(event.Type) {
+		return nil
+	}
+	return eventSink.SendEvent(event)
+}
+
+// Compile compiles the expression, before the filter is used
+func (f *FilterConfig) Compile() error {
+	if f.Expression == "" {
+		return nil
+	}
+	expression, err := CompileCondition(f.Expression)
+	if err != nil {
+		return fmt.Errorf("filter %v", err)
+	}
+	f.expression = expression
+	return nil
+}
+
+// HasRecordConditions tells if the filter selects records (fields or expression) and not only devices
+func (f *FilterConfig) HasRecordConditions() bool {
+	return len(f.Fields) > 0 || f.expression != nil
+}
+
+func (f *FilterConfig) MatchEventType(eventType string) bool {
+	if len(f.EventTypes) == 0 {
+		return true
+	}
+	for _, prefix := range f.EventTypes {
+		if strings.HasPrefix(eventType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *FilterConfig) MatchDevice(imei string, codec teltonika.CodecId) bool {
+	if !f.MatchImei(imei) {
+		return false
+	}
+	if len(f.Codecs) > 0 && !containsString(f.Codecs, codecName(codec)) {
+		return false
+	}
+	return true
+}
+
+func (f *FilterConfig) MatchImei(imei string) bool {
+	if len(f.Imeis) > 0 && !containsString(f.Imeis, imei) {
+		return false
+	}
+	if len(f.ImeiPrefixes) > 0 {
+		matched := false
+		for _, prefix := range f.ImeiPrefixes {
+			if strings.HasPrefix(imei, prefix) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(f.Groups) > 0 && !deviceGroups.Member(imei, f.Groups) {
+		return false
+	}
+	return true
+}
+
+func (f *FilterConfig) MatchRecord(record *teltonika.Data) bool {
+	if f.expression != nil && !f.expression.Eval(record) {
+		return false
+	}
+	for name, expected := range f.Fields {
+		if name == "priority" {
+			if expected != priorityName(record.Priority) && expected != strconv.Itoa(int(record.Priority)) {
+				return false
+			}
+			continue
+		}
+		value, ok := recordValue(record, name)
+		if !ok {
+			return false
+		}
+		if expectedValue, err := strconv.ParseFloat(expected, 64); err != nil || expectedValue != value {
+			return false
+		}
+	}
+	return true
+}
+
+// recordValue resolves record fields and IO elements (by name or io_<id>) as numbers
+func recordValue(record *teltonika.Data, name string) (float64, bool) {
+	switch name {
+	case "timestamp":
+		return float64(record.TimestampMs), true
+	case "lat":
+		return record.Lat, true
+	case "lng":
+		return record.Lng, true
+	case "altitude":
+		return float64(record.Altitude), true
+	case "angle":
+		return float64(record.Angle), true
+	case "speed":
+		return float64(record.Speed), true
+	case "satellites":
+		return float64(record.Satellites), true
+	case "priority":
+		return float64(record.Priority), true
+	case "event_id":
+		return float64(record.EventID), true
+	}
+	id, ok := ioIdByName(name)
+	if !ok {
+		return 0, false
+	}
+	value, ok := findElement(record, id)
+	if !ok {
+		return 0, false
+	}
+	return ioNumber(id, value)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
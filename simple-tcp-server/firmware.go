@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FirmwareConfig: the firmware is read with getver DelaySeconds (default 15) after a device connects, the
+// records are kept in File if set. An update started through the api polls the device every PollSeconds
+// (default 60) for up to TimeoutMinutes (default 30)
+type FirmwareConfig struct {
+	File           string `json:"file"`
+	DelaySeconds   int    `json:"delaySeconds"`
+	PollSeconds    int    `json:"pollSeconds"`
+	TimeoutMinutes int    `json:"timeoutMinutes"`
+}
+
+// DeviceFirmware is the firmware record of a device, Update is the last update started through the api
+type DeviceFirmware struct {
+	Imei         string          `json:"imei"`
+	Firmware     string          `json:"firmware"`
+	GnssFirmware string          `json:"gnssFirmware,omitempty"`
+	Hardware     string          `json:"hardware,omitempty"`
+	Checked      time.Time       `json:"checked"`
+	Changed      *time.Time      `json:"changed,omitempty"`
+	Previous     string          `json:"previous,omitempty"`
+	Update       *FirmwareUpdate `json:"update,omitempty"`
+}
+
+// FirmwareUpdate is the status of an update: waiting (for the device to report another version),
+// updated, timeout (no newer firmware or the update failed) or failed (the command couldn't be sent)
+type FirmwareUpdate struct {
+	Status    string    `json:"status"`
+	From      string    `json:"from"`
+	To        string    `json:"to,omitempty"`
+	Requested time.Time `json:"requested"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// FirmwareService tracks the firmware of the devices and emits device.firmware_changed events, Execute sends
+// a command and waits for the response, Publish publishes the events, Authorize returns the operator of an api
+// request (set by the caller)
+type FirmwareService struct {
+	Execute   func(imei string, cmd string, timeout time.Duration, operator string) (string, error)
+	Publish   func(events ...*Event)
+	Authorize func(r *http.Request) (string, bool)
+	file      string
+	delay     time.Duration
+	poll      time.Duration
+	timeout   time.Duration
+	logger    *Logger
+	mutex     sync.Mutex
+	devices   map[string]*DeviceFirmware
+}
+
+func NewFirmwareService(config *FirmwareConfig, logger *Logger) (*FirmwareService, error) {
+	if config == nil {
+		config = &FirmwareConfig{}
+	}
+	f := &FirmwareService{
+		file:    config.File,
+		delay:   time.Second * 15,
+		poll:    time.Minute,
+		timeout: time.Minute * 30,
+		logger:  logger,
+		devices: make(map[string]*DeviceFirmware),
+	}
+	if config.DelaySeconds > 0 {
+		f.delay = time.Duration(config.DelaySeconds) * time.Second
+	}
+	if config.PollSeconds > 0 {
+		f.poll = time.Duration(config.PollSeconds) * time.Second
+	}
+	if config.TimeoutMinutes > 0 {
+		f.timeout = time.Duration(config.TimeoutMinutes) * time.Minute
+	}
+	if f.file != "" {
+		data, err := os.ReadFile(f.file)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("firmware read error (%v)", err)
+		}
+		if err == nil {
+			if err = json.Unmarshal(data, &f.devices); err != nil {
+				return nil, fmt.Errorf("firmware parse error (%v)", err)
+			}
+		}
+	}
+	return f, nil
+}
+
+// Connected reads the firmware of a device that just connected (TCPServer.OnConnect)
+func (f *FirmwareService) Connected(imei string) {
+	go func() {
+		time.Sleep(f.delay)
+		if _, err := f.Check(imei); err != nil {
+			f.logger.Error.Printf("[%s]: %v", imei, err)
+		}
+	}()
+}
+
+// Check reads the firmware with getver and records it
+func (f *FirmwareService) Check(imei string) (*DeviceFirmware, error) {
+	response, err := f.Execute(imei, GetVerCommand().Text(), time.Minute, "system")
+	if err != nil {
+		return nil, fmt.Errorf("firmware getver error (%v)", err)
+	}
+	version, err := ParseGetVerResponse(response)
+	if err != nil {
+		return nil, err
+	}
+
+	var event *Event
+	f.mutex.Lock()
+	now := time.Now().UTC()
+	device, ok := f.devices[imei]
+	if !ok {
+		device = &DeviceFirmware{Imei: imei}
+		f.devices[imei] = device
+	}
+	if ok && device.Firmware != version.Firmware {
+		device.Previous, device.Changed = device.Firmware, &now
+		event = &Event{Type: "device.firmware_changed", Imei: imei, Time: now, Data: map[string]any{
+			"from":     device.Firmware,
+			"to":       version.Firmware,
+			"hardware": version.Hardware,
+		}}
+	}
+	device.Firmware, device.GnssFirmware, device.Hardware, device.Checked = version.Firmware, version.GnssFirmware, version.Hardware, now
+	if update := device.Update; update != nil && update.Status == "waiting" && update.From != version.Firmware {
+		update.Status, update.To = "updated", version.Firmware
+	}
+	record := *device
+	f.saveLocked()
+	f.mutex.Unlock()
+
+	if event != nil && f.Publish != nil {
+		f.Publish(event)
+	}
+	return &record, nil
+}
+
+// saveLocked writes the records to the file, the mutex must be held
+func (f *FirmwareService) saveLocked() {
+	if f.file == "" {
+		return
+	}
+	data, err := json.Marshal(f.devices)
+	if err == nil {
+		err = os.WriteFile(f.file, data, 0o644)
+	}
+	if err != nil {
+		f.logger.Error.Printf("firmware save error (%v)", err)
+	}
+}
+
+// StartUpdate sends web_connect (the device checks FOTA WEB for an update) and polls the device until
+// it reports another firmware version or the timeout
+func (f *FirmwareService) StartUpdate(imei string, operator string) (*FirmwareUpdate, error) {
+	f.mutex.Lock()
+	device, ok := f.devices[imei]
+	if !ok {
+		f.mutex.Unlock()
+		return nil, fmt.Errorf("firmware of '%s' unknown, the device didn't report its version yet", imei)
+	}
+	if device.Update != nil && device.Update.Status == "waiting" {
+		update := *device.Update
+		f.mutex.Unlock()
+		return &update, nil
+	}
+	update := &FirmwareUpdate{Status: "waiting", From: device.Firmware, Requested: time.Now().UTC()}
+	device.Update = update
+	f.saveLocked()
+	f.mutex.Unlock()
+
+	if _, err := f.Execute(imei, WebConnectCommand().Text(), time.Minute, operator); err != nil {
+		f.mutex.Lock()
+		update.Status, update.Error = "failed", err.Error()
+		f.saveLocked()
+		f.mutex.Unlock()
+		return nil, fmt.Errorf("firmware web_connect error (%v)", err)
+	}
+	go f.pollUpdate(imei, update)
+	return update, nil
+}
+
+func (f *FirmwareService) pollUpdate(imei string, update *FirmwareUpdate) {
+	deadline := update.Requested.Add(f.timeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(f.poll)
+		f.mutex.Lock()
+		waiting := update.Status == "waiting"
+		f.mutex.Unlock()
+		if !waiting {
+			return
+		}
+		// the device is offline while it updates, the check after the reconnect sees the new version
+		_, _ = f.Check(imei)
+	}
+	f.mutex.Lock()
+	if update.Status == "waiting" {
+		update.Status = "timeout"
+		f.saveLocked()
+	}
+	f.mutex.Unlock()
+}
+
+// Firmware returns the firmware record of the device, nil if unknown
+func (f *FirmwareService) Firmware(imei string) *DeviceFirmware {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	device, ok := f.devices[imei]
+	if !ok {
+		return nil
+	}
+	record := *device
+	if device.Update != nil {
+		update := *device.Update
+		record.Update = &update
+	}
+	return &record
+}
+
+// FirmwareReportEntry counts the devices of a hardware model running a firmware version
+type FirmwareReportEntry struct {
+	Hardware string   `json:"hardware"`
+	Firmware string   `json:"firmware"`
+	Devices  int      `json:"devices"`
+	Imeis    []string `json:"imeis"`
+}
+
+// Report groups the devices by model and firmware version
+func (f *FirmwareService) Report() []*FirmwareReportEntry {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	entries := make(map[string]*FirmwareReportEntry)
+	for imei, device := range f.devices {
+		key := device.Hardware + "/" + device.Firmware
+		entry, ok := entries[key]
+		if !ok {
+			entry = &FirmwareReportEntry{Hardware: device.Hardware, Firmware: device.Firmware}
+			entries[key] = entry
+		}
+		entry.Devices++
+		entry.Imeis = append(entry.Imeis, imei)
+	}
+	report := make([]*FirmwareReportEntry, 0, len(entries))
+	for _, entry := range entries {
+		sort.Strings(entry.Imeis)
+		report = append(report, entry)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Hardware != report[j].Hardware {
+			return report[i].Hardware < report[j].Hardware
+		}
+		return report[i].Firmware < report[j].Firmware
+	})
+	return report
+}
+
+// ServeReport handles GET /firmware
+func (f *FirmwareService) ServeReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJson(w, http.StatusOK, f.Report())
+}
+
+// ServeHTTP handles /devices/{imei}/firmware: GET returns the record, POST starts an update
+func (f *FirmwareService) ServeHTTP(w http.ResponseWriter, r *http.Request, imei string) {
+	switch r.Method {
+	case http.MethodGet:
+		record := f.Firmware(imei)
+		if record == nil {
+			http.NotFound(w, r)
+			return
+		}
+		writeJson(w, http.StatusOK, record)
+	case http.MethodPost:
+		operator, ok := authorize(w, r, f.Authorize)
+		if !ok {
+			return
+		}
+		update, err := f.StartUpdate(imei, operator)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		writeJson(w, http.StatusAccepted, update)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
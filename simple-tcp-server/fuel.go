@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FuelConfig: for every device the first vehicle matching its imei applies
+type FuelConfig struct {
+	Vehicles []*FuelVehicle `json:"vehicles"`
+}
+
+// FuelVehicle: Sensor is the fuel level IO element (default fuelLevelLls1, 201), its value is converted
+// to liters with the Calibration table (sensor value to liters pairs, interpolated), as a percentage of
+// TankLiters if set (OBD fuelLevel), or taken as liters. The level is the median of the last Window (default 5)
+// values. A rise of RefuelLiters (default 10) is a refuel, a drop of DrainLiters (default 8) while standing
+// is a suspected drain, the event is emitted once the level is stable for SettleSeconds (default 60)
+type FuelVehicle struct {
+	DeviceSelector
+	Sensor        string       `json:"sensor"`
+	Calibration   [][2]float64 `json:"calibration"`
+	TankLiters    float64      `json:"tankLiters"`
+	Window        int          `json:"window"`
+	RefuelLiters  float64      `json:"refuelLiters"`
+	DrainLiters   float64      `json:"drainLiters"`
+	SettleSeconds int          `json:"settleSeconds"`
+	sensor        uint16
+}
+
+// FuelLevel is the fuel state of a device, served by the api
+type FuelLevel struct {
+	Liters  float64   `json:"liters"`
+	Raw     uint64    `json:"raw"`
+	Updated time.Time `json:"updated"`
+}
+
+// FuelMonitor smooths the fuel level and emits fuel.refuel and fuel.drain events with the volume
+type FuelMonitor struct {
+	vehicles []*FuelVehicle
+	devices  sync.Map
+}
+
+type fuelDevice struct {
+	mutex    sync.Mutex
+	level    FuelLevel
+	window   []float64
+	baseline float64
+	started  bool
+	change   float64
+	since    time.Time
+	stable   time.Time
+	last     float64
+}
+
+func NewFuelMonitor(config *FuelConfig) (*FuelMonitor, error) {
+	f := &FuelMonitor{}
+	if config == nil {
+		return f, nil
+	}
+	for _, vehicle := range config.Vehicles {
+		name := vehicle.Sensor
+		if name == "" {
+			name = "fuelLevelLls1"
+		}
+		id, ok := ioIdByName(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown fuel sensor '%s'", name)
+		}
+		vehicle.sensor = id
+		sort.Slice(vehicle.Calibration, func(i, j int) bool {
+			return vehicle.Calibration[i][0] < vehicle.Calibration[j][0]
+		})
+		if vehicle.Window <= 0 {
+			vehicle.Window = 5
+		}
+		if vehicle.RefuelLiters <= 0 {
+			vehicle.RefuelLiters = 10
+		}
+		if vehicle.DrainLiters <= 0 {
+			vehicle.DrainLiters = 8
+		}
+		if vehicle.SettleSeconds <= 0 {
+			vehicle.SettleSeconds = 60
+		}
+	}
+	f.vehicles = config.Vehicles
+	return f, nil
+}
+
+func (f *FuelMonitor) vehicle(imei string) *FuelVehicle {
+	for _, vehicle := range f.vehicles {
+		if vehicle.Match(imei) {
+			return vehicle
+		}
+	}
+	return nil
+}
+
+// Liters converts a sensor value
+func (v *FuelVehicle) Liters(raw uint64) float64 {
+	value := float64(raw)
+	table := v.Calibration
+	switch {
+	case len(table) >= 2:
+		i := sort.Search(len(table), func(i int) bool { return table[i][0] >= value })
+		if i == 0 {
+			i = 1
+		} else if i == len(table) {
+			i = len(table) - 1
+		}
+		a, b := table[i-1], table[i]
+		if b[0] == a[0] {
+			return a[1]
+		}
+		return a[1] + (value-a[0])*(b[1]-a[1])/(b[0]-a[0])
+	case v.TankLiters > 0:
+		return value / 100 * v.TankLiters
+	}
+	return value
+}
+
+func (f *FuelMonitor) Process(imei string, pkt *teltonika.Packet) []*Event {
+	vehicle := f.vehicle(imei)
+	if vehicle == nil {
+		return nil
+	}
+	value, _ := f.devices.LoadOrStore(imei, &fuelDevice{})
+	device := value.(*fuelDevice)
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	var events []*Event
+	for i := range pkt.Data {
+		record := &pkt.Data[i]
+		raw, ok := ioUint(record, vehicle.sensor)
+		if !ok {
+			continue
+		}
+		recordTime := time.UnixMilli(int64(record.TimestampMs)).UTC()
+		device.window = append(device.window, vehicle.Liters(raw))
+		if len(device.window) > vehicle.Window {
+			device.window = device.window[len(device.window)-vehicle.Window:]
+		}
+		level := median(device.window)
+		device.level = FuelLevel{Liters: level, Raw: raw, Updated: recordTime}
+		if !device.started {
+			device.started, device.baseline, device.last, device.stable = true, level, level, recordTime
+			continue
+		}
+
+		// the level is stable while it changes less than a liter between records
+		if level-device.last > 1 || device.last-level > 1 {
+			device.stable = recordTime
+		}
+		device.last = level
+		settled := recordTime.Sub(device.stable) >= time.Duration(vehicle.SettleSeconds)*time.Second
+		moving := record.Speed > 0
+
+		switch {
+		case device.change == 0 && level-device.baseline >= vehicle.RefuelLiters:
+			device.change, device.since = 1, recordTime
+		case device.change == 0 && device.baseline-level >= vehicle.DrainLiters && !moving:
+			device.change, device.since = -1, recordTime
+		}
+		if device.change != 0 && (settled || moving) {
+			liters := level - device.baseline
+			eventType := "fuel.refuel"
+			if device.change < 0 {
+				eventType, liters = "fuel.drain", -liters
+			}
+			threshold := vehicle.RefuelLiters
+			if device.change < 0 {
+				threshold = vehicle.DrainLiters
+			}
+			// a change that didn't hold (slosh on a slope) isn't reported
+			if liters >= threshold {
+				events = append(events, NewEvent(eventType, imei, record, map[string]any{
+					"liters":      liters,
+					"levelBefore": device.baseline,
+					"levelAfter":  level,
+					"since":       device.since.Format(time.RFC3339),
+				}))
+			}
+			device.change, device.baseline = 0, level
+		}
+		// consumption while driving moves the baseline
+		if device.change == 0 && moving {
+			device.baseline = level
+		}
+	}
+	return events
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// Level returns the fuel state of the device, nil if it has no fuel sensor readings
+func (f *FuelMonitor) Level(imei string) *FuelLevel {
+	value, ok := f.devices.Load(imei)
+	if !ok {
+		return nil
+	}
+	device := value.(*fuelDevice)
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+	level := device.level
+	return &level
+}
+
+// ServeHTTP handles GET /devices/{imei}/fuel
+func (f *FuelMonitor) ServeHTTP(w http.ResponseWriter, r *http.Request, imei string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	level := f.Level(imei)
+	if level == nil {
+		http.NotFound(w, r)
+		return
+	}
+	writeJson(w, http.StatusOK, level)
+}
+
+// Purge forgets the device (a Purger)
+func (f *FuelMonitor) Purge(imei string) (int, error) {
+	return purgeSyncMap(&f.devices, imei), nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// GapsConfig: a device is silent when it sends nothing for Factor (default 3) times its reporting
+// interval, but at least MinSilentSeconds (default 300). The interval is learned per device from the
+// packet arrivals unless ExpectedSeconds is set
+type GapsConfig struct {
+	ExpectedSeconds  int     `json:"expectedSeconds"`
+	Factor           float64 `json:"factor"`
+	MinSilentSeconds int     `json:"minSilentSeconds"`
+}
+
+// GapDetector tracks the packet arrivals of the devices and emits device.silent when a device stops
+// reporting and device.resumed (with the gap duration) when it's back, Publish delivers the events
+type GapDetector struct {
+	expected  time.Duration
+	factor    float64
+	minSilent time.Duration
+	mutex     sync.Mutex
+	devices   map[string]*gapDevice
+	Publish   func(events ...*Event)
+}
+
+type gapDevice struct {
+	lastSeen time.Time
+	interval time.Duration
+	silent   bool
+	lat      float64
+	lng      float64
+}
+
+// SilentDevice is a device not heard from, served by the api
+type SilentDevice struct {
+	Imei          string    `json:"imei"`
+	LastSeen      time.Time `json:"lastSeen"`
+	SilentSeconds int64     `json:"silentSeconds"`
+	Lat           float64   `json:"lat"`
+	Lng           float64   `json:"lng"`
+}
+
+func NewGapDetector(config *GapsConfig) *GapDetector {
+	g := &GapDetector{factor: 3, minSilent: time.Minute * 5, devices: make(map[string]*gapDevice)}
+	if config != nil {
+		g.expected = time.Duration(config.ExpectedSeconds) * time.Second
+		if config.Factor > 0 {
+			g.factor = config.Factor
+		}
+		if config.MinSilentSeconds > 0 {
+			g.minSilent = time.Duration(config.MinSilentSeconds) * time.Second
+		}
+	}
+	go func() {
+		for range time.Tick(time.Second * 10) {
+			g.check(time.Now())
+		}
+	}()
+	return g
+}
+
+// Seen records a packet arrival, it's called for every packet before the stages (which may drop or hold packets)
+func (g *GapDetector) Seen(imei string, pkt *teltonika.Packet) {
+	now := time.Now()
+	g.mutex.Lock()
+
+	device, ok := g.devices[imei]
+	if !ok {
+		device = &gapDevice{interval: g.expected}
+		g.devices[imei] = device
+	}
+	var events []*Event
+	if ok {
+		gap := now.Sub(device.lastSeen)
+		if device.silent {
+			device.silent = false
+			events = append(events, g.event("device.resumed", imei, device, now, map[string]any{
+				"lastSeen":   device.lastSeen.UTC().Format(time.RFC3339),
+				"gapSeconds": int64(gap.Seconds()),
+			}))
+		} else if g.expected == 0 {
+			// moving average of the arrival interval, gaps don't count
+			if device.interval == 0 {
+				device.interval = gap
+			} else {
+				device.interval = (device.interval*4 + gap) / 5
+			}
+		}
+	}
+	device.lastSeen = now
+	for i := len(pkt.Data) - 1; i >= 0; i-- {
+		if hasFix(&pkt.Data[i]) {
+			device.lat, device.lng = pkt.Data[i].Lat, pkt.Data[i].Lng
+			break
+		}
+	}
+	g.mutex.Unlock()
+	if len(events) > 0 && g.Publish != nil {
+		g.Publish(events...)
+	}
+}
+
+func (g *GapDetector) threshold(device *gapDevice) time.Duration {
+	threshold := time.Duration(float64(device.interval) * g.factor)
+	if threshold < g.minSilent {
+		threshold = g.minSilent
+	}
+	return threshold
+}
+
+func (g *GapDetector) check(now time.Time) {
+	var events []*Event
+	g.mutex.Lock()
+	for imei, device := range g.devices {
+		if device.silent || now.Sub(device.lastSeen) < g.threshold(device) {
+			continue
+		}
+		device.silent = true
+		events = append(events, g.event("device.silent", imei, device, now, map[string]any{
+			"lastSeen":        device.lastSeen.UTC().Format(time.RFC3339),
+			"intervalSeconds": int64(device.interval.Seconds()),
+		}))
+	}
+	g.mutex.Unlock()
+	if len(events) > 0 && g.Publish != nil {
+		g.Publish(events...)
+	}
+}
+
+func (g *GapDetector) event(eventType string, imei string, device *gapDevice, now time.Time, data map[string]any) *Event {
+	return &Event{Type: eventType, Imei: imei, Time: now.UTC(), Lat: device.lat, Lng: device.lng, Data: data}
+}
+
+// Silent returns the devices not heard from for at least the duration, the longest silent first
+func (g *GapDetector) Silent(duration time.Duration) []SilentDevice {
+	now := time.Now()
+	g.mutex.Lock()
+	devices := make([]SilentDevice, 0)
+	for imei, device := range g.devices {
+		if silent := now.Sub(device.lastSeen); silent >= duration {
+			devices = append(devices, SilentDevice{Imei: imei, LastSeen: device.lastSeen.UTC(),
+				SilentSeconds: int64(silent.Seconds()), Lat: device.lat, Lng: device.lng})
+		}
+	}
+	g.mutex.Unlock()
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].LastSeen.Before(devices[j].LastSeen)
+	})
+	return devices
+}
+
+// ServeHTTP handles GET /devices?silent_for=1h (a Go duration, without it all known devices)
+func (g *GapDetector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	duration := time.Duration(0)
+	if value := r.URL.Query().Get("silent_for"); value != "" {
+		var err error
+		if duration, err = time.ParseDuration(value); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	writeJson(w, http.StatusOK, g.Silent(duration))
+}
+
+// Purge forgets the device (a Purger)
+func (g *GapDetector) Purge(imei string) (int, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if _, ok := g.devices[imei]; !ok {
+		return 0, nil
+	}
+	delete(g.devices, imei)
+	return 1, nil
+}
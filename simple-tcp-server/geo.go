@@ -0,0 +1,37 @@
+package main
+
+import "math"
+
+const earthRadius = 6371008.8
+
+// haversine returns the great circle distance in meters
+func haversine(lat1, lng1, lat2, lng2 float64) float64 {
+	phi1, phi2 := lat1*math.Pi/180, lat2*math.Pi/180
+	dPhi := (lat2 - lat1) * math.Pi / 180
+	dLambda := (lng2 - lng1) * math.Pi / 180
+	a := math.Sin(dPhi/2)*math.Sin(dPhi/2) + math.Cos(phi1)*math.Cos(phi2)*math.Sin(dLambda/2)*math.Sin(dLambda/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// project maps a point to meters on a plane tangent at the origin (equirectangular),
+// precise enough for fences up to a few tens of kilometers
+func project(originLat, originLng, lat, lng float64) (x, y float64) {
+	x = (lng - originLng) * math.Pi / 180 * earthRadius * math.Cos(originLat*math.Pi/180)
+	y = (lat - originLat) * math.Pi / 180 * earthRadius
+	return x, y
+}
+
+// segmentDistance is the distance from the point p to the segment a-b (plane coordinates)
+func segmentDistance(px, py, ax, ay, bx, by float64) float64 {
+	dx, dy := bx-ax, by-ay
+	t := 0.0
+	if l := dx*dx + dy*dy; l > 0 {
+		t = math.Max(0, math.Min(1, ((px-ax)*dx+(py-ay)*dy)/l))
+	}
+	return math.Hypot(px-ax-t*dx, py-ay-t*dy)
+}
+
+// hasFix reports whether the record position is valid, without a fix trackers repeat the last position with no satellites
+func hasFix(record *teltonika.Data) bool {
+	return record.Satellites > 0 && (record.Lat != 0 || record.Lng != 0)
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var geocodingMetrics = expvar.NewMap("geocoding")
+
+// GeocodingConfig: Provider is "nominatim" (default), "photon" or "google", Url overrides the provider
+// endpoint (self-hosted instances), ApiKey is required by google. Lookups are limited to RequestsPerSecond
+// (default 1, the public nominatim policy), a record is left without address rather than waiting more
+// than MaxWaitMs (default 500) for its turn. Addresses are cached for positions rounded to Precision decimals
+// (default 4, ~10 m), CacheSize (default 10000) positions
+type GeocodingConfig struct {
+	Provider          string  `json:"provider"`
+	Url               string  `json:"url"`
+	ApiKey            string  `json:"apiKey"`
+	UserAgent         string  `json:"userAgent"`
+	Language          string  `json:"language"`
+	RequestsPerSecond float64 `json:"requestsPerSecond"`
+	MaxWaitMs         int     `json:"maxWaitMs"`
+	Precision         int     `json:"precision"`
+	CacheSize         int     `json:"cacheSize"`
+}
+
+// Address is the result of a reverse lookup
+type Address struct {
+	DisplayName string `json:"address"`
+	Road        string `json:"road"`
+	HouseNumber string `json:"house_number"`
+	City        string `json:"city"`
+	Postcode    string `json:"postcode"`
+	Country     string `json:"country"`
+	CountryCode string `json:"country_code"`
+}
+
+// Geocoder resolves a position to an address, nil if there's no address at the position
+type Geocoder interface {
+	Reverse(lat float64, lng float64) (*Address, error)
+}
+
+func NewGeocoder(config *GeocodingConfig) (Geocoder, error) {
+	client := &http.Client{Timeout: time.Second * 5}
+	userAgent := config.UserAgent
+	if userAgent == "" {
+		userAgent = "teltonika-tcp-server"
+	}
+	switch config.Provider {
+	case "", "nominatim":
+		return &nominatimGeocoder{url: defaultString(config.Url, "https://nominatim.openstreetmap.org"),
+			userAgent: userAgent, language: config.Language, client: client}, nil
+	case "photon":
+		return &photonGeocoder{url: defaultString(config.Url, "https://photon.komoot.io"),
+			userAgent: userAgent, language: config.Language, client: client}, nil
+	case "google":
+		if config.ApiKey == "" {
+			return nil, fmt.Errorf("google geocoder requires apiKey")
+		}
+		return &googleGeocoder{url: defaultString(config.Url, "https://maps.googleapis.com"),
+			apiKey: config.ApiKey, language: config.Language, client: client}, nil
+	}
+	return nil, fmt.Errorf("unknown geocoding provider '%s'", config.Provider)
+}
+
+func defaultString(s string, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+// geocoderGet fetches a provider response and decodes it into v
+func geocoderGet(client *http.Client, requestUrl string, headers map[string]string, v any) error {
+	req, err := http.NewRequest(http.MethodGet, requestUrl, nil)
+	if err != nil {
+		return err
+	}
+	for k, value := range headers {
+		req.Header.Set(k, value)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		_, _ = io.Copy(io.Discard, res.Body)
+		return fmt.Errorf("geocoder http status %d", res.StatusCode)
+	}
+	if err = json.NewDecoder(res.Body).Decode(v); err != nil {
+		return fmt.Errorf("geocoder response parse error (%v)", err)
+	}
+	return nil
+}
+
+func formatCoordinate(v float64) string {
+	return strconv.FormatFloat(v, 'f', 6, 64)
+}
+
+type nominatimGeocoder struct {
+	url       string
+	userAgent string
+	language  string
+	client    *http.Client
+}
+
+func (g *nominatimGeocoder) Reverse(lat float64, lng float64) (*Address, error) {
+	query := url.Values{"format": {"jsonv2"}, "lat": {formatCoordinate(lat)}, "lon": {formatCoordinate(lng)}}
+	if g.language != "" {
+		query.Set("accept-language", g.language)
+	}
+	var res struct {
+		Error       string            `json:"error"`
+		DisplayName string            `json:"display_name"`
+		Address     map[string]string `json:"address"`
+	}
+	if err := geocoderGet(g.client, g.url+"/reverse?"+query.Encode(), map[string]string{"User-Agent": g.userAgent}, &res); err != nil {
+		return nil, err
+	}
+	if res.Error != "" || res.DisplayName == "" {
+		return nil, nil
+	}
+	city := res.Address["city"]
+	for _, key := range []string{"town", "village", "municipality"} {
+		if city == "" {
+			city = res.Address[key]
+		}
+	}
+	return &Address{
+		DisplayName: res.DisplayName,
+		Road:        res.Address["road"],
+		HouseNumber: res.Address["house_number"],
+		City:        city,
+		Postcode:    res.Address["postcode"],
+		Country:     res.Address["country"],
+		CountryCode: strings.ToUpper(res.Address["country_code"]),
+	}, nil
+}
+
+type photonGeocoder struct {
+	url       string
+	userAgent string
+	language  string
+	client    *http.Client
+}
+
+func (g *photonGeocoder) Reverse(lat float64, lng float64) (*Address, error) {
+	query := url.Values{"lat": {formatCoordinate(lat)}, "lon": {formatCoordinate(lng)}}
+	if g.language != "" {
+		query.Set("lang", g.language)
+	}
+	var res struct {
+		Features []struct {
+			Properties map[string]any `json:"properties"`
+		} `json:"features"`
+	}
+	if err := geocoderGet(g.client, g.url+"/reverse?"+query.Encode(), map[string]string{"User-Agent": g.userAgent}, &res); err != nil {
+		return nil, err
+	}
+	if len(res.Features) == 0 {
+		return nil, nil
+	}
+	property := func(key string) string {
+		s, _ := res.Features[0].Properties[key].(string)
+		return s
+	}
+	address := &Address{
+		Road:        property("street"),
+		HouseNumber: property("housenumber"),
+		City:        property("city"),
+		Postcode:    property("postcode"),
+		Country:     property("country"),
+		CountryCode: strings.ToUpper(property("countrycode")),
+	}
+	if address.Road == "" {
+		address.Road = property("name")
+	}
+	parts := make([]string, 0, 4)
+	for _, part := range []string{strings.TrimSpace(address.Road + " " + address.HouseNumber),
+		strings.TrimSpace(address.Postcode + " " + address.City), address.Country} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	address.DisplayName = strings.Join(parts, ", ")
+	return address, nil
+}
+
+type googleGeocoder struct {
+	url      string
+	apiKey   string
+	language string
+	client   *http.Client
+}
+
+func (g *googleGeocoder) Reverse(lat float64, lng float64) (*Address, error) {
+	query := url.Values{"latlng": {formatCoordinate(lat) + "," + formatCoordinate(lng)}, "key": {g.apiKey}}
+	if g.language != "" {
+		query.Set("language", g.language)
+	}
+	var res struct {
+		Status       string `json:"status"`
+		ErrorMessage string `json:"error_message"`
+		Results      []struct {
+			FormattedAddress  string `json:"formatted_address"`
+			AddressComponents []struct {
+				LongName  string   `json:"long_name"`
+				ShortName string   `json:"short_name"`
+				Types     []string `json:"types"`
+			} `json:"address_components"`
+		} `json:"results"`
+	}
+	if err := geocoderGet(g.client, g.url+"/maps/api/geocode/json?"+query.Encode(), nil, &res); err != nil {
+		return nil, err
+	}
+	if res.Status == "ZERO_RESULTS" || (res.Status == "OK" && len(res.Results) == 0) {
+		return nil, nil
+	}
+	if res.Status != "OK" {
+		return nil, fmt.Errorf("google geocoder status %s (%s)", res.Status, res.ErrorMessage)
+	}
+	result := res.Results[0]
+	address := &Address{DisplayName: result.FormattedAddress}
+	for _, component := range result.AddressComponents {
+		switch {
+		case containsString(component.Types, "route"):
+			address.Road = component.LongName
+		case containsString(component.Types, "street_number"):
+			address.HouseNumber = component.LongName
+		case containsString(component.Types, "locality"):
+			address.City = component.LongName
+		case containsString(component.Types, "postal_code"):
+			address.Postcode = component.LongName
+		case containsString(component.Types, "country"):
+			address.Country = component.LongName
+			address.CountryCode = component.ShortName
+		}
+	}
+	return address, nil
+}
+
+// GeocodingEnricher attaches the address of the record position, lookups are cached and rate limited
+type GeocodingEnricher struct {
+	geocoder  Geocoder
+	interval  time.Duration
+	maxWait   time.Duration
+	precision int
+	cacheSize int
+	mutex     sync.Mutex
+	next      time.Time
+	cache     map[string]*Address
+	order     []string
+}
+
+func NewGeocodingEnricher(config *GeocodingConfig) (*GeocodingEnricher, error) {
+	geocoder, err := NewGeocoder(config)
+	if err != nil {
+		return nil, err
+	}
+	g := &GeocodingEnricher{
+		geocoder:  geocoder,
+		interval:  time.Second,
+		maxWait:   time.Millisecond * 500,
+		precision: 4,
+		cacheSize: 10000,
+		cache:     make(map[string]*Address),
+	}
+	if config.RequestsPerSecond > 0 {
+		g.interval = time.Duration(float64(time.Second) / config.RequestsPerSecond)
+	}
+	if config.MaxWaitMs > 0 {
+		g.maxWait = time.Duration(config.MaxWaitMs) * time.Millisecond
+	}
+	if config.Precision > 0 {
+		g.precision = config.Precision
+	}
+	if config.CacheSize > 0 {
+		g.cacheSize = config.CacheSize
+	}
+	return g, nil
+}
+
+// EnrichRecord looks up the address of the record position (see RecordEnricher)
+func (g *GeocodingEnricher) EnrichRecord(imei string, record *teltonika.Data) (map[string]any, error) {
+	if !hasFix(record) {
+		return nil, nil
+	}
+	key := strconv.FormatFloat(record.Lat, 'f', g.precision, 64) + "," + strconv.FormatFloat(record.Lng, 'f', g.precision, 64)
+	g.mutex.Lock()
+	address, ok := g.cache[key]
+	if ok {
+		g.mutex.Unlock()
+		geocodingMetrics.Add("cacheHits", 1)
+		return address.attributes(), nil
+	}
+	now := time.Now()
+	if g.next.Before(now) {
+		g.next = now
+	}
+	wait := g.next.Sub(now)
+	if wait > g.maxWait {
+		g.mutex.Unlock()
+		geocodingMetrics.Add("skipped", 1)
+		return nil, nil
+	}
+	g.next = g.next.Add(g.interval)
+	g.mutex.Unlock()
+
+	time.Sleep(wait)
+	geocodingMetrics.Add("requests", 1)
+	address, err := g.geocoder.Reverse(record.Lat, record.Lng)
+	if err != nil {
+		geocodingMetrics.Add("errors", 1)
+		return nil, fmt.Errorf("reverse geocoding error (%v)", err)
+	}
+
+	g.mutex.Lock()
+	if _, ok = g.cache[key]; !ok {
+		if len(g.order) >= g.cacheSize {
+			delete(g.cache, g.order[0])
+			g.order = g.order[1:]
+		}
+		g.cache[key] = address
+		g.order = append(g.order, key)
+	}
+	g.mutex.Unlock()
+	return address.attributes(), nil
+}
+
+// attributes are the non-empty address fields
+func (a *Address) attributes() map[string]any {
+	if a == nil {
+		return nil
+	}
+	attributes := make(map[string]any)
+	for k, v := range map[string]string{
+		"address":      a.DisplayName,
+		"road":         a.Road,
+		"house_number": a.HouseNumber,
+		"city":         a.City,
+		"postcode":     a.Postcode,
+		"country":      a.Country,
+		"country_code": a.CountryCode,
+	} {
+		if v != "" {
+			attributes[k] = v
+		}
+	}
+	return attributes
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Geofence is a circle (Lat, Lng and Radius in meters) or a polygon (Polygon of [lat, lng] vertices),
+// Imeis and Groups limit the fence to the devices (all devices if both are empty), with DwellSeconds set
+// a dwell event is emitted once a device stays inside that long
+type Geofence struct {
+	Name         string       `json:"name"`
+	Lat          float64      `json:"lat,omitempty"`
+	Lng          float64      `json:"lng,omitempty"`
+	Radius       float64      `json:"radius,omitempty"`
+	Polygon      [][2]float64 `json:"polygon,omitempty"`
+	Imeis        []string     `json:"imeis,omitempty"`
+	Groups       []string     `json:"groups,omitempty"`
+	DwellSeconds int          `json:"dwellSeconds,omitempty"`
+}
+
+// GeofencingConfig: a device enters a fence once it's inside the border and exits once it's
+// Margin meters outside, the state changes after Confirmations consecutive records
+type GeofencingConfig struct {
+	Fences        []*Geofence `json:"fences"`
+	Margin        float64     `json:"margin"`
+	Confirmations int         `json:"confirmations"`
+}
+
+func (g *Geofence) validate() error {
+	if g.Name == "" {
+		return errors.New("geofence has no name")
+	}
+	if len(g.Polygon) == 0 && g.Radius <= 0 {
+		return fmt.Errorf("geofence '%s' needs a radius or a polygon", g.Name)
+	}
+	if len(g.Polygon) > 0 && len(g.Polygon) < 3 {
+		return fmt.Errorf("geofence '%s' polygon needs at least 3 vertices", g.Name)
+	}
+	return nil
+}
+
+// distance is the signed distance in meters from the fence border, negative inside
+func (g *Geofence) distance(lat, lng float64) float64 {
+	if len(g.Polygon) == 0 {
+		return haversine(g.Lat, g.Lng, lat, lng) - g.Radius
+	}
+	inside := false
+	border := math.Inf(1)
+	for i, j := 0, len(g.Polygon)-1; i < len(g.Polygon); j, i = i, i+1 {
+		ax, ay := project(lat, lng, g.Polygon[j][0], g.Polygon[j][1])
+		bx, by := project(lat, lng, g.Polygon[i][0], g.Polygon[i][1])
+		if (ay > 0) != (by > 0) && ax+(0-ay)*(bx-ax)/(by-ay) > 0 {
+			inside = !inside
+		}
+		border = math.Min(border, segmentDistance(0, 0, ax, ay, bx, by))
+	}
+	if inside {
+		return -border
+	}
+	return border
+}
+
+func (g *Geofence) appliesTo(imei string) bool {
+	if len(g.Imeis) == 0 && len(g.Groups) == 0 {
+		return true
+	}
+	return containsString(g.Imeis, imei) || deviceGroups.Member(imei, g.Groups)
+}
+
+// GeofenceEngine evaluates every record against the fences, emitting geofence.enter,
+// geofence.exit and geofence.dwell events, fences can be changed at runtime (http api),
+// Authorize returns the operator of an api request changing them (set by the caller)
+type GeofenceEngine struct {
+	Authorize     func(r *http.Request) (string, bool)
+	mutex         sync.RWMutex
+	fences        map[string]*Geofence
+	margin        float64
+	confirmations int
+	devices       sync.Map
+}
+
+type geofenceDevice struct {
+	mutex  sync.Mutex
+	states map[string]*geofenceState
+}
+
+type geofenceState struct {
+	inside  bool
+	pending int
+	since   time.Time
+	dwelled bool
+}
+
+func NewGeofenceEngine(config *GeofencingConfig) (*GeofenceEngine, error) {
+	g := &GeofenceEngine{fences: make(map[string]*Geofence), margin: 20, confirmations: 2}
+	if config == nil {
+		return g, nil
+	}
+	if config.Margin > 0 {
+		g.margin = config.Margin
+	}
+	if config.Confirmations > 0 {
+		g.confirmations = config.Confirmations
+	}
+	for _, fence := range config.Fences {
+		if err := g.Set(fence); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// Set adds the fence or replaces the fence with the same name
+func (g *GeofenceEngine) Set(fence *Geofence) error {
+	if err := fence.validate(); err != nil {
+		return err
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.fences[fence.Name] = fence
+	return nil
+}
+
+func (g *GeofenceEngine) Delete(name string) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	_, ok := g.fences[name]
+	delete(g.fences, name)
+	return ok
+}
+
+func (g *GeofenceEngine) Fences() []*Geofence {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	fences := make([]*Geofence, 0, len(g.fences))
+	for _, fence := range g.fences {
+		fences = append(fences, fence)
+	}
+	sort.Slice(fences, func(i, j int) bool {
+		return fences[i].Name < fences[j].Name
+	})
+	return fences
+}
+
+func (g *GeofenceEngine) Process(imei string, pkt *teltonika.Packet) []*Event {
+	fences := g.Fences()
+	if len(fences) == 0 {
+		return nil
+	}
+	value, _ := g.devices.LoadOrStore(imei, &geofenceDevice{states: make(map[string]*geofenceState)})
+	device := value.(*geofenceDevice)
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	var events []*Event
+	for i := range pkt.Data {
+		record := &pkt.Data[i]
+		if !hasFix(record) {
+			continue
+		}
+		recordTime := time.UnixMilli(int64(record.TimestampMs))
+		for _, fence := range fences {
+			if !fence.appliesTo(imei) {
+				continue
+			}
+			state, ok := device.states[fence.Name]
+			if !ok {
+				state = &geofenceState{}
+				device.states[fence.Name] = state
+			}
+
+			d := fence.distance(record.Lat, record.Lng)
+			if (!state.inside && d <= 0) || (state.inside && d > g.margin) {
+				state.pending++
+			} else {
+				state.pending = 0
+			}
+			if state.pending >= g.confirmations {
+				state.pending = 0
+				state.inside = !state.inside
+				if state.inside {
+					state.since, state.dwelled = recordTime, false
+					events = append(events, NewEvent("geofence.enter", imei, record, map[string]any{"geofence": fence.Name}))
+				} else {
+					events = append(events, NewEvent("geofence.exit", imei, record, map[string]any{
+						"geofence":        fence.Name,
+						"durationSeconds": int64(recordTime.Sub(state.since).Seconds()),
+					}))
+				}
+			}
+			if state.inside && !state.dwelled && fence.DwellSeconds > 0 &&
+				recordTime.Sub(state.since) >= time.Duration(fence.DwellSeconds)*time.Second {
+				state.dwelled = true
+				events = append(events, NewEvent("geofence.dwell", imei, record, map[string]any{
+					"geofence":        fence.Name,
+					"durationSeconds": int64(recordTime.Sub(state.since).Seconds()),
+				}))
+			}
+		}
+	}
+	return events
+}
+
+// ServeHTTP handles /geofences: GET lists the fences, POST adds or replaces a fence (or an array of fences),
+// DELETE ?name=<name> removes a fence, the changes are authorized
+func (g *GeofenceEngine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		if _, ok := authorize(w, r, g.Authorize); !ok {
+			return
+		}
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJson(w, http.StatusOK, g.Fences())
+	case http.MethodPost, http.MethodPut:
+		body := json.RawMessage{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fences := make([]*Geofence, 0)
+		if err := json.Unmarshal(body, &fences); err != nil {
+			fence := &Geofence{}
+			if err = json.Unmarshal(body, fence); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			fences = append(fences, fence)
+		}
+		for _, fence := range fences {
+			if err := fence.validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		for _, fence := range fences {
+			_ = g.Set(fence)
+		}
+		writeJson(w, http.StatusOK, fences)
+	case http.MethodDelete:
+		if !g.Delete(r.URL.Query().Get("name")) {
+			http.Error(w, "geofence not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Purge forgets the device (a Purger)
+func (g *GeofenceEngine) Purge(imei string) (int, error) {
+	return purgeSyncMap(&g.devices, imei), nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"expvar"
+	"strings"
+	"sync"
+	"time"
+)
+
+var gnssMetrics = expvar.NewMap("gnss")
+
+// GnssSecurityConfig: a fix implying a speed over MaxSpeedKmh (default 300) for a jump of at least
+// MinJumpMeters (default 1000) is a teleport, satellites dropping by SatelliteDrop (default 5) or more
+// between records while the HDOP stays the same is suspect too (spoofers and jammers affect the receiver
+// differently than real obstructions, which degrade the HDOP)
+type GnssSecurityConfig struct {
+	MaxSpeedKmh   float64 `json:"maxSpeedKmh"`
+	MinJumpMeters float64 `json:"minJumpMeters"`
+	SatelliteDrop int     `json:"satelliteDrop"`
+}
+
+// GnssSecurity decodes the jamming IO (249, 318) and detects suspect fixes, suspect records get the gnss_suspect
+// attribute with the comma separated reasons (Enricher), Publish delivers the security.jamming.start / security.jamming.end and
+// security.gnss_suspect events
+type GnssSecurity struct {
+	maxSpeed float64
+	minJump  float64
+	satDrop  int
+	devices  sync.Map
+	Publish  func(events ...*Event)
+}
+
+type gnssDevice struct {
+	mutex    sync.Mutex
+	last     *teltonika.Data
+	hdop     uint64
+	hasHdop  bool
+	jamming  bool
+	jamSince time.Time
+}
+
+func NewGnssSecurity(config *GnssSecurityConfig) *GnssSecurity {
+	g := &GnssSecurity{maxSpeed: 300, minJump: 1000, satDrop: 5}
+	if config == nil {
+		return g
+	}
+	if config.MaxSpeedKmh > 0 {
+		g.maxSpeed = config.MaxSpeedKmh
+	}
+	if config.MinJumpMeters > 0 {
+		g.minJump = config.MinJumpMeters
+	}
+	if config.SatelliteDrop > 0 {
+		g.satDrop = config.SatelliteDrop
+	}
+	return g
+}
+
+// jammingState reads the jamming IO: 249 is 1 while jamming, 318 is 1 (warning) or 2 (critical)
+func jammingState(record *teltonika.Data) (jamming bool, known bool) {
+	if value, ok := ioUint(record, ioNames["gnssJamming"]); ok {
+		return value != 0, true
+	}
+	if value, ok := ioUint(record, ioNames["jamming"]); ok {
+		return value != 0, true
+	}
+	return false, false
+}
+
+func (g *GnssSecurity) Enrich(imei string, pkt *teltonika.Packet) ([]map[string]any, error) {
+	value, _ := g.devices.LoadOrStore(imei, &gnssDevice{})
+	device := value.(*gnssDevice)
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	var attributes []map[string]any
+	var events []*Event
+	for i := range pkt.Data {
+		record := &pkt.Data[i]
+		reasons := make([]string, 0)
+
+		if jamming, known := jammingState(record); known {
+			if jamming {
+				reasons = append(reasons, "jamming")
+			}
+			if jamming != device.jamming {
+				device.jamming = jamming
+				recordTime := time.UnixMilli(int64(record.TimestampMs)).UTC()
+				if jamming {
+					device.jamSince = recordTime
+					events = append(events, NewEvent("security.jamming.start", imei, record, nil))
+				} else {
+					events = append(events, NewEvent("security.jamming.end", imei, record, map[string]any{
+						"since":           device.jamSince.Format(time.RFC3339),
+						"durationSeconds": int64(recordTime.Sub(device.jamSince).Seconds()),
+					}))
+				}
+			}
+		}
+
+		hdop, hasHdop := ioUint(record, ioNames["gnssHdop"])
+		if last := device.last; last != nil && record.TimestampMs > last.TimestampMs {
+			if hasFix(record) && hasFix(last) {
+				meters := haversine(last.Lat, last.Lng, record.Lat, record.Lng)
+				hours := float64(record.TimestampMs-last.TimestampMs) / 3600000
+				if meters >= g.minJump && meters/1000/hours > g.maxSpeed {
+					reasons = append(reasons, "teleport")
+				}
+			}
+			if int(last.Satellites)-int(record.Satellites) >= g.satDrop && hasHdop && device.hasHdop && hdop == device.hdop {
+				reasons = append(reasons, "satellite_drop")
+			}
+		}
+		if device.last == nil || record.TimestampMs >= device.last.TimestampMs {
+			copied := *record
+			copied.Elements = nil
+			device.last = &copied
+			device.hdop, device.hasHdop = hdop, hasHdop
+		}
+
+		if len(reasons) == 0 {
+			continue
+		}
+		if attributes == nil {
+			attributes = make([]map[string]any, len(pkt.Data))
+		}
+		attributes[i] = map[string]any{"gnss_suspect": strings.Join(reasons, ",")}
+		for _, reason := range reasons {
+			gnssMetrics.Add(reason, 1)
+			if reason != "jamming" {
+				events = append(events, NewEvent("security.gnss_suspect", imei, record, map[string]any{"reason": reason}))
+			}
+		}
+	}
+	if len(events) > 0 && g.Publish != nil {
+		g.Publish(events...)
+	}
+	return attributes, nil
+}
+
+// Purge forgets the device (a Purger)
+func (g *GnssSecurity) Purge(imei string) (int, error) {
+	return purgeSyncMap(&g.devices, imei), nil
+}
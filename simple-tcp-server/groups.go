@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var groupsMetrics = expvar.NewMap("groups")
+
+// GroupsConfig: Groups are the initial groups (name -> imeis), the groups changed through the api are kept
+// in File (replacing the initial ones) if set
+type GroupsConfig struct {
+	File   string              `json:"file"`
+	Groups map[string][]string `json:"groups"`
+}
+
+// DeviceGroups holds named groups of devices, the groups of a device are its tags. They are usable as
+// selectors (DeviceSelector, filters, geofences, campaigns) through deviceGroups
+type DeviceGroups struct {
+	file   string
+	logger *Logger
+	mutex  sync.RWMutex
+	groups map[string]map[string]bool
+}
+
+// deviceGroups is the registry the selectors use, empty until main sets it
+var deviceGroups = &DeviceGroups{groups: make(map[string]map[string]bool)}
+
+func NewDeviceGroups(config *GroupsConfig, logger *Logger) (*DeviceGroups, error) {
+	if config == nil {
+		config = &GroupsConfig{}
+	}
+	g := &DeviceGroups{file: config.File, logger: logger, groups: make(map[string]map[string]bool)}
+	groups := config.Groups
+	if g.file != "" {
+		data, err := os.ReadFile(g.file)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("groups read error (%v)", err)
+		}
+		if err == nil {
+			groups = nil
+			if err = json.Unmarshal(data, &groups); err != nil {
+				return nil, fmt.Errorf("groups parse error (%v)", err)
+			}
+		}
+	}
+	for name, imeis := range groups {
+		if err := validGroupName(name); err != nil {
+			return nil, err
+		}
+		g.setLocked(name, imeis)
+	}
+	return g, nil
+}
+
+func validGroupName(name string) error {
+	if name == "" || strings.ContainsAny(name, "/ ") {
+		return fmt.Errorf("invalid group name '%s'", name)
+	}
+	return nil
+}
+
+// setLocked replaces the members of the group (removes the group if imeis is empty), the mutex must be held
+func (g *DeviceGroups) setLocked(name string, imeis []string) {
+	if len(imeis) == 0 {
+		delete(g.groups, name)
+		return
+	}
+	members := make(map[string]bool, len(imeis))
+	for _, imei := range imeis {
+		members[imei] = true
+	}
+	g.groups[name] = members
+}
+
+// Member reports whether the device is in one of the groups
+func (g *DeviceGroups) Member(imei string, groups []string) bool {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	for _, name := range groups {
+		if g.groups[name][imei] {
+			return true
+		}
+	}
+	return false
+}
+
+// Members returns the devices of the groups (sorted, without duplicates)
+func (g *DeviceGroups) Members(groups ...string) []string {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	set := make(map[string]bool)
+	for _, name := range groups {
+		for imei := range g.groups[name] {
+			set[imei] = true
+		}
+	}
+	return sortedSet(set)
+}
+
+// Tags returns the groups of the device (sorted)
+func (g *DeviceGroups) Tags(imei string) []string {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	tags := make([]string, 0)
+	for name, members := range g.groups {
+		if members[imei] {
+			tags = append(tags, name)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// SetTags makes the device a member of exactly the groups, creating the missing ones
+func (g *DeviceGroups) SetTags(imei string, tags []string) error {
+	for _, name := range tags {
+		if err := validGroupName(name); err != nil {
+			return err
+		}
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for name, members := range g.groups {
+		if !containsString(tags, name) {
+			delete(members, imei)
+			if len(members) == 0 {
+				delete(g.groups, name)
+			}
+		}
+	}
+	for _, name := range tags {
+		if g.groups[name] == nil {
+			g.groups[name] = make(map[string]bool)
+		}
+		g.groups[name][imei] = true
+	}
+	g.saveLocked()
+	return nil
+}
+
+// Count adds the records of a packet to the metrics of the groups of the device
+func (g *DeviceGroups) Count(imei string, pkt *teltonika.Packet) {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	for name, members := range g.groups {
+		if members[imei] {
+			groupsMetrics.Add(name+".packets", 1)
+			groupsMetrics.Add(name+".records", int64(len(pkt.Data)))
+		}
+	}
+}
+
+func (g *DeviceGroups) listLocked() map[string][]string {
+	list := make(map[string][]string, len(g.groups))
+	for name, members := range g.groups {
+		list[name] = sortedSet(members)
+	}
+	return list
+}
+
+// saveLocked writes the groups to the file, the mutex must be held
+func (g *DeviceGroups) saveLocked() {
+	if g.file == "" {
+		return
+	}
+	data, err := json.Marshal(g.listLocked())
+	if err == nil {
+		err = os.WriteFile(g.file, data, 0o644)
+	}
+	if err != nil {
+		g.logger.Error.Printf("groups save error (%v)", err)
+	}
+}
+
+func sortedSet(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ServeHTTP handles /groups: GET lists the groups, GET /groups/{name} lists the members,
+// PUT /groups/{name} replaces them (["352093081452251", ...]), DELETE /groups/{name} removes the group
+func (g *DeviceGroups) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/groups"), "/")
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		g.mutex.RLock()
+		defer g.mutex.RUnlock()
+		writeJson(w, http.StatusOK, g.listLocked())
+	case name == "":
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	case r.Method == http.MethodGet:
+		g.mutex.RLock()
+		defer g.mutex.RUnlock()
+		members, ok := g.groups[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeJson(w, http.StatusOK, sortedSet(members))
+	case r.Method == http.MethodPut:
+		var imeis []string
+		if err := json.NewDecoder(r.Body).Decode(&imeis); err != nil {
+			http.Error(w, "invalid group ("+err.Error()+")", http.StatusBadRequest)
+			return
+		}
+		if err := validGroupName(name); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		g.mutex.Lock()
+		defer g.mutex.Unlock()
+		g.setLocked(name, imeis)
+		g.saveLocked()
+		writeJson(w, http.StatusOK, sortedSet(g.groups[name]))
+	case r.Method == http.MethodDelete:
+		g.mutex.Lock()
+		defer g.mutex.Unlock()
+		if _, ok := g.groups[name]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		delete(g.groups, name)
+		g.saveLocked()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// ServeTags handles /devices/{imei}/tags: GET returns the groups of the device, PUT sets them (["vans", "north"])
+func (g *DeviceGroups) ServeTags(w http.ResponseWriter, r *http.Request, imei string) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJson(w, http.StatusOK, g.Tags(imei))
+	case http.MethodPut:
+		var tags []string
+		if err := json.NewDecoder(r.Body).Decode(&tags); err != nil {
+			http.Error(w, "invalid tags ("+err.Error()+")", http.StatusBadRequest)
+			return
+		}
+		if err := g.SetTags(imei, tags); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJson(w, http.StatusOK, g.Tags(imei))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
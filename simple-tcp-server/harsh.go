@@ -0,0 +1,170 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HarshProfile holds the thresholds (in g) for the devices with the imei prefixes or in the groups, ForwardAxis and LateralAxis
+// map the accelerometer IO (x, y, z, "-" inverts) to the vehicle axes, the accelerometer isn't used if they are empty
+type HarshProfile struct {
+	ImeiPrefixes  []string `json:"imeiPrefixes"`
+	Groups        []string `json:"groups"`
+	AccelerationG float64  `json:"accelerationG"`
+	BrakingG      float64  `json:"brakingG"`
+	CorneringG    float64  `json:"corneringG"`
+	ForwardAxis   string   `json:"forwardAxis"`
+	LateralAxis   string   `json:"lateralAxis"`
+}
+
+// HarshDrivingConfig: the top level profile is the default, Profiles override it for device models (first match wins)
+type HarshDrivingConfig struct {
+	HarshProfile
+	Profiles []*HarshProfile `json:"profiles"`
+}
+
+const (
+	greenDrivingAcceleration = 1
+	greenDrivingBraking      = 2
+	greenDrivingCornering    = 3
+)
+
+var harshEventTypes = map[int]string{
+	greenDrivingAcceleration: "driving.harsh_acceleration",
+	greenDrivingBraking:      "driving.harsh_braking",
+	greenDrivingCornering:    "driving.harsh_cornering",
+}
+
+// HarshDrivingDetector emits driving.harsh_* events from the green driving IO (253 type, 254 value in 0.01 g)
+// and from the accelerometer IO (17-19, mG), the same thresholds are applied to all device models,
+// so devices configured with lower thresholds don't flood the outputs
+type HarshDrivingDetector struct {
+	defaults *HarshProfile
+	profiles []*HarshProfile
+	cooldown time.Duration
+	last     sync.Map
+}
+
+func NewHarshDrivingDetector(config *HarshDrivingConfig) *HarshDrivingDetector {
+	h := &HarshDrivingDetector{
+		defaults: &HarshProfile{AccelerationG: 0.3, BrakingG: 0.35, CorneringG: 0.3},
+		cooldown: time.Second * 5,
+	}
+	if config == nil {
+		return h
+	}
+	h.defaults = withHarshDefaults(&config.HarshProfile, h.defaults)
+	for _, profile := range config.Profiles {
+		h.profiles = append(h.profiles, withHarshDefaults(profile, h.defaults))
+	}
+	return h
+}
+
+func withHarshDefaults(profile *HarshProfile, defaults *HarshProfile) *HarshProfile {
+	p := *profile
+	if p.AccelerationG <= 0 {
+		p.AccelerationG = defaults.AccelerationG
+	}
+	if p.BrakingG <= 0 {
+		p.BrakingG = defaults.BrakingG
+	}
+	if p.CorneringG <= 0 {
+		p.CorneringG = defaults.CorneringG
+	}
+	return &p
+}
+
+func (h *HarshDrivingDetector) profile(imei string) *HarshProfile {
+	for _, profile := range h.profiles {
+		if deviceGroups.Member(imei, profile.Groups) {
+			return profile
+		}
+		for _, prefix := range profile.ImeiPrefixes {
+			if strings.HasPrefix(imei, prefix) {
+				return profile
+			}
+		}
+	}
+	return h.defaults
+}
+
+func (h *HarshDrivingDetector) Process(imei string, pkt *teltonika.Packet) []*Event {
+	profile := h.profile(imei)
+	var events []*Event
+	for i := range pkt.Data {
+		record := &pkt.Data[i]
+		kind, g, source := 0, 0.0, ""
+		if drivingType, ok := ioUint(record, ioNames["greenDrivingType"]); ok && harshEventTypes[int(drivingType)] != "" {
+			value, _ := ioUint(record, ioNames["greenDrivingValue"])
+			kind, g, source = int(drivingType), float64(value)/100, "green_driving"
+		} else if kind, g = accelerometerHarsh(record, profile); kind != 0 {
+			source = "accelerometer"
+		}
+		if kind == 0 || g < profile.threshold(kind) {
+			continue
+		}
+
+		// one event per maneuver, devices report the same maneuver in several records
+		recordTime := time.UnixMilli(int64(record.TimestampMs))
+		key := imei + harshEventTypes[kind]
+		if last, ok := h.last.Load(key); ok {
+			if d := recordTime.Sub(last.(time.Time)); d < h.cooldown && d > -h.cooldown {
+				continue
+			}
+		}
+		h.last.Store(key, recordTime)
+		events = append(events, NewEvent(harshEventTypes[kind], imei, record, map[string]any{
+			"g":      math.Round(g*100) / 100,
+			"speed":  record.Speed,
+			"source": source,
+		}))
+	}
+	return events
+}
+
+func (p *HarshProfile) threshold(kind int) float64 {
+	switch kind {
+	case greenDrivingAcceleration:
+		return p.AccelerationG
+	case greenDrivingBraking:
+		return p.BrakingG
+	default:
+		return p.CorneringG
+	}
+}
+
+// accelerometerHarsh returns the strongest maneuver over the thresholds on the mapped axes
+func accelerometerHarsh(record *teltonika.Data, profile *HarshProfile) (int, float64) {
+	forward, okForward := accelerometerAxis(record, profile.ForwardAxis)
+	lateral, okLateral := accelerometerAxis(record, profile.LateralAxis)
+	kind, strongest := 0, 0.0
+	if okForward && forward >= profile.AccelerationG {
+		kind, strongest = greenDrivingAcceleration, forward
+	}
+	if okForward && -forward >= profile.BrakingG && -forward > strongest {
+		kind, strongest = greenDrivingBraking, -forward
+	}
+	if okLateral && math.Abs(lateral) >= profile.CorneringG && math.Abs(lateral) > strongest {
+		kind, strongest = greenDrivingCornering, math.Abs(lateral)
+	}
+	return kind, strongest
+}
+
+// accelerometerAxis reads the axis IO (signed mG) in g
+func accelerometerAxis(record *teltonika.Data, axis string) (float64, bool) {
+	sign := 1.0
+	if strings.HasPrefix(axis, "-") {
+		sign, axis = -1, axis[1:]
+	}
+	id, ok := ioNames["axis"+strings.ToUpper(axis)]
+	if axis == "" || !ok {
+		return 0, false
+	}
+	value, ok := ioUint(record, id)
+	if !ok {
+		return 0, false
+	}
+	return sign * float64(int16(uint16(value))) / 1000, true
+}
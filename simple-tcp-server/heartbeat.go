@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// heartbeatFrameSize is a data packet without records: the header, the codec id, the two record counts and the crc
+const heartbeatFrameSize = frameHeaderSize + 3 + 4
+
+// decodeHeartbeat decodes a data packet without records (codec 8, 8E or 16), the keepalive some firmwares send
+// instead of an empty connection. Those don't go through the decoder, they are acked with 0 records
+func decodeHeartbeat(frame []byte) (*teltonika.Packet, bool) {
+	if len(frame) != heartbeatFrameSize || binary.BigEndian.Uint32(frame[4:8]) != 3 {
+		return nil, false
+	}
+	codec := teltonika.CodecId(frame[8])
+	if codec != teltonika.Codec8 && codec != teltonika.Codec8E && codec != teltonika.Codec16 {
+		return nil, false
+	}
+	if frame[9] != 0 || frame[10] != 0 || binary.BigEndian.Uint32(frame[11:]) != uint32(crc16(frame[8:11])) {
+		return nil, false
+	}
+	return &teltonika.Packet{CodecID: codec, Data: []teltonika.Data{}}, true
+}
+
+// isHeartbeat tells if the packet is a data packet without records
+func isHeartbeat(pkt *teltonika.Packet) bool {
+	return len(pkt.Data) == 0 && len(pkt.Messages) == 0 &&
+		(pkt.CodecID == teltonika.Codec8 || pkt.CodecID == teltonika.Codec8E || pkt.CodecID == teltonika.Codec16)
+}
+
+// NewHeartbeatEvent is the "device.heartbeat" event of a data packet without records
+func NewHeartbeatEvent(imei string, codec teltonika.CodecId) *Event {
+	return &Event{
+		Type: "device.heartbeat",
+		Imei: imei,
+		Time: time.Now().UTC(),
+		Data: map[string]any{"codec": codecName(codec)},
+	}
+}
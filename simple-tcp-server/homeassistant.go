@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+)
+
+// HomeAssistantDiscovery builds retained MQTT discovery configs, a device_tracker
+// and a few sensors per imei plus a sensor for every IO element seen from the device
+type HomeAssistantDiscovery struct {
+	prefix    string
+	announced sync.Map
+}
+
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+}
+
+type haConfig struct {
+	Name                string    `json:"name"`
+	UniqueId            string    `json:"unique_id"`
+	StateTopic          string    `json:"state_topic,omitempty"`
+	ValueTemplate       string    `json:"value_template,omitempty"`
+	UnitOfMeasurement   string    `json:"unit_of_measurement,omitempty"`
+	JsonAttributesTopic string    `json:"json_attributes_topic,omitempty"`
+	SourceType          string    `json:"source_type,omitempty"`
+	Device              *haDevice `json:"device"`
+}
+
+func NewHomeAssistantDiscovery(prefix string) *HomeAssistantDiscovery {
+	return &HomeAssistantDiscovery{prefix: prefix}
+}
+
+func (h *HomeAssistantDiscovery) Announce(imei string, stateTopic string, record *teltonika.Data) []mqttMessage {
+	device := &haDevice{Identifiers: []string{imei}, Name: "Teltonika " + imei, Manufacturer: "Teltonika"}
+	messages := make([]mqttMessage, 0)
+
+	if h.markAnnounced(imei, "tracker") {
+		messages = append(messages, h.message("device_tracker", imei, "tracker", &haConfig{
+			Name:                "Location",
+			UniqueId:            imei + "_tracker",
+			JsonAttributesTopic: stateTopic,
+			SourceType:          "gps",
+			Device:              device,
+		}))
+		sensors := []struct{ key, name, unit string }{
+			{"speed", "Speed", "km/h"},
+			{"altitude", "Altitude", "m"},
+			{"satellites", "Satellites", ""},
+		}
+		for _, sensor := range sensors {
+			messages = append(messages, h.sensor(imei, sensor.key, sensor.name, sensor.unit, stateTopic, device))
+		}
+	}
+
+	for _, el := range record.Elements {
+		key := "io_" + strconv.Itoa(int(el.Id))
+		if h.markAnnounced(imei, key) {
+			messages = append(messages, h.sensor(imei, key, "IO "+strconv.Itoa(int(el.Id)), "", stateTopic, device))
+		}
+	}
+	return messages
+}
+
+func (h *HomeAssistantDiscovery) sensor(imei, key, name, unit, stateTopic string, device *haDevice) mqttMessage {
+	return h.message("sensor", imei, key, &haConfig{
+		Name:              name,
+		UniqueId:          imei + "_" + key,
+		StateTopic:        stateTopic,
+		ValueTemplate:     "{{ value_json." + key + " }}",
+		UnitOfMeasurement: unit,
+		Device:            device,
+	})
+}
+
+func (h *HomeAssistantDiscovery) message(component, imei, objectId string, config *haConfig) mqttMessage {
+	payload, _ := json.Marshal(config)
+	return mqttMessage{
+		topic:   h.prefix + "/" + component + "/" + imei + "/" + objectId + "/config",
+		payload: payload,
+		retain:  true,
+	}
+}
+
+func (h *HomeAssistantDiscovery) markAnnounced(imei string, key string) bool {
+	_, loaded := h.announced.LoadOrStore(imei+"/"+key, true)
+	return !loaded
+}
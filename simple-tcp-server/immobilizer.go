@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ImmobilizerConfig: Output is the digital output wired to the immobilizer relay (1 or 2, default 1). The device
+// is immobilized only if its last state is at most MaxStateAgeSeconds old (default 300) with a speed up to
+// MaxSpeedKmh (default 0) and, with RequireIgnitionOff, the ignition off. The output change must show up in
+// the records within ConfirmSeconds (default 120)
+type ImmobilizerConfig struct {
+	Output             int    `json:"output"`
+	MaxSpeedKmh        uint16 `json:"maxSpeedKmh"`
+	RequireIgnitionOff bool   `json:"requireIgnitionOff"`
+	MaxStateAgeSeconds int    `json:"maxStateAgeSeconds"`
+	ConfirmSeconds     int    `json:"confirmSeconds"`
+}
+
+// ImmobilizerResult reports an immobilize or release request, Status is confirmed or unconfirmed
+// (the command was sent but no record showed the output change in time)
+type ImmobilizerResult struct {
+	Action    string     `json:"action"`
+	Status    string     `json:"status"`
+	Command   string     `json:"command"`
+	Response  string     `json:"response"`
+	Confirmed *time.Time `json:"confirmed,omitempty"`
+}
+
+// Immobilizer drives the immobilizer output with the preconditions checked on the device state and watches
+// the records for the confirmation (Processor), Execute sends a command and waits for the response, Authorize
+// returns the operator of an api request (both set by the caller)
+type Immobilizer struct {
+	Execute   func(imei string, cmd string, timeout time.Duration, operator string) (string, error)
+	Authorize func(r *http.Request) (string, bool)
+	config    ImmobilizerConfig
+	state     *StateService
+	outputId  uint16
+	mutex     sync.Mutex
+	waiters   map[string][]*immobilizerWaiter
+}
+
+type immobilizerWaiter struct {
+	value uint64
+	after uint64
+	done  chan time.Time
+}
+
+func NewImmobilizer(config *ImmobilizerConfig, state *StateService) (*Immobilizer, error) {
+	i := &Immobilizer{state: state, waiters: make(map[string][]*immobilizerWaiter)}
+	if config != nil {
+		i.config = *config
+	}
+	if i.config.Output == 0 {
+		i.config.Output = 1
+	}
+	if i.config.Output < 1 || i.config.Output > 2 {
+		return nil, fmt.Errorf("immobilizer output must be 1 or 2")
+	}
+	if i.config.MaxStateAgeSeconds <= 0 {
+		i.config.MaxStateAgeSeconds = 300
+	}
+	if i.config.ConfirmSeconds <= 0 {
+		i.config.ConfirmSeconds = 120
+	}
+	i.outputId = ioNames["digitalOutput"+strconv.Itoa(i.config.Output)]
+	return i, nil
+}
+
+func (i *Immobilizer) Process(imei string, pkt *teltonika.Packet) []*Event {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	waiters := i.waiters[imei]
+	if len(waiters) == 0 {
+		return nil
+	}
+	remaining := waiters[:0]
+	for _, waiter := range waiters {
+		confirmed := false
+		for n := range pkt.Data {
+			record := &pkt.Data[n]
+			value, ok := ioUint(record, i.outputId)
+			if ok && value == waiter.value && record.TimestampMs >= waiter.after {
+				waiter.done <- time.UnixMilli(int64(record.TimestampMs)).UTC()
+				confirmed = true
+				break
+			}
+		}
+		if !confirmed {
+			remaining = append(remaining, waiter)
+		}
+	}
+	i.waiters[imei] = remaining
+	return nil
+}
+
+// check verifies the preconditions on the last state of the device
+func (i *Immobilizer) check(imei string) error {
+	state, err := i.state.State(imei)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return fmt.Errorf("no state of the device")
+	}
+	age := time.Since(time.UnixMilli(int64(state.TimestampMs)))
+	if age > time.Duration(i.config.MaxStateAgeSeconds)*time.Second {
+		return fmt.Errorf("device state is %s old", age.Truncate(time.Second))
+	}
+	if state.Speed > i.config.MaxSpeedKmh {
+		return fmt.Errorf("device moves at %d km/h", state.Speed)
+	}
+	if i.config.RequireIgnitionOff {
+		ignition, ok := state.IO[strconv.Itoa(int(ioNames["ignition"]))]
+		if !ok || fmt.Sprint(ignition) != "0" {
+			return fmt.Errorf("ignition isn't off")
+		}
+	}
+	return nil
+}
+
+// Set immobilizes (on true, after the precondition check) or releases the vehicle for the operator and waits for
+// the confirmation
+func (i *Immobilizer) Set(imei string, on bool, operator string) (*ImmobilizerResult, error) {
+	action, value := "release", uint64(0)
+	if on {
+		action, value = "immobilize", 1
+		if err := i.check(imei); err != nil {
+			return nil, &preconditionError{err}
+		}
+	}
+	states := strings.Repeat("?", i.config.Output-1) + strconv.Itoa(int(value))
+	command, err := SetDigoutCommand(states)
+	if err != nil {
+		return nil, err
+	}
+
+	waiter := &immobilizerWaiter{value: value, after: uint64(time.Now().UnixMilli()), done: make(chan time.Time, 1)}
+	i.mutex.Lock()
+	i.waiters[imei] = append(i.waiters[imei], waiter)
+	i.mutex.Unlock()
+	defer i.removeWaiter(imei, waiter)
+
+	result := &ImmobilizerResult{Action: action, Status: "unconfirmed", Command: command.Text()}
+	if result.Response, err = i.Execute(imei, command.Text(), time.Minute, operator); err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(time.Duration(i.config.ConfirmSeconds) * time.Second)
+	defer timer.Stop()
+	select {
+	case confirmed := <-waiter.done:
+		result.Status, result.Confirmed = "confirmed", &confirmed
+	case <-timer.C:
+	}
+	return result, nil
+}
+
+func (i *Immobilizer) removeWaiter(imei string, waiter *immobilizerWaiter) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	waiters := i.waiters[imei]
+	for n, w := range waiters {
+		if w == waiter {
+			i.waiters[imei] = append(waiters[:n], waiters[n+1:]...)
+			break
+		}
+	}
+	if len(i.waiters[imei]) == 0 {
+		delete(i.waiters, imei)
+	}
+}
+
+type preconditionError struct {
+	err error
+}
+
+func (e *preconditionError) Error() string {
+	return "precondition failed: " + e.err.Error()
+}
+
+// ServeHTTP handles /devices/{imei}/immobilize: POST immobilizes, DELETE releases, both respond
+// with the result once confirmed or after the confirmation timeout
+func (i *Immobilizer) ServeHTTP(w http.ResponseWriter, r *http.Request, imei string) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	operator, ok := authorize(w, r, i.Authorize)
+	if !ok {
+		return
+	}
+	result, err := i.Set(imei, r.Method == http.MethodPost, operator)
+	if _, ok := err.(*preconditionError); ok {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	status := http.StatusOK
+	if result.Status != "confirmed" {
+		status = http.StatusGatewayTimeout
+	}
+	writeJson(w, status, result)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ioNames maps common FMB AVL IDs to names usable in config (filters, rules, templates)
+var ioNames = map[string]uint16{
+	"digitalInput1":      1,
+	"digitalInput2":      2,
+	"digitalInput3":      3,
+	"analogInput1":       9,
+	"fuelUsedGps":        12,
+	"fuelRateGps":        13,
+	"ecoScore":           15,
+	"totalOdometer":      16,
+	"axisX":              17,
+	"axisY":              18,
+	"axisZ":              19,
+	"gsmSignal":          21,
+	"bleTemperature1":    25,
+	"bleTemperature2":    26,
+	"bleTemperature3":    27,
+	"bleTemperature4":    28,
+	"externalVoltage":    66,
+	"batteryVoltage":     67,
+	"batteryCurrent":     68,
+	"gnssStatus":         69,
+	"iButton":            78,
+	"bleHumidity1":       86,
+	"fuelLevel":          89,
+	"bleHumidity2":       104,
+	"bleHumidity3":       106,
+	"bleHumidity4":       108,
+	"digitalOutput1":     179,
+	"digitalOutput2":     180,
+	"gnssPdop":           181,
+	"gnssHdop":           182,
+	"tripOdometer":       199,
+	"sleepMode":          200,
+	"fuelLevelLls1":      201,
+	"fuelTemperatureLls": 202,
+	"rfid":               207,
+	"ignition":           239,
+	"movement":           240,
+	"activeGsmOperator":  241,
+	"towing":             246,
+	"crashDetection":     247,
+	"jamming":            249,
+	"idling":             251,
+	"unplug":             252,
+	"greenDrivingType":   253,
+	"greenDrivingValue":  254,
+	"overSpeeding":       255,
+	"crashTraceData":     257,
+	"instantMovement":    303,
+	"gnssJamming":        318,
+}
+
+// ioSigned are the IO elements with a signed value: the accelerometer axes (mG) and the temperatures
+var ioSigned = map[uint16]bool{17: true, 18: true, 19: true, 25: true, 26: true, 27: true, 28: true, 202: true}
+
+// ioNumber reads the value of the element as a number, sign extended for the signed elements
+func ioNumber(id uint16, value []byte) (float64, bool) {
+	if ioSigned[id] {
+		v, ok := ioElementInt(value)
+		return float64(v), ok
+	}
+	v, ok := ioElementUint(value)
+	return float64(v), ok
+}
+
+func ioIdByName(name string) (uint16, bool) {
+	if id, ok := ioNames[name]; ok {
+		return id, true
+	}
+	if strings.HasPrefix(name, "io_") {
+		id, err := strconv.ParseUint(strings.TrimPrefix(name, "io_"), 10, 16)
+		return uint16(id), err == nil
+	}
+	return 0, false
+}
+
+// ioName returns the name of the AVL id, io_<id> if it has none
+func ioName(id uint16) string {
+	for name, nameId := range ioNames {
+		if nameId == id {
+			return name
+		}
+	}
+	return "io_" + strconv.Itoa(int(id))
+}
+
+func findElement(record *teltonika.Data, id uint16) ([]byte, bool) {
+	for _, el := range record.Elements {
+		if el.Id == id {
+			return el.Value, true
+		}
+	}
+	return nil, false
+}
+
+// IOIndex looks up the IO elements of a record by id with a binary search, built once per record for the consumers
+// looking up many elements of the same record (several alert conditions) instead of scanning the elements each time.
+// The values aren't copied, the index is valid as long as the record
+type IOIndex struct {
+	elements []teltonika.IOElement
+}
+
+func NewIOIndex(record *teltonika.Data) *IOIndex {
+	elements := append([]teltonika.IOElement(nil), record.Elements...)
+	sort.SliceStable(elements, func(i, j int) bool { return elements[i].Id < elements[j].Id })
+	return &IOIndex{elements: elements}
+}
+
+// Get returns the value of the element, the first one if the record has the id twice (like findElement)
+func (x *IOIndex) Get(id uint16) ([]byte, bool) {
+	i := sort.Search(len(x.elements), func(i int) bool { return x.elements[i].Id >= id })
+	if i < len(x.elements) && x.elements[i].Id == id {
+		return x.elements[i].Value, true
+	}
+	return nil, false
+}
+
+func (x *IOIndex) Uint(id uint16) (uint64, bool) {
+	value, ok := x.Get(id)
+	if !ok {
+		return 0, false
+	}
+	return ioElementUint(value)
+}
+
+func ioUint(record *teltonika.Data, id uint16) (uint64, bool) {
+	value, ok := findElement(record, id)
+	if !ok {
+		return 0, false
+	}
+	return ioElementUint(value)
+}
+
+func priorityName(priority uint8) string {
+	switch priority {
+	case 0:
+		return "low"
+	case 1:
+		return "high"
+	case 2:
+		return "panic"
+	default:
+		return strconv.Itoa(int(priority))
+	}
+}
+
+func codecName(codec teltonika.CodecId) string {
+	if codec == teltonika.Codec8E {
+		return "8E"
+	}
+	return strconv.Itoa(int(codec))
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+)
+
+var ioParserMetrics = expvar.NewMap("ioParsers")
+
+// IOParserConfig: a parser of the IO element Id (a proprietary sensor on an ADC or RS232 input, ...), the typed value
+// is attached to the records as the Name attribute. Type is "int" (signed), "uint", "float" (IEEE 754, 4 or 8
+// bytes), "ascii" or "hex", the numbers are Scale (default 1) * value + Offset. Quantity ("distance" in km, "volume"
+// in l, "temperature" in °C) converts the number to the unit profile of the device (see UnitsConfig)
+type IOParserConfig struct {
+	Id       uint16  `json:"id"`
+	Name     string  `json:"name"`
+	Type     string  `json:"type"`
+	Scale    float64 `json:"scale"`
+	Offset   float64 `json:"offset"`
+	Quantity string  `json:"quantity"`
+}
+
+// IOParser decodes the raw value of an IO element (big endian, as the device sent it)
+type IOParser func(value []byte) (any, error)
+
+// IOParserRegistry holds the parsers of the IO elements by AVL id, it's a RecordEnricher run by the enrich stage
+type IOParserRegistry struct {
+	mutex   sync.RWMutex
+	parsers map[uint16]*ioParser
+}
+
+type ioParser struct {
+	name     string
+	parse    IOParser
+	quantity string
+}
+
+// ioParsers is the registry of the server, the parsers of the config and of RegisterIOParser
+var ioParsers = NewIOParserRegistry()
+
+func NewIOParserRegistry() *IOParserRegistry {
+	return &IOParserRegistry{parsers: make(map[uint16]*ioParser)}
+}
+
+// RegisterIOParser adds a parser written in Go: a file added to this package registers its parsers from init(),
+// the codec package stays as is. A parser of the config for the same id replaces it
+func RegisterIOParser(id uint16, name string, parse IOParser) {
+	ioParsers.Register(id, name, parse)
+}
+
+func (r *IOParserRegistry) Register(id uint16, name string, parse IOParser) {
+	r.register(id, &ioParser{name: name, parse: parse})
+}
+
+func (r *IOParserRegistry) register(id uint16, parser *ioParser) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.parsers[id] = parser
+}
+
+// Configure registers the parsers of the config
+func (r *IOParserRegistry) Configure(configs []*IOParserConfig) error {
+	for _, config := range configs {
+		if config.Name == "" {
+			return fmt.Errorf("io parser %d requires name", config.Id)
+		}
+		if _, ok := unitNames[config.Quantity]; config.Quantity != "" && !ok {
+			return fmt.Errorf("io parser '%s': unknown quantity '%s'", config.Name, config.Quantity)
+		}
+		parse, err := newConfigIOParser(config)
+		if err != nil {
+			return err
+		}
+		r.register(config.Id, &ioParser{name: config.Name, parse: parse, quantity: config.Quantity})
+	}
+	return nil
+}
+
+func (r *IOParserRegistry) Len() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return len(r.parsers)
+}
+
+// EnrichRecord attaches the parsed values of the elements of the record, a value that doesn't parse is left out
+func (r *IOParserRegistry) EnrichRecord(imei string, record *teltonika.Data) (map[string]any, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	var values map[string]any
+	var firstErr error
+	var profile *UnitProfile
+	profiled := false
+	for _, el := range record.Elements {
+		parser, ok := r.parsers[el.Id]
+		if !ok {
+			continue
+		}
+		value, err := parser.parse(el.Value)
+		if err != nil {
+			ioParserMetrics.Add("errors", 1)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("io parser '%s' error (%v)", parser.name, err)
+			}
+			continue
+		}
+		if number, ok := numberValue(value); ok && parser.quantity != "" {
+			if !profiled {
+				profile, profiled = unitProfiles.Profile(imei), true
+			}
+			if profile != nil {
+				value = profile.Convert(parser.quantity, number)
+			}
+		}
+		if values == nil {
+			values = make(map[string]any)
+		}
+		values[parser.name] = value
+		ioParserMetrics.Add("parsed", 1)
+	}
+	return values, firstErr
+}
+
+func newConfigIOParser(config *IOParserConfig) (IOParser, error) {
+	scale := config.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	scaled := scale != 1 || config.Offset != 0
+	number := func(v float64) any {
+		return v*scale + config.Offset
+	}
+	switch config.Type {
+	case "int":
+		return func(value []byte) (any, error) {
+			if len(value) == 0 || len(value) > 8 {
+				return nil, fmt.Errorf("%d bytes int", len(value))
+			}
+			signed, _ := ioElementInt(value)
+			if !scaled {
+				return signed, nil
+			}
+			return number(float64(signed)), nil
+		}, nil
+	case "", "uint":
+		return func(value []byte) (any, error) {
+			v, ok := ioElementUint(value)
+			if !ok || len(value) == 0 {
+				return nil, fmt.Errorf("%d bytes uint", len(value))
+			}
+			if !scaled {
+				return v, nil
+			}
+			return number(float64(v)), nil
+		}, nil
+	case "float":
+		return func(value []byte) (any, error) {
+			switch len(value) {
+			case 4:
+				return number(float64(math.Float32frombits(binary.BigEndian.Uint32(value)))), nil
+			case 8:
+				return number(math.Float64frombits(binary.BigEndian.Uint64(value))), nil
+			}
+			return nil, fmt.Errorf("%d bytes float", len(value))
+		}, nil
+	case "ascii":
+		return func(value []byte) (any, error) {
+			return strings.TrimRight(string(value), "\x00 "), nil
+		}, nil
+	case "hex":
+		return func(value []byte) (any, error) {
+			return hex.EncodeToString(value), nil
+		}, nil
+	}
+	return nil, fmt.Errorf("io parser '%s': unknown type '%s'", config.Name, config.Type)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"strconv"
+	"time"
+)
+
+// AppendPacketJson appends the json of the packet to buf, the same json as json.Marshal of the packet without the
+// reflection (the packet is logged for every frame)
+func AppendPacketJson(buf []byte, packet *teltonika.Packet) []byte {
+	buf = append(buf, `{"codecId":`...)
+	buf = strconv.AppendUint(buf, uint64(packet.CodecID), 10)
+	if len(packet.Data) > 0 {
+		buf = append(buf, `,"data":[`...)
+		for i := range packet.Data {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = appendRecordJson(buf, &packet.Data[i])
+		}
+		buf = append(buf, ']')
+	}
+	if len(packet.Messages) > 0 {
+		buf = append(buf, `,"messages":[`...)
+		for i, msg := range packet.Messages {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = append(buf, '{')
+			if msg.Timestamp != 0 {
+				buf = append(buf, `"timestamp":`...)
+				buf = strconv.AppendUint(buf, uint64(msg.Timestamp), 10)
+				buf = append(buf, ',')
+			}
+			buf = append(buf, `"type":`...)
+			buf = strconv.AppendUint(buf, uint64(msg.Type), 10)
+			if msg.Imei != "" {
+				buf = append(buf, `,"imei":`...)
+				buf = appendJsonString(buf, msg.Imei)
+			}
+			buf = append(buf, `,"text":`...)
+			buf = appendJsonString(buf, msg.Text)
+			buf = append(buf, '}')
+		}
+		buf = append(buf, ']')
+	}
+	return append(buf, '}')
+}
+
+func appendRecordJson(buf []byte, record *teltonika.Data) []byte {
+	buf = append(buf, `{"timestampMs":`...)
+	buf = strconv.AppendUint(buf, record.TimestampMs, 10)
+	buf = append(buf, `,"lng":`...)
+	buf = appendJsonFloat(buf, record.Lng)
+	buf = append(buf, `,"lat":`...)
+	buf = appendJsonFloat(buf, record.Lat)
+	buf = append(buf, `,"altitude":`...)
+	buf = strconv.AppendInt(buf, int64(record.Altitude), 10)
+	buf = append(buf, `,"angle":`...)
+	buf = strconv.AppendUint(buf, uint64(record.Angle), 10)
+	buf = append(buf, `,"event_id":`...)
+	buf = strconv.AppendUint(buf, uint64(record.EventID), 10)
+	buf = append(buf, `,"speed":`...)
+	buf = strconv.AppendUint(buf, uint64(record.Speed), 10)
+	buf = append(buf, `,"satellites":`...)
+	buf = strconv.AppendUint(buf, uint64(record.Satellites), 10)
+	buf = append(buf, `,"priority":`...)
+	buf = strconv.AppendUint(buf, uint64(record.Priority), 10)
+	buf = append(buf, `,"generationType":`...)
+	buf = strconv.AppendUint(buf, uint64(record.GenerationType), 10)
+	buf = append(buf, `,"elements":`...)
+	if record.Elements == nil {
+		return append(buf, "null}"...)
+	}
+	buf = append(buf, '[')
+	for i, el := range record.Elements {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, `{"id":`...)
+		buf = strconv.AppendUint(buf, uint64(el.Id), 10)
+		buf = append(buf, `,"value":`...)
+		buf = appendJsonBytes(buf, el.Value)
+		buf = append(buf, '}')
+	}
+	return append(buf, "]}"...)
+}
+
+// appendJsonString appends the quoted string, the strings needing escapes go through encoding/json
+func appendJsonString(buf []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c >= 0x80 || c == '"' || c == '\\' || c == '<' || c == '>' || c == '&' {
+			quoted, _ := json.Marshal(s)
+			return append(buf, quoted...)
+		}
+	}
+	buf = append(buf, '"')
+	buf = append(buf, s...)
+	return append(buf, '"')
+}
+
+// appendJsonFloat formats like encoding/json, the exponent form (out of the coordinate range) goes through it
+func appendJsonFloat(buf []byte, f float64) []byte {
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) || math.IsNaN(f) || math.IsInf(f, 0) {
+		encoded, err := json.Marshal(f)
+		if err != nil {
+			return append(buf, "null"...)
+		}
+		return append(buf, encoded...)
+	}
+	return strconv.AppendFloat(buf, f, 'f', -1, 64)
+}
+
+// appendJsonBytes appends the bytes as a base64 string like encoding/json, null for nil
+func appendJsonBytes(buf []byte, bs []byte) []byte {
+	if bs == nil {
+		return append(buf, "null"...)
+	}
+	buf = append(buf, '"')
+	n := len(buf)
+	buf = append(buf, make([]byte, base64.StdEncoding.EncodedLen(len(bs)))...)
+	base64.StdEncoding.Encode(buf[n:], bs)
+	return append(buf, '"')
+}
+
+// appendGpsFrameJson appends a frame of the hook json (buildJsonPacket), the attributes (rare) are merged in key
+// order and go through encoding/json
+func appendGpsFrameJson(buf []byte, record *teltonika.Data, attributes map[string]any) []byte {
+	if len(attributes) == 0 {
+		buf = append(buf, `{"lat":`...)
+		buf = appendJsonFloat(buf, record.Lat)
+		buf = append(buf, `,"lon":`...)
+		buf = appendJsonFloat(buf, record.Lng)
+		buf = append(buf, `,"timestamp":`...)
+		buf = strconv.AppendInt(buf, int64(record.TimestampMs/1000), 10)
+		return append(buf, '}')
+	}
+	frame := map[string]any{"lat": record.Lat, "lon": record.Lng, "timestamp": int64(record.TimestampMs / 1000)}
+	for k, v := range attributes {
+		frame[k] = v
+	}
+	encoded, err := json.Marshal(frame)
+	if err != nil {
+		return append(buf, "{}"...)
+	}
+	return append(buf, encoded...)
+}
+
+// appendHookJson appends the hook json of the packet (see buildJsonPacket)
+func appendHookJson(buf []byte, imei string, pkt *AnnotatedPacket, now time.Time) []byte {
+	buf = append(buf, `{`...)
+	if pkt.Backfill {
+		buf = append(buf, `"backfill":true,`...)
+	}
+	buf = append(buf, `"deveui":`...)
+	buf = appendJsonString(buf, imei)
+	buf = append(buf, `,"frames":{"gps":[`...)
+	for i := range pkt.Data {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = appendGpsFrameJson(buf, &pkt.Data[i], pkt.RecordAttributes(i))
+	}
+	buf = append(buf, "]}"...)
+	if pkt.Key != "" {
+		buf = append(buf, `,"key":`...)
+		buf = appendJsonString(buf, pkt.Key)
+	}
+	buf = append(buf, `,"time":`...)
+	buf = appendJsonString(buf, now.String())
+	return append(buf, '}')
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var lifecycleMetrics = expvar.NewMap("lifecycle")
+
+// RetentionConfig: Days is how long the stores keep the data of the devices, by store name ("recorder",
+// "deadLetter", "commands", "audit", ...), the expired data is removed every hour. The stores without retention keep
+// their data until it's purged (DELETE /devices/{imei}/data) or, for the caches, replaced
+type RetentionConfig struct {
+	Days map[string]int `json:"days"`
+}
+
+// Purger is implemented by the stores and caches holding data of the devices, Purge removes the data of the device
+// and returns the number of items removed
+type Purger interface {
+	Purge(imei string) (int, error)
+}
+
+// Expirer is implemented by the stores with a retention, ExpireBefore removes the data older than before and returns
+// the number of items removed
+type Expirer interface {
+	ExpireBefore(before time.Time) (int, error)
+}
+
+// DataLifecycle purges the data of a device from every registered store and applies the retention of the stores.
+// A purge is written to Audit and published as a device.purged event, so the sinks can purge their copies too
+type DataLifecycle struct {
+	retention map[string]time.Duration
+	logger    *Logger
+	mutex     sync.Mutex
+	names     []string
+	stores    map[string]any
+	Audit     *AuditLog
+	Authorize func(r *http.Request) (string, bool)
+	Publish   func(events ...*Event)
+}
+
+func NewDataLifecycle(config *RetentionConfig, logger *Logger) *DataLifecycle {
+	l := &DataLifecycle{retention: make(map[string]time.Duration), logger: logger, stores: make(map[string]any)}
+	if config != nil {
+		for name, days := range config.Days {
+			if days > 0 {
+				l.retention[name] = time.Duration(days) * time.Hour * 24
+			}
+		}
+	}
+	go func() {
+		for range time.Tick(time.Hour) {
+			l.Expire(time.Now())
+		}
+	}()
+	return l
+}
+
+// Register adds a store, a Purger, an Expirer or both
+func (l *DataLifecycle) Register(name string, store any) {
+	_, purger := store.(Purger)
+	_, expirer := store.(Expirer)
+	if !purger && !expirer {
+		panic(fmt.Errorf("store '%s' is neither a Purger nor an Expirer", name))
+	}
+	if _, ok := l.retention[name]; ok && !expirer {
+		l.logger.Error.Printf("store '%s' has no retention, its retention days are ignored", name)
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, ok := l.stores[name]; !ok {
+		l.names = append(l.names, name)
+	}
+	l.stores[name] = store
+}
+
+// Purge removes the data of the device from every store, the result is the number of items removed by store. The
+// stores failing don't stop the others, the error names them
+func (l *DataLifecycle) Purge(imei string) (map[string]int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	removed := make(map[string]int)
+	var failed []string
+	for _, name := range l.names {
+		purger, ok := l.stores[name].(Purger)
+		if !ok {
+			continue
+		}
+		n, err := purger.Purge(imei)
+		removed[name] = n
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	lifecycleMetrics.Add("purges", 1)
+	if len(failed) > 0 {
+		lifecycleMetrics.Add("purgeErrors", 1)
+		return removed, fmt.Errorf("purge error (%s)", strings.Join(failed, ", "))
+	}
+	return removed, nil
+}
+
+// Expire applies the retention of the stores
+func (l *DataLifecycle) Expire(now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, name := range l.names {
+		retention, ok := l.retention[name]
+		expirer, isExpirer := l.stores[name].(Expirer)
+		if !ok || !isExpirer {
+			continue
+		}
+		n, err := expirer.ExpireBefore(now.Add(-retention))
+		lifecycleMetrics.Add("expired", int64(n))
+		if err != nil {
+			l.logger.Error.Printf("%s retention error (%v)", name, err)
+		} else if n > 0 {
+			l.logger.Info.Printf("%s retention: %d items expired", name, n)
+		}
+	}
+}
+
+// ServeHTTP handles DELETE /devices/{imei}/data, the response is the number of items removed by store
+// ({"imei": "...", "removed": {"recorder": 120, ...}}), 500 with the error if a store failed
+func (l *DataLifecycle) ServeHTTP(w http.ResponseWriter, r *http.Request, imei string) {
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	operator, ok := authorize(w, r, l.Authorize)
+	if !ok {
+		return
+	}
+	removed, err := l.Purge(imei)
+
+	names := make([]string, 0, len(removed))
+	for name := range removed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	summary := make([]string, len(names))
+	for i, name := range names {
+		summary[i] = fmt.Sprintf("%s: %d", name, removed[name])
+	}
+	entry := &AuditEntry{Time: time.Now().UTC(), Kind: "purge", Imei: imei, Operator: operator, Channel: "api",
+		Status: "purged", Text: strings.Join(summary, ", ")}
+	if err != nil {
+		entry.Status, entry.Error = "failed", err.Error()
+	}
+	if l.Audit != nil {
+		l.Audit.Write(entry)
+	}
+	l.logger.Info.Printf("[%s]: data purged by '%s' (%s)", imei, operator, entry.Text)
+	if l.Publish != nil {
+		l.Publish(&Event{Type: "device.purged", Imei: imei, Time: entry.Time, Data: map[string]any{"removed": removed}})
+	}
+
+	if err != nil {
+		writeJson(w, http.StatusInternalServerError, map[string]any{"imei": imei, "removed": removed, "error": err.Error()})
+		return
+	}
+	writeJson(w, http.StatusOK, map[string]any{"imei": imei, "removed": removed})
+}
+
+// purgeSyncMap forgets the device in a map of the devices
+func purgeSyncMap(devices *sync.Map, imei string) int {
+	if _, ok := devices.LoadAndDelete(imei); ok {
+		return 1
+	}
+	return 0
+}
+
+// rewriteJsonLines rewrites a json lines file without the lines drop tells, the file is replaced once it's written
+func rewriteJsonLines(path string, drop func(line []byte) bool) (int, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%s open error (%v)", path, err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	tmp, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return 0, fmt.Errorf("%s open error (%v)", path, err)
+	}
+	writer := bufio.NewWriter(tmp)
+	removed := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		if drop(scanner.Bytes()) {
+			removed++
+			continue
+		}
+		_, _ = writer.Write(scanner.Bytes())
+		_ = writer.WriteByte('\n')
+	}
+	if err = scanner.Err(); err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || removed == 0 {
+		_ = os.Remove(path + ".tmp")
+		if err != nil {
+			return 0, fmt.Errorf("%s rewrite error (%v)", path, err)
+		}
+		return 0, nil
+	}
+	if err = os.Rename(path+".tmp", path); err != nil {
+		return 0, fmt.Errorf("%s rewrite error (%v)", path, err)
+	}
+	return removed, nil
+}
+
+// lineOf tells if the json line has the imei, the lines that don't parse are kept
+func lineOf(imei string) func(line []byte) bool {
+	return func(line []byte) bool {
+		var item struct {
+			Imei string `json:"imei"`
+		}
+		return json.Unmarshal(line, &item) == nil && item.Imei == imei
+	}
+}
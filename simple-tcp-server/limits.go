@@ -0,0 +1,78 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+)
+
+var limitsMetrics = expvar.NewMap("limits")
+
+// LimitsConfig: the limits of the packets of the devices. MaxPacketBytes is the max tcp frame size (-max-packet-size
+// if 0), MaxRecords the max records of a data packet (no limit if 0, the codecs allow 255) and MaxIoElementBytes the
+// max size of an IO element value (no limit if 0, codec 8E and 16 variable size elements can be up to 65535 bytes).
+// MaxConnectionBytes is the max memory of a tcp connection (no limit if 0): the bytes it read and holds and its
+// packets waiting in the pipeline workers. A tcp device exceeding a limit is disconnected unanswered, the udp packet
+// is dropped
+type LimitsConfig struct {
+	MaxPacketBytes     int `json:"maxPacketBytes"`
+	MaxRecords         int `json:"maxRecords"`
+	MaxIoElementBytes  int `json:"maxIoElementBytes"`
+	MaxConnectionBytes int `json:"maxConnectionBytes"`
+}
+
+// LimitError is returned for a packet exceeding a limit, Limit is "packet", "records", "ioElement" or "connection"
+type LimitError struct {
+	Limit string
+	Value int
+	Max   int
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s limit exceeded (%d, max %d)", e.Limit, e.Value, e.Max)
+}
+
+func limitError(limit string, value int, max int) *LimitError {
+	limitsMetrics.Add(limit, 1)
+	return &LimitError{Limit: limit, Value: value, Max: max}
+}
+
+// CheckFrame checks the record count of a tcp data packet before it is decoded
+func (l *LimitsConfig) CheckFrame(frame []byte) error {
+	if l.MaxRecords <= 0 || len(frame) < frameHeaderSize+2 {
+		return nil
+	}
+	switch codec := frame[frameHeaderSize]; codec {
+	case byte(teltonika.Codec8), byte(teltonika.Codec8E), byte(teltonika.Codec16):
+		if records := int(frame[frameHeaderSize+1]); records > l.MaxRecords {
+			return limitError("records", records, l.MaxRecords)
+		}
+	}
+	return nil
+}
+
+// CheckPacket checks the records and the IO element values of a decoded packet, with the values referenced from
+// the read buffer nothing was copied yet
+func (l *LimitsConfig) CheckPacket(packet *teltonika.Packet) error {
+	if l.MaxRecords > 0 && len(packet.Data) > l.MaxRecords {
+		return limitError("records", len(packet.Data), l.MaxRecords)
+	}
+	if l.MaxIoElementBytes <= 0 {
+		return nil
+	}
+	for _, record := range packet.Data {
+		for _, el := range record.Elements {
+			if len(el.Value) > l.MaxIoElementBytes {
+				return limitError("ioElement", len(el.Value), l.MaxIoElementBytes)
+			}
+		}
+	}
+	return nil
+}
+
+// CheckConnection checks the memory of a connection, the buffered and the queued bytes
+func (l *LimitsConfig) CheckConnection(buffered int64, queued int64) error {
+	if l.MaxConnectionBytes > 0 && buffered+queued > int64(l.MaxConnectionBytes) {
+		return limitError("connection", int(buffered+queued), l.MaxConnectionBytes)
+	}
+	return nil
+}
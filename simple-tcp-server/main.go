@@ -1,23 +1,31 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var decodeConfig = &teltonika.DecodeConfig{IoElementsAlloc: teltonika.OnReadBuffer}
 
+var tcpMetrics = expvar.NewMap("tcp")
+
 type Logger struct {
 	Info  *log.Logger
 	Error *log.Logger
@@ -26,20 +34,102 @@ type Logger struct {
 type TrackersHub interface {
 	SendPacket(imei string, packet *teltonika.Packet) error
 	ListClients() []*TCPClient
+	Kick(imei string) bool
 }
 
 type TCPServer struct {
 	address   string
 	clients   sync.Map
 	logger    *Logger
-	OnPacket  func(imei string, pkt *teltonika.Packet)
-	OnClose   func(imei string)
+	mutex     sync.Mutex
+	listener  net.Listener
+	closing   bool
+	sessions  sync.WaitGroup
+	OnPacket  func(imei string, pkt *teltonika.Packet) error
+	OnClose   func(imei string, reason string)
 	OnConnect func(imei string)
+	// OnError is called for the decode errors of a connected device and the panics of the callbacks (optional)
+	OnError func(imei string, err error)
+	// Accept decides if the device may connect (all devices if nil), a rejected device is answered 0 and disconnected
+	Accept func(imei string, address string) bool
+	// TLS enables tls on the listener, VerifyIdentity checks the imei against the tls connection (optional),
+	// a device failing the check is rejected like by Accept
+	TLS            *tls.Config
+	VerifyIdentity func(imei string, state *tls.ConnectionState) error
+	// Proxy forwards the raw stream to an upstream platform, the device gets the upstream answers (optional)
+	Proxy *UpstreamProxy
+	// OnFrame gets the raw frames of the device as read, before decoding (optional), the frame must not be retained
+	OnFrame func(imei string, frame []byte)
+	// Limits bound the packets of the devices, MaxPacketBytes is checked before the frame is read (defaultMaxPacketSize
+	// if 0), the records before the packet is decoded, the memory of the connection after the packet is handled
+	Limits LimitsConfig
+	// Queued returns the bytes of the packets of the device waiting to be processed (optional, see Pipeline.Queued)
+	Queued func(imei string) int64
+	// ImeiLuhn rejects the imeis with an invalid check digit (the last digit, Luhn)
+	ImeiLuhn bool
+	// Retransmissions recognizes the packets the device sends again, they are acked without passing their records
+	// on (optional)
+	Retransmissions *RetransmissionFilter
+	// Acknowledge replaces the automatic ack of the data packets (optional): it's called after OnPacket with the ack
+	// the decoder suggests (the record count) and the error of OnPacket, and returns the ack to write (nil writes
+	// nothing). The packet is processed before it's acked this way, an ack of 0 records makes the device send the
+	// packet again. Without it the suggested ack is written before OnPacket
+	Acknowledge func(imei string, pkt *teltonika.Packet, response []byte, err error) []byte
+	// OnListen is called once the server listens (optional)
+	OnListen func()
 }
 
+// defaultMaxPacketSize is well above the 1280 bytes the devices put in a tcp packet
+const defaultMaxPacketSize = 16 * 1024
+
+// frameHeaderSize is the preamble (4 zero bytes) and the data field length of a tcp frame, the data field is
+// followed by the 4 byte crc
+const frameHeaderSize = 8
+
 type TCPClient struct {
 	conn net.Conn
 	imei string
+	// buffered and queued are the bytes read and in use for the current packet and of the packets waiting in the
+	// pipeline
+	buffered int64
+	queued   int64
+	// done is closed to stop the read loop (stopReason is the close reason), exited when the connection ended
+	done       chan struct{}
+	exited     chan struct{}
+	stopOnce   sync.Once
+	stopReason string
+}
+
+// stop ends the read loop of the client: the packets already read are handled and acked, the read in progress
+// returns at once (the read deadline is moved to the past) instead of waiting for the device or the read timeout
+func (c *TCPClient) stop(reason string) {
+	c.stopOnce.Do(func() {
+		c.stopReason = reason
+		close(c.done)
+		_ = c.conn.SetReadDeadline(time.Unix(1, 0))
+	})
+}
+
+// stopped returns the close reason once the client is stopped
+func (c *TCPClient) stopped() (string, bool) {
+	select {
+	case <-c.done:
+		return c.stopReason, true
+	default:
+		return "", false
+	}
+}
+
+// wait waits for the connection of the client to end, false if it's still running after timeout
+func (c *TCPClient) wait(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-c.exited:
+		return true
+	case <-timer.C:
+		return false
+	}
 }
 
 func NewTCPServer(address string) *TCPServer {
@@ -53,29 +143,98 @@ func NewTCPServerLogger(address string, logger *Logger) *TCPServer {
 func (r *TCPServer) Run() error {
 	logger := r.logger
 
-	addr, err := net.ResolveTCPAddr("tcp", r.address)
-	if err != nil {
-		return fmt.Errorf("tcp address resolve error (%v)", err)
+	listener := systemdListener("tcp", r.address)
+	if listener == nil {
+		addr, err := net.ResolveTCPAddr("tcp", r.address)
+		if err != nil {
+			return fmt.Errorf("tcp address resolve error (%v)", err)
+		}
+		if listener, err = net.ListenTCP("tcp", addr); err != nil {
+			return fmt.Errorf("tcp listener create error (%v)", err)
+		}
 	}
-
-	listener, err := net.ListenTCP("tcp", addr)
-	if err != nil {
-		return fmt.Errorf("tcp listener create error (%v)", err)
+	if r.TLS != nil {
+		listener = tls.NewListener(listener, r.TLS)
 	}
 
 	defer func() {
 		_ = listener.Close()
 	}()
 
-	logger.Info.Println("tcp server listening at " + r.address)
+	r.mutex.Lock()
+	if r.closing {
+		r.mutex.Unlock()
+		return nil
+	}
+	r.listener = listener
+	r.mutex.Unlock()
+
+	logger.Info.Println("tcp server listening at " + listener.Addr().String())
+	if r.OnListen != nil {
+		r.OnListen()
+	}
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if r.isClosing() {
+				return nil
+			}
 			return fmt.Errorf("tcp connection accept error (%v)", err)
 		}
-		go r.handleConnection(conn)
+		r.sessions.Add(1)
+		go func() {
+			defer r.sessions.Done()
+			r.handleConnection(conn)
+		}()
+	}
+}
+
+// Shutdown stops accepting devices and stops the connected devices (see TCPClient.stop), Run returns nil then. It
+// waits for the connections to end or ctx to be done, the devices logging in meanwhile are disconnected unanswered
+func (r *TCPServer) Shutdown(ctx context.Context) error {
+	r.mutex.Lock()
+	r.closing = true
+	listener := r.listener
+	r.mutex.Unlock()
+	if listener != nil {
+		_ = listener.Close()
+	}
+	r.clients.Range(func(_, value any) bool {
+		value.(*TCPClient).stop(CloseShutdown)
+		return true
+	})
+
+	done := make(chan struct{})
+	go func() {
+		r.sessions.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *TCPServer) isClosing() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.closing
+}
+
+// Kick disconnects the device, false if it isn't connected. It returns once the connection ended (or after 10
+// seconds), the device reconnects on its own
+func (r *TCPServer) Kick(imei string) bool {
+	clientRaw, ok := r.clients.Load(imei)
+	if !ok {
+		return false
 	}
+	client := clientRaw.(*TCPClient)
+	client.stop(CloseKicked)
+	client.wait(time.Second * 10)
+	return true
 }
 
 func (r *TCPServer) SendPacket(imei string, packet *teltonika.Packet) error {
@@ -97,6 +256,12 @@ func (r *TCPServer) SendPacket(imei string, packet *teltonika.Packet) error {
 	return nil
 }
 
+// IsConnected tells if the device is connected
+func (r *TCPServer) IsConnected(imei string) bool {
+	_, ok := r.clients.Load(imei)
+	return ok
+}
+
 func (r *TCPServer) ListClients() []*TCPClient {
 	clients := make([]*TCPClient, 0, 10)
 	r.clients.Range(func(key, value any) bool {
@@ -108,18 +273,26 @@ func (r *TCPServer) ListClients() []*TCPClient {
 
 func (r *TCPServer) handleConnection(conn net.Conn) {
 	logger := r.logger
-	client := &TCPClient{conn, ""}
+	client := &TCPClient{conn: conn, done: make(chan struct{}), exited: make(chan struct{})}
 	imei := ""
+	reason := CloseError
 
 	addr := conn.RemoteAddr().String()
 
 	defer func(conn net.Conn) {
 		if r.OnClose != nil && imei != "" {
-			r.OnClose(imei)
+			_ = r.call(imei, "OnClose", func() error {
+				r.OnClose(imei, reason)
+				return nil
+			})
 		}
 		if imei != "" {
-			logger.Info.Printf("[%s]: disconnected", imei)
-			r.clients.Delete(imei)
+			disconnectMetrics.Add(reason, 1)
+			logger.Info.Printf("[%s]: disconnected (%s)", imei, reason)
+			// a replaced connection may end after its successor logged in
+			if value, ok := r.clients.Load(imei); ok && value == client {
+				r.clients.Delete(imei)
+			}
 		} else {
 			logger.Info.Printf("[%s]: disconnected", addr)
 		}
@@ -127,74 +300,399 @@ func (r *TCPServer) handleConnection(conn net.Conn) {
 		if err := conn.Close(); err != nil {
 			logger.Error.Printf("[%s]: connection close error (%v)", addr, err)
 		}
+		close(client.exited)
 	}(conn)
 
 	logger.Info.Printf("[%s]: connected", addr)
 
-	buf := make([]byte, 100)
-	size, err := conn.Read(buf) // Read imei
+	if err := conn.SetReadDeadline(time.Now().Add(time.Minute)); err != nil {
+		logger.Error.Printf("[%s]: SetReadDeadline error (%v)", addr, err)
+		return
+	}
+	login, err := readLogin(conn)
 	if err != nil {
-		logger.Error.Printf("[%s]: connection read error (%v)", addr, err)
+		logger.Error.Printf("[%s]: login read error (%v)", addr, err)
 		return
 	}
-	if size < 2 {
-		logger.Error.Printf("[%s]: invalid first message (read: %s)", addr, hex.EncodeToString(buf))
+	if err = checkImei(string(login[2:]), r.ImeiLuhn); err != nil {
+		logger.Error.Printf("[%s]: invalid login %s (%v)", addr, hex.EncodeToString(login), err)
 		return
 	}
-	imeiLen := int(binary.BigEndian.Uint16(buf[:2]))
-	buf = buf[2:]
+	imei = string(login[2:])
+	client.imei = imei
 
-	if len(buf) < imeiLen {
-		logger.Error.Printf("[%s]: invalid imei size (read: %s)", addr, hex.EncodeToString(buf))
-		return
+	if tlsConn, ok := conn.(*tls.Conn); ok && r.VerifyIdentity != nil {
+		state := tlsConn.ConnectionState()
+		if err = r.VerifyIdentity(imei, &state); err != nil {
+			logger.Error.Printf("[%s]: imei %s rejected (%v)", addr, imei, err)
+			if _, err = conn.Write([]byte{0}); err != nil {
+				logger.Error.Printf("[%s]: error writing reject (%v)", imei, err)
+			}
+			imei = ""
+			return
+		}
 	}
 
-	imei = strings.TrimSpace(string(buf[:imeiLen]))
-	client.imei = imei
+	if r.Accept != nil && !r.Accept(imei, addr) {
+		logger.Info.Printf("[%s]: imei %s rejected", addr, imei)
+		if _, err = conn.Write([]byte{0}); err != nil {
+			logger.Error.Printf("[%s]: error writing reject (%v)", imei, err)
+		}
+		imei = ""
+		return
+	}
 
-	if r.OnConnect != nil {
-		r.OnConnect(imei)
+	var upstream net.Conn
+	answer := byte(1)
+	if r.Proxy != nil {
+		if upstream, answer, err = r.Proxy.Login(imei, login); err != nil {
+			logger.Error.Printf("[%s]: %v", imei, err)
+			imei = ""
+			return
+		}
+		defer func() {
+			_ = upstream.Close()
+		}()
+		if answer != 1 {
+			logger.Info.Printf("[%s]: imei %s rejected by the upstream", addr, imei)
+			if _, err = conn.Write([]byte{answer}); err != nil {
+				logger.Error.Printf("[%s]: error writing reject (%v)", imei, err)
+			}
+			imei = ""
+			return
+		}
 	}
 
+	// a device connecting again (its previous connection is half-open, or two devices share the imei) replaces the
+	// previous connection, which ends before the new one is announced
+	if previousRaw, ok := r.clients.Load(imei); ok {
+		previous := previousRaw.(*TCPClient)
+		logger.Info.Printf("[%s]: imei %s already connected from %s, the previous connection is closed", addr, imei,
+			previous.conn.RemoteAddr())
+		previous.stop(CloseReplaced)
+		if !previous.wait(time.Second * 10) {
+			logger.Error.Printf("[%s]: previous connection still running", imei)
+		}
+	}
+	r.mutex.Lock()
+	if r.closing {
+		r.mutex.Unlock()
+		logger.Info.Printf("[%s]: imei %s not accepted, the server is shutting down", addr, imei)
+		imei = ""
+		return
+	}
 	r.clients.Store(imei, client)
+	r.mutex.Unlock()
+
+	if r.OnConnect != nil {
+		_ = r.call(imei, "OnConnect", func() error {
+			r.OnConnect(imei)
+			return nil
+		})
+	}
 
 	logger.Info.Printf("[%s]: imei - %s", addr, client.imei)
 
-	if _, err = conn.Write([]byte{1}); err != nil {
+	if _, err = conn.Write([]byte{answer}); err != nil {
 		logger.Error.Printf("[%s]: error writing ack (%v)", client.imei, err)
+		reason = closeReason(err)
 		return
 	}
+	if upstream != nil {
+		go r.Proxy.Relay(imei, upstream, conn)
+	}
 
+	maxSize := r.Limits.MaxPacketBytes
+	if maxSize <= 0 {
+		maxSize = defaultMaxPacketSize
+	}
+	// the frames the device pipelines arrive in the same reads, their acks are held back until the reader has no
+	// more buffered data and written together (writev)
+	reader := bufio.NewReaderSize(conn, 4096)
+	var acks net.Buffers
 	readBuffer := make([]byte, 1300)
+	// the log lines of a packet are built in buffers reused for the next packets
+	var jsonBuffer, hexBuffer []byte
 	for {
 		if err = conn.SetReadDeadline(time.Now().Add(time.Minute * 15)); err != nil {
 			logger.Error.Printf("[%s]: SetReadDeadline error (%v)", imei, err)
+			reason = closeReason(err)
+			return
+		}
+		// checked after the deadline is set, a stop from now on moves the deadline of this read
+		var frame []byte
+		stopReason, stopped := client.stopped()
+		if !stopped {
+			readBuffer, frame, err = readFrame(reader, readBuffer, maxSize)
+			if err != nil {
+				stopReason, stopped = client.stopped()
+			}
+		}
+		if stopped {
+			reason = stopReason
+			if len(acks) > 0 {
+				_ = conn.SetWriteDeadline(time.Now().Add(time.Second * 10))
+				if err = r.writeAcks(conn, &acks); err != nil {
+					logger.Error.Printf("[%s]: error writing response (%v)", imei, err)
+				}
+			}
+			logger.Info.Printf("[%s]: connection stopped (%s)", imei, reason)
 			return
 		}
-		read, res, err := teltonika.DecodeTCPFromReaderBuf(conn, readBuffer, decodeConfig)
+		if err != nil {
+			reason = closeReason(err)
+			var partial *PartialFrameError
+			if errors.As(err, &partial) {
+				tcpMetrics.Add("partialFrames", 1)
+				tcpMetrics.Add("partialFrameBytes", int64(partial.Read))
+			}
+			// the packets before the cut are handled, their held back acks still reach a device that only closed
+			// its side (half-close) or went quiet
+			if len(acks) > 0 && reason != CloseReset {
+				_ = conn.SetWriteDeadline(time.Now().Add(time.Second * 10))
+				if werr := r.writeAcks(conn, &acks); werr != nil {
+					logger.Error.Printf("[%s]: error writing response (%v)", imei, werr)
+				}
+			}
+			if reason == CloseEOF && partial == nil {
+				logger.Info.Printf("[%s]: connection closed by the device", imei)
+			} else {
+				logger.Error.Printf("[%s]: packet read error (%v)", imei, err)
+			}
+			if r.OnError != nil && (reason != CloseEOF || partial != nil) {
+				r.OnError(imei, err)
+			}
+			return
+		}
+
+		if r.OnFrame != nil {
+			r.OnFrame(imei, frame)
+		}
+
+		if err = r.Limits.CheckFrame(frame); err != nil {
+			logger.Error.Printf("[%s]: %v", imei, err)
+			reason = CloseLimit
+			if r.OnError != nil {
+				r.OnError(imei, err)
+			}
+			return
+		}
+		packet, heartbeat := decodeHeartbeat(frame)
+		if heartbeat {
+			tcpMetrics.Add("heartbeats", 1)
+		} else {
+			_, packet, err = teltonika.DecodeTCPFromSlice(frame, decodeConfig)
+		}
 		if err != nil {
 			logger.Error.Printf("[%s]: packet decode error (%v)", imei, err)
+			reason = CloseDecode
+			if r.OnError != nil {
+				r.OnError(imei, err)
+			}
+			return
+		}
+		if err = r.Limits.CheckPacket(packet); err != nil {
+			logger.Error.Printf("[%s]: %v", imei, err)
+			reason = CloseLimit
+			if r.OnError != nil {
+				r.OnError(imei, err)
+			}
 			return
 		}
 
-		if res.Response != nil {
-			if _, err = conn.Write(res.Response); err != nil {
-				logger.Error.Printf("[%s]: error writing response (%v)", imei, err)
+		hexBuffer = appendHex(hexBuffer[:0], frame)
+		logger.Info.Printf("[%s]: message: %s", imei, hexBuffer)
+		response := dataResponse(packet)
+		retransmitted := r.Retransmissions != nil && r.Retransmissions.Seen(imei, frame, packet)
+		deferred := r.Acknowledge != nil && !retransmitted && upstream == nil
+		if upstream != nil {
+			if err = r.Proxy.Forward(upstream, frame); err != nil {
+				logger.Error.Printf("[%s]: %v", imei, err)
+				reason = CloseError
 				return
 			}
+		} else if response != nil && !deferred {
+			acks = append(acks, response)
+		}
+		if err = r.flushAcks(conn, reader, &acks); err != nil {
+			logger.Error.Printf("[%s]: error writing response (%v)", imei, err)
+			reason = closeReason(err)
+			return
 		}
 
-		logger.Info.Printf("[%s]: message: %s", imei, hex.EncodeToString(readBuffer[:read]))
-		jsonData, err := json.Marshal(res.Packet)
-		if err != nil {
-			logger.Error.Printf("[%s]: decoder result marshaling error (%v)", imei, err)
+		if retransmitted {
+			logger.Info.Printf("[%s]: retransmitted packet, %d records already received", imei, len(packet.Data))
+			continue
 		}
-		logger.Info.Printf("[%s]: decoded: %s", imei, string(jsonData))
+		jsonBuffer = AppendPacketJson(jsonBuffer[:0], packet)
+		logger.Info.Printf("[%s]: decoded: %s", imei, jsonBuffer)
 
+		var handleErr error
 		if r.OnPacket != nil {
-			r.OnPacket(imei, res.Packet)
+			handleErr = r.call(imei, "OnPacket", func() error {
+				return r.OnPacket(imei, packet)
+			})
+		}
+		if deferred && response != nil {
+			if response = r.Acknowledge(imei, packet, response, handleErr); response != nil {
+				acks = append(acks, response)
+			}
+			if err = r.flushAcks(conn, reader, &acks); err != nil {
+				logger.Error.Printf("[%s]: error writing response (%v)", imei, err)
+				reason = closeReason(err)
+				return
+			}
+		}
+		if handleErr == nil && r.Retransmissions != nil {
+			r.Retransmissions.Remember(imei, frame, packet)
+		}
+
+		// the bytes in use for the device: the data read ahead (pipelined frames), the frame and its log lines and the
+		// acks held back, the fixed sizes of the empty buffers aren't counted
+		buffered, queued := int64(reader.Buffered()+len(frame)+len(jsonBuffer)+len(hexBuffer)), int64(0)
+		for _, ack := range acks {
+			buffered += int64(len(ack))
+		}
+		if r.Queued != nil {
+			queued = r.Queued(imei)
+		}
+		atomic.StoreInt64(&client.buffered, buffered)
+		atomic.StoreInt64(&client.queued, queued)
+		if err = r.Limits.CheckConnection(buffered, queued); err != nil {
+			logger.Error.Printf("[%s]: %v", imei, err)
+			reason = CloseLimit
+			if r.OnError != nil {
+				r.OnError(imei, err)
+			}
+			return
+		}
+	}
+}
+
+// call runs a callback, a panic is recovered (see PanicError) and reported to OnError, the connection goes on
+func (r *TCPServer) call(imei string, where string, f func() error) error {
+	err := safeCall(where, f)
+	var panicErr *PanicError
+	if errors.As(err, &panicErr) {
+		r.logger.Error.Printf("[%s]: %v\n%s", imei, err, panicErr.Stack)
+		if r.OnError != nil {
+			r.OnError(imei, err)
+		}
+	}
+	return err
+}
+
+// flushAcks writes the pending acks once the reader has no more buffered data (no pipelined packet to handle first)
+func (r *TCPServer) flushAcks(conn net.Conn, reader *bufio.Reader, acks *net.Buffers) error {
+	if len(*acks) == 0 || reader.Buffered() > 0 {
+		return nil
+	}
+	return r.writeAcks(conn, acks)
+}
+
+func (r *TCPServer) writeAcks(conn net.Conn, acks *net.Buffers) error {
+	tcpMetrics.Add("acks", int64(len(*acks)))
+	tcpMetrics.Add("ackWrites", 1)
+	if _, err := acks.WriteTo(conn); err != nil {
+		return err
+	}
+	*acks = (*acks)[:0]
+	return nil
+}
+
+// readLogin reads the login packet exactly: the 2 byte imei length, then the imei
+func readLogin(reader io.Reader) ([]byte, error) {
+	login := make([]byte, 2, 17)
+	if _, err := io.ReadFull(reader, login); err != nil {
+		return nil, err
+	}
+	imeiLen := int(binary.BigEndian.Uint16(login))
+	if imeiLen != 15 {
+		return nil, fmt.Errorf("invalid imei length %d", imeiLen)
+	}
+	login = login[:2+imeiLen]
+	if _, err := io.ReadFull(reader, login[2:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return login, nil
+}
+
+// checkImei checks that the imei is 15 digits, with luhn that the last digit is the Luhn check digit of the others
+func checkImei(imei string, luhn bool) error {
+	if len(imei) != 15 {
+		return fmt.Errorf("imei must be 15 digits")
+	}
+	sum := 0
+	for i := 0; i < len(imei); i++ {
+		c := imei[i]
+		if c < '0' || c > '9' {
+			return fmt.Errorf("imei must be 15 digits")
+		}
+		digit := int(c - '0')
+		if i%2 == 1 {
+			if digit *= 2; digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+	}
+	if luhn && sum%10 != 0 {
+		return fmt.Errorf("imei check digit is invalid")
+	}
+	return nil
+}
+
+// readFrame reads exactly one frame: the header, then the declared data field and the crc. buf grows to the frame
+// size when needed, it is returned with the frame (a slice of it)
+func readFrame(reader io.Reader, buf []byte, maxSize int) ([]byte, []byte, error) {
+	if n, err := io.ReadFull(reader, buf[:frameHeaderSize]); err != nil {
+		if n > 0 {
+			return buf, nil, &PartialFrameError{Read: n, Err: err}
+		}
+		return buf, nil, err
+	}
+	if preamble := binary.BigEndian.Uint32(buf[:4]); preamble != 0 {
+		return buf, nil, fmt.Errorf("%w %08x", errInvalidPreamble, preamble)
+	}
+	size := uint64(frameHeaderSize) + uint64(binary.BigEndian.Uint32(buf[4:8])) + 4
+	if size > uint64(maxSize) {
+		return buf, nil, limitError("packet", int(size), maxSize)
+	}
+	if int(size) > len(buf) {
+		grown := make([]byte, size)
+		copy(grown, buf[:frameHeaderSize])
+		buf = grown
+	}
+	if n, err := io.ReadFull(reader, buf[frameHeaderSize:size]); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
 		}
+		return buf, nil, &PartialFrameError{Read: frameHeaderSize + n, Size: int(size), Err: err}
 	}
+	return buf, buf[:size], nil
+}
+
+// appendHex appends the hex digits of the bytes, the log line of a frame reuses its buffer
+func appendHex(buf []byte, bs []byte) []byte {
+	n := len(buf)
+	buf = append(buf, make([]byte, hex.EncodedLen(len(bs)))...)
+	hex.Encode(buf[n:], bs)
+	return buf
+}
+
+// dataResponse is the ack of a data packet (codec 8, 8E and 16), the number of records. The other packets (codec 12,
+// 13 and 14 messages) aren't acked
+func dataResponse(packet *teltonika.Packet) []byte {
+	switch packet.CodecID {
+	case teltonika.Codec8, teltonika.Codec8E, teltonika.Codec16:
+		response := make([]byte, 4)
+		binary.BigEndian.PutUint32(response, uint32(len(packet.Data)))
+		return response
+	}
+	return nil
 }
 
 type HTTPServer struct {
@@ -202,14 +700,24 @@ type HTTPServer struct {
 	hub      TrackersHub
 	respChan *sync.Map
 	logger   *Logger
+	handlers map[string]http.Handler
+	// Tracker keeps the status of the commands, Sms is the sms channel (optional), Operator identifies the
+	// operator sending a command through the api, false rejects the request (optional)
+	Tracker  *CommandTracker
+	Sms      *SmsCommands
+	Operator func(r *http.Request) (string, bool)
+	// OnDeviceMessage gets the messages of the devices that aren't a response to a command (optional)
+	OnDeviceMessage func(imei string, codec teltonika.CodecId, message *teltonika.Message)
+	// OnListen is called once the server listens (optional)
+	OnListen func()
 }
 
 func NewHTTPServer(address string, hub TrackersHub) *HTTPServer {
-	return &HTTPServer{address: address, respChan: &sync.Map{}, hub: hub}
+	return &HTTPServer{address: address, respChan: &sync.Map{}, hub: hub, Tracker: NewCommandTracker()}
 }
 
 func NewHTTPServerLogger(address string, hub TrackersHub, logger *Logger) *HTTPServer {
-	return &HTTPServer{address: address, respChan: &sync.Map{}, hub: hub, logger: logger}
+	return &HTTPServer{address: address, respChan: &sync.Map{}, hub: hub, logger: logger, Tracker: NewCommandTracker()}
 }
 
 func (hs *HTTPServer) Run() error {
@@ -221,27 +729,65 @@ func (hs *HTTPServer) Run() error {
 
 	handler.HandleFunc("/list-clients", hs.listClients)
 
-	logger.Info.Println("http server listening at " + hs.address)
+	handler.HandleFunc("/kick", hs.handleKick)
 
-	err := http.ListenAndServe(hs.address, handler)
+	handler.Handle("/debug/vars", expvar.Handler())
+
+	for pattern, h := range hs.handlers {
+		handler.Handle(pattern, h)
+	}
+
+	listener := systemdListener("http", hs.address)
+	if listener == nil {
+		var err error
+		if listener, err = net.Listen("tcp", hs.address); err != nil {
+			return fmt.Errorf("http listen error (%v)", err)
+		}
+	}
+	logger.Info.Println("http server listening at " + listener.Addr().String())
+	if hs.OnListen != nil {
+		hs.OnListen()
+	}
+
+	err := http.Serve(listener, handler)
 	if err != nil {
 		return fmt.Errorf("http listen error (%v)", err)
 	}
 	return nil
 }
 
-func (hs *HTTPServer) WriteMessage(imei string, message *teltonika.Message) {
-	ch, ok := hs.respChan.Load(imei)
-	if ok {
-		select {
-		case ch.(chan *teltonika.Message) <- message:
+// Handle registers an additional route, it must be called before Run
+func (hs *HTTPServer) Handle(pattern string, handler http.Handler) {
+	if hs.handlers == nil {
+		hs.handlers = make(map[string]http.Handler)
+	}
+	hs.handlers[pattern] = handler
+}
+
+// WriteMessage routes a message of the device: a codec 12 response goes to the pending command, the messages the
+// device sends on its own (a codec 12 response with no command pending or after the command got its response, codec
+// 13 and 14 messages) go to OnDeviceMessage
+func (hs *HTTPServer) WriteMessage(imei string, codec teltonika.CodecId, message *teltonika.Message) {
+	if codec == teltonika.Codec12 && message.Type == teltonika.TypeResponse {
+		if ch, ok := hs.respChan.Load(imei); ok {
+			select {
+			case ch.(chan *teltonika.Message) <- message:
+				return
+			default:
+			}
 		}
 	}
+	if hs.OnDeviceMessage != nil {
+		hs.OnDeviceMessage(imei, codec, message)
+	} else {
+		hs.logger.Info.Printf("[%s]: unsolicited message '%s'", imei, message.Text)
+	}
 }
 
 func (hs *HTTPServer) listClients(w http.ResponseWriter, _ *http.Request) {
 	for _, client := range hs.hub.ListClients() {
-		_, err := w.Write([]byte(client.conn.RemoteAddr().String() + " - " + client.imei + "\n"))
+		_, err := w.Write([]byte(fmt.Sprintf("%s - %s - buffered %d, queued %d bytes\n", client.conn.RemoteAddr(),
+			client.imei, atomic.LoadInt64(&client.buffered), atomic.LoadInt64(&client.queued))))
 		if err != nil {
 			return
 		}
@@ -249,23 +795,50 @@ func (hs *HTTPServer) listClients(w http.ResponseWriter, _ *http.Request) {
 	w.WriteHeader(200)
 }
 
-func (hs *HTTPServer) handleCmd(w http.ResponseWriter, r *http.Request) {
-	logger := hs.logger
+// handleKick handles POST /kick?imei=..., the device is disconnected (404 if it isn't connected)
+func (hs *HTTPServer) handleKick(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	operator, ok := authorize(w, r, hs.Authorize)
+	if !ok {
+		return
+	}
+	imei := r.URL.Query().Get("imei")
+	if !hs.hub.Kick(imei) {
+		http.Error(w, fmt.Sprintf("client with imei '%s' not found", imei), http.StatusNotFound)
+		return
+	}
+	hs.logger.Info.Printf("[%s]: disconnected through the api by '%s'", imei, operator)
+	w.WriteHeader(http.StatusOK)
+}
 
-	params := r.URL.Query()
-	imei := params.Get("imei")
-	buf := make([]byte, 512)
-	n, _ := r.Body.Read(buf)
-	cmd := string(buf[:n])
+func writeJson(w http.ResponseWriter, status int, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
 
+var errCommandTimeout = errors.New("tracker response timeout exceeded")
+
+// Execute sends the command text of the operator ("system" for the server itself) to the device and waits for its
+// response (commands to a device are serialized), errCommandTimeout if the device doesn't respond in time
+func (hs *HTTPServer) Execute(imei string, cmd string, timeout time.Duration, operator string) (response string, err error) {
 	packet := &teltonika.Packet{
 		CodecID:  teltonika.Codec12,
 		Data:     nil,
 		Messages: []teltonika.Message{{Type: teltonika.TypeCommand, Text: strings.TrimSpace(cmd)}},
 	}
 
+	// result isn't closed: a late response of the device may still be sent to it after the Delete, the buffer
+	// takes it and the channel is collected
 	result := make(chan *teltonika.Message, 1)
-	defer close(result)
 	for {
 		if _, loaded := hs.respChan.LoadOrStore(imei, result); !loaded {
 			break
@@ -275,7 +848,40 @@ func (hs *HTTPServer) handleCmd(w http.ResponseWriter, r *http.Request) {
 
 	defer hs.respChan.Delete(imei)
 
+	status := hs.Tracker.Start(imei, "gprs", strings.TrimSpace(cmd), "pending", operator)
+	defer func() {
+		hs.Tracker.Finish(status, response, err)
+	}()
 	if err := hs.hub.SendPacket(imei, packet); err != nil {
+		return "", err
+	}
+	hs.logger.Info.Printf("command '%s' sent to '%s'", cmd, imei)
+	ticker := time.NewTimer(timeout)
+	defer ticker.Stop()
+
+	select {
+	case msg := <-result:
+		return msg.Text, nil
+	case <-ticker.C:
+		return "", errCommandTimeout
+	}
+}
+
+func (hs *HTTPServer) handleCmd(w http.ResponseWriter, r *http.Request) {
+	logger := hs.logger
+
+	operator, ok := authorize(w, r, hs.Authorize)
+	if !ok {
+		return
+	}
+	params := r.URL.Query()
+	imei := params.Get("imei")
+	buf := make([]byte, 512)
+	n, _ := r.Body.Read(buf)
+	cmd := string(buf[:n])
+
+	response, err := hs.Execute(imei, cmd, time.Second*90, operator)
+	if err != nil && err != errCommandTimeout {
 		logger.Error.Printf("send packet error (%v)", err)
 		_, err = w.Write([]byte(err.Error() + "\n"))
 		if err != nil {
@@ -284,15 +890,10 @@ func (hs *HTTPServer) handleCmd(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(400)
 		}
 	} else {
-		logger.Info.Printf("command '%s' sent to '%s'", cmd, imei)
-		ticker := time.NewTimer(time.Second * 90)
-		defer ticker.Stop()
-
-		select {
-		case msg := <-result:
-			_, err = w.Write([]byte(msg.Text + "\n"))
-		case <-ticker.C:
-			_, err = w.Write([]byte("tracker response timeout exceeded\n"))
+		if err == errCommandTimeout {
+			_, err = w.Write([]byte(err.Error() + "\n"))
+		} else {
+			_, err = w.Write([]byte(response + "\n"))
 		}
 
 		if err != nil {
@@ -303,13 +904,125 @@ func (hs *HTTPServer) handleCmd(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func main() {
+// Authorize returns the operator of an api request issuing commands or reading the audit (see Operator),
+// false if the request must be rejected
+func (hs *HTTPServer) Authorize(r *http.Request) (string, bool) {
+	if hs.Operator == nil {
+		return "", true
+	}
+	return hs.Operator(r)
+}
+
+// authorize returns the operator of the request, the request is answered 401 if it's rejected
+func authorize(w http.ResponseWriter, r *http.Request, operator func(r *http.Request) (string, bool)) (string, bool) {
+	if operator == nil {
+		return "", true
+	}
+	name, ok := operator(r)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	return name, ok
+}
+
+func (hs *HTTPServer) connected(imei string) bool {
+	for _, client := range hs.hub.ListClients() {
+		if client.imei == imei {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeCommand handles POST /devices/{imei}/commands with {"name": "setdigout", "args": ["1?"]}, the command
+// is built from the catalog (see NewCommand), the response is {"command": "setdigout 1?", "response": "..."},
+// with "parsed" for the commands with a structured response (see ParseCommandResponse). With "channel": "sms"
+// (or "auto" and the device offline) the command is sent as a sms and the answer is 202 with the command status.
+// GET returns the status of the latest commands, both are authorized
+func (hs *HTTPServer) ServeCommand(w http.ResponseWriter, r *http.Request, imei string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	operator, ok := authorize(w, r, hs.Authorize)
+	if !ok {
+		return
+	}
+	if r.Method == http.MethodGet {
+		writeJson(w, http.StatusOK, hs.Tracker.List(imei))
+		return
+	}
+	var req struct {
+		Name    string   `json:"name"`
+		Args    []string `json:"args"`
+		Channel string   `json:"channel"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid command request ("+err.Error()+")", http.StatusBadRequest)
+		return
+	}
+	command, err := NewCommand(req.Name, req.Args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch req.Channel {
+	case "", "gprs":
+	case "sms", "auto":
+		if req.Channel == "auto" && hs.connected(imei) {
+			break
+		}
+		if hs.Sms == nil || !hs.Sms.CanSend(imei) {
+			http.Error(w, "sms channel unavailable for the device", http.StatusBadRequest)
+			return
+		}
+		status, err := hs.Sms.Send(imei, command.Text(), operator)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		writeJson(w, http.StatusAccepted, status)
+		return
+	default:
+		http.Error(w, "unknown channel '"+req.Channel+"'", http.StatusBadRequest)
+		return
+	}
+	response, err := hs.Execute(imei, command.Text(), time.Second*90, operator)
+	switch {
+	case err == errCommandTimeout:
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		result := map[string]any{"command": command.Text(), "response": response}
+		parsed, err := ParseCommandResponse(command.Name, response)
+		if err != nil {
+			hs.logger.Error.Printf("[%s]: %v", imei, err)
+		} else if parsed != nil {
+			result["parsed"] = parsed
+		}
+		writeJson(w, http.StatusOK, result)
+	}
+}
+
+// runServer is the main of the tcp server
+func runServer() {
 	var httpAddress string
 	var tcpAddress string
-	var outHook string
+	var udpAddress string
+	var maxPacketSize int
+	var imeiLuhn bool
+	var reprocess string
+	var shutdownGrace time.Duration
+	sinkOptions := &SinkOptions{}
 	flag.StringVar(&tcpAddress, "address", "0.0.0.0:8080", "tcp server address")
+	flag.IntVar(&maxPacketSize, "max-packet-size", defaultMaxPacketSize, "max tcp packet size in bytes, devices sending bigger packets are disconnected")
+	flag.BoolVar(&imeiLuhn, "imei-luhn", false, "reject the devices whose imei has an invalid check digit")
+	flag.StringVar(&udpAddress, "udp", "", "udp server address, the udp packets go through the same sinks (disabled if empty)")
 	flag.StringVar(&httpAddress, "http", "0.0.0.0:8081", "http server address")
-	flag.StringVar(&outHook, "hook", "http://localhost:5000/api/v1/metric", "output hook")
+	sinkOptions.Register(flag.CommandLine)
+	flag.StringVar(&reprocess, "reprocess", "", "redeliver the letters of this dead letter file (or s3://bucket/prefix) and exit")
+	flag.DurationVar(&shutdownGrace, "shutdown-grace", time.Second*25, "max time to drain the devices and queues and save the state on SIGTERM")
 	flag.Parse()
 
 	logger := &Logger{
@@ -318,58 +1031,610 @@ func main() {
 	}
 
 	serverTcp := NewTCPServerLogger(tcpAddress, logger)
+	serverTcp.Limits.MaxPacketBytes = maxPacketSize
+	serverTcp.ImeiLuhn = imeiLuhn
+	serverTcp.Retransmissions = NewRetransmissionFilter(8)
 	serverHttp := NewHTTPServerLogger(httpAddress, serverTcp, logger)
 
-	serverTcp.OnPacket = func(imei string, pkt *teltonika.Packet) {
-		if pkt.Messages != nil && len(pkt.Messages) > 0 {
-			serverHttp.WriteMessage(imei, &pkt.Messages[0])
+	built, err := sinkOptions.Build(logger)
+	if err != nil {
+		panic(err)
+	}
+	config, deadLetters, pseudonyms := built.Config, built.DeadLetters, built.Pseudonyms
+	records, stats, sinks := built.Records, built.Stats, built.Sinks
+	hookConfig := sinkOptions.HookConfig
+	if pseudonyms != nil {
+		pseudonyms.Authorize = serverHttp.Authorize
+	}
+
+	if reprocess != "" {
+		if err = ReprocessDeadLetters(reprocess, sinks, 0, logger); err != nil {
+			panic(err)
 		}
-		if pkt.Data != nil {
-			go hookSend(outHook, imei, pkt, logger)
+		if err = pseudonyms.Save(); err != nil {
+			panic(err)
 		}
+		return
 	}
 
+	pipeline := NewPipeline(sinks, logger)
+	lifecycle := NewDataLifecycle(config.Retention, logger)
+	lifecycle.Authorize = serverHttp.Authorize
+	lifecycle.Publish = pipeline.Publish
+	if queue, ok := deadLetters.(*FileDeadLetterQueue); ok {
+		lifecycle.Register("deadLetter", queue)
+	}
+	var dedup *Deduplicator
+	if config.Dedup != nil {
+		if dedup, err = NewDeduplicator(config.Dedup, logger); err != nil {
+			panic(err)
+		}
+		pipeline.Stages = append(pipeline.Stages, dedup)
+	}
+	if config.Timestamps != nil {
+		timestamps, err := NewTimestampFilter(config.Timestamps)
+		if err != nil {
+			panic(err)
+		}
+		timestamps.Publish = pipeline.Publish
+		pipeline.Stages = append(pipeline.Stages, timestamps)
+	}
+	var reorder *ReorderStage
+	if config.Reorder != nil {
+		reorder = NewReorderStage(config.Reorder)
+		reorder.Emit = pipeline.After(reorder)
+		pipeline.Stages = append(pipeline.Stages, reorder)
+	}
+	if config.Downsample != nil {
+		pipeline.Stages = append(pipeline.Stages, NewDownsampler(config.Downsample))
+	}
+	if config.Script != nil {
+		script, err := NewScriptStage(config.Script, logger)
+		if err != nil {
+			panic(err)
+		}
+		pipeline.Stages = append(pipeline.Stages, script)
+	}
+	enrich := NewEnrichStage(logger)
+	if err = ioParsers.Configure(config.IOParsers); err != nil {
+		panic(err)
+	}
+	if ioParsers.Len() > 0 {
+		enrich.Enrichers = append(enrich.Enrichers, RecordEnricher(ioParsers.EnrichRecord))
+	}
+	gnss := NewGnssSecurity(config.GnssSecurity)
+	gnss.Publish = pipeline.Publish
+	enrich.Enrichers = append(enrich.Enrichers, gnss)
+	clock := NewClockMonitor(config.ClockSkew)
+	if config.ClockSkew != nil && config.ClockSkew.Annotate {
+		enrich.Enrichers = append(enrich.Enrichers, RecordEnricher(clock.EnrichRecord))
+	}
+	if config.Geocoding != nil {
+		geocoding, err := NewGeocodingEnricher(config.Geocoding)
+		if err != nil {
+			panic(err)
+		}
+		enrich.Enrichers = append(enrich.Enrichers, RecordEnricher(geocoding.EnrichRecord))
+	}
+	if config.MapMatching != nil {
+		mapMatching, err := NewMapMatchingEnricher(config.MapMatching)
+		if err != nil {
+			panic(err)
+		}
+		enrich.Enrichers = append(enrich.Enrichers, mapMatching)
+	}
+	var directory *DirectoryService
+	if config.Directory != nil {
+		if directory, err = NewDirectoryService(config.Directory, logger); err != nil {
+			panic(err)
+		}
+		enrich.Enrichers = append(enrich.Enrichers, directory)
+		pipeline.Vehicle = directory.Vehicle
+		unitProfiles.Tenant = func(imei string) string {
+			if device := directory.Device(imei); device != nil {
+				return device.Tenant
+			}
+			return ""
+		}
+		if pseudonyms != nil {
+			pseudonyms.Tenant = func(imei string) string {
+				if tenant := directory.Tenant(imei); tenant != "" {
+					return tenant
+				}
+				return config.Tenant(imei)
+			}
+		}
+	}
+	if config.Units != nil {
+		if err = unitProfiles.Configure(config.Units); err != nil {
+			panic(err)
+		}
+	}
+	pipeline.Stages = append(pipeline.Stages, enrich)
+	stateStore, err := NewStateStore(config.State, logger)
+	if err != nil {
+		panic(err)
+	}
+	state := NewStateService(stateStore, logger)
+	pipeline.Stages = append(pipeline.Stages, state)
+	geofences, err := NewGeofenceEngine(config.Geofencing)
+	if err != nil {
+		panic(err)
+	}
+	geofences.Authorize = serverHttp.Authorize
+	odometer := NewOdometerService(config.Odometer)
+	trips := NewTripDetector(config.Trips)
+	trips.Odometer = odometer
+	alerts, err := NewAlertRules(config.Alerts)
+	if err != nil {
+		panic(err)
+	}
+	drivers := NewDriverSessions(config.Drivers)
+	towing := NewTowingDetector(config.Towing)
+	fuel, err := NewFuelMonitor(config.Fuel)
+	if err != nil {
+		panic(err)
+	}
+	power := NewPowerMonitor(config.Power)
+	immobilizer, err := NewImmobilizer(config.Immobilizer, state)
+	if err != nil {
+		panic(err)
+	}
+	immobilizer.Execute = serverHttp.Execute
+	immobilizer.Authorize = serverHttp.Authorize
+	coldChain, err := NewColdChainMonitor(config.ColdChain)
+	if err != nil {
+		panic(err)
+	}
+	if config.Crash != nil {
+		crash := NewCrashNotifier(config.Crash, logger)
+		crash.Command = func(imei string, text string) error {
+			return serverTcp.SendPacket(imei, &teltonika.Packet{
+				CodecID:  teltonika.Codec12,
+				Messages: []teltonika.Message{{Type: teltonika.TypeCommand, Text: text}},
+			})
+		}
+		crash.Deliver = pipeline.Publish
+		if config.Crash.Hook != nil {
+			config.Crash.Hook.Events = true
+			sink, err := config.Crash.Hook.Sink(hookConfig, logger)
+			if err != nil {
+				panic(err)
+			}
+			crash.Deliver = func(events ...*Event) {
+				for _, event := range events {
+					if err := sink.(EventSink).SendEvent(event); err != nil {
+						logger.Error.Printf("[%s]: crash sink error (%v)", event.Imei, err)
+					}
+				}
+			}
+		}
+		pipeline.Processors = append(pipeline.Processors, crash)
+	}
+	shadow, err := NewShadowService(config.Shadow, logger)
+	if err != nil {
+		panic(err)
+	}
+	shadow.Execute = serverHttp.Execute
+	shadow.Authorize = serverHttp.Authorize
+	scheduler, err := NewCommandScheduler(config.Schedules, logger)
+	if err != nil {
+		panic(err)
+	}
+	scheduler.Execute = serverHttp.Execute
+	scheduler.Authorize = serverHttp.Authorize
+	scheduler.Devices = func() []string {
+		imeis := make([]string, 0)
+		for _, client := range serverTcp.ListClients() {
+			imeis = append(imeis, client.imei)
+		}
+		return imeis
+	}
+	if config.Provisioning != nil {
+		provisioner, err := NewProvisioner(config.Provisioning, logger)
+		if err != nil {
+			panic(err)
+		}
+		provisioner.Configure = shadow.Provision
+		serverTcp.Accept = provisioner.Accept
+		serverHttp.Handle("/provisioning", provisioner)
+		serverHttp.Handle("/provisioning/", provisioner)
+	}
+	if config.Limits != nil {
+		serverTcp.Limits = *config.Limits
+		if serverTcp.Limits.MaxPacketBytes == 0 {
+			serverTcp.Limits.MaxPacketBytes = maxPacketSize
+		}
+	}
+	if config.Recorder != nil {
+		recorder, err := NewRawRecorder(config.Recorder, logger)
+		if err != nil {
+			panic(err)
+		}
+		if config.Recorder.Encryption != nil {
+			if recorder.Cipher, err = NewFrameCipher(config.Recorder.Encryption, config.Tenants); err != nil {
+				panic(err)
+			}
+		}
+		serverTcp.OnFrame = recorder.Record
+		lifecycle.Register("recorder", recorder)
+	}
+	if config.Proxy != nil {
+		proxy, err := NewUpstreamProxy(config.Proxy, logger)
+		if err != nil {
+			panic(err)
+		}
+		serverTcp.Proxy = proxy
+	}
+	if config.Tls != nil {
+		tlsConfig, identity, err := config.Tls.ServerConfig()
+		if err != nil {
+			panic(err)
+		}
+		serverTcp.TLS = tlsConfig
+		if identity != nil {
+			serverTcp.VerifyIdentity = identity.Verify
+		}
+	}
+	if config.Audit != nil {
+		audit, err := NewAuditLog(config.Audit, logger)
+		if err != nil {
+			panic(err)
+		}
+		serverHttp.Tracker.Audit = audit
+		lifecycle.Audit = audit
+		lifecycle.Register("audit", audit)
+		serverHttp.Operator = audit.Operator
+		serverHttp.Handle("/audit", audit)
+	}
+	if config.Sms != nil {
+		sms, err := NewSmsCommands(config.Sms, serverHttp.Tracker, logger)
+		if err != nil {
+			panic(err)
+		}
+		serverHttp.Sms = sms
+		serverHttp.Handle("/sms/inbound", http.HandlerFunc(sms.ServeInbound))
+	}
+	firmware, err := NewFirmwareService(config.Firmware, logger)
+	if err != nil {
+		panic(err)
+	}
+	firmware.Execute = serverHttp.Execute
+	firmware.Authorize = serverHttp.Authorize
+	firmware.Publish = pipeline.Publish
+	stream := NewLiveStream()
+	serverTcp.OnError = stream.Error
+	pipeline.OnError = stream.Error
+	var failover *FailoverCoordinator
+	if config.Failover != nil {
+		if config.Failover.Redis == nil && config.State != nil && config.State.Redis != nil {
+			// the redis of the state store, the failover keys have their own prefix
+			redis := *config.State.Redis
+			redis.KeyPrefix = ""
+			config.Failover.Redis = &redis
+		}
+		if failover, err = NewFailoverCoordinator(config.Failover, logger); err != nil {
+			panic(err)
+		}
+		failover.Publish = pipeline.Publish
+		if memory, ok := stateStore.(*MemoryStateStore); ok {
+			failover.Register("state", memory)
+		}
+		failover.Register("commands", serverHttp.Tracker)
+		failover.Register("shadow", shadow)
+		if dedup != nil {
+			failover.Register("dedup", dedup)
+		}
+	}
+	serverTcp.OnConnect = func(imei string) {
+		if failover != nil {
+			failover.Connected(imei)
+		}
+		if directory != nil {
+			directory.Connected(imei)
+		}
+		stream.Connected(imei)
+		shadow.Connected(imei)
+		scheduler.Connected(imei)
+		// the firmware is only read at connect when the firmware section is configured
+		if config.Firmware != nil {
+			firmware.Connected(imei)
+		}
+	}
+	campaigns, err := NewCampaignManager(config.Campaigns, logger)
+	if err != nil {
+		panic(err)
+	}
+	campaigns.Execute = serverHttp.Execute
+	campaigns.Authorize = serverHttp.Authorize
+	campaigns.Online = serverTcp.IsConnected
+	campaigns.Start()
+	gaps := NewGapDetector(config.Gaps)
+	gaps.Publish = pipeline.Publish
+	codecs := NewCodecMonitor(config.Codecs, logger)
+	codecs.Publish = pipeline.Publish
+	if directory != nil {
+		codecs.Expected = directory.Codecs
+	}
+	var anomalies *AnomalyDetector
+	if config.Anomalies != nil {
+		anomalies = NewAnomalyDetector(config.Anomalies)
+		anomalies.Publish = pipeline.Publish
+	}
+	pipeline.Processors = append(pipeline.Processors, odometer, geofences, trips,
+		NewHarshDrivingDetector(config.HarshDriving), alerts, drivers, towing, fuel, power, coldChain, immobilizer)
+	lifecycle.Register("commands", serverHttp.Tracker)
+	lifecycle.Register("retransmissions", serverTcp.Retransmissions)
+	lifecycle.Register("state", stateStore)
+	lifecycle.Register("clock", clock)
+	lifecycle.Register("codecs", codecs)
+	lifecycle.Register("gaps", gaps)
+	lifecycle.Register("stream", stream)
+	lifecycle.Register("gnss", gnss)
+	lifecycle.Register("geofences", geofences)
+	lifecycle.Register("odometer", odometer)
+	lifecycle.Register("trips", trips)
+	lifecycle.Register("alerts", alerts)
+	lifecycle.Register("drivers", drivers)
+	lifecycle.Register("towing", towing)
+	lifecycle.Register("fuel", fuel)
+	lifecycle.Register("power", power)
+	lifecycle.Register("sensors", coldChain)
+	if records != nil {
+		lifecycle.Register("records", records)
+	}
+	if anomalies != nil {
+		lifecycle.Register("anomalies", anomalies)
+	}
+	if stats != nil {
+		lifecycle.Register("stats", stats)
+	}
+	if directory != nil {
+		lifecycle.Register("directory", directory)
+	}
+	if pseudonyms != nil {
+		lifecycle.Register("pseudonyms", pseudonyms)
+		serverHttp.Handle("/pseudonyms/", pseudonyms)
+	}
+	var snapshots *SnapshotService
+	if config.Snapshots != nil {
+		if snapshots, err = NewSnapshotService(config.Snapshots, logger); err != nil {
+			panic(err)
+		}
+		if memory, ok := stateStore.(*MemoryStateStore); ok {
+			snapshots.Register("state", memory)
+		}
+		snapshots.Register("commands", serverHttp.Tracker)
+		if dedup != nil {
+			snapshots.Register("dedup", dedup)
+		}
+		if err = snapshots.Restore(); err != nil {
+			panic(err)
+		}
+		snapshots.Start()
+	}
+	if failover != nil {
+		// a standby follows the active gateway from here, over the snapshot
+		failover.Start()
+		serverHttp.Handle("/failover", failover)
+	}
+
+	devices := NewDeviceAPI()
+	devices.Handle("state", state.ServeHTTP)
+	devices.Handle("trips", trips.ServeHTTP)
+	devices.Handle("odometer", odometer.ServeHTTP)
+	devices.Handle("drivers", drivers.ServeHTTP)
+	devices.Handle("towing", towing.ServeHTTP)
+	devices.Handle("fuel", fuel.ServeHTTP)
+	devices.Handle("power", power.ServeHTTP)
+	devices.Handle("sensors", coldChain.ServeHTTP)
+	devices.Handle("commands", serverHttp.ServeCommand)
+	devices.Handle("shadow", shadow.ServeHTTP)
+	devices.Handle("firmware", firmware.ServeHTTP)
+	devices.Handle("immobilize", immobilizer.ServeHTTP)
+	devices.Handle("tags", deviceGroups.ServeTags)
+	devices.Handle("data", lifecycle.ServeHTTP)
+	if records != nil {
+		devices.Handle("records", records.ServeHTTP)
+	}
+	if stats != nil {
+		devices.Handle("stats", stats.ServeHTTP)
+		serverHttp.Handle("/stats", http.HandlerFunc(stats.ServeFleet))
+	}
+	devices.Detail("state", func(imei string) any {
+		s, err := state.State(imei)
+		if err != nil {
+			logger.Error.Printf("[%s]: %v", imei, err)
+		}
+		return s
+	})
+	devices.Detail("power", func(imei string) any { return power.Health(imei) })
+	devices.Detail("fuel", func(imei string) any { return fuel.Level(imei) })
+	devices.Detail("sensors", func(imei string) any { return coldChain.Sensors(imei) })
+	devices.Detail("firmware", func(imei string) any { return firmware.Firmware(imei) })
+	devices.Detail("tags", func(imei string) any { return deviceGroups.Tags(imei) })
+	devices.Detail("clock", func(imei string) any { return clock.Skew(imei) })
+	devices.Detail("codec", func(imei string) any { return codecs.Codec(imei) })
+	if directory != nil {
+		devices.Detail("directory", func(imei string) any { return directory.Device(imei) })
+	}
+	if anomalies != nil {
+		devices.Detail("anomalies", func(imei string) any { return anomalies.Baseline(imei) })
+	}
+	serverHttp.Handle("/parameters", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, http.StatusOK, fmbParameters)
+	}))
+	serverHttp.Handle("/campaigns", campaigns)
+	serverHttp.Handle("/campaigns/", campaigns)
+	serverHttp.Handle("/schedules", scheduler)
+	serverHttp.Handle("/schedules/", scheduler)
+	serverHttp.Handle("/firmware", http.HandlerFunc(firmware.ServeReport))
+	serverHttp.Handle("/groups", deviceGroups)
+	serverHttp.Handle("/groups/", deviceGroups)
+	serverHttp.Handle("/geofences", geofences)
+	serverHttp.Handle("/devices/", devices)
+	serverHttp.Handle("/devices", gaps)
+	serverHttp.Handle("/drivers", http.HandlerFunc(drivers.ServeActive))
+	serverHttp.Handle("/stream", stream)
+	serverHttp.Handle("/dashboard", http.HandlerFunc(ServeDashboard))
+
+	var bridge *SerialBridge
+	if config.SerialBridge != nil {
+		bridge = NewSerialBridge(config.SerialBridge, logger)
+		bridge.Send = serverTcp.SendPacket
+		bridge.Connected = serverTcp.IsConnected
+	}
+	serverTcp.OnClose = func(imei string, reason string) {
+		stream.Disconnected(imei, reason)
+		if bridge != nil {
+			bridge.Close(imei)
+		}
+	}
+
+	handleData := func(imei string, pkt *teltonika.Packet) error {
+		gaps.Seen(imei, pkt)
+		clock.Seen(imei, pkt)
+		if anomalies != nil {
+			anomalies.Seen(imei, pkt)
+		}
+		if isHeartbeat(pkt) {
+			pipeline.Publish(NewHeartbeatEvent(imei, pkt.CodecID))
+			return nil
+		}
+		if pkt.Data == nil {
+			return nil
+		}
+		codecs.Seen(imei, pkt)
+		stream.Packet(imei, pkt)
+		deviceGroups.Count(imei, pkt)
+		return pipeline.Handle(imei, pkt)
+	}
+	serverHttp.OnDeviceMessage = func(imei string, codec teltonika.CodecId, message *teltonika.Message) {
+		pipeline.Publish(NewDeviceMessageEvent(imei, codec, message))
+	}
+	serverTcp.OnPacket = func(imei string, pkt *teltonika.Packet) error {
+		for i := range pkt.Messages {
+			if bridge == nil || !bridge.Deliver(imei, &pkt.Messages[i]) {
+				serverHttp.WriteMessage(imei, pkt.CodecID, &pkt.Messages[i])
+			}
+		}
+		return handleData(imei, pkt)
+	}
+	if config.Ack != nil {
+		ack, err := NewAckPolicy(config.Ack, config.Pipeline != nil, config.Reorder != nil, logger)
+		if err != nil {
+			panic(err)
+		}
+		if ack.Accepted() && dedup != nil {
+			dedup.Deferred = true
+			ack.Dedup = dedup
+		}
+		if ack.Deferred() {
+			serverTcp.Acknowledge = ack.Acknowledge
+		}
+	}
+
+	if config.Pipeline != nil {
+		pipeline.Start(config.Pipeline)
+		serverTcp.Queued = pipeline.Queued
+	}
+	// systemd (Type=notify) gets READY=1 once the servers listen
+	var listening sync.WaitGroup
+	listening.Add(2)
+	serverTcp.OnListen = listening.Done
+	serverHttp.OnListen = listening.Done
 	go func() {
-		panic(serverTcp.Run())
+		if err := serverTcp.Run(); err != nil {
+			panic(err)
+		}
 	}()
-	panic(serverHttp.Run())
-}
-
-func buildJsonPacket(imei string, pkt *teltonika.Packet) []byte {
-	if pkt.Data == nil {
-		return nil
+	var serverUdp *UDPServer
+	if udpAddress != "" {
+		serverUdp = NewUDPServer(udpAddress, 20, logger)
+		serverUdp.Limits = serverTcp.Limits
+		serverUdp.OnPacket = func(imei string, pkt *teltonika.Packet) {
+			_ = handleData(imei, pkt)
+		}
+		listening.Add(1)
+		serverUdp.OnListen = listening.Done
+		go func() {
+			if err := serverUdp.Run(); err != nil {
+				panic(err)
+			}
+		}()
+	}
+	go func() {
+		listening.Wait()
+		if notified, err := sdNotify("READY=1"); err != nil {
+			logger.Error.Printf("%v", err)
+		} else if notified {
+			logger.Info.Println("systemd notified")
+		}
+		sdWatchdog(logger)
+	}()
+	// on SIGTERM the devices are disconnected, the records received are delivered and the state is saved before the
+	// exit, within the grace period (keep it below terminationGracePeriodSeconds or TimeoutStopSec=)
+	shutdown := NewShutdown(shutdownGrace, logger)
+	shutdown.Add("tcp", serverTcp.Shutdown)
+	if serverUdp != nil {
+		shutdown.Add("udp", func(ctx context.Context) error {
+			serverUdp.Shutdown()
+			return nil
+		})
 	}
-	gpsFrames := make([]interface{}, 0)
-	for _, frame := range pkt.Data {
-		gpsFrames = append(gpsFrames, map[string]interface{}{
-			"timestamp": int64(frame.TimestampMs / 1000.0),
-			"lat":       frame.Lat,
-			"lon":       frame.Lng,
+	if reorder != nil {
+		shutdown.Add("reorder", func(ctx context.Context) error {
+			reorder.Flush()
+			return nil
 		})
 	}
-	if len(gpsFrames) == 0 {
+	shutdown.Add("sinks", func(ctx context.Context) error {
+		deadline, _ := ctx.Deadline()
+		if !pipeline.Drain(time.Until(deadline)) {
+			return fmt.Errorf("pipeline not drained")
+		}
+		if !drainSinks(pipeline.Sinks, time.Until(deadline)) {
+			return fmt.Errorf("sink queues not drained")
+		}
 		return nil
+	})
+	if snapshots != nil {
+		shutdown.Add("snapshot", func(ctx context.Context) error {
+			return snapshots.Save()
+		})
 	}
-	values := map[string]interface{}{
-		"deveui": imei,
-		"time":   time.Now().String(),
-		"frames": map[string]interface{}{
-			"gps": gpsFrames,
-		},
+	if memory, ok := stateStore.(*MemoryStateStore); ok && config.State != nil && config.State.Backend == "file" {
+		shutdown.Add("state", func(ctx context.Context) error {
+			return memory.Save(config.State.File)
+		})
 	}
-	jsonValue, _ := json.Marshal(values)
-	return jsonValue
+	if dedup != nil {
+		shutdown.Add("dedup", func(ctx context.Context) error {
+			return dedup.Save()
+		})
+	}
+	if pseudonyms != nil {
+		shutdown.Add("pseudonyms", func(ctx context.Context) error {
+			return pseudonyms.Save()
+		})
+	}
+	if stats != nil && config.Stats.File != "" {
+		shutdown.Add("stats", func(ctx context.Context) error {
+			return stats.Save(config.Stats.File)
+		})
+	}
+	shutdown.Notify()
+	if bridge != nil {
+		go func() {
+			panic(bridge.Run())
+		}()
+	}
+	panic(serverHttp.Run())
 }
 
-func hookSend(outHook string, imei string, pkt *teltonika.Packet, logger *Logger) {
-	jsonValue := buildJsonPacket(imei, pkt)
-	if jsonValue == nil {
-		return
-	}
-	res, err := http.Post(outHook, "application/json", bytes.NewBuffer(jsonValue))
-	if err != nil {
-		logger.Error.Printf("http post error (%v)", err)
-	} else {
-		logger.Info.Printf("packet sent to output hook, status: %s", res.Status)
+func buildJsonPacket(imei string, pkt *AnnotatedPacket) []byte {
+	if len(pkt.Data) == 0 {
+		return nil
 	}
+	return appendHookJson(make([]byte, 0, 128+len(pkt.Data)*64), imei, pkt, time.Now())
 }
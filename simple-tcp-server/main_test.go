@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// testLogger discards the log lines of the tested components
+func testLogger() *Logger {
+	return &Logger{Info: log.New(io.Discard, "", 0), Error: log.New(io.Discard, "", 0)}
+}
+
+// unhex decodes the expected bytes of a table test, spaces are ignored
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestServeCommandAuthorized(t *testing.T) {
+	hs := NewHTTPServerLogger("", nil, testLogger())
+	hs.Operator = func(r *http.Request) (string, bool) {
+		return "alice", r.Header.Get("X-Api-Key") == "k3y"
+	}
+	tests := []struct {
+		name   string
+		method string
+		key    string
+		body   string
+		status int
+	}{
+		{"statuses without key", http.MethodGet, "", "", http.StatusUnauthorized},
+		{"statuses", http.MethodGet, "k3y", "", http.StatusOK},
+		{"command without key", http.MethodPost, "", `{"name": "getver"}`, http.StatusUnauthorized},
+		{"unknown command", http.MethodPost, "k3y", `{"name": "nope"}`, http.StatusBadRequest},
+		{"other method", http.MethodDelete, "k3y", "", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/devices/352093081452251/commands", strings.NewReader(tt.body))
+			if tt.key != "" {
+				r.Header.Set("X-Api-Key", tt.key)
+			}
+			w := httptest.NewRecorder()
+			hs.ServeCommand(w, r, "352093081452251")
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	// a frame of 4 data bytes: the preamble, the data field length, the data and the crc
+	frame := "00000000 00000004 08010000 0000c5f3"
+	tests := []struct {
+		name    string
+		input   string
+		oneByte bool
+		bufSize int
+		want    []string
+		partial *PartialFrameError
+		err     error
+	}{
+		{name: "frame", input: frame, bufSize: 1300, want: []string{frame}},
+		{name: "grown buffer", input: frame, bufSize: frameHeaderSize, want: []string{frame}},
+		{name: "one byte reads", input: frame, oneByte: true, bufSize: 1300, want: []string{frame}},
+		{name: "pipelined frames", input: frame + frame, bufSize: 1300, want: []string{frame, frame}},
+		{name: "closed", input: "", bufSize: 1300, err: io.EOF},
+		{name: "cut header", input: "00000000 0000", bufSize: 1300, partial: &PartialFrameError{Read: 6}},
+		{name: "cut data", input: "00000000 00000004 080100", bufSize: 1300,
+			partial: &PartialFrameError{Read: 11, Size: 16}},
+		{name: "invalid preamble", input: "00000001 00000004 08010000 0000c5f3", bufSize: 1300, err: errInvalidPreamble},
+		{name: "oversized", input: "00000000 00000800", bufSize: 1300, err: &LimitError{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reader io.Reader = bytes.NewReader(unhex(t, tt.input))
+			if tt.oneByte {
+				reader = iotest.OneByteReader(reader)
+			}
+			buf := make([]byte, tt.bufSize)
+			for _, want := range tt.want {
+				var got []byte
+				var err error
+				if buf, got, err = readFrame(reader, buf, 1300); err != nil {
+					t.Fatalf("readFrame() error %v", err)
+				}
+				if !bytes.Equal(got, unhex(t, want)) {
+					t.Errorf("readFrame() = % x, want %s", got, want)
+				}
+			}
+			_, got, err := readFrame(reader, buf, 1300)
+			var partial *PartialFrameError
+			var limit *LimitError
+			switch {
+			case tt.partial != nil:
+				if !errors.As(err, &partial) || partial.Read != tt.partial.Read || partial.Size != tt.partial.Size ||
+					!errors.Is(err, io.ErrUnexpectedEOF) {
+					t.Errorf("readFrame() error %v, want %v", err, tt.partial)
+				}
+			case tt.err == nil || tt.err == io.EOF:
+				if err != io.EOF || got != nil {
+					t.Errorf("readFrame() = % x %v, want EOF", got, err)
+				}
+			case errors.As(tt.err, &limit):
+				if !errors.As(err, &limit) || limit.Value != 2060 || limit.Max != 1300 {
+					t.Errorf("readFrame() error %v, want the packet limit", err)
+				}
+			default:
+				if !errors.Is(err, tt.err) {
+					t.Errorf("readFrame() error %v, want %v", err, tt.err)
+				}
+			}
+		})
+	}
+}
+
+func TestReadLogin(t *testing.T) {
+	login := "000f 333532303933303831343532323531"
+	tests := []struct {
+		name    string
+		input   string
+		oneByte bool
+		want    string
+		err     error
+	}{
+		{name: "login", input: login, want: login},
+		{name: "one byte reads", input: login, oneByte: true, want: login},
+		{name: "first packet follows", input: login + "00000000", want: login},
+		{name: "closed", input: "", err: io.EOF},
+		{name: "cut length", input: "00", err: io.ErrUnexpectedEOF},
+		{name: "cut imei", input: "000f 3335", err: io.ErrUnexpectedEOF},
+		{name: "invalid length", input: "0010 33353230393330383134353232353131", err: errors.New("invalid imei length 16")},
+		{name: "no imei", input: "0000", err: errors.New("invalid imei length 0")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reader io.Reader = bytes.NewReader(unhex(t, tt.input))
+			if tt.oneByte {
+				reader = iotest.OneByteReader(reader)
+			}
+			got, err := readLogin(reader)
+			if tt.err != nil {
+				if err == nil || (!errors.Is(err, tt.err) && err.Error() != tt.err.Error()) {
+					t.Errorf("readLogin() error %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil || !bytes.Equal(got, unhex(t, tt.want)) {
+				t.Errorf("readLogin() = % x %v, want %s", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckImei(t *testing.T) {
+	tests := []struct {
+		imei  string
+		luhn  bool
+		valid bool
+	}{
+		{"352093081452251", false, true},
+		{"352093081452251", true, true},
+		{"490154203237518", true, true},
+		{"490154203237519", false, true},
+		{"490154203237519", true, false},
+		{"35209308145225", false, false},
+		{"3520930814522510", false, false},
+		{"35209308145225a", false, false},
+		{"-52093081452251", false, false},
+		{"", false, false},
+	}
+	for _, tt := range tests {
+		if err := checkImei(tt.imei, tt.luhn); (err == nil) != tt.valid {
+			t.Errorf("checkImei(%q, %v) error %v, want valid %v", tt.imei, tt.luhn, err, tt.valid)
+		}
+	}
+}
+
+// lateHub is a TrackersHub keeping the response channel of the command sent, as a WriteMessage that loaded it
+// before the command timed out
+type lateHub struct {
+	hs     *HTTPServer
+	result interface{}
+}
+
+func (h *lateHub) SendPacket(imei string, _ *teltonika.Packet) error {
+	h.result, _ = h.hs.respChan.Load(imei)
+	return nil
+}
+
+func (h *lateHub) ListClients() []*TCPClient {
+	return nil
+}
+
+func (h *lateHub) Kick(string) bool {
+	return false
+}
+
+func TestExecuteLateResponse(t *testing.T) {
+	hub := &lateHub{}
+	hs := NewHTTPServerLogger("", hub, testLogger())
+	hub.hs = hs
+	if _, err := hs.Execute("352093081452251", "getver", time.Millisecond, "system"); err != errCommandTimeout {
+		t.Fatalf("Execute() error %v, want %v", err, errCommandTimeout)
+	}
+	if _, ok := hs.respChan.Load("352093081452251"); ok {
+		t.Errorf("the response channel is still pending")
+	}
+	// the send of a late response mustn't panic
+	select {
+	case hub.result.(chan *teltonika.Message) <- &teltonika.Message{Type: teltonika.TypeResponse, Text: "late"}:
+	default:
+		t.Errorf("the late response is blocked")
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var mapMatchingMetrics = expvar.NewMap("mapMatching")
+
+// MapMatchingConfig: Provider is "osrm" or "valhalla", Url is the service endpoint (self-hosted,
+// the public demo servers don't allow production use). Profile is the OSRM profile (default "driving")
+// or the valhalla costing (default "auto"). RadiusMeters (default 25) is the GPS accuracy, Context
+// (default 3) is the number of previous fixes of the device sent along with the packet records
+// (the packets of a device carry few records, the matcher needs the trace)
+type MapMatchingConfig struct {
+	Provider     string `json:"provider"`
+	Url          string `json:"url"`
+	Profile      string `json:"profile"`
+	RadiusMeters int    `json:"radiusMeters"`
+	Context      int    `json:"context"`
+}
+
+// MatchedPoint is a trace point snapped to the road, SpeedLimit is in km/h (0 if unknown)
+type MatchedPoint struct {
+	Lat        float64
+	Lng        float64
+	Road       string
+	SpeedLimit float64
+}
+
+// tracePoint is a fix of the trace sent to the map matcher
+type tracePoint struct {
+	Lat  float64
+	Lng  float64
+	Time time.Time
+}
+
+// MapMatcher snaps a trace to the roads, the result has an entry per trace point (nil if the point wasn't matched)
+type MapMatcher interface {
+	Match(trace []tracePoint) ([]*MatchedPoint, error)
+}
+
+func NewMapMatcher(config *MapMatchingConfig) (MapMatcher, error) {
+	if config.Url == "" {
+		return nil, fmt.Errorf("map matching requires url")
+	}
+	client := &http.Client{Timeout: time.Second * 5}
+	radius := config.RadiusMeters
+	if radius <= 0 {
+		radius = 25
+	}
+	endpoint := strings.TrimSuffix(config.Url, "/")
+	switch config.Provider {
+	case "osrm":
+		return &osrmMatcher{url: endpoint, profile: defaultString(config.Profile, "driving"), radius: radius, client: client}, nil
+	case "valhalla":
+		return &valhallaMatcher{url: endpoint, costing: defaultString(config.Profile, "auto"), radius: radius, client: client}, nil
+	}
+	return nil, fmt.Errorf("unknown map matching provider '%s'", config.Provider)
+}
+
+// osrmMaxspeed is an entry of the maxspeed annotation (one per road segment of a leg)
+type osrmMaxspeed struct {
+	Speed   float64 `json:"speed"`
+	Unit    string  `json:"unit"`
+	Unknown bool    `json:"unknown"`
+	None    bool    `json:"none"`
+}
+
+type osrmMatcher struct {
+	url     string
+	profile string
+	radius  int
+	client  *http.Client
+}
+
+func (m *osrmMatcher) Match(trace []tracePoint) ([]*MatchedPoint, error) {
+	coordinates := make([]string, 0, len(trace))
+	timestamps := make([]string, 0, len(trace))
+	radiuses := make([]string, 0, len(trace))
+	for _, p := range trace {
+		coordinates = append(coordinates, formatCoordinate(p.Lng)+","+formatCoordinate(p.Lat))
+		timestamps = append(timestamps, strconv.FormatInt(p.Time.Unix(), 10))
+		radiuses = append(radiuses, strconv.Itoa(m.radius))
+	}
+	query := url.Values{
+		"timestamps":  {strings.Join(timestamps, ";")},
+		"radiuses":    {strings.Join(radiuses, ";")},
+		"annotations": {"maxspeed"},
+		"overview":    {"false"},
+		"tidy":        {"true"},
+		"gaps":        {"ignore"},
+	}
+	var res struct {
+		Code        string `json:"code"`
+		Message     string `json:"message"`
+		Tracepoints []*struct {
+			Location       [2]float64 `json:"location"`
+			Name           string     `json:"name"`
+			MatchingsIndex int        `json:"matchings_index"`
+			WaypointIndex  int        `json:"waypoint_index"`
+		} `json:"tracepoints"`
+		Matchings []struct {
+			Legs []struct {
+				Annotation struct {
+					Maxspeed []osrmMaxspeed `json:"maxspeed"`
+				} `json:"annotation"`
+			} `json:"legs"`
+		} `json:"matchings"`
+	}
+	requestUrl := m.url + "/match/v1/" + m.profile + "/" + strings.Join(coordinates, ";") + "?" + query.Encode()
+	if err := matcherRequest(m.client, http.MethodGet, requestUrl, nil, &res); err != nil {
+		return nil, err
+	}
+	if res.Code == "NoMatch" {
+		return make([]*MatchedPoint, len(trace)), nil
+	}
+	if res.Code != "Ok" {
+		return nil, fmt.Errorf("osrm match error %s (%s)", res.Code, res.Message)
+	}
+	matched := make([]*MatchedPoint, len(trace))
+	for i, tp := range res.Tracepoints {
+		if tp == nil || i >= len(matched) {
+			continue
+		}
+		point := &MatchedPoint{Lat: tp.Location[1], Lng: tp.Location[0], Road: tp.Name}
+		// the speed limit of the leg starting at the point (the last point takes the end of the previous leg)
+		if tp.MatchingsIndex < len(res.Matchings) {
+			legs := res.Matchings[tp.MatchingsIndex].Legs
+			var maxspeeds []osrmMaxspeed
+			index := 0
+			if tp.WaypointIndex < len(legs) {
+				maxspeeds = legs[tp.WaypointIndex].Annotation.Maxspeed
+			} else if len(legs) > 0 {
+				maxspeeds = legs[len(legs)-1].Annotation.Maxspeed
+				index = len(maxspeeds) - 1
+			}
+			if index >= 0 && index < len(maxspeeds) && !maxspeeds[index].Unknown && !maxspeeds[index].None {
+				point.SpeedLimit = maxspeeds[index].Speed
+				if maxspeeds[index].Unit == "mph" {
+					point.SpeedLimit *= 1.609344
+				}
+			}
+		}
+		matched[i] = point
+	}
+	return matched, nil
+}
+
+type valhallaMatcher struct {
+	url     string
+	costing string
+	radius  int
+	client  *http.Client
+}
+
+func (m *valhallaMatcher) Match(trace []tracePoint) ([]*MatchedPoint, error) {
+	shape := make([]map[string]any, 0, len(trace))
+	for _, p := range trace {
+		shape = append(shape, map[string]any{"lat": p.Lat, "lon": p.Lng, "time": p.Time.Unix(), "radius": m.radius})
+	}
+	body, err := json.Marshal(map[string]any{
+		"shape":       shape,
+		"costing":     m.costing,
+		"shape_match": "map_snap",
+		"units":       "kilometers",
+		"filters": map[string]any{
+			"attributes": []string{"edge.names", "edge.speed_limit", "matched.point", "matched.type", "matched.edge_index"},
+			"action":     "include",
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("valhalla request marshaling error (%v)", err)
+	}
+	var res struct {
+		Edges []struct {
+			Names      []string `json:"names"`
+			SpeedLimit any      `json:"speed_limit"`
+		} `json:"edges"`
+		MatchedPoints []struct {
+			Lat       float64 `json:"lat"`
+			Lon       float64 `json:"lon"`
+			Type      string  `json:"type"`
+			EdgeIndex *int    `json:"edge_index"`
+		} `json:"matched_points"`
+	}
+	if err = matcherRequest(m.client, http.MethodPost, m.url+"/trace_attributes", body, &res); err != nil {
+		return nil, err
+	}
+	matched := make([]*MatchedPoint, len(trace))
+	for i, mp := range res.MatchedPoints {
+		if i >= len(matched) || mp.Type == "unmatched" {
+			continue
+		}
+		point := &MatchedPoint{Lat: mp.Lat, Lng: mp.Lon}
+		if mp.EdgeIndex != nil && *mp.EdgeIndex >= 0 && *mp.EdgeIndex < len(res.Edges) {
+			edge := res.Edges[*mp.EdgeIndex]
+			if len(edge.Names) > 0 {
+				point.Road = edge.Names[0]
+			}
+			// speed_limit is a number or "unlimited"
+			if limit, ok := edge.SpeedLimit.(float64); ok {
+				point.SpeedLimit = limit
+			}
+		}
+		matched[i] = point
+	}
+	return matched, nil
+}
+
+func matcherRequest(client *http.Client, method string, requestUrl string, body []byte, v any) error {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, requestUrl, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	// OSRM answers NoMatch with 400 and a json body
+	if res.StatusCode >= 500 {
+		_, _ = io.Copy(io.Discard, res.Body)
+		return fmt.Errorf("map matcher http status %d", res.StatusCode)
+	}
+	if err = json.NewDecoder(res.Body).Decode(v); err != nil {
+		return fmt.Errorf("map matcher response parse error (%v, http status %d)", err, res.StatusCode)
+	}
+	return nil
+}
+
+// MapMatchingEnricher snaps the records with a fix to the roads (Enricher), the attributes are matched_lat,
+// matched_lng, matched_road and speed_limit (km/h)
+type MapMatchingEnricher struct {
+	matcher MapMatcher
+	context int
+	mutex   sync.Mutex
+	traces  map[string][]tracePoint
+}
+
+func NewMapMatchingEnricher(config *MapMatchingConfig) (*MapMatchingEnricher, error) {
+	matcher, err := NewMapMatcher(config)
+	if err != nil {
+		return nil, err
+	}
+	context := config.Context
+	if context <= 0 {
+		context = 3
+	}
+	return &MapMatchingEnricher{matcher: matcher, context: context, traces: make(map[string][]tracePoint)}, nil
+}
+
+func (m *MapMatchingEnricher) Enrich(imei string, pkt *teltonika.Packet) ([]map[string]any, error) {
+	m.mutex.Lock()
+	trace := append([]tracePoint(nil), m.traces[imei]...)
+	m.mutex.Unlock()
+
+	context := len(trace)
+	indexes := make([]int, 0, len(pkt.Data))
+	for i := range pkt.Data {
+		record := &pkt.Data[i]
+		if !hasFix(record) {
+			continue
+		}
+		t := time.UnixMilli(int64(record.TimestampMs))
+		if len(trace) > 0 && !t.After(trace[len(trace)-1].Time) {
+			// the matchers require increasing timestamps
+			continue
+		}
+		trace = append(trace, tracePoint{Lat: record.Lat, Lng: record.Lng, Time: t})
+		indexes = append(indexes, i)
+	}
+	if len(indexes) == 0 {
+		return nil, nil
+	}
+	m.mutex.Lock()
+	keep := len(trace) - m.context
+	if keep < 0 {
+		keep = 0
+	}
+	m.traces[imei] = append([]tracePoint(nil), trace[keep:]...)
+	m.mutex.Unlock()
+	if len(trace) < 2 {
+		return nil, nil
+	}
+
+	mapMatchingMetrics.Add("requests", 1)
+	matched, err := m.matcher.Match(trace)
+	if err != nil {
+		mapMatchingMetrics.Add("errors", 1)
+		return nil, fmt.Errorf("map matching error (%v)", err)
+	}
+	attributes := make([]map[string]any, len(pkt.Data))
+	for n, i := range indexes {
+		if context+n >= len(matched) {
+			break
+		}
+		point := matched[context+n]
+		if point == nil {
+			mapMatchingMetrics.Add("unmatched", 1)
+			continue
+		}
+		values := map[string]any{"matched_lat": point.Lat, "matched_lng": point.Lng}
+		if point.Road != "" {
+			values["matched_road"] = point.Road
+		}
+		if point.SpeedLimit > 0 {
+			values["speed_limit"] = point.SpeedLimit
+		}
+		attributes[i] = values
+	}
+	return attributes, nil
+}
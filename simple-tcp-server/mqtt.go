@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	mqttConnect    = 0x10
+	mqttConnAck    = 0x20
+	mqttPublish    = 0x30
+	mqttPingReq    = 0xC0
+	mqttDisconnect = 0xE0
+)
+
+// MQTTClient is a minimal MQTT 3.1.1 publisher (QoS 0 only), connection is
+// established lazily and re-established on the next publish after an error
+type MQTTClient struct {
+	address   string
+	clientId  string
+	username  string
+	password  string
+	keepAlive time.Duration
+	conn      net.Conn
+	mutex     sync.Mutex
+}
+
+func NewMQTTClient(address string, clientId string, username string, password string) *MQTTClient {
+	c := &MQTTClient{address: address, clientId: clientId, username: username, password: password, keepAlive: time.Second * 60}
+	go c.ping()
+	return c
+}
+
+func (c *MQTTClient) Publish(topic string, payload []byte, retain bool) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return err
+		}
+	}
+
+	flags := byte(mqttPublish)
+	if retain {
+		flags |= 0x01
+	}
+	body := make([]byte, 0, len(topic)+len(payload)+2)
+	body = mqttAppendString(body, topic)
+	body = append(body, payload...)
+
+	if err := c.write(mqttPacket(flags, body)); err != nil {
+		return fmt.Errorf("mqtt publish error (%v)", err)
+	}
+	return nil
+}
+
+func (c *MQTTClient) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.conn == nil {
+		return nil
+	}
+	_ = c.write([]byte{mqttDisconnect, 0})
+	return c.closeConn()
+}
+
+func (c *MQTTClient) connect() error {
+	conn, err := net.DialTimeout("tcp", c.address, time.Second*10)
+	if err != nil {
+		return fmt.Errorf("mqtt dial error (%v)", err)
+	}
+
+	flags := byte(0x02) // clean session
+	if c.username != "" {
+		flags |= 0x80
+	}
+	if c.password != "" {
+		flags |= 0x40
+	}
+	body := mqttAppendString(nil, "MQTT")
+	body = append(body, 4, flags)
+	keepAlive := uint16(c.keepAlive / time.Second)
+	body = append(body, byte(keepAlive>>8), byte(keepAlive))
+	body = mqttAppendString(body, c.clientId)
+	if c.username != "" {
+		body = mqttAppendString(body, c.username)
+	}
+	if c.password != "" {
+		body = mqttAppendString(body, c.password)
+	}
+
+	if err = conn.SetDeadline(time.Now().Add(time.Second * 10)); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	if _, err = conn.Write(mqttPacket(mqttConnect, body)); err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("mqtt connect write error (%v)", err)
+	}
+	ack := make([]byte, 4)
+	if _, err = io.ReadFull(conn, ack); err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("mqtt connack read error (%v)", err)
+	}
+	if ack[0] != mqttConnAck || ack[3] != 0 {
+		_ = conn.Close()
+		return fmt.Errorf("mqtt connection refused (code: %d)", ack[3])
+	}
+	if err = conn.SetDeadline(time.Time{}); err != nil {
+		_ = conn.Close()
+		return err
+	}
+
+	c.conn = conn
+	go c.discard(conn)
+	return nil
+}
+
+func (c *MQTTClient) write(packet []byte) error {
+	if err := c.conn.SetWriteDeadline(time.Now().Add(time.Second * 10)); err != nil {
+		_ = c.closeConn()
+		return err
+	}
+	if _, err := c.conn.Write(packet); err != nil {
+		_ = c.closeConn()
+		return err
+	}
+	return nil
+}
+
+func (c *MQTTClient) closeConn() error {
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// discard consumes broker packets (PINGRESP only with QoS 0) until the connection breaks
+func (c *MQTTClient) discard(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	for {
+		if _, err := reader.ReadByte(); err != nil {
+			break
+		}
+		size, err := mqttReadLength(reader)
+		if err != nil {
+			break
+		}
+		if _, err = reader.Discard(size); err != nil {
+			break
+		}
+	}
+	c.mutex.Lock()
+	if c.conn == conn {
+		_ = c.closeConn()
+	}
+	c.mutex.Unlock()
+}
+
+func (c *MQTTClient) ping() {
+	ticker := time.NewTicker(c.keepAlive / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.mutex.Lock()
+		if c.conn != nil {
+			_ = c.write([]byte{mqttPingReq, 0})
+		}
+		c.mutex.Unlock()
+	}
+}
+
+func mqttPacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+	size := len(body)
+	for {
+		b := byte(size % 128)
+		size /= 128
+		if size > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if size == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+func mqttAppendString(buf []byte, s string) []byte {
+	buf = append(buf, byte(len(s)>>8), byte(len(s)))
+	return append(buf, s...)
+}
+
+func mqttReadLength(reader *bufio.Reader) (int, error) {
+	size, multiplier := 0, 1
+	for i := 0; i < 4; i++ {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		size += int(b&0x7F) * multiplier
+		if b&0x80 == 0 {
+			return size, nil
+		}
+		multiplier *= 128
+	}
+	return 0, errors.New("malformed remaining length")
+}
+
+type mqttMessage struct {
+	imei    string
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+type MQTTSink struct {
+	client        *MQTTClient
+	topicPrefix   string
+	discovery     *HomeAssistantDiscovery
+	cloudEvents   bool
+	encoder       *ValueEncoder
+	queue         chan mqttMessage
+	pending       int64
+	logger        *Logger
+	retryInterval time.Duration
+	maxAttempts   int
+	DeadLetters   DeadLetterQueue
+	Breaker       *CircuitBreaker
+	Pseudonyms    *Pseudonymizer
+}
+
+func NewMQTTSink(client *MQTTClient, topicPrefix string, logger *Logger) *MQTTSink {
+	s := &MQTTSink{
+		client:        client,
+		topicPrefix:   topicPrefix,
+		encoder:       valueEncoders["json"],
+		queue:         make(chan mqttMessage, 1000),
+		logger:        logger,
+		retryInterval: time.Second * 5,
+		maxAttempts:   10,
+	}
+	go s.run()
+	return s
+}
+
+func (s *MQTTSink) StateTopic(imei string) string {
+	return s.topicPrefix + "/" + imei + "/state"
+}
+
+func (s *MQTTSink) Send(imei string, pkt *AnnotatedPacket) error {
+	imei, pkt = s.Pseudonyms.Packet(imei, pkt)
+	// backfill records are history, they're flagged and don't replace the retained state
+	backfill := pkt.Backfill
+	for i, record := range pkt.Data {
+		state := map[string]any{
+			"timestamp":  record.TimestampMs,
+			"latitude":   record.Lat,
+			"longitude":  record.Lng,
+			"altitude":   record.Altitude,
+			"angle":      record.Angle,
+			"speed":      record.Speed,
+			"satellites": record.Satellites,
+			"priority":   record.Priority,
+			"event_id":   record.EventID,
+		}
+		for _, el := range record.Elements {
+			state["io_"+strconv.Itoa(int(el.Id))] = ioElementValue(el.Value)
+		}
+		for k, v := range pkt.RecordAttributes(i) {
+			state[k] = v
+		}
+		if backfill {
+			state["backfill"] = true
+		}
+
+		if s.discovery != nil {
+			for _, msg := range s.discovery.Announce(imei, s.StateTopic(imei), &record) {
+				if err := s.enqueue(msg); err != nil {
+					return err
+				}
+			}
+		}
+
+		payload, err := s.encoder.Marshal(state)
+		if err == nil && s.cloudEvents {
+			ts := time.UnixMilli(int64(record.TimestampMs))
+			payload, err = json.Marshal(newCloudEvent(cloudEventRecordType, imei, ts, s.encoder.ContentType, payload))
+		}
+		if err != nil {
+			return fmt.Errorf("mqtt state marshaling error (%v)", err)
+		}
+		if err = s.enqueue(mqttMessage{imei: imei, topic: s.StateTopic(imei), payload: payload, retain: !backfill}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EventsTopic receives the events of the device (not retained)
+func (s *MQTTSink) EventsTopic(imei string) string {
+	return s.topicPrefix + "/" + imei + "/events"
+}
+
+func (s *MQTTSink) SendEvent(event *Event) error {
+	event = s.Pseudonyms.Event(event)
+	var payload []byte
+	var err error
+	if s.encoder == valueEncoders["json"] {
+		payload, err = json.Marshal(event)
+	} else {
+		payload, err = s.encoder.Marshal(event.Value())
+	}
+	if err == nil && s.cloudEvents {
+		payload, err = json.Marshal(newCloudEvent(cloudEventTypePrefix+event.Type, event.Imei, event.Time, s.encoder.ContentType, payload))
+	}
+	if err != nil {
+		return fmt.Errorf("mqtt event marshaling error (%v)", err)
+	}
+	return s.enqueue(mqttMessage{imei: event.Imei, topic: s.EventsTopic(event.Imei), payload: payload})
+}
+
+func (s *MQTTSink) enqueue(msg mqttMessage) error {
+	atomic.AddInt64(&s.pending, 1)
+	select {
+	case s.queue <- msg:
+		return nil
+	default:
+		atomic.AddInt64(&s.pending, -1)
+		return fmt.Errorf("mqtt queue is full, message to '%s' dropped", msg.topic)
+	}
+}
+
+func (s *MQTTSink) run() {
+	for msg := range s.queue {
+		for attempt := 1; ; attempt++ {
+			s.Breaker.Wait()
+			err := s.client.Publish(msg.topic, msg.payload, msg.retain)
+			s.Breaker.Done(err)
+			if err == nil {
+				break
+			}
+			s.logger.Error.Printf("mqtt error (%v)", err)
+			if s.Breaker.Open() {
+				attempt = 0
+				continue
+			}
+			if attempt >= s.maxAttempts {
+				letter := NewDeadLetter(s.Name(), msg.imei, msg.topic, msg.payload, attempt, err)
+				letter.ContentType = s.encoder.ContentType
+				putDeadLetter(s.DeadLetters, letter, s.logger)
+				break
+			}
+			time.Sleep(s.retryInterval)
+		}
+		atomic.AddInt64(&s.pending, -1)
+	}
+}
+
+// Drain waits until the queued messages are published or dead lettered
+func (s *MQTTSink) Drain(timeout time.Duration) bool {
+	return waitDrained(timeout, func() bool { return atomic.LoadInt64(&s.pending) == 0 })
+}
+
+func (s *MQTTSink) Name() string {
+	return "mqtt:" + s.client.address
+}
+
+func (s *MQTTSink) Redeliver(letter *DeadLetter) error {
+	return s.client.Publish(letter.Target, letter.Bytes(), true)
+}
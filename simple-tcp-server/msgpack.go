@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// MarshalMsgpack encodes values built from maps with string keys, slices, strings,
+// byte slices, bools, integers and floats (keys are sorted so the output is stable)
+func MarshalMsgpack(v any) ([]byte, error) {
+	return appendMsgpack(nil, v)
+}
+
+func appendMsgpack(buf []byte, v any) ([]byte, error) {
+	switch value := v.(type) {
+	case nil:
+		return append(buf, 0xc0), nil
+	case bool:
+		if value {
+			return append(buf, 0xc3), nil
+		}
+		return append(buf, 0xc2), nil
+	case float64:
+		buf = append(buf, 0xcb)
+		return binary.BigEndian.AppendUint64(buf, math.Float64bits(value)), nil
+	case float32:
+		buf = append(buf, 0xcb)
+		return binary.BigEndian.AppendUint64(buf, math.Float64bits(float64(value))), nil
+	case string:
+		return appendMsgpackString(buf, value), nil
+	case []byte:
+		return appendMsgpackBinary(buf, value), nil
+	case []any:
+		buf = appendMsgpackHeader(buf, len(value), 0x90, 0xdc, 0xdd)
+		var err error
+		for _, item := range value {
+			if buf, err = appendMsgpack(buf, item); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case map[string]any:
+		keys := sortedKeys(value)
+		buf = appendMsgpackHeader(buf, len(keys), 0x80, 0xde, 0xdf)
+		var err error
+		for _, key := range keys {
+			buf = appendMsgpackString(buf, key)
+			if buf, err = appendMsgpack(buf, value[key]); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	}
+
+	if u, ok := asUint64(v); ok {
+		return appendMsgpackUint(buf, u), nil
+	}
+	if i, ok := asInt64(v); ok {
+		if i >= 0 {
+			return appendMsgpackUint(buf, uint64(i)), nil
+		}
+		return appendMsgpackInt(buf, i), nil
+	}
+	return nil, fmt.Errorf("msgpack: unsupported type %T", v)
+}
+
+func appendMsgpackUint(buf []byte, u uint64) []byte {
+	switch {
+	case u <= 0x7f:
+		return append(buf, byte(u))
+	case u <= math.MaxUint8:
+		return append(buf, 0xcc, byte(u))
+	case u <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xcd), uint16(u))
+	case u <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xce), uint32(u))
+	default:
+		return binary.BigEndian.AppendUint64(append(buf, 0xcf), u)
+	}
+}
+
+func appendMsgpackInt(buf []byte, i int64) []byte {
+	switch {
+	case i >= -32:
+		return append(buf, byte(i))
+	case i >= math.MinInt8:
+		return append(buf, 0xd0, byte(i))
+	case i >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xd1), uint16(i))
+	case i >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xd2), uint32(i))
+	default:
+		return binary.BigEndian.AppendUint64(append(buf, 0xd3), uint64(i))
+	}
+}
+
+func appendMsgpackString(buf []byte, s string) []byte {
+	switch {
+	case len(s) <= 31:
+		buf = append(buf, 0xa0|byte(len(s)))
+	case len(s) <= math.MaxUint8:
+		buf = append(buf, 0xd9, byte(len(s)))
+	case len(s) <= math.MaxUint16:
+		buf = binary.BigEndian.AppendUint16(append(buf, 0xda), uint16(len(s)))
+	default:
+		buf = binary.BigEndian.AppendUint32(append(buf, 0xdb), uint32(len(s)))
+	}
+	return append(buf, s...)
+}
+
+func appendMsgpackBinary(buf []byte, b []byte) []byte {
+	switch {
+	case len(b) <= math.MaxUint8:
+		buf = append(buf, 0xc4, byte(len(b)))
+	case len(b) <= math.MaxUint16:
+		buf = binary.BigEndian.AppendUint16(append(buf, 0xc5), uint16(len(b)))
+	default:
+		buf = binary.BigEndian.AppendUint32(append(buf, 0xc6), uint32(len(b)))
+	}
+	return append(buf, b...)
+}
+
+func appendMsgpackHeader(buf []byte, size int, fix byte, head16 byte, head32 byte) []byte {
+	switch {
+	case size <= 15:
+		return append(buf, fix|byte(size))
+	case size <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, head16), uint16(size))
+	default:
+		return binary.BigEndian.AppendUint32(append(buf, head32), uint32(size))
+	}
+}
+
+// joinMsgpack builds an array from encoded values
+func joinMsgpack(payloads [][]byte) []byte {
+	buf := appendMsgpackHeader(nil, len(payloads), 0x90, 0xdc, 0xdd)
+	for _, p := range payloads {
+		buf = append(buf, p...)
+	}
+	return buf
+}
+
+func asUint64(v any) (uint64, bool) {
+	switch value := v.(type) {
+	case uint:
+		return uint64(value), true
+	case uint8:
+		return uint64(value), true
+	case uint16:
+		return uint64(value), true
+	case uint32:
+		return uint64(value), true
+	case uint64:
+		return value, true
+	}
+	return 0, false
+}
+
+func asInt64(v any) (int64, bool) {
+	switch value := v.(type) {
+	case int:
+		return int64(value), true
+	case int8:
+		return int64(value), true
+	case int16:
+		return int64(value), true
+	case int32:
+		return int64(value), true
+	case int64:
+		return value, true
+	}
+	return 0, false
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
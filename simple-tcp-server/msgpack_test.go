@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMarshalMsgpack(t *testing.T) {
+	tests := []struct {
+		name  string
+		value any
+		want  string
+	}{
+		{"nil", nil, "c0"},
+		{"false", false, "c2"},
+		{"true", true, "c3"},
+		{"positive fixint", 127, "7f"},
+		{"uint8", uint8(128), "cc 80"},
+		{"uint16", 256, "cd 01 00"},
+		{"uint32", uint32(65536), "ce 00 01 00 00"},
+		{"uint64", uint64(1) << 32, "cf 00 00 00 01 00 00 00 00"},
+		{"negative fixint", -1, "ff"},
+		{"negative fixint min", int8(-32), "e0"},
+		{"int8", -33, "d0 df"},
+		{"int16", int16(-129), "d1 ff 7f"},
+		{"int32", int32(-32769), "d2 ff ff 7f ff"},
+		{"int64", int64(-1) << 40, "d3 ff ff ff 00 00 00 00 00"},
+		{"float64", 1.5, "cb 3f f8 00 00 00 00 00 00"},
+		{"float32 as float64", float32(0.5), "cb 3f e0 00 00 00 00 00 00"},
+		{"fixstr", "a", "a1 61"},
+		{"str8", strings.Repeat("x", 32), "d9 20" + strings.Repeat(" 78", 32)},
+		{"bin8", []byte{1, 2}, "c4 02 01 02"},
+		{"fixarray", []any{1, "a"}, "92 01 a1 61"},
+		{"array16", make([]any, 16), "dc 00 10" + strings.Repeat(" c0", 16)},
+		{"map sorted keys", map[string]any{"b": 1, "a": 2}, "82 a1 61 02 a1 62 01"},
+		{"nested", map[string]any{"io": map[string]any{"x": []any{}}}, "81 a2 69 6f 81 a1 78 90"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MarshalMsgpack(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := unhex(t, tt.want); !bytes.Equal(got, want) {
+				t.Errorf("got % x, want % x", got, want)
+			}
+		})
+	}
+}
+
+func TestMarshalMsgpackUnsupported(t *testing.T) {
+	for _, value := range []any{struct{}{}, map[string]any{"a": []any{complex(1, 2)}}, []string{"a"}} {
+		if _, err := MarshalMsgpack(value); err == nil {
+			t.Errorf("no error for %T", value)
+		}
+	}
+}
+
+func TestJoinMsgpack(t *testing.T) {
+	if got, want := joinMsgpack([][]byte{{0x01}, {0xa1, 0x61}}), unhex(t, "92 01 a1 61"); !bytes.Equal(got, want) {
+		t.Errorf("got % x, want % x", got, want)
+	}
+}
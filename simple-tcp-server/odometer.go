@@ -0,0 +1,166 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// OdometerConfig: fixes implying a speed over MaxSpeedKmh from the previous fix are dropped as jumps,
+// Days is how many days of daily distance are kept per device
+type OdometerConfig struct {
+	MaxSpeedKmh   float64 `json:"maxSpeedKmh"`
+	MinSatellites int     `json:"minSatellites"`
+	Days          int     `json:"days"`
+}
+
+// Odometer is the distance of a device: TotalMeters follows the device odometer IO (16) when the device
+// sends it and continues from the last reading with GNSS distance, GpsMeters is the GNSS distance only
+type Odometer struct {
+	TotalMeters       float64            `json:"totalMeters"`
+	GpsMeters         float64            `json:"gpsMeters"`
+	DeviceMeters      *uint64            `json:"deviceMeters,omitempty"`
+	DeviceReadingTime *time.Time         `json:"deviceReadingTime,omitempty"`
+	Updated           time.Time          `json:"updated"`
+	Days              map[string]float64 `json:"days"`
+}
+
+// OdometerService accumulates the distance between valid fixes per device
+type OdometerService struct {
+	maxSpeed      float64
+	minSatellites uint8
+	days          int
+	devices       sync.Map
+}
+
+type odometerDevice struct {
+	mutex    sync.Mutex
+	odometer Odometer
+	lastFix  *teltonika.Data
+	rejected int
+}
+
+func NewOdometerService(config *OdometerConfig) *OdometerService {
+	o := &OdometerService{maxSpeed: 250, minSatellites: 4, days: 31}
+	if config == nil {
+		return o
+	}
+	if config.MaxSpeedKmh > 0 {
+		o.maxSpeed = config.MaxSpeedKmh
+	}
+	if config.MinSatellites > 0 {
+		o.minSatellites = uint8(config.MinSatellites)
+	}
+	if config.Days > 0 {
+		o.days = config.Days
+	}
+	return o
+}
+
+func (o *OdometerService) device(imei string) *odometerDevice {
+	value, _ := o.devices.LoadOrStore(imei, &odometerDevice{odometer: Odometer{Days: make(map[string]float64)}})
+	return value.(*odometerDevice)
+}
+
+func (o *OdometerService) Process(imei string, pkt *teltonika.Packet) []*Event {
+	device := o.device(imei)
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	odometer := &device.odometer
+	for i := range pkt.Data {
+		record := pkt.Data[i]
+		record.Elements = nil
+		recordTime := time.UnixMilli(int64(record.TimestampMs)).UTC()
+
+		if value, ok := ioUint(&pkt.Data[i], ioNames["totalOdometer"]); ok {
+			if odometer.DeviceReadingTime == nil || !recordTime.Before(*odometer.DeviceReadingTime) {
+				odometer.DeviceMeters, odometer.DeviceReadingTime = &value, &recordTime
+				odometer.TotalMeters = float64(value)
+			}
+		}
+
+		if !hasFix(&record) || record.Satellites < o.minSatellites {
+			continue
+		}
+		last := device.lastFix
+		if last == nil || record.TimestampMs <= last.TimestampMs {
+			if last == nil {
+				device.lastFix = &record
+			}
+			continue
+		}
+		meters := haversine(last.Lat, last.Lng, record.Lat, record.Lng)
+		seconds := float64(record.TimestampMs-last.TimestampMs) / 1000
+		if meters/seconds*3.6 > o.maxSpeed {
+			// a jump, after a few rejected fixes in a row the device is assumed to be there (gap in data)
+			if device.rejected++; device.rejected >= 3 {
+				device.lastFix, device.rejected = &record, 0
+			}
+			continue
+		}
+		device.rejected = 0
+		device.lastFix = &record
+
+		odometer.GpsMeters += meters
+		if odometer.DeviceReadingTime == nil || recordTime.After(*odometer.DeviceReadingTime) {
+			odometer.TotalMeters += meters
+		}
+		odometer.Days[recordTime.Format("2006-01-02")] += meters
+		odometer.Updated = recordTime
+		o.pruneDays(odometer)
+	}
+	return nil
+}
+
+func (o *OdometerService) pruneDays(odometer *Odometer) {
+	if len(odometer.Days) <= o.days {
+		return
+	}
+	days := make([]string, 0, len(odometer.Days))
+	for day := range odometer.Days {
+		days = append(days, day)
+	}
+	sort.Strings(days)
+	for _, day := range days[:len(days)-o.days] {
+		delete(odometer.Days, day)
+	}
+}
+
+// Odometer returns a copy of the device odometer, distances rounded to meters
+func (o *OdometerService) Odometer(imei string) Odometer {
+	device := o.device(imei)
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+	odometer := device.odometer
+	odometer.TotalMeters = math.Round(odometer.TotalMeters)
+	odometer.GpsMeters = math.Round(odometer.GpsMeters)
+	odometer.Days = make(map[string]float64, len(device.odometer.Days))
+	for day, meters := range device.odometer.Days {
+		odometer.Days[day] = math.Round(meters)
+	}
+	return odometer
+}
+
+func (o *OdometerService) TotalMeters(imei string) float64 {
+	device := o.device(imei)
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+	return math.Round(device.odometer.TotalMeters)
+}
+
+// ServeHTTP handles GET /devices/{imei}/odometer
+func (o *OdometerService) ServeHTTP(w http.ResponseWriter, r *http.Request, imei string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJson(w, http.StatusOK, o.Odometer(imei))
+}
+
+// Purge forgets the device (a Purger)
+func (o *OdometerService) Purge(imei string) (int, error) {
+	return purgeSyncMap(&o.devices, imei), nil
+}
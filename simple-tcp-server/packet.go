@@ -0,0 +1,73 @@
+package main
+
+// AnnotatedPacket is a packet with the annotations the stages attach to it on its way to the sinks: the attributes
+// of the records (by record index, see EnrichStage), the backfill flag (see ReorderStage) and the fields every record
+// changed in the device state (see StateService). The annotations travel with the packet, a stage or sink deriving
+// a packet of some of the records keeps them with Derive. Key is the idempotency key of a reprocessed packet (see
+// ReprocessRecordings), empty for the live packets
+type AnnotatedPacket struct {
+	*teltonika.Packet
+	Attributes []map[string]any
+	Backfill   bool
+	Changes    []map[string]any
+	Key        string
+	// storage is the memory of a pooled copy (see PipelineConfig.Pooled), shared by the packets derived from it
+	storage *packetStorage
+}
+
+// Release puts the memory of a pooled packet back to the pool, the pipeline calls it once the processors and the
+// sinks handled the packet: the records and the IO values of the packet and of the packets derived from it must not
+// be used after. The packets a stage drops or holds back aren't released, the garbage collector takes them. It does
+// nothing for the packets that aren't pooled
+func (p *AnnotatedPacket) Release() {
+	if p.storage != nil {
+		p.storage.release()
+	}
+}
+
+// RecordAttributes returns the attributes attached to the i-th record, nil if there are none
+func (p *AnnotatedPacket) RecordAttributes(i int) map[string]any {
+	if i < 0 || i >= len(p.Attributes) {
+		return nil
+	}
+	return p.Attributes[i]
+}
+
+// RecordChanges returns the fields the i-th record changed in the device state, false if they aren't known
+func (p *AnnotatedPacket) RecordChanges(i int) (map[string]any, bool) {
+	if i < 0 || i >= len(p.Changes) {
+		return nil, false
+	}
+	return p.Changes[i], true
+}
+
+// Derive returns a packet of records, the record at i derived from the record at indexes[i] of p (nil indexes if
+// the records are in the order of p), with their attributes and changes, the backfill flag, the key, the messages
+// and the pooled storage of p
+func (p *AnnotatedPacket) Derive(records []teltonika.Data, indexes []int) *AnnotatedPacket {
+	derived := &AnnotatedPacket{
+		Packet:   &teltonika.Packet{CodecID: p.CodecID, Data: records, Messages: p.Messages},
+		Backfill: p.Backfill,
+		Key:      p.Key,
+		storage:  p.storage,
+	}
+	index := func(i int) int {
+		if indexes != nil {
+			return indexes[i]
+		}
+		return i
+	}
+	if len(p.Attributes) > 0 {
+		derived.Attributes = make([]map[string]any, len(records))
+		for i := range records {
+			derived.Attributes[i] = p.RecordAttributes(index(i))
+		}
+	}
+	if len(p.Changes) > 0 {
+		derived.Changes = make([]map[string]any, len(records))
+		for i := range records {
+			derived.Changes[i], _ = p.RecordChanges(index(i))
+		}
+	}
+	return derived
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"runtime/debug"
+)
+
+var panicMetrics = expvar.NewMap("panics")
+
+// PanicError is a panic recovered in a callback or a sink, Where is the callback ("OnPacket", "OnConnect",
+// "OnClose"), "sink" / "eventSink" or, in the pipeline workers, "stage" / "processor". A panicking callback costs
+// the packet or the event, not the gateway
+type PanicError struct {
+	Where string
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic in %s (%v)", e.Where, e.Value)
+}
+
+// safeCall runs f, a panic is recovered, counted in the panics metrics and returned as a *PanicError
+func safeCall(where string, f func() error) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			panicMetrics.Add(where, 1)
+			err = &PanicError{Where: where, Value: v, Stack: debug.Stack()}
+		}
+	}()
+	return f()
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ParameterSpec describes a device configuration parameter: Type is "uint" (Min/Max is the value range)
+// or "string" (Min/Max is the length range)
+type ParameterSpec struct {
+	Id   uint16 `json:"id"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Min  int64  `json:"min"`
+	Max  int64  `json:"max"`
+}
+
+// fmbParameters is the catalog of the common FMB1xx parameters (GPRS, server, sleep, data acquisition),
+// parameters missing from it are still accepted by id, unvalidated
+var fmbParameters = []*ParameterSpec{
+	{Id: 102, Name: "sleepMode", Type: "uint", Min: 0, Max: 4},
+	{Id: 2001, Name: "apn", Type: "string", Min: 0, Max: 32},
+	{Id: 2002, Name: "apnUsername", Type: "string", Min: 0, Max: 30},
+	{Id: 2003, Name: "apnPassword", Type: "string", Min: 0, Max: 30},
+	{Id: 2004, Name: "serverDomain", Type: "string", Min: 0, Max: 55},
+	{Id: 2005, Name: "serverPort", Type: "uint", Min: 0, Max: 65535},
+	{Id: 2006, Name: "serverProtocol", Type: "uint", Min: 0, Max: 1},
+	{Id: 10000, Name: "homeStopMinPeriod", Type: "uint", Min: 0, Max: 2592000},
+	{Id: 10004, Name: "homeStopMinSavedRecords", Type: "uint", Min: 1, Max: 255},
+	{Id: 10005, Name: "homeStopSendPeriod", Type: "uint", Min: 0, Max: 2592000},
+	{Id: 10050, Name: "homeMovingMinPeriod", Type: "uint", Min: 0, Max: 2592000},
+	{Id: 10051, Name: "homeMovingMinDistance", Type: "uint", Min: 0, Max: 65535},
+	{Id: 10052, Name: "homeMovingMinAngle", Type: "uint", Min: 0, Max: 180},
+	{Id: 10053, Name: "homeMovingMinSpeedDelta", Type: "uint", Min: 0, Max: 255},
+	{Id: 10054, Name: "homeMovingMinSavedRecords", Type: "uint", Min: 1, Max: 255},
+	{Id: 10055, Name: "homeMovingSendPeriod", Type: "uint", Min: 0, Max: 2592000},
+}
+
+var parametersById, parametersByName = func() (map[uint16]*ParameterSpec, map[string]*ParameterSpec) {
+	byId := make(map[uint16]*ParameterSpec, len(fmbParameters))
+	byName := make(map[string]*ParameterSpec, len(fmbParameters))
+	for _, spec := range fmbParameters {
+		byId[spec.Id], byName[spec.Name] = spec, spec
+	}
+	return byId, byName
+}()
+
+// parameterId resolves a parameter name or id
+func parameterId(key string) (uint16, error) {
+	if spec, ok := parametersByName[key]; ok {
+		return spec.Id, nil
+	}
+	id, err := strconv.ParseUint(key, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("unknown parameter '%s'", key)
+	}
+	return uint16(id), nil
+}
+
+// Format converts a value (string, integer or bool) to the parameter text and checks the range
+func (p *ParameterSpec) Format(value any) (string, error) {
+	var text string
+	switch v := value.(type) {
+	case string:
+		text = v
+	case bool:
+		text = "0"
+		if v {
+			text = "1"
+		}
+	case float64:
+		if v != float64(int64(v)) {
+			return "", fmt.Errorf("parameter %s: %v isn't an integer", p.Name, v)
+		}
+		text = strconv.FormatInt(int64(v), 10)
+	case int, int64, uint16, uint32, uint64:
+		text = fmt.Sprint(v)
+	default:
+		return "", fmt.Errorf("parameter %s: unsupported value type %T", p.Name, value)
+	}
+	if _, err := p.Parse(text); err != nil {
+		return "", err
+	}
+	return text, nil
+}
+
+// Parse converts the parameter text to its typed value (int64 or string) and checks the range
+func (p *ParameterSpec) Parse(text string) (any, error) {
+	switch p.Type {
+	case "uint":
+		v, err := strconv.ParseInt(text, 10, 64)
+		if err != nil || v < p.Min || v > p.Max {
+			return nil, fmt.Errorf("parameter %s: value '%s' out of range %d-%d", p.Name, text, p.Min, p.Max)
+		}
+		return v, nil
+	default:
+		if int64(len(text)) < p.Min || int64(len(text)) > p.Max {
+			return nil, fmt.Errorf("parameter %s: length %d out of range %d-%d", p.Name, len(text), p.Min, p.Max)
+		}
+		return text, nil
+	}
+}
+
+// SetParamCommandFromMap builds setparam from parameter names (or ids) to values, catalog
+// parameters are validated
+func SetParamCommandFromMap(values map[string]any) (*Command, error) {
+	params := make(map[uint16]string, len(values))
+	for key, value := range values {
+		id, err := parameterId(key)
+		if err != nil {
+			return nil, err
+		}
+		spec, ok := parametersById[id]
+		if !ok {
+			spec = &ParameterSpec{Id: id, Name: key, Type: "string", Max: 255}
+		}
+		if params[id], err = spec.Format(value); err != nil {
+			return nil, err
+		}
+	}
+	return SetParamCommand(params)
+}
+
+// ParameterValue is a parameter read by getparam, Value is typed for catalog parameters (raw text otherwise)
+type ParameterValue struct {
+	Id    uint16 `json:"id"`
+	Name  string `json:"name,omitempty"`
+	Value any    `json:"value"`
+}
+
+var getParamResponse = regexp.MustCompile(`Param ID:\s*(\d+)\s+Value:([^;]*)`)
+
+// ParseGetParamResponse parses the getparam response ("Param ID:2001 Value:internet", several separated by ';')
+func ParseGetParamResponse(text string) ([]*ParameterValue, error) {
+	matches := getParamResponse.FindAllStringSubmatch(text, -1)
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("unexpected getparam response '%s'", text)
+	}
+	values := make([]*ParameterValue, 0, len(matches))
+	for _, match := range matches {
+		id, err := strconv.ParseUint(match[1], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected getparam response '%s'", text)
+		}
+		raw := strings.TrimSpace(match[2])
+		value := &ParameterValue{Id: uint16(id), Value: raw}
+		if spec, ok := parametersById[value.Id]; ok {
+			value.Name = spec.Name
+			if typed, err := spec.Parse(raw); err == nil {
+				value.Value = typed
+			}
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var pipelineMetrics = expvar.NewMap("pipeline")
+
+// PipelineConfig: with the section the pipeline runs in its own workers instead of the connection goroutines (the
+// decode stage): the stages (enrich) run in EnrichWorkers and the processors and sinks (fan-out) in FanoutWorkers
+// workers (default 4 each), every worker is fed by a queue of QueueSize packets (default 1000). The packets of a
+// device always go to the same worker so they keep their order. A full queue blocks the connection until there's
+// room, a slow sink slows the reading of the devices down instead of growing the memory. With Pooled the copies of
+// the queued packets come from a pool and go back to it once the fan-out handled them (see AnnotatedPacket.Release)
+type PipelineConfig struct {
+	EnrichWorkers int  `json:"enrichWorkers"`
+	FanoutWorkers int  `json:"fanoutWorkers"`
+	QueueSize     int  `json:"queueSize"`
+	Pooled        bool `json:"pooled"`
+}
+
+type pipelineItem struct {
+	imei   string
+	pkt    *AnnotatedPacket
+	queued time.Time
+	size   int64
+}
+
+// pipelineStage is a set of workers with a bounded queue each, its metrics are the queued packets, the handled
+// packets, the total time the packets waited in the queue (waitUs) and the total handling time (latencyUs). The
+// bytes of the queued packets are counted per device in bytes until the packet is handled
+type pipelineStage struct {
+	queues  []chan pipelineItem
+	metrics *expvar.Map
+	bytes   *sync.Map
+	// pending counts the packets queued or being handled
+	pending int64
+}
+
+func newPipelineStage(name string, workers int, size int, bytes *sync.Map, handle func(imei string, pkt *AnnotatedPacket)) *pipelineStage {
+	s := &pipelineStage{queues: make([]chan pipelineItem, workers), metrics: new(expvar.Map).Init(), bytes: bytes}
+	s.metrics.Set("queued", expvar.Func(func() any {
+		queued := 0
+		for _, queue := range s.queues {
+			queued += len(queue)
+		}
+		return queued
+	}))
+	pipelineMetrics.Set(name, s.metrics)
+	for i := range s.queues {
+		queue := make(chan pipelineItem, size)
+		s.queues[i] = queue
+		go func() {
+			for item := range queue {
+				start := time.Now()
+				handle(item.imei, item.pkt)
+				s.metrics.Add("waitUs", start.Sub(item.queued).Microseconds())
+				s.metrics.Add("latencyUs", time.Since(start).Microseconds())
+				s.metrics.Add("packets", 1)
+				s.count(item.imei, -item.size)
+				atomic.AddInt64(&s.pending, -1)
+			}
+		}()
+	}
+	return s
+}
+
+// push queues the packet to the worker of the device (FNV-1a of the imei)
+func (s *pipelineStage) push(imei string, pkt *AnnotatedPacket) {
+	hash := uint32(2166136261)
+	for i := 0; i < len(imei); i++ {
+		hash = (hash ^ uint32(imei[i])) * 16777619
+	}
+	size := packetBytes(pkt.Packet)
+	s.count(imei, size)
+	atomic.AddInt64(&s.pending, 1)
+	s.queues[hash%uint32(len(s.queues))] <- pipelineItem{imei: imei, pkt: pkt, queued: time.Now(), size: size}
+}
+
+func (s *pipelineStage) count(imei string, delta int64) {
+	counter, ok := s.bytes.Load(imei)
+	if !ok {
+		counter, _ = s.bytes.LoadOrStore(imei, new(int64))
+	}
+	atomic.AddInt64(counter.(*int64), delta)
+}
+
+// Drain waits for the packets queued in the workers to be handled, false if some are still there after timeout. The
+// enrich workers are checked first, they queue to the fan-out workers
+func (p *Pipeline) Drain(timeout time.Duration) bool {
+	if p.enrich == nil {
+		return true
+	}
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&p.enrich.pending) > 0 || atomic.LoadInt64(&p.fanout.pending) > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	return true
+}
+
+// Queued returns the bytes of the packets of the device waiting in the workers (0 if the pipeline isn't started)
+func (p *Pipeline) Queued(imei string) int64 {
+	if counter, ok := p.queued.Load(imei); ok {
+		return atomic.LoadInt64(counter.(*int64))
+	}
+	return 0
+}
+
+// Start moves the stages and the fan-out to workers, it must be called before the first packet
+func (p *Pipeline) Start(config *PipelineConfig) {
+	enrichWorkers, fanoutWorkers, size := 4, 4, 1000
+	if config.EnrichWorkers > 0 {
+		enrichWorkers = config.EnrichWorkers
+	}
+	if config.FanoutWorkers > 0 {
+		fanoutWorkers = config.FanoutWorkers
+	}
+	if config.QueueSize > 0 {
+		size = config.QueueSize
+	}
+	p.pooled = config.Pooled
+	enrich := p.recovered("stage", func(imei string, pkt *AnnotatedPacket) error {
+		return p.run(0, imei, pkt)
+	})
+	fanout := p.recovered("processor", func(imei string, pkt *AnnotatedPacket) error {
+		// released after a panic too, nothing holds the packet once its sinks returned
+		defer pkt.Release()
+		return p.process(imei, pkt)
+	})
+	p.enrich = newPipelineStage("enrich", enrichWorkers, size, &p.queued, enrich)
+	p.fanout = newPipelineStage("fanout", fanoutWorkers, size, &p.queued, fanout)
+}
+
+// queuedCopy copies the packet queued to the workers, into a storage of the pool when pooled
+func (p *Pipeline) queuedCopy(pkt *teltonika.Packet) *AnnotatedPacket {
+	if !p.pooled {
+		return &AnnotatedPacket{Packet: copyPacket(pkt)}
+	}
+	storage := packetPool.Get().(*packetStorage)
+	atomic.StoreInt32(&storage.released, 0)
+	pipelineMetrics.Add("pooled", 1)
+	return &AnnotatedPacket{Packet: storage.copy(pkt), storage: storage}
+}
+
+// recovered wraps the handler of the workers, a panic of a stage or a processor is recovered (see PanicError) and
+// reported to OnError, the worker goes on with the next packet
+func (p *Pipeline) recovered(where string,
+	handle func(imei string, pkt *AnnotatedPacket) error) func(imei string, pkt *AnnotatedPacket) {
+	return func(imei string, pkt *AnnotatedPacket) {
+		err := safeCall(where, func() error {
+			_ = handle(imei, pkt)
+			return nil
+		})
+		if panicErr, ok := err.(*PanicError); ok {
+			p.logger.Error.Printf("[%s]: %v\n%s", imei, err, panicErr.Stack)
+			p.reportPanic(imei, err)
+		}
+	}
+}
+
+// copyPacket copies the packet with the IO values of its records, the queued packets must not point into the read
+// buffer of the connection
+func copyPacket(pkt *teltonika.Packet) *teltonika.Packet {
+	return new(packetStorage).copy(pkt)
+}
+
+// packetStorage is the memory of a copied packet: its records, the IO elements of all the records and all their
+// values, each in a single slice the records index into, so a copy takes the same few allocations whatever the
+// number of records and elements
+type packetStorage struct {
+	packet   teltonika.Packet
+	records  []teltonika.Data
+	elements []teltonika.IOElement
+	values   []byte
+	// released is set once the storage went back to the pool
+	released int32
+}
+
+// packetPool keeps the storages of the released packets
+var packetPool = sync.Pool{New: func() any { return new(packetStorage) }}
+
+// maxPooledValues bounds the values kept by a pooled storage, the storage of a bigger packet is left to the garbage
+// collector so a single big packet doesn't pin its memory in the pool
+const maxPooledValues = 64 * 1024
+
+// release puts the storage back to the pool, once
+func (s *packetStorage) release() {
+	if !atomic.CompareAndSwapInt32(&s.released, 0, 1) {
+		return
+	}
+	pipelineMetrics.Add("released", 1)
+	if cap(s.values) > maxPooledValues {
+		return
+	}
+	// the messages and the imeis they carry don't stay in the pool
+	s.packet = teltonika.Packet{}
+	packetPool.Put(s)
+}
+
+// copy copies pkt into the storage, its slices are reused when they are big enough
+func (s *packetStorage) copy(pkt *teltonika.Packet) *teltonika.Packet {
+	count, size := 0, 0
+	for i := range pkt.Data {
+		count += len(pkt.Data[i].Elements)
+		for _, el := range pkt.Data[i].Elements {
+			size += len(el.Value)
+		}
+	}
+	if cap(s.records) < len(pkt.Data) {
+		s.records = make([]teltonika.Data, len(pkt.Data))
+	}
+	// the records without elements get an empty slice like the copies of copyRecord
+	if s.elements == nil || cap(s.elements) < count {
+		s.elements = make([]teltonika.IOElement, count)
+	}
+	if cap(s.values) < size {
+		s.values = make([]byte, size)
+	}
+	// the slices of a record are capped, an append to them can't overwrite the next record
+	records, elements, values := s.records[:len(pkt.Data)], s.elements[:count], s.values[:size]
+	for i := range pkt.Data {
+		record := pkt.Data[i]
+		n := len(record.Elements)
+		record.Elements, elements = elements[:n:n], elements[n:]
+		for j, el := range pkt.Data[i].Elements {
+			// the empty values are nil like the copies of copyRecord
+			record.Elements[j] = teltonika.IOElement{Id: el.Id}
+			if m := len(el.Value); m > 0 {
+				record.Elements[j].Value = values[:m:m]
+				values = values[copy(values, el.Value):]
+			}
+		}
+		records[i] = record
+	}
+	s.packet = teltonika.Packet{CodecID: pkt.CodecID, Messages: pkt.Messages}
+	if pkt.Data != nil {
+		s.packet.Data = records
+	}
+	return &s.packet
+}
+
+// packetBytes is the approximate memory of a copied packet: the records with their element slices and IO values
+func packetBytes(pkt *teltonika.Packet) int64 {
+	size := int64(64)
+	for i := range pkt.Data {
+		size += 96 + int64(len(pkt.Data[i].Elements))*32
+		for _, el := range pkt.Data[i].Elements {
+			size += int64(len(el.Value))
+		}
+	}
+	for _, msg := range pkt.Messages {
+		size += 48 + int64(len(msg.Text))
+	}
+	return size
+}
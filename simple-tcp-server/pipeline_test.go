@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/hex"
+	"expvar"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// sinkFunc is a Sink of a function
+type sinkFunc func(imei string, pkt *AnnotatedPacket) error
+
+func (f sinkFunc) Send(imei string, pkt *AnnotatedPacket) error {
+	return f(imei, pkt)
+}
+
+// testPacket is a packet of records with 1 to 4 byte values, the elements of the first record only are empty
+func testPacket(records int) *teltonika.Packet {
+	pkt := &teltonika.Packet{CodecID: teltonika.Codec8E, Data: make([]teltonika.Data, records)}
+	for i := range pkt.Data {
+		pkt.Data[i] = teltonika.Data{TimestampMs: uint64(1700000000000 + i*1000), Lat: 54.68, Lng: 25.28,
+			Elements: []teltonika.IOElement{}}
+		if i == 0 {
+			continue
+		}
+		pkt.Data[i].Elements = []teltonika.IOElement{
+			{Id: 239, Value: []byte{1}},
+			{Id: 66, Value: []byte{0x2e, byte(i)}},
+			{Id: 16, Value: []byte{0, 1, 2, byte(i)}},
+			{Id: 385, Value: nil},
+		}
+	}
+	return pkt
+}
+
+func TestCopyPacket(t *testing.T) {
+	tests := []struct {
+		name string
+		pkt  *teltonika.Packet
+	}{
+		{"records", testPacket(10)},
+		{"single record", testPacket(1)},
+		{"messages", &teltonika.Packet{CodecID: teltonika.Codec12, Messages: []teltonika.Message{{Text: "getver"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			copied := copyPacket(tt.pkt)
+			if !reflect.DeepEqual(copied, tt.pkt) {
+				t.Fatalf("copyPacket() = %+v, want %+v", copied, tt.pkt)
+			}
+			for i := range tt.pkt.Data {
+				for j := range tt.pkt.Data[i].Elements {
+					if value := tt.pkt.Data[i].Elements[j].Value; len(value) > 0 {
+						value[0] ^= 0xff
+					}
+				}
+			}
+			if reflect.DeepEqual(copied, tt.pkt) && len(tt.pkt.Data) > 1 {
+				t.Errorf("the copy shares the values of the packet")
+			}
+		})
+	}
+}
+
+func TestCopyPacketCapped(t *testing.T) {
+	copied := copyPacket(testPacket(3))
+	first := copied.Data[1].Elements
+	_ = append(first, teltonika.IOElement{Id: 1})
+	if copied.Data[2].Elements[0].Id != 239 {
+		t.Errorf("an append to the elements of a record overwrote the next record")
+	}
+	value := first[1].Value
+	_ = append(value, 0xff)
+	if got := first[2].Value; got[0] != 0 {
+		t.Errorf("an append to a value overwrote the next value: % x", got)
+	}
+}
+
+func TestAppendHex(t *testing.T) {
+	for _, frame := range [][]byte{nil, {0}, {0x00, 0x0f, 0xa0, 0xff}} {
+		if got, want := appendHex([]byte("x"), frame), "x"+hex.EncodeToString(frame); string(got) != want {
+			t.Errorf("appendHex() = %s, want %s", got, want)
+		}
+	}
+}
+
+func TestPipelinePooled(t *testing.T) {
+	released := func() int64 {
+		if v, ok := pipelineMetrics.Get("released").(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := released()
+	var handled []*AnnotatedPacket
+	var timestamps []uint64
+	pipeline := NewPipeline([]Sink{sinkFunc(func(imei string, pkt *AnnotatedPacket) error {
+		handled = append(handled, pkt)
+		timestamps = append(timestamps, pkt.Data[len(pkt.Data)-1].TimestampMs)
+		return nil
+	})}, testLogger())
+	pipeline.Start(&PipelineConfig{EnrichWorkers: 1, FanoutWorkers: 1, Pooled: true})
+	for i := 1; i <= 3; i++ {
+		if err := pipeline.Handle("352093081452251", testPacket(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !pipeline.Drain(time.Second * 5) {
+		t.Fatal("pipeline not drained")
+	}
+	want := []uint64{1700000000000, 1700000001000, 1700000002000}
+	if !reflect.DeepEqual(timestamps, want) {
+		t.Errorf("timestamps %v, want %v", timestamps, want)
+	}
+	for i, pkt := range handled {
+		if pkt.storage == nil {
+			t.Fatalf("packet %d isn't pooled", i)
+		}
+		// the storage may be in use again, only the first release counts
+		pkt.Release()
+	}
+	if got := released() - before; got != 3 {
+		t.Errorf("%d packets released, want 3", got)
+	}
+}
+
+func TestReleaseNotPooled(t *testing.T) {
+	pkt := &AnnotatedPacket{Packet: copyPacket(testPacket(2))}
+	pkt.Release()
+	if pkt.Data[1].Elements[0].Id != 239 {
+		t.Errorf("a packet that isn't pooled was released")
+	}
+	storage := &packetStorage{}
+	derived := (&AnnotatedPacket{Packet: storage.copy(testPacket(2)), storage: storage}).Derive(nil, nil)
+	derived.Release()
+	if atomic.LoadInt32(&storage.released) != 1 {
+		t.Errorf("the derived packet didn't release the storage")
+	}
+}
+
+// BenchmarkCopyPacket copies a typical 10 record packet, as queued to the pipeline workers
+func BenchmarkCopyPacket(b *testing.B) {
+	pkt := testPacket(10)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		copyPacket(pkt)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// PowerConfig: the device is disconnected from the vehicle power when the external voltage stays under
+// DisconnectMv (default 6000) or the unplug IO is set for MinSeconds (default 30), the internal battery
+// is low under LowBatteryMv (default 3700). A voltage sample is kept every SampleSeconds (default 300),
+// History (default 288, a day) samples per device
+type PowerConfig struct {
+	DisconnectMv  uint64 `json:"disconnectMv"`
+	LowBatteryMv  uint64 `json:"lowBatteryMv"`
+	MinSeconds    int    `json:"minSeconds"`
+	SampleSeconds int    `json:"sampleSeconds"`
+	History       int    `json:"history"`
+}
+
+// PowerSample is a voltage reading, 0 if the record had no value
+type PowerSample struct {
+	Time       time.Time `json:"time"`
+	ExternalMv uint64    `json:"externalMv"`
+	BatteryMv  uint64    `json:"batteryMv"`
+}
+
+// PowerHealth is the power state of a device, served by the api
+type PowerHealth struct {
+	ExternalMv        uint64        `json:"externalMv"`
+	BatteryMv         uint64        `json:"batteryMv"`
+	Connected         bool          `json:"connected"`
+	DisconnectedSince *time.Time    `json:"disconnectedSince,omitempty"`
+	LowBattery        bool          `json:"lowBattery"`
+	MinExternalMv     uint64        `json:"minExternalMv"`
+	MaxExternalMv     uint64        `json:"maxExternalMv"`
+	Updated           time.Time     `json:"updated"`
+	History           []PowerSample `json:"history"`
+}
+
+// PowerMonitor tracks the voltages and emits power.disconnected / power.connected and
+// battery.low / battery.ok events
+type PowerMonitor struct {
+	disconnectMv uint64
+	lowBatteryMv uint64
+	delay        time.Duration
+	sample       time.Duration
+	history      int
+	devices      sync.Map
+}
+
+type powerDevice struct {
+	mutex        sync.Mutex
+	health       PowerHealth
+	disconnected alertState
+	lowBattery   alertState
+	external     bool
+}
+
+func NewPowerMonitor(config *PowerConfig) *PowerMonitor {
+	p := &PowerMonitor{disconnectMv: 6000, lowBatteryMv: 3700, delay: time.Second * 30, sample: time.Minute * 5, history: 288}
+	if config == nil {
+		return p
+	}
+	if config.DisconnectMv > 0 {
+		p.disconnectMv = config.DisconnectMv
+	}
+	if config.LowBatteryMv > 0 {
+		p.lowBatteryMv = config.LowBatteryMv
+	}
+	if config.MinSeconds > 0 {
+		p.delay = time.Duration(config.MinSeconds) * time.Second
+	}
+	if config.SampleSeconds > 0 {
+		p.sample = time.Duration(config.SampleSeconds) * time.Second
+	}
+	if config.History > 0 {
+		p.history = config.History
+	}
+	return p
+}
+
+func (p *PowerMonitor) Process(imei string, pkt *teltonika.Packet) []*Event {
+	value, _ := p.devices.LoadOrStore(imei, &powerDevice{health: PowerHealth{Connected: true}})
+	device := value.(*powerDevice)
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	var events []*Event
+	health := &device.health
+	for i := range pkt.Data {
+		record := &pkt.Data[i]
+		external, hasExternal := ioUint(record, ioNames["externalVoltage"])
+		battery, hasBattery := ioUint(record, ioNames["batteryVoltage"])
+		unplug, hasUnplug := ioUint(record, ioNames["unplug"])
+		if !hasExternal && !hasBattery && !hasUnplug {
+			continue
+		}
+		t := time.UnixMilli(int64(record.TimestampMs)).UTC()
+		if t.Before(health.Updated) {
+			// a late record doesn't change the current state
+			continue
+		}
+		health.Updated = t
+
+		if hasExternal {
+			health.ExternalMv = external
+			if !device.external || external < health.MinExternalMv {
+				health.MinExternalMv = external
+			}
+			if !device.external || external > health.MaxExternalMv {
+				health.MaxExternalMv = external
+			}
+			device.external = true
+		}
+		if hasBattery {
+			health.BatteryMv = battery
+		}
+		if hasExternal || hasUnplug {
+			off := (hasExternal && external < p.disconnectMv) || (hasUnplug && unplug == 1)
+			started, ended := device.disconnected.update(t, off, !off, p.delay)
+			switch {
+			case started:
+				since := device.disconnected.since
+				health.Connected, health.DisconnectedSince = false, &since
+				events = append(events, NewEvent("power.disconnected", imei, record, map[string]any{
+					"externalMv": health.ExternalMv,
+					"batteryMv":  health.BatteryMv,
+				}))
+			case ended:
+				health.Connected, health.DisconnectedSince = true, nil
+				events = append(events, NewEvent("power.connected", imei, record, map[string]any{
+					"externalMv":      health.ExternalMv,
+					"durationSeconds": int64(t.Sub(device.disconnected.since).Seconds()),
+				}))
+			}
+		}
+		if hasBattery {
+			low := battery < p.lowBatteryMv
+			started, ended := device.lowBattery.update(t, low, !low, p.delay)
+			switch {
+			case started:
+				health.LowBattery = true
+				events = append(events, NewEvent("battery.low", imei, record, map[string]any{"batteryMv": battery}))
+			case ended:
+				health.LowBattery = false
+				events = append(events, NewEvent("battery.ok", imei, record, map[string]any{"batteryMv": battery}))
+			}
+		}
+
+		if n := len(health.History); n == 0 || t.Sub(health.History[n-1].Time) >= p.sample {
+			health.History = append(health.History, PowerSample{Time: t, ExternalMv: health.ExternalMv, BatteryMv: health.BatteryMv})
+			if len(health.History) > p.history {
+				health.History = health.History[len(health.History)-p.history:]
+			}
+		}
+	}
+	return events
+}
+
+// Health returns the power state of the device, nil if it didn't report voltages yet
+func (p *PowerMonitor) Health(imei string) *PowerHealth {
+	value, ok := p.devices.Load(imei)
+	if !ok {
+		return nil
+	}
+	device := value.(*powerDevice)
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+	if device.health.Updated.IsZero() {
+		return nil
+	}
+	health := device.health
+	health.History = append([]PowerSample(nil), health.History...)
+	return &health
+}
+
+// ServeHTTP handles GET /devices/{imei}/power
+func (p *PowerMonitor) ServeHTTP(w http.ResponseWriter, r *http.Request, imei string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	health := p.Health(imei)
+	if health == nil {
+		http.NotFound(w, r)
+		return
+	}
+	writeJson(w, http.StatusOK, health)
+}
+
+// Purge forgets the device (a Purger)
+func (p *PowerMonitor) Purge(imei string) (int, error) {
+	return purgeSyncMap(&p.devices, imei), nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// protobuf wire encoding of teltonika.proto, written by hand to keep the example dependency free
+
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+var errProtoTruncated = errors.New("protobuf message truncated")
+
+func MarshalPacketProto(imei string, pkt *AnnotatedPacket) []byte {
+	buf := protoAppendString(nil, 1, imei)
+	buf = protoAppendVarint(buf, 2, uint64(pkt.CodecID))
+	for i := range pkt.Data {
+		record := marshalAVLDataProto(&pkt.Data[i])
+		for k, v := range pkt.RecordAttributes(i) {
+			entry := protoAppendString(nil, 1, k)
+			entry = protoAppendString(entry, 2, fmt.Sprint(v))
+			record = protoAppendBytes(record, 12, entry)
+		}
+		buf = protoAppendBytes(buf, 3, record)
+	}
+	for _, msg := range pkt.Messages {
+		m := protoAppendVarint(nil, 1, uint64(msg.Timestamp))
+		m = protoAppendVarint(m, 2, uint64(msg.Type))
+		m = protoAppendString(m, 3, msg.Imei)
+		m = protoAppendString(m, 4, msg.Text)
+		buf = protoAppendBytes(buf, 4, m)
+	}
+	if pkt.Backfill {
+		buf = protoAppendVarint(buf, 5, 1)
+	}
+	if pkt.Key != "" {
+		buf = protoAppendString(buf, 6, pkt.Key)
+	}
+	return buf
+}
+
+func marshalAVLDataProto(record *teltonika.Data) []byte {
+	buf := protoAppendVarint(nil, 1, record.TimestampMs)
+	buf = protoAppendDouble(buf, 2, record.Lng)
+	buf = protoAppendDouble(buf, 3, record.Lat)
+	buf = protoAppendVarint(buf, 4, protoZigZag(int64(record.Altitude)))
+	buf = protoAppendVarint(buf, 5, uint64(record.Angle))
+	buf = protoAppendVarint(buf, 6, uint64(record.EventID))
+	buf = protoAppendVarint(buf, 7, uint64(record.Speed))
+	buf = protoAppendVarint(buf, 8, uint64(record.Satellites))
+	buf = protoAppendVarint(buf, 9, uint64(record.Priority))
+	buf = protoAppendVarint(buf, 10, uint64(record.GenerationType))
+	for _, el := range record.Elements {
+		e := protoAppendVarint(nil, 1, uint64(el.Id))
+		e = protoAppendBytes(e, 2, el.Value)
+		buf = protoAppendBytes(buf, 11, e)
+	}
+	return buf
+}
+
+// JoinPacketsProto builds a PacketBatch from marshaled packets
+func JoinPacketsProto(packets [][]byte) []byte {
+	buf := make([]byte, 0)
+	for _, p := range packets {
+		buf = protoAppendBytes(buf, 1, p)
+	}
+	return buf
+}
+
+func UnmarshalPacketProto(data []byte) (string, *teltonika.Packet, error) {
+	imei := ""
+	pkt := &teltonika.Packet{}
+	err := protoFields(data, func(field int, wireType int, value uint64, bytes []byte) error {
+		switch field {
+		case 1:
+			imei = string(bytes)
+		case 2:
+			pkt.CodecID = teltonika.CodecId(value)
+		case 3:
+			record, err := unmarshalAVLDataProto(bytes)
+			if err != nil {
+				return err
+			}
+			pkt.Data = append(pkt.Data, *record)
+		case 4:
+			msg := teltonika.Message{}
+			err := protoFields(bytes, func(field int, wireType int, value uint64, bytes []byte) error {
+				switch field {
+				case 1:
+					msg.Timestamp = uint32(value)
+				case 2:
+					msg.Type = teltonika.MessageType(value)
+				case 3:
+					msg.Imei = string(bytes)
+				case 4:
+					msg.Text = string(bytes)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			pkt.Messages = append(pkt.Messages, msg)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("packet unmarshaling error (%v)", err)
+	}
+	return imei, pkt, nil
+}
+
+func unmarshalAVLDataProto(data []byte) (*teltonika.Data, error) {
+	record := &teltonika.Data{}
+	err := protoFields(data, func(field int, wireType int, value uint64, bytes []byte) error {
+		switch field {
+		case 1:
+			record.TimestampMs = value
+		case 2:
+			record.Lng = math.Float64frombits(value)
+		case 3:
+			record.Lat = math.Float64frombits(value)
+		case 4:
+			record.Altitude = int16(int64(value>>1) ^ -int64(value&1))
+		case 5:
+			record.Angle = uint16(value)
+		case 6:
+			record.EventID = uint16(value)
+		case 7:
+			record.Speed = uint16(value)
+		case 8:
+			record.Satellites = uint8(value)
+		case 9:
+			record.Priority = uint8(value)
+		case 10:
+			record.GenerationType = teltonika.GenerationType(value)
+		case 11:
+			el := teltonika.IOElement{}
+			err := protoFields(bytes, func(field int, wireType int, value uint64, bytes []byte) error {
+				switch field {
+				case 1:
+					el.Id = uint16(value)
+				case 2:
+					el.Value = append([]byte(nil), bytes...)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			record.Elements = append(record.Elements, el)
+		}
+		return nil
+	})
+	return record, err
+}
+
+// protoFields walks the fields of a message, value holds varint and fixed values, bytes the length-delimited ones
+func protoFields(data []byte, fn func(field int, wireType int, value uint64, bytes []byte) error) error {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errProtoTruncated
+		}
+		data = data[n:]
+		field, wireType := int(tag>>3), int(tag&7)
+
+		var value uint64
+		var bytes []byte
+		switch wireType {
+		case protoVarint:
+			value, n = binary.Uvarint(data)
+			if n <= 0 {
+				return errProtoTruncated
+			}
+			data = data[n:]
+		case protoFixed64:
+			if len(data) < 8 {
+				return errProtoTruncated
+			}
+			value = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case protoFixed32:
+			if len(data) < 4 {
+				return errProtoTruncated
+			}
+			value = uint64(binary.LittleEndian.Uint32(data))
+			data = data[4:]
+		case protoBytes:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < size {
+				return errProtoTruncated
+			}
+			bytes = data[n : n+int(size)]
+			data = data[n+int(size):]
+		default:
+			return fmt.Errorf("unsupported wire type %d", wireType)
+		}
+		if err := fn(field, wireType, value, bytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func protoAppendTag(buf []byte, field int, wireType int) []byte {
+	return binary.AppendUvarint(buf, uint64(field<<3|wireType))
+}
+
+func protoAppendVarint(buf []byte, field int, value uint64) []byte {
+	if value == 0 {
+		return buf
+	}
+	buf = protoAppendTag(buf, field, protoVarint)
+	return binary.AppendUvarint(buf, value)
+}
+
+func protoAppendDouble(buf []byte, field int, value float64) []byte {
+	if value == 0 {
+		return buf
+	}
+	buf = protoAppendTag(buf, field, protoFixed64)
+	return binary.LittleEndian.AppendUint64(buf, math.Float64bits(value))
+}
+
+func protoAppendBytes(buf []byte, field int, value []byte) []byte {
+	buf = protoAppendTag(buf, field, protoBytes)
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+func protoAppendString(buf []byte, field int, value string) []byte {
+	if value == "" {
+		return buf
+	}
+	return protoAppendBytes(buf, field, []byte(value))
+}
+
+func protoZigZag(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
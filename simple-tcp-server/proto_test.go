@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestProtoAppend(t *testing.T) {
+	tests := []struct {
+		name string
+		got  []byte
+		want string
+	}{
+		{"varint", protoAppendVarint(nil, 1, 150), "08 96 01"},
+		{"zero varint omitted", protoAppendVarint(nil, 1, 0), ""},
+		{"string", protoAppendString(nil, 2, "testing"), "12 07 74 65 73 74 69 6e 67"},
+		{"empty string omitted", protoAppendString(nil, 2, ""), ""},
+		{"empty bytes kept", protoAppendBytes(nil, 3, nil), "1a 00"},
+		{"double", protoAppendDouble(nil, 2, 1.5), "11 00 00 00 00 00 00 f8 3f"},
+		{"large field number", protoAppendVarint(nil, 16, 1), "80 01 01"},
+		{"batch", JoinPacketsProto([][]byte{{0x08, 0x01}, {}}), "0a 02 08 01 0a 00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if want := unhex(t, tt.want); !bytes.Equal(tt.got, want) {
+				t.Errorf("got % x, want % x", tt.got, want)
+			}
+		})
+	}
+}
+
+func TestProtoZigZag(t *testing.T) {
+	tests := []struct {
+		value int64
+		want  uint64
+	}{{0, 0}, {-1, 1}, {1, 2}, {-2, 3}, {2147483647, 4294967294}, {-2147483648, 4294967295}}
+	for _, tt := range tests {
+		if got := protoZigZag(tt.value); got != tt.want {
+			t.Errorf("protoZigZag(%d) = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestPacketProtoRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		imei   string
+		packet *teltonika.Packet
+	}{
+		{"empty", "352093081452251", &teltonika.Packet{CodecID: teltonika.Codec8}},
+		{"records", "352093081452251", &teltonika.Packet{CodecID: teltonika.Codec8E, Data: []teltonika.Data{
+			{TimestampMs: 1700000000000, Lat: 54.6872, Lng: -25.2797, Altitude: -12, Angle: 359, EventID: 385,
+				Speed: 88, Satellites: 12, Priority: 2, GenerationType: 3, Elements: []teltonika.IOElement{
+					{Id: 239, Value: []byte{1}}, {Id: 385, Value: []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}}}},
+			{TimestampMs: 1700000001000, Altitude: 32767},
+		}}},
+		{"messages", "", &teltonika.Packet{CodecID: teltonika.Codec12, Messages: []teltonika.Message{
+			{Timestamp: 1700000000, Type: teltonika.TypeResponse, Imei: "352093081452251", Text: "getver"},
+		}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := MarshalPacketProto(tt.imei, &AnnotatedPacket{Packet: tt.packet})
+			imei, packet, err := UnmarshalPacketProto(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if imei != tt.imei || !reflect.DeepEqual(packet, tt.packet) {
+				t.Errorf("round trip %s %+v, want %s %+v", imei, packet, tt.imei, tt.packet)
+			}
+		})
+	}
+}
+
+func TestUnmarshalPacketProtoErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"truncated tag", "80"},
+		{"truncated varint", "10 8e"},
+		{"truncated bytes", "0a 0f 33 35"},
+		{"truncated double", "1a 03 11 00 00"},
+		{"start group wire type", "0b"},
+		{"truncated record field", "1a 02 08 ff"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := UnmarshalPacketProto(unhex(t, tt.data)); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProvisioningConfig: an unknown device is accepted or rejected by the Url webhook, posted {"imei": ...,
+// "address": ...} it answers {"accept": true, "parameters": {"apn": "internet"}}, the parameters are pushed to the
+// device. The decisions are kept in File if set. With RejectOnError a device is rejected when the webhook fails
+// (accepted otherwise, the webhook is asked again on the next connection)
+type ProvisioningConfig struct {
+	Url           string `json:"url"`
+	BearerToken   string `json:"bearerToken"`
+	TimeoutMs     int    `json:"timeoutMs"`
+	File          string `json:"file"`
+	RejectOnError bool   `json:"rejectOnError"`
+}
+
+// ProvisioningDecision is the webhook answer
+type ProvisioningDecision struct {
+	Accept     bool           `json:"accept"`
+	Parameters map[string]any `json:"parameters,omitempty"`
+}
+
+// ProvisionedDevice is the recorded decision on a device
+type ProvisionedDevice struct {
+	Accepted   bool           `json:"accepted"`
+	Time       time.Time      `json:"time"`
+	Address    string         `json:"address"`
+	Parameters map[string]any `json:"parameters,omitempty"`
+}
+
+// Provisioner decides on the devices connecting for the first time (TCPServer.Accept), Configure pushes the
+// initial parameters of an accepted device (set by the caller)
+type Provisioner struct {
+	Configure func(imei string, parameters map[string]any) error
+	config    *ProvisioningConfig
+	client    *http.Client
+	logger    *Logger
+	mutex     sync.Mutex
+	devices   map[string]*ProvisionedDevice
+}
+
+func NewProvisioner(config *ProvisioningConfig, logger *Logger) (*Provisioner, error) {
+	if config.Url == "" {
+		return nil, fmt.Errorf("provisioning requires url")
+	}
+	timeout := time.Duration(config.TimeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		timeout = time.Second * 10
+	}
+	p := &Provisioner{config: config, client: &http.Client{Timeout: timeout}, logger: logger, devices: make(map[string]*ProvisionedDevice)}
+	if config.File != "" {
+		data, err := os.ReadFile(config.File)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("provisioning read error (%v)", err)
+		}
+		if err == nil {
+			if err = json.Unmarshal(data, &p.devices); err != nil {
+				return nil, fmt.Errorf("provisioning parse error (%v)", err)
+			}
+		}
+	}
+	return p, nil
+}
+
+// Accept tells if the device may connect, unknown devices are provisioned through the webhook
+func (p *Provisioner) Accept(imei string, address string) bool {
+	p.mutex.Lock()
+	device, ok := p.devices[imei]
+	p.mutex.Unlock()
+	if ok {
+		return device.Accepted
+	}
+
+	decision, err := p.decide(imei, address)
+	if err != nil {
+		p.logger.Error.Printf("[%s]: provisioning error (%v)", imei, err)
+		return !p.config.RejectOnError
+	}
+	if !decision.Accept {
+		p.logger.Info.Printf("[%s]: provisioning rejected the device", imei)
+	}
+	p.mutex.Lock()
+	p.devices[imei] = &ProvisionedDevice{Accepted: decision.Accept, Time: time.Now().UTC(), Address: address, Parameters: decision.Parameters}
+	p.saveLocked()
+	p.mutex.Unlock()
+
+	if decision.Accept && len(decision.Parameters) > 0 && p.Configure != nil {
+		if err = p.Configure(imei, decision.Parameters); err != nil {
+			p.logger.Error.Printf("[%s]: provisioning parameters error (%v)", imei, err)
+		}
+	}
+	return decision.Accept
+}
+
+func (p *Provisioner) decide(imei string, address string) (*ProvisioningDecision, error) {
+	body, err := json.Marshal(map[string]string{"imei": imei, "address": address})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, p.config.Url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.config.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+p.config.BearerToken)
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		_, _ = io.Copy(io.Discard, res.Body)
+		return nil, fmt.Errorf("provisioning webhook http status %d", res.StatusCode)
+	}
+	decision := &ProvisioningDecision{}
+	if err = json.NewDecoder(res.Body).Decode(decision); err != nil {
+		return nil, fmt.Errorf("provisioning response parse error (%v)", err)
+	}
+	return decision, nil
+}
+
+// saveLocked writes the decisions to the file, the mutex must be held
+func (p *Provisioner) saveLocked() {
+	if p.config.File == "" {
+		return
+	}
+	data, err := json.Marshal(p.devices)
+	if err == nil {
+		err = os.WriteFile(p.config.File, data, 0o644)
+	}
+	if err != nil {
+		p.logger.Error.Printf("provisioning save error (%v)", err)
+	}
+}
+
+// ServeHTTP handles /provisioning: GET lists the decisions, DELETE /provisioning/{imei} forgets one
+// (the webhook is asked again on the next connection)
+func (p *Provisioner) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	imei := strings.Trim(strings.TrimPrefix(r.URL.Path, "/provisioning"), "/")
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	switch {
+	case imei == "" && r.Method == http.MethodGet:
+		type entry struct {
+			Imei string `json:"imei"`
+			*ProvisionedDevice
+		}
+		list := make([]entry, 0, len(p.devices))
+		for imei, device := range p.devices {
+			list = append(list, entry{imei, device})
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Imei < list[j].Imei })
+		writeJson(w, http.StatusOK, list)
+	case imei != "" && r.Method == http.MethodDelete:
+		if _, ok := p.devices[imei]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		delete(p.devices, imei)
+		p.saveLocked()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
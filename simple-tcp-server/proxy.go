@@ -0,0 +1,77 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+var proxyMetrics = expvar.NewMap("proxy")
+
+// ProxyConfig: Address is the upstream platform (host:port) the raw stream of every device is forwarded to while the
+// records are still processed locally. The device gets the answers of the upstream instead of ours, so the upstream
+// stays the platform of record during a migration
+type ProxyConfig struct {
+	Address string `json:"address"`
+}
+
+// UpstreamProxy opens an upstream connection per device, the frames of the device are forwarded as received and
+// everything the upstream sends (login answer, acks, commands) is relayed to the device. A device whose upstream
+// is unreachable is disconnected unanswered, it retries with its records still buffered
+type UpstreamProxy struct {
+	address string
+	logger  *Logger
+}
+
+func NewUpstreamProxy(config *ProxyConfig, logger *Logger) (*UpstreamProxy, error) {
+	if config.Address == "" {
+		return nil, fmt.Errorf("proxy requires address")
+	}
+	return &UpstreamProxy{address: config.Address, logger: logger}, nil
+}
+
+// Login opens the upstream connection with the login frame of the device and returns the answer of the upstream
+func (p *UpstreamProxy) Login(imei string, login []byte) (net.Conn, byte, error) {
+	upstream, err := net.DialTimeout("tcp", p.address, time.Second*10)
+	if err != nil {
+		proxyMetrics.Add("errors", 1)
+		return nil, 0, fmt.Errorf("proxy dial error (%v)", err)
+	}
+	answer := make([]byte, 1)
+	_ = upstream.SetDeadline(time.Now().Add(time.Second * 30))
+	if _, err = upstream.Write(login); err == nil {
+		_, err = io.ReadFull(upstream, answer)
+	}
+	if err != nil {
+		_ = upstream.Close()
+		proxyMetrics.Add("errors", 1)
+		return nil, 0, fmt.Errorf("proxy login error (%v)", err)
+	}
+	_ = upstream.SetDeadline(time.Time{})
+	proxyMetrics.Add("sessions", 1)
+	return upstream, answer[0], nil
+}
+
+// Forward sends a frame of the device to the upstream
+func (p *UpstreamProxy) Forward(upstream net.Conn, frame []byte) error {
+	if _, err := upstream.Write(frame); err != nil {
+		proxyMetrics.Add("errors", 1)
+		return fmt.Errorf("proxy forward error (%v)", err)
+	}
+	proxyMetrics.Add("bytesUpstream", int64(len(frame)))
+	return nil
+}
+
+// Relay copies the upstream to the device until the upstream closes, the device is disconnected then
+func (p *UpstreamProxy) Relay(imei string, upstream net.Conn, device net.Conn) {
+	n, err := io.Copy(device, upstream)
+	proxyMetrics.Add("bytesDownstream", n)
+	if err != nil {
+		p.logger.Error.Printf("[%s]: proxy relay error (%v)", imei, err)
+	} else {
+		p.logger.Info.Printf("[%s]: upstream closed the connection", imei)
+	}
+	_ = device.Close()
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var pseudonymMetrics = expvar.NewMap("pseudonyms")
+
+// PseudonymsConfig: the imeis are replaced by pseudonyms in the outbound payloads (hooks, routes, flespi,
+// ThingsBoard, mqtt, wialon) and in the logs. Mode "hmac" (default) derives the pseudonym from the imei with
+// HMAC-SHA256 and the key of the tenant of the device (Keys by tenant, the directory or the tenants of the config
+// tell it, Key for the others); "token" draws a random one, kept in File so it survives restarts (the new ones are
+// saved every SaveSeconds, default 5, and at shutdown). The pseudonyms are mapped back to the imeis by the server
+// only (GET /pseudonyms/{pseudonym})
+type PseudonymsConfig struct {
+	Mode        string            `json:"mode"`
+	Key         string            `json:"key"`
+	Keys        map[string]string `json:"keys"`
+	File        string            `json:"file"`
+	SaveSeconds int               `json:"saveSeconds"`
+}
+
+// Pseudonymizer replaces the imeis, Tenant returns the tenant of a device (optional), Authorize returns the operator
+// of an api request (set by the caller). A nil Pseudonymizer leaves the imeis as they are
+type Pseudonymizer struct {
+	Tenant    func(imei string) string
+	Authorize func(r *http.Request) (string, bool)
+	config    *PseudonymsConfig
+	mutex     sync.RWMutex
+	byImei    map[string]string
+	byToken   map[string]string
+	// dirty tells the mapping changed since it was saved, saving serializes the saves
+	dirty  bool
+	saving sync.Mutex
+}
+
+func NewPseudonymizer(config *PseudonymsConfig) (*Pseudonymizer, error) {
+	p := &Pseudonymizer{config: config, byImei: make(map[string]string), byToken: make(map[string]string)}
+	switch config.Mode {
+	case "", "hmac":
+		if config.Key == "" && len(config.Keys) == 0 {
+			return nil, fmt.Errorf("pseudonyms hmac mode requires key")
+		}
+	case "token":
+		if config.File == "" {
+			return nil, fmt.Errorf("pseudonyms token mode requires file")
+		}
+	default:
+		return nil, fmt.Errorf("unknown pseudonyms mode '%s'", config.Mode)
+	}
+	if config.File != "" {
+		data, err := os.ReadFile(config.File)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("pseudonyms read error (%v)", err)
+		}
+		if err == nil {
+			if err = json.Unmarshal(data, &p.byToken); err != nil {
+				return nil, fmt.Errorf("pseudonyms parse error (%v)", err)
+			}
+		}
+		for token, imei := range p.byToken {
+			p.byImei[imei] = token
+		}
+	}
+	pseudonymMetrics.Set("devices", expvar.Func(func() any {
+		p.mutex.RLock()
+		defer p.mutex.RUnlock()
+		return len(p.byImei)
+	}))
+	if config.Mode == "token" {
+		interval := time.Duration(config.SaveSeconds) * time.Second
+		if interval <= 0 {
+			interval = time.Second * 5
+		}
+		go func() {
+			for range time.Tick(interval) {
+				// the errors are counted in saveErrors, the mapping is saved again on the next tick
+				_ = p.Save()
+			}
+		}()
+	}
+	return p, nil
+}
+
+// Pseudonym returns the pseudonym of the imei
+func (p *Pseudonymizer) Pseudonym(imei string) string {
+	if p == nil || imei == "" {
+		return imei
+	}
+	p.mutex.RLock()
+	token, ok := p.byImei[imei]
+	p.mutex.RUnlock()
+	if ok {
+		return token
+	}
+	known := true
+	if p.config.Mode == "token" {
+		buf := make([]byte, 10)
+		if _, err := rand.Read(buf); err != nil {
+			// crypto/rand doesn't fail on the supported platforms, an imei is never sent in its place
+			panic(err)
+		}
+		token = "t" + hex.EncodeToString(buf)
+	} else {
+		tenant := ""
+		if p.Tenant != nil {
+			tenant = p.Tenant(imei)
+		}
+		key, ok := p.config.Keys[tenant]
+		if !ok {
+			key = p.config.Key
+		}
+		// the pseudonym of a device without a known tenant isn't kept when there are tenant keys, the device
+		// gets the one of its tenant once the directory knows it
+		known = tenant != "" || len(p.config.Keys) == 0
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write([]byte(imei))
+		token = "p" + hex.EncodeToString(mac.Sum(nil)[:10])
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if existing, ok := p.byImei[imei]; ok {
+		return existing
+	}
+	p.byToken[token] = imei
+	if known {
+		p.byImei[imei] = token
+	}
+	p.dirty = p.dirty || p.config.Mode == "token"
+	return token
+}
+
+// Imei maps the pseudonym back, false if it isn't known
+func (p *Pseudonymizer) Imei(pseudonym string) (string, bool) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	imei, ok := p.byToken[pseudonym]
+	return imei, ok
+}
+
+// Save writes the mapping of the token mode to the file if it changed since the last save, the file is written
+// from a copy so the pseudonyms aren't held up
+func (p *Pseudonymizer) Save() error {
+	if p == nil || p.config.Mode != "token" {
+		return nil
+	}
+	p.saving.Lock()
+	defer p.saving.Unlock()
+
+	p.mutex.Lock()
+	if !p.dirty {
+		p.mutex.Unlock()
+		return nil
+	}
+	tokens := make(map[string]string, len(p.byToken))
+	for token, imei := range p.byToken {
+		tokens[token] = imei
+	}
+	p.dirty = false
+	p.mutex.Unlock()
+
+	data, err := json.Marshal(tokens)
+	if err == nil {
+		err = os.WriteFile(p.config.File+".tmp", data, 0o600)
+	}
+	if err == nil {
+		err = os.Rename(p.config.File+".tmp", p.config.File)
+	}
+	if err != nil {
+		pseudonymMetrics.Add("saveErrors", 1)
+		p.mutex.Lock()
+		p.dirty = true
+		p.mutex.Unlock()
+		return fmt.Errorf("pseudonyms write error (%v)", err)
+	}
+	return nil
+}
+
+// Packet returns the pseudonym of the imei and the packet with the imeis of its messages replaced (a copy, pkt is
+// shared with the other sinks)
+func (p *Pseudonymizer) Packet(imei string, pkt *AnnotatedPacket) (string, *AnnotatedPacket) {
+	if p == nil {
+		return imei, pkt
+	}
+	pseudonym := p.Pseudonym(imei)
+	replace := false
+	for _, msg := range pkt.Messages {
+		replace = replace || msg.Imei != ""
+	}
+	if !replace {
+		return pseudonym, pkt
+	}
+	packet := *pkt.Packet
+	packet.Messages = append([]teltonika.Message(nil), pkt.Messages...)
+	for i := range packet.Messages {
+		packet.Messages[i].Imei = p.Pseudonym(packet.Messages[i].Imei)
+	}
+	derived := *pkt
+	derived.Packet = &packet
+	return pseudonym, &derived
+}
+
+// Event returns a copy of the event with the pseudonym of its imei
+func (p *Pseudonymizer) Event(event *Event) *Event {
+	if p == nil || event.Imei == "" {
+		return event
+	}
+	copied := *event
+	copied.Imei = p.Pseudonym(event.Imei)
+	return &copied
+}
+
+// imeiPattern matches the imeis in the log lines, the hex dumps of the packets don't have word boundaries around
+// their digits
+var imeiPattern = regexp.MustCompile(`\b[0-9]{15}\b`)
+
+// Writer replaces the imeis in the log lines written to w: the ones with a pseudonym and the numbers with a valid
+// check digit, other 15 digit numbers (timestamps, counters) are left as they are and don't get a pseudonym
+func (p *Pseudonymizer) Writer(w io.Writer) io.Writer {
+	return &pseudonymWriter{pseudonyms: p, writer: w}
+}
+
+type pseudonymWriter struct {
+	pseudonyms *Pseudonymizer
+	writer     io.Writer
+}
+
+// Write writes a log line (log.Logger writes a line at a time), n is the length of the original line
+func (w *pseudonymWriter) Write(line []byte) (int, error) {
+	replaced := imeiPattern.ReplaceAllFunc(line, func(match []byte) []byte {
+		imei := string(match)
+		if !w.pseudonyms.known(imei) && checkImei(imei, true) != nil {
+			return match
+		}
+		return []byte(w.pseudonyms.Pseudonym(imei))
+	})
+	if _, err := w.writer.Write(replaced); err != nil {
+		return 0, err
+	}
+	return len(line), nil
+}
+
+// known tells if the imei has a pseudonym
+func (p *Pseudonymizer) known(imei string) bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	_, ok := p.byImei[imei]
+	return ok
+}
+
+// Purge forgets the pseudonyms of the device (a Purger), a token can't be mapped back then
+func (p *Pseudonymizer) Purge(imei string) (int, error) {
+	p.mutex.Lock()
+	delete(p.byImei, imei)
+	count := 0
+	for token, tokenImei := range p.byToken {
+		if tokenImei == imei {
+			delete(p.byToken, token)
+			count++
+		}
+	}
+	p.dirty = p.dirty || (count > 0 && p.config.Mode == "token")
+	p.mutex.Unlock()
+	// the file forgets the device right away
+	return count, p.Save()
+}
+
+// ServeHTTP handles GET /pseudonyms/{pseudonym}, the imei of the pseudonym
+func (p *Pseudonymizer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := authorize(w, r, p.Authorize); !ok {
+		return
+	}
+	pseudonym := strings.TrimPrefix(r.URL.Path, "/pseudonyms/")
+	imei, ok := p.Imei(pseudonym)
+	if !ok {
+		http.Error(w, "unknown pseudonym", http.StatusNotFound)
+		return
+	}
+	writeJson(w, http.StatusOK, map[string]string{"pseudonym": pseudonym, "imei": imei})
+}
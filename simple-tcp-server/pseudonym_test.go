@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPseudonymWriter(t *testing.T) {
+	p, err := NewPseudonymizer(&PseudonymsConfig{Mode: "token", File: filepath.Join(t.TempDir(), "pseudonyms.json")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a device known by its pseudonym, its imei hasn't a valid check digit
+	known := p.Pseudonym("490154203237519")
+	tests := []struct {
+		name     string
+		line     string
+		replaced bool
+	}{
+		{"imei", "[352093081452251]: connected", true},
+		{"known imei", "[490154203237519]: connected", true},
+		{"other number", "offset 170000000000123 reached", false},
+		{"hex dump", "message: 000f333532303933303831343532323531", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if _, err := p.Writer(&out).Write([]byte(tt.line)); err != nil {
+				t.Fatal(err)
+			}
+			if replaced := out.String() != tt.line; replaced != tt.replaced {
+				t.Errorf("Write(%q) = %q, want replaced %v", tt.line, out.String(), tt.replaced)
+			}
+		})
+	}
+	if _, ok := p.Imei("170000000000123"); ok || len(p.byToken) != 2 || p.Pseudonym("490154203237519") != known {
+		t.Errorf("pseudonyms %v", p.byToken)
+	}
+}
+
+func TestPseudonymSave(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "pseudonyms.json")
+	p, err := NewPseudonymizer(&PseudonymsConfig{Mode: "token", File: file, SaveSeconds: 3600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := p.Pseudonym("352093081452251")
+	if !strings.HasPrefix(token, "t") {
+		t.Fatalf("token %s", token)
+	}
+	if _, err = os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("the file is written before Save (%v)", err)
+	}
+	if err = p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := NewPseudonymizer(&PseudonymsConfig{Mode: "token", File: file, SaveSeconds: 3600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imei, ok := loaded.Imei(token); !ok || imei != "352093081452251" {
+		t.Errorf("Imei(%s) = %s %v", token, imei, ok)
+	}
+
+	if count, err := p.Purge("352093081452251"); count != 1 || err != nil {
+		t.Fatalf("Purge() = %d %v", count, err)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := make(map[string]string)
+	if err = json.Unmarshal(data, &saved); err != nil || len(saved) != 0 {
+		t.Errorf("saved after the purge %s %v", data, err)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var ErrQueueFull = errors.New("queue is full")
+
+// Queue is a bounded FIFO, Peek blocks until an item is available
+// and the item stays queued until Pop (at-least-once delivery)
+type Queue interface {
+	Push(data []byte) error
+	Peek() ([]byte, error)
+	Pop() error
+	Len() int
+}
+
+type MemoryQueue struct {
+	items   [][]byte
+	maxSize int
+	mutex   sync.Mutex
+	cond    *sync.Cond
+}
+
+func NewMemoryQueue(maxSize int) *MemoryQueue {
+	q := &MemoryQueue{maxSize: maxSize}
+	q.cond = sync.NewCond(&q.mutex)
+	return q
+}
+
+func (q *MemoryQueue) Push(data []byte) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.items) >= q.maxSize {
+		return ErrQueueFull
+	}
+	q.items = append(q.items, data)
+	q.cond.Signal()
+	return nil
+}
+
+func (q *MemoryQueue) Peek() ([]byte, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for len(q.items) == 0 {
+		q.cond.Wait()
+	}
+	return q.items[0], nil
+}
+
+func (q *MemoryQueue) Pop() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.items) == 0 {
+		return nil
+	}
+	q.items[0] = nil
+	q.items = q.items[1:]
+	return nil
+}
+
+func (q *MemoryQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.items)
+}
+
+// DiskQueue keeps one file per item, named by its sequence number,
+// so queued items survive restarts
+type DiskQueue struct {
+	dir     string
+	maxSize int
+	head    uint64
+	tail    uint64
+	mutex   sync.Mutex
+	cond    *sync.Cond
+}
+
+func NewDiskQueue(dir string, maxSize int) (*DiskQueue, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("queue dir create error (%v)", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("queue dir read error (%v)", err)
+	}
+	seqs := make([]uint64, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".msg") {
+			continue
+		}
+		if seq, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), ".msg"), 10, 64); err == nil {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	q := &DiskQueue{dir: dir, maxSize: maxSize}
+	if len(seqs) > 0 {
+		q.head = seqs[0]
+		q.tail = seqs[len(seqs)-1] + 1
+	}
+	q.cond = sync.NewCond(&q.mutex)
+	return q, nil
+}
+
+func (q *DiskQueue) Push(data []byte) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if int(q.tail-q.head) >= q.maxSize {
+		return ErrQueueFull
+	}
+	tmp := filepath.Join(q.dir, "tmp")
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("queue write error (%v)", err)
+	}
+	if err := os.Rename(tmp, q.path(q.tail)); err != nil {
+		return fmt.Errorf("queue write error (%v)", err)
+	}
+	q.tail++
+	q.cond.Signal()
+	return nil
+}
+
+func (q *DiskQueue) Peek() ([]byte, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for {
+		for q.head == q.tail {
+			q.cond.Wait()
+		}
+		data, err := os.ReadFile(q.path(q.head))
+		if errors.Is(err, os.ErrNotExist) {
+			q.head++
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("queue read error (%v)", err)
+		}
+		return data, nil
+	}
+}
+
+func (q *DiskQueue) Pop() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.head == q.tail {
+		return nil
+	}
+	if err := os.Remove(q.path(q.head)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("queue remove error (%v)", err)
+	}
+	q.head++
+	return nil
+}
+
+func (q *DiskQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return int(q.tail - q.head)
+}
+
+func (q *DiskQueue) path(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d.msg", seq))
+}
+
+// SpillQueue is a memory queue spilling to a disk queue while Spill tells so (an open circuit), the items keep
+// their order: once an item is spilled the new items follow it to the disk until the disk queue is empty again.
+// It has a single consumer
+type SpillQueue struct {
+	memory Queue
+	disk   Queue
+	spill  func() bool
+	mutex  sync.Mutex
+	cond   *sync.Cond
+}
+
+func NewSpillQueue(memory Queue, disk Queue, spill func() bool) *SpillQueue {
+	q := &SpillQueue{memory: memory, disk: disk, spill: spill}
+	q.cond = sync.NewCond(&q.mutex)
+	return q
+}
+
+func (q *SpillQueue) Push(data []byte) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	target := q.memory
+	if q.disk.Len() > 0 || q.spill() {
+		target = q.disk
+	}
+	if err := target.Push(data); err != nil {
+		return err
+	}
+	q.cond.Signal()
+	return nil
+}
+
+// Peek returns the head of the memory queue, the spilled items come after it
+func (q *SpillQueue) Peek() ([]byte, error) {
+	q.mutex.Lock()
+	for q.memory.Len() == 0 && q.disk.Len() == 0 {
+		q.cond.Wait()
+	}
+	head := q.memory
+	if head.Len() == 0 {
+		head = q.disk
+	}
+	q.mutex.Unlock()
+	return head.Peek()
+}
+
+func (q *SpillQueue) Pop() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.memory.Len() > 0 {
+		return q.memory.Pop()
+	}
+	return q.disk.Pop()
+}
+
+func (q *SpillQueue) Len() int {
+	return q.memory.Len() + q.disk.Len()
+}
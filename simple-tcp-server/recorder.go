@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var recorderMetrics = expvar.NewMap("recorder")
+
+// RecorderConfig: the raw frames of the devices are written to Dir as json lines, a file is rotated at MaxFileMB
+// (default 64) and the MaxFiles (default 10) newest files are kept. The files replay with teltonika-replay. With
+// Encryption the frames are encrypted at rest (see RecorderEncryptionConfig)
+type RecorderConfig struct {
+	Dir        string                    `json:"dir"`
+	MaxFileMB  int                       `json:"maxFileMB"`
+	MaxFiles   int                       `json:"maxFiles"`
+	Encryption *RecorderEncryptionConfig `json:"encryption"`
+}
+
+// RecordedFrame is a json line of a recorder file, Hex is the frame as the device sent it, or the sealed frame
+// (nonce and ciphertext) if KeyId is set
+type RecordedFrame struct {
+	Time  time.Time `json:"time"`
+	Imei  string    `json:"imei"`
+	Hex   string    `json:"hex"`
+	KeyId string    `json:"keyId,omitempty"`
+}
+
+// Raw returns the frame, opened with c if it's sealed
+func (f *RecordedFrame) Raw(c *FrameCipher) ([]byte, error) {
+	raw, err := hex.DecodeString(f.Hex)
+	if err != nil || f.KeyId == "" {
+		return raw, err
+	}
+	if c == nil {
+		return nil, fmt.Errorf("frame sealed with key '%s', the recorder encryption isn't configured", f.KeyId)
+	}
+	return c.Open(f.KeyId, f.Imei, raw)
+}
+
+// RawRecorder is the raw tap of the device connections (TCPServer.OnFrame), Cipher encrypts the frames (optional)
+type RawRecorder struct {
+	dir      string
+	maxBytes int64
+	maxFiles int
+	logger   *Logger
+	mutex    sync.Mutex
+	file     *os.File
+	size     int64
+	Cipher   *FrameCipher
+}
+
+func NewRawRecorder(config *RecorderConfig, logger *Logger) (*RawRecorder, error) {
+	if config.Dir == "" {
+		return nil, fmt.Errorf("recorder requires dir")
+	}
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("recorder dir error (%v)", err)
+	}
+	r := &RawRecorder{dir: config.Dir, maxBytes: 64 << 20, maxFiles: 10, logger: logger}
+	if config.MaxFileMB > 0 {
+		r.maxBytes = int64(config.MaxFileMB) << 20
+	}
+	if config.MaxFiles > 0 {
+		r.maxFiles = config.MaxFiles
+	}
+	return r, nil
+}
+
+// Record appends the frame of the device to the current file
+func (r *RawRecorder) Record(imei string, frame []byte) {
+	recorded := &RecordedFrame{Time: time.Now().UTC(), Imei: imei}
+	if r.Cipher != nil {
+		keyId, sealed, err := r.Cipher.Seal(imei, frame)
+		if err != nil {
+			recorderMetrics.Add("errors", 1)
+			r.logger.Error.Printf("[%s]: recorder encryption error (%v)", imei, err)
+			return
+		}
+		recorded.KeyId, frame = keyId, sealed
+	}
+	recorded.Hex = hex.EncodeToString(frame)
+	line, err := json.Marshal(recorded)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.file == nil || r.size+int64(len(line)) > r.maxBytes {
+		if err = r.rotate(); err != nil {
+			recorderMetrics.Add("errors", 1)
+			r.logger.Error.Printf("%v", err)
+			return
+		}
+	}
+	n, err := r.file.Write(line)
+	r.size += int64(n)
+	if err != nil {
+		recorderMetrics.Add("errors", 1)
+		r.logger.Error.Printf("[%s]: recorder write error (%v)", imei, err)
+		return
+	}
+	recorderMetrics.Add("frames", 1)
+}
+
+// rotate opens a new file and removes the oldest files over maxFiles, the mutex must be held
+func (r *RawRecorder) rotate() error {
+	if r.file != nil {
+		_ = r.file.Close()
+		r.file = nil
+	}
+	name := filepath.Join(r.dir, "raw-"+time.Now().UTC().Format("20060102T150405.000000000")+".jsonl")
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("recorder open error (%v)", err)
+	}
+	r.file, r.size = file, 0
+
+	files, err := filepath.Glob(filepath.Join(r.dir, "raw-*.jsonl"))
+	if err != nil {
+		return nil
+	}
+	sort.Strings(files)
+	for len(files) > r.maxFiles {
+		if err = os.Remove(files[0]); err != nil {
+			r.logger.Error.Printf("recorder remove error (%v)", err)
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+// Purge removes the frames of the device from the files (a Purger), the current file is closed and the next frame
+// opens a new one
+func (r *RawRecorder) Purge(imei string) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.file != nil {
+		_ = r.file.Close()
+		r.file = nil
+	}
+	files, err := filepath.Glob(filepath.Join(r.dir, "raw-*.jsonl"))
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, file := range files {
+		n, err := rewriteJsonLines(file, lineOf(imei))
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// ExpireBefore removes the files last written before the time (an Expirer), the result is the number of files
+func (r *RawRecorder) ExpireBefore(before time.Time) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	files, err := filepath.Glob(filepath.Join(r.dir, "raw-*.jsonl"))
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil || !info.ModTime().Before(before) {
+			continue
+		}
+		if r.file != nil && r.file.Name() == file {
+			_ = r.file.Close()
+			r.file = nil
+		}
+		if err = os.Remove(file); err != nil {
+			return removed, fmt.Errorf("recorder remove error (%v)", err)
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// RecorderEncryptionConfig: the recorded frames are encrypted with AES-256-GCM. Keys maps the key ids to the keys
+// (64 hex digits, or "env:NAME" to take them from the environment), Tenants maps the tenant names to the key id of
+// their devices (TenantConfig.Imeis), the other devices use the Default key id. Every line records its key id, so a
+// key is rotated by adding a new key id and pointing the tenant to it, the old key stays for reading the old files
+type RecorderEncryptionConfig struct {
+	Keys    map[string]string `json:"keys"`
+	Tenants map[string]string `json:"tenants"`
+	Default string            `json:"default"`
+}
+
+// FrameCipher seals the recorded frames with the key of the tenant of the device, the imei is authenticated with
+// the frame so a line can't be moved to another device
+type FrameCipher struct {
+	keys       map[string]cipher.AEAD
+	devices    map[string]string
+	defaultKey string
+}
+
+func NewFrameCipher(config *RecorderEncryptionConfig, tenants []*TenantConfig) (*FrameCipher, error) {
+	keys, err := parseRecorderKeys(config.Keys)
+	if err != nil {
+		return nil, err
+	}
+	c := &FrameCipher{keys: keys, devices: make(map[string]string), defaultKey: config.Default}
+	if _, ok := keys[c.defaultKey]; !ok {
+		return nil, fmt.Errorf("recorder encryption default key '%s' not found", c.defaultKey)
+	}
+	for _, tenant := range tenants {
+		keyId, ok := config.Tenants[tenant.Name]
+		if !ok {
+			continue
+		}
+		if _, ok = keys[keyId]; !ok {
+			return nil, fmt.Errorf("recorder encryption key '%s' of tenant '%s' not found", keyId, tenant.Name)
+		}
+		for _, imei := range tenant.Imeis {
+			c.devices[imei] = keyId
+		}
+	}
+	return c, nil
+}
+
+// parseRecorderKeys reads the AES-256 keys of the key ids
+func parseRecorderKeys(config map[string]string) (map[string]cipher.AEAD, error) {
+	keys := make(map[string]cipher.AEAD, len(config))
+	for keyId, value := range config {
+		if strings.HasPrefix(value, "env:") {
+			value = os.Getenv(strings.TrimPrefix(value, "env:"))
+		}
+		key, err := hex.DecodeString(value)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("recorder encryption key '%s' must be 32 bytes (64 hex digits)", keyId)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		if keys[keyId], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// Seal encrypts the frame of the device, the result is the nonce followed by the ciphertext
+func (c *FrameCipher) Seal(imei string, frame []byte) (string, []byte, error) {
+	keyId, ok := c.devices[imei]
+	if !ok {
+		keyId = c.defaultKey
+	}
+	aead := c.keys[keyId]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(frame)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+	return keyId, aead.Seal(nonce, nonce, frame, []byte(imei)), nil
+}
+
+// Open decrypts a sealed frame of the device
+func (c *FrameCipher) Open(keyId string, imei string, sealed []byte) ([]byte, error) {
+	aead, ok := c.keys[keyId]
+	if !ok {
+		return nil, fmt.Errorf("recorder encryption key '%s' not found", keyId)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("sealed frame too short")
+	}
+	frame, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(imei))
+	if err != nil {
+		return nil, fmt.Errorf("frame decryption error (%v)", err)
+	}
+	return frame, nil
+}
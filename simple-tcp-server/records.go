@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var recordStoreMetrics = expvar.NewMap("records")
+
+const recordDayLayout = "2006-01-02"
+
+// RecordStoreConfig: the records of the devices are stored in Dir, a json lines file by device and day of the
+// record time ({imei}/2006-01-02.jsonl, UTC), and served by GET /devices/{imei}/records. A page has at most
+// MaxLimit (default 10000) records
+type RecordStoreConfig struct {
+	Dir      string `json:"dir"`
+	MaxLimit int    `json:"maxLimit"`
+}
+
+// StoredRecord is a record of the store, IO is keyed by the element id like DeviceState.IO
+type StoredRecord struct {
+	TimestampMs uint64         `json:"timestampMs"`
+	Lat         float64        `json:"lat"`
+	Lng         float64        `json:"lng"`
+	Altitude    int16          `json:"altitude"`
+	Angle       uint16         `json:"angle"`
+	Speed       uint16         `json:"speed"`
+	Satellites  uint8          `json:"satellites"`
+	EventID     uint16         `json:"eventId"`
+	Priority    uint8          `json:"priority"`
+	IO          map[string]any `json:"io,omitempty"`
+	Attributes  map[string]any `json:"attributes,omitempty"`
+}
+
+// field returns a position field by its json name, or an IO element by name (ioNames) or io_<id>
+func (s *StoredRecord) field(name string) (any, bool) {
+	switch name {
+	case "timestampMs":
+		return s.TimestampMs, true
+	case "lat":
+		return s.Lat, true
+	case "lng":
+		return s.Lng, true
+	case "altitude":
+		return s.Altitude, true
+	case "angle":
+		return s.Angle, true
+	case "speed":
+		return s.Speed, true
+	case "satellites":
+		return s.Satellites, true
+	case "eventId":
+		return s.EventID, true
+	case "priority":
+		return s.Priority, true
+	case "attributes":
+		return s.Attributes, s.Attributes != nil
+	}
+	if id, ok := ioIdByName(name); ok {
+		value, ok := s.IO[strconv.Itoa(int(id))]
+		return value, ok
+	}
+	return nil, false
+}
+
+// RecordStore is a Sink keeping the history of the devices on disk
+type RecordStore struct {
+	dir      string
+	maxLimit int
+	mutex    sync.RWMutex
+}
+
+func NewRecordStore(config *RecordStoreConfig) (*RecordStore, error) {
+	if config.Dir == "" {
+		return nil, fmt.Errorf("records requires dir")
+	}
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("records dir error (%v)", err)
+	}
+	s := &RecordStore{dir: config.Dir, maxLimit: 10000}
+	if config.MaxLimit > 0 {
+		s.maxLimit = config.MaxLimit
+	}
+	return s, nil
+}
+
+// Send appends the records of the packet to the files of their days
+func (s *RecordStore) Send(imei string, pkt *AnnotatedPacket) error {
+	if len(pkt.Data) == 0 || strings.ContainsAny(imei, `/\.`) {
+		return nil
+	}
+	days := make(map[string][]byte)
+	for i := range pkt.Data {
+		record := &pkt.Data[i]
+		stored := &StoredRecord{TimestampMs: record.TimestampMs, Lat: record.Lat, Lng: record.Lng,
+			Altitude: record.Altitude, Angle: record.Angle, Speed: record.Speed, Satellites: record.Satellites,
+			EventID: record.EventID, Priority: record.Priority, Attributes: pkt.RecordAttributes(i)}
+		if len(record.Elements) > 0 {
+			stored.IO = make(map[string]any, len(record.Elements))
+			for _, el := range record.Elements {
+				stored.IO[strconv.Itoa(int(el.Id))] = ioElementValue(el.Value)
+			}
+		}
+		line, err := json.Marshal(stored)
+		if err != nil {
+			return fmt.Errorf("records marshaling error (%v)", err)
+		}
+		day := time.UnixMilli(int64(record.TimestampMs)).UTC().Format(recordDayLayout)
+		days[day] = append(append(days[day], line...), '\n')
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := os.MkdirAll(filepath.Join(s.dir, imei), 0o755); err != nil {
+		return fmt.Errorf("records dir error (%v)", err)
+	}
+	for day, lines := range days {
+		file, err := os.OpenFile(filepath.Join(s.dir, imei, day+".jsonl"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return fmt.Errorf("records open error (%v)", err)
+		}
+		_, err = file.Write(lines)
+		_ = file.Close()
+		if err != nil {
+			return fmt.Errorf("records write error (%v)", err)
+		}
+	}
+	recordStoreMetrics.Add("records", int64(len(pkt.Data)))
+	return nil
+}
+
+// Query returns the records of the device from (included) to (excluded), oldest first
+func (s *RecordStore) Query(imei string, from time.Time, to time.Time) ([]*StoredRecord, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	records := make([]*StoredRecord, 0)
+	fromMs, toMs := uint64(from.UnixMilli()), uint64(to.UnixMilli())
+	for day := from.UTC().Truncate(time.Hour * 24); day.Before(to); day = day.Add(time.Hour * 24) {
+		file, err := os.Open(filepath.Join(s.dir, imei, day.Format(recordDayLayout)+".jsonl"))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("records read error (%v)", err)
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			record := &StoredRecord{}
+			if err = json.Unmarshal(scanner.Bytes(), record); err != nil {
+				break
+			}
+			if record.TimestampMs >= fromMs && record.TimestampMs < toMs {
+				records = append(records, record)
+			}
+		}
+		if err == nil {
+			err = scanner.Err()
+		}
+		_ = file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("records read error (%v)", err)
+		}
+	}
+	// history uploads come after newer records
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].TimestampMs < records[j].TimestampMs
+	})
+	return records, nil
+}
+
+// Purge removes the records of the device (a Purger)
+func (s *RecordStore) Purge(imei string) (int, error) {
+	if imei == "" || strings.ContainsAny(imei, `/\.`) {
+		return 0, nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	files, err := filepath.Glob(filepath.Join(s.dir, imei, "*.jsonl"))
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, file := range files {
+		if data, err := os.ReadFile(file); err == nil {
+			removed += bytes.Count(data, []byte{'\n'})
+		}
+	}
+	if err = os.RemoveAll(filepath.Join(s.dir, imei)); err != nil {
+		return removed, fmt.Errorf("records remove error (%v)", err)
+	}
+	return removed, nil
+}
+
+// ExpireBefore removes the days that ended before the time (an Expirer), the result is the number of files
+func (s *RecordStore) ExpireBefore(before time.Time) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	files, err := filepath.Glob(filepath.Join(s.dir, "*", "*.jsonl"))
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, file := range files {
+		day, err := time.Parse(recordDayLayout, strings.TrimSuffix(filepath.Base(file), ".jsonl"))
+		if err != nil || !day.Add(time.Hour*24).Before(before) {
+			continue
+		}
+		if err = os.Remove(file); err != nil {
+			return removed, fmt.Errorf("records remove error (%v)", err)
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// ServeHTTP handles GET /devices/{imei}/records?from=...&to=... (RFC 3339, the last 24 hours by default). Options:
+// fields (comma separated position fields and IO element names, timestampMs is always there), interval (seconds,
+// the first record of every interval is kept), simplify (meters, Douglas-Peucker on the track), limit (records by
+// page, 1000 by default) and cursor (the next value of the previous page)
+func (s *RecordStore) ServeHTTP(w http.ResponseWriter, r *http.Request, imei string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	params := r.URL.Query()
+	to, from := time.Now(), time.Time{}
+	var err error
+	for name, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		if value := params.Get(name); value != "" {
+			if *t, err = time.Parse(time.RFC3339, value); err != nil {
+				http.Error(w, "invalid "+name+" ("+err.Error()+")", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if from.IsZero() {
+		from = to.Add(-time.Hour * 24)
+	}
+	limit, interval, simplify, cursor := 1000, 0, 0.0, uint64(0)
+	for name, parse := range map[string]func(string) error{
+		"limit":    func(v string) (err error) { limit, err = strconv.Atoi(v); return },
+		"interval": func(v string) (err error) { interval, err = strconv.Atoi(v); return },
+		"simplify": func(v string) (err error) { simplify, err = strconv.ParseFloat(v, 64); return },
+		"cursor":   func(v string) (err error) { cursor, err = strconv.ParseUint(v, 10, 64); return },
+	} {
+		if value := params.Get(name); value != "" {
+			if err = parse(value); err != nil {
+				http.Error(w, "invalid "+name+" ("+err.Error()+")", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if limit <= 0 || limit > s.maxLimit {
+		limit = s.maxLimit
+	}
+	if !from.Before(to) || interval < 0 || simplify < 0 {
+		http.Error(w, "invalid range", http.StatusBadRequest)
+		return
+	}
+
+	records, err := s.Query(imei, from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if interval > 0 {
+		records = thinRecords(records, uint64(interval)*1000)
+	}
+	if simplify > 0 {
+		records = simplifyRecords(records, simplify)
+	}
+	page := records
+	if cursor > 0 {
+		start := sort.Search(len(page), func(i int) bool { return page[i].TimestampMs > cursor })
+		page = page[start:]
+	}
+	result := map[string]any{"imei": imei}
+	if len(page) > limit {
+		page = page[:limit]
+		result["next"] = strconv.FormatUint(page[limit-1].TimestampMs, 10)
+	}
+	recordStoreMetrics.Add("queries", 1)
+
+	fields := params.Get("fields")
+	if fields == "" {
+		result["records"] = page
+		writeJson(w, http.StatusOK, result)
+		return
+	}
+	names := strings.Split(fields, ",")
+	selected := make([]map[string]any, len(page))
+	for i, record := range page {
+		selected[i] = map[string]any{"timestampMs": record.TimestampMs}
+		for _, name := range names {
+			if value, ok := record.field(strings.TrimSpace(name)); ok {
+				selected[i][strings.TrimSpace(name)] = value
+			}
+		}
+	}
+	result["records"] = selected
+	writeJson(w, http.StatusOK, result)
+}
+
+// thinRecords keeps the first record of every interval (ms), and the records with an event or a priority
+func thinRecords(records []*StoredRecord, interval uint64) []*StoredRecord {
+	thinned := make([]*StoredRecord, 0, len(records))
+	bucket := uint64(0)
+	for i, record := range records {
+		if i == 0 || record.TimestampMs/interval != bucket || record.EventID != 0 || record.Priority > 0 {
+			thinned = append(thinned, record)
+			bucket = record.TimestampMs / interval
+		}
+	}
+	return thinned
+}
+
+// simplifyRecords simplifies the track at the tolerance (meters) with the Douglas-Peucker of the Downsampler, the
+// records without a fix are kept
+func simplifyRecords(records []*StoredRecord, tolerance float64) []*StoredRecord {
+	track := make([]teltonika.Data, len(records))
+	keep := make([]bool, len(records))
+	for i, record := range records {
+		track[i] = teltonika.Data{TimestampMs: record.TimestampMs, Lat: record.Lat, Lng: record.Lng,
+			Satellites: record.Satellites, EventID: record.EventID, Priority: record.Priority}
+		keep[i] = true
+	}
+	(&Downsampler{tolerance: tolerance}).simplify(track, keep)
+	simplified := make([]*StoredRecord, 0, len(records))
+	for i, record := range records {
+		if keep[i] {
+			simplified = append(simplified, record)
+		}
+	}
+	return simplified
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RedisConfig: KeyPrefix defaults to "teltonika:state:", the state of a device is a json string at <prefix><imei>
+type RedisConfig struct {
+	Address   string `json:"address"`
+	Password  string `json:"password"`
+	DB        int    `json:"db"`
+	KeyPrefix string `json:"keyPrefix"`
+}
+
+// RedisClient is a minimal RESP client (single connection, commands are serialized), it reconnects on errors
+type RedisClient struct {
+	address  string
+	password string
+	db       int
+	mutex    sync.Mutex
+	conn     net.Conn
+	reader   *bufio.Reader
+}
+
+var errRedisNil = errors.New("redis nil")
+
+func NewRedisClient(config *RedisConfig) *RedisClient {
+	return &RedisClient{address: config.Address, password: config.Password, db: config.DB}
+}
+
+// Do sends the command and returns the reply (string, int64, []any), errRedisNil for a nil reply
+func (c *RedisClient) Do(args ...string) (any, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	reply, err := c.do(args)
+	var redisErr redisError
+	if err != nil && err != errRedisNil && !errors.As(err, &redisErr) {
+		// connection error, retry once on a new connection
+		c.close()
+		reply, err = c.do(args)
+	}
+	return reply, err
+}
+
+func (c *RedisClient) do(args []string) (any, error) {
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return nil, err
+		}
+	}
+	_ = c.conn.SetDeadline(time.Now().Add(time.Second * 5))
+	if _, err := c.conn.Write(redisCommand(args)); err != nil {
+		c.close()
+		return nil, err
+	}
+	reply, err := redisReadReply(c.reader)
+	var redisErr redisError
+	if err != nil && err != errRedisNil && !errors.As(err, &redisErr) {
+		c.close()
+	}
+	return reply, err
+}
+
+func (c *RedisClient) connect() error {
+	conn, err := net.DialTimeout("tcp", c.address, time.Second*10)
+	if err != nil {
+		return fmt.Errorf("redis connect error (%v)", err)
+	}
+	c.conn, c.reader = conn, bufio.NewReader(conn)
+	if c.password != "" {
+		if _, err = c.do([]string{"AUTH", c.password}); err != nil {
+			c.close()
+			return fmt.Errorf("redis auth error (%v)", err)
+		}
+	}
+	if c.db != 0 {
+		if _, err = c.do([]string{"SELECT", strconv.Itoa(c.db)}); err != nil {
+			c.close()
+			return fmt.Errorf("redis select error (%v)", err)
+		}
+	}
+	return nil
+}
+
+func (c *RedisClient) close() {
+	if c.conn != nil {
+		_ = c.conn.Close()
+		c.conn, c.reader = nil, nil
+	}
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func redisCommand(args []string) []byte {
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+	return buf
+}
+
+func redisReadReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 {
+		return nil, fmt.Errorf("redis protocol error")
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, redisError(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		buf := make([]byte, n+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		items := make([]any, 0, n)
+		for i := 0; i < n; i++ {
+			item, err := redisReadReply(r)
+			if err != nil && err != errRedisNil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis protocol error (unexpected '%c')", kind)
+}
+
+// RedisStateStore keeps the device states in redis, shared by several server instances
+type RedisStateStore struct {
+	client *RedisClient
+	prefix string
+}
+
+func NewRedisStateStore(config *RedisConfig) *RedisStateStore {
+	prefix := config.KeyPrefix
+	if prefix == "" {
+		prefix = "teltonika:state:"
+	}
+	return &RedisStateStore{client: NewRedisClient(config), prefix: prefix}
+}
+
+func (s *RedisStateStore) Get(imei string) (*DeviceState, error) {
+	reply, err := s.client.Do("GET", s.prefix+imei)
+	if err == errRedisNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, ok := reply.(string)
+	if !ok {
+		return nil, fmt.Errorf("redis unexpected reply %v", reply)
+	}
+	state := &DeviceState{}
+	if err = json.Unmarshal([]byte(data), state); err != nil {
+		return nil, fmt.Errorf("state parse error (%v)", err)
+	}
+	return state, nil
+}
+
+func (s *RedisStateStore) Put(state *DeviceState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("state marshaling error (%v)", err)
+	}
+	_, err = s.client.Do("SET", s.prefix+state.Imei, string(data))
+	return err
+}
+
+// Purge removes the state of the device (a Purger)
+func (s *RedisStateStore) Purge(imei string) (int, error) {
+	reply, err := s.client.Do("DEL", s.prefix+imei)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := reply.(int64)
+	return int(n), nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// ReorderConfig: records are held for WindowSeconds (default 30) and released sorted by timestamp,
+// a device buffer is released early when it holds MaxRecords (default 500). Records older than
+// BackfillSeconds (default 120) when they arrive are backfill (history sent after a reconnect),
+// live and backfill records are sorted and released as separate streams
+type ReorderConfig struct {
+	WindowSeconds   int `json:"windowSeconds"`
+	MaxRecords      int `json:"maxRecords"`
+	BackfillSeconds int `json:"backfillSeconds"`
+}
+
+// ReorderStage buffers the records of every device and passes them on sorted, Emit continues
+// the pipeline with the released packets (from the stage goroutine), the packets of the backfill stream
+// are flagged (AnnotatedPacket.Backfill) and the encoders add the flag to the payloads
+type ReorderStage struct {
+	window     time.Duration
+	backfill   time.Duration
+	maxRecords int
+	mutex      sync.Mutex
+	devices    map[string]*reorderDevice
+	Emit       func(imei string, pkt *AnnotatedPacket)
+}
+
+type reorderDevice struct {
+	live     []reorderedRecord
+	backfill []reorderedRecord
+}
+
+type reorderedRecord struct {
+	record     teltonika.Data
+	attributes map[string]any
+	codec      teltonika.CodecId
+	arrived    time.Time
+}
+
+func NewReorderStage(config *ReorderConfig) *ReorderStage {
+	r := &ReorderStage{
+		window:     time.Second * 30,
+		backfill:   time.Minute * 2,
+		maxRecords: 500,
+		devices:    make(map[string]*reorderDevice),
+	}
+	if config.WindowSeconds > 0 {
+		r.window = time.Duration(config.WindowSeconds) * time.Second
+	}
+	if config.BackfillSeconds > 0 {
+		r.backfill = time.Duration(config.BackfillSeconds) * time.Second
+	}
+	if config.MaxRecords > 0 {
+		r.maxRecords = config.MaxRecords
+	}
+	go func() {
+		for range time.Tick(time.Second) {
+			r.release(time.Now().Add(-r.window))
+		}
+	}()
+	return r
+}
+
+// Apply takes the records over (the values are copied, pkt may point into the read buffer),
+// messages are passed on right away
+func (r *ReorderStage) Apply(imei string, pkt *AnnotatedPacket) *AnnotatedPacket {
+	now := time.Now()
+	r.mutex.Lock()
+	device, ok := r.devices[imei]
+	if !ok {
+		device = &reorderDevice{}
+		r.devices[imei] = device
+	}
+	full := false
+	for i := range pkt.Data {
+		item := reorderedRecord{
+			record:     copyRecord(&pkt.Data[i]),
+			attributes: pkt.RecordAttributes(i),
+			codec:      pkt.CodecID,
+			arrived:    now,
+		}
+		if now.Sub(time.UnixMilli(int64(item.record.TimestampMs))) > r.backfill {
+			device.backfill = append(device.backfill, item)
+		} else {
+			device.live = append(device.live, item)
+		}
+		full = full || len(device.live) >= r.maxRecords || len(device.backfill) >= r.maxRecords
+	}
+	r.mutex.Unlock()
+	if full {
+		r.release(now.Add(-r.window))
+	}
+
+	if len(pkt.Messages) == 0 {
+		return nil
+	}
+	return pkt.Derive(nil, nil)
+}
+
+// Flush releases all buffered records (shutdown)
+func (r *ReorderStage) Flush() {
+	r.release(time.Now().Add(time.Hour))
+}
+
+// release passes on the records that arrived before the cutoff and the records over the size limit
+func (r *ReorderStage) release(cutoff time.Time) {
+	type released struct {
+		imei     string
+		backfill bool
+		records  []reorderedRecord
+	}
+	var out []released
+
+	r.mutex.Lock()
+	for imei, device := range r.devices {
+		var records []reorderedRecord
+		if device.live, records = r.take(device.live, cutoff); len(records) > 0 {
+			out = append(out, released{imei: imei, records: records})
+		}
+		if device.backfill, records = r.take(device.backfill, cutoff); len(records) > 0 {
+			out = append(out, released{imei: imei, backfill: true, records: records})
+		}
+		if len(device.live) == 0 && len(device.backfill) == 0 {
+			delete(r.devices, imei)
+		}
+	}
+	r.mutex.Unlock()
+
+	for _, o := range out {
+		pkt := &AnnotatedPacket{
+			Packet:   &teltonika.Packet{CodecID: o.records[0].codec, Data: make([]teltonika.Data, 0, len(o.records))},
+			Backfill: o.backfill,
+		}
+		for i, item := range o.records {
+			pkt.Data = append(pkt.Data, item.record)
+			if item.attributes != nil {
+				if pkt.Attributes == nil {
+					pkt.Attributes = make([]map[string]any, len(o.records))
+				}
+				pkt.Attributes[i] = item.attributes
+			}
+		}
+		r.Emit(o.imei, pkt)
+	}
+}
+
+// take sorts the buffer and splits off the records up to the newest timestamp among the expired records
+// (or the oldest records over the size limit), so the released stream stays ordered
+func (r *ReorderStage) take(buffer []reorderedRecord, cutoff time.Time) ([]reorderedRecord, []reorderedRecord) {
+	if len(buffer) == 0 {
+		return buffer, nil
+	}
+	sort.SliceStable(buffer, func(i, j int) bool {
+		return buffer[i].record.TimestampMs < buffer[j].record.TimestampMs
+	})
+	n := 0
+	if len(buffer) >= r.maxRecords {
+		n = len(buffer) - r.maxRecords/2
+	}
+	for i, item := range buffer {
+		if !item.arrived.After(cutoff) && i+1 > n {
+			n = i + 1
+		}
+	}
+	if n == 0 {
+		return buffer, nil
+	}
+	return append([]reorderedRecord(nil), buffer[n:]...), buffer[:n]
+}
+
+// copyRecord copies the record with its IO values
+func copyRecord(record *teltonika.Data) teltonika.Data {
+	c := *record
+	c.Elements = make([]teltonika.IOElement, len(record.Elements))
+	for i, el := range record.Elements {
+		c.Elements[i] = teltonika.IOElement{Id: el.Id, Value: append([]byte(nil), el.Value...)}
+	}
+	return c
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// runReprocess is the main of teltonika-reprocess: the frames of the raw recorder are decoded again with the current
+// code and the dead letters are redelivered, through the sinks the server builds from the same flags and config
+func runReprocess() {
+	var raw string
+	var letters string
+	var rate float64
+	sinkOptions := &SinkOptions{}
+	sinkOptions.Register(flag.CommandLine)
+	flag.StringVar(&raw, "raw", "", "recorder file or directory of raw-*.jsonl files to decode again and send to the sinks")
+	flag.StringVar(&letters, "letters", "", "dead letter file (or s3://bucket/prefix) to redeliver")
+	flag.Float64Var(&rate, "rate", 0, "max packets or letters a second (no limit if 0)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-raw file|dir] [-letters file|s3://bucket/prefix] [-rate n] [-config file] [sink flags]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if raw == "" && letters == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	logger := &Logger{
+		Info:  log.New(os.Stderr, "INFO: ", log.Ldate|log.Ltime),
+		Error: log.New(os.Stderr, "ERROR: ", log.Ldate|log.Ltime),
+	}
+	built, err := sinkOptions.Build(logger)
+	if err != nil {
+		logger.Error.Fatal(err)
+	}
+	if letters != "" {
+		if err = ReprocessDeadLetters(letters, built.Sinks, rate, logger); err != nil {
+			logger.Error.Fatal(err)
+		}
+	}
+	if raw != "" {
+		var frameCipher *FrameCipher
+		if config := built.Config; config.Recorder != nil && config.Recorder.Encryption != nil {
+			if frameCipher, err = NewFrameCipher(config.Recorder.Encryption, config.Tenants); err != nil {
+				logger.Error.Fatal(err)
+			}
+		}
+		if err = ReprocessRecordings(raw, frameCipher, built.Sinks, rate, logger); err != nil {
+			logger.Error.Fatal(err)
+		}
+	}
+	if err = built.Pseudonyms.Save(); err != nil {
+		logger.Error.Fatal(err)
+	}
+}
+
+// ReprocessRecordings decodes again the frames of raw recorder files (a directory stands for its raw-*.jsonl files)
+// and sends the data packets to the sinks, at most rate packets a second (no limit if 0). The stages and processors
+// don't run, the packets carry an idempotency key (hash of the imei and the frame) so receivers can drop the
+// packets they already have. The sealed frames are opened with c
+func ReprocessRecordings(path string, c *FrameCipher, sinks []Sink, rate float64, logger *Logger) error {
+	files := []string{path}
+	if info, err := os.Stat(path); err != nil {
+		return fmt.Errorf("recording open error (%v)", err)
+	} else if info.IsDir() {
+		if files, err = filepath.Glob(filepath.Join(path, "raw-*.jsonl")); err != nil {
+			return err
+		}
+		sort.Strings(files)
+	}
+
+	limit := newRateLimit(rate)
+	sent, failed := 0, 0
+	for _, name := range files {
+		file, err := os.Open(name)
+		if err != nil {
+			return fmt.Errorf("recording open error (%v)", err)
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+		for scanner.Scan() {
+			frame := &RecordedFrame{}
+			if err = json.Unmarshal(scanner.Bytes(), frame); err != nil {
+				_ = file.Close()
+				return fmt.Errorf("recording parse error (%v)", err)
+			}
+			raw, err := frame.Raw(c)
+			if err != nil {
+				failed++
+				logger.Error.Printf("[%s]: recorded frame error (%v)", frame.Imei, err)
+				continue
+			}
+			_, packet, err := teltonika.DecodeTCPFromSlice(raw, decodeConfig)
+			if err != nil {
+				failed++
+				logger.Error.Printf("[%s]: recorded frame decode error (%v)", frame.Imei, err)
+				continue
+			}
+			if len(packet.Data) == 0 {
+				continue
+			}
+			limit.wait()
+			pkt := &AnnotatedPacket{Packet: packet, Key: idempotencyKey([]byte(frame.Imei), raw)}
+			_ = publish(sinks, frame.Imei, pkt, logger)
+			sent++
+		}
+		err = scanner.Err()
+		_ = file.Close()
+		if err != nil {
+			return fmt.Errorf("recording read error (%v)", err)
+		}
+	}
+	if !drainSinks(sinks, reprocessDrainTimeout) {
+		logger.Error.Printf("sinks not drained after %s, the packets still queued are lost", reprocessDrainTimeout)
+	}
+	logger.Info.Printf("reprocessed %s: %d packets sent, %d frames failed", path, sent, failed)
+	return nil
+}
+
+// reprocessDrainTimeout bounds the wait for the queues of the sinks before the reprocessing exits
+const reprocessDrainTimeout = time.Minute * 10
+
+// Drainer is implemented by the sinks that deliver from a background queue, Drain returns false if the queue
+// isn't empty after timeout
+type Drainer interface {
+	Drain(timeout time.Duration) bool
+}
+
+// drainSinks drains the sinks (and the wrapped sinks) that have a queue
+func drainSinks(sinks []Sink, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	var drain func(sink Sink) bool
+	drain = func(sink Sink) bool {
+		if d, ok := sink.(Drainer); ok && !d.Drain(time.Until(deadline)) {
+			return false
+		}
+		if w, ok := sink.(interface{ Unwrap() Sink }); ok {
+			return drain(w.Unwrap())
+		}
+		return true
+	}
+	for _, sink := range sinks {
+		if !drain(sink) {
+			return false
+		}
+	}
+	return true
+}
+
+// waitDrained polls drained until it is true or timeout passed
+func waitDrained(timeout time.Duration, drained func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for !drained() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	return true
+}
+
+// idempotencyKey is the hex of the first 16 bytes of the sha256 of the parts
+func idempotencyKey(parts ...[]byte) string {
+	h := sha256.New()
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// rateLimit spaces the calls of wait by the interval of the rate
+type rateLimit struct {
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimit(rate float64) *rateLimit {
+	if rate <= 0 {
+		return &rateLimit{}
+	}
+	return &rateLimit{interval: time.Duration(float64(time.Second) / rate)}
+}
+
+func (l *rateLimit) wait() {
+	if l.interval == 0 {
+		return
+	}
+	now := time.Now()
+	if l.next.After(now) {
+		time.Sleep(l.next.Sub(now))
+		now = l.next
+	}
+	l.next = now.Add(l.interval)
+}
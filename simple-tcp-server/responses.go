@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DeviceInfo is the parsed getinfo response: "RTC:2018/11/22 7:44 Init:2018/11/22 7:13 UpTime:1854s
+// PWR:PwrVoltage RST:2 GPS:3 SAT:0 ... REC:6 ...", GpsState is 0 off, 1 no antenna, 2 no fix, 3 fix, 4 sleep,
+// 5 antenna overcurrent
+type DeviceInfo struct {
+	Rtc           *time.Time        `json:"rtc,omitempty"`
+	Init          *time.Time        `json:"init,omitempty"`
+	UptimeSeconds int64             `json:"uptimeSeconds"`
+	Power         string            `json:"power,omitempty"`
+	GpsState      int64             `json:"gpsState"`
+	Satellites    int64             `json:"satellites"`
+	Records       int64             `json:"records"`
+	Fields        map[string]string `json:"fields"`
+}
+
+// VersionInfo is the parsed getver response: "Ver:03.18.10_03 GPS:AXN_3.80_3333_16070400,0000,LIC: Hw:FMB920
+// Mod:4 IMEI:352093081429150 Init:2018-11-22 7:13 Uptime:3390 MAC:001E4292E1C3 ..."
+type VersionInfo struct {
+	Firmware      string            `json:"firmware"`
+	GnssFirmware  string            `json:"gnssFirmware,omitempty"`
+	Hardware      string            `json:"hardware,omitempty"`
+	Modification  string            `json:"modification,omitempty"`
+	Imei          string            `json:"imei,omitempty"`
+	Init          *time.Time        `json:"init,omitempty"`
+	UptimeSeconds int64             `json:"uptimeSeconds"`
+	Mac           string            `json:"mac,omitempty"`
+	Fields        map[string]string `json:"fields"`
+}
+
+// GpsInfo is the parsed getgps response: "GPS:1 Sat:7 Lat:54.71 Long:25.30 Alt:147 Speed:0 Dir:0
+// Date: 2018/11/22 Time: 7:44:0"
+type GpsInfo struct {
+	Fix        bool       `json:"fix"`
+	Satellites int64      `json:"satellites"`
+	Lat        float64    `json:"lat"`
+	Lng        float64    `json:"lng"`
+	Altitude   float64    `json:"altitude"`
+	Speed      float64    `json:"speed"`
+	Angle      float64    `json:"angle"`
+	Time       *time.Time `json:"time,omitempty"`
+}
+
+// BatteryInfo is the parsed battery response: "BatState: 1 FSMState: ACTIVE ChargerIC: DONE ExtV: 12.2
+// BatV: 4.1 BatI: 0.0", voltages in V, the current in A
+type BatteryInfo struct {
+	State           string            `json:"state"`
+	Charger         string            `json:"charger,omitempty"`
+	ExternalVoltage float64           `json:"externalVoltage"`
+	BatteryVoltage  float64           `json:"batteryVoltage"`
+	BatteryCurrent  float64           `json:"batteryCurrent"`
+	Fields          map[string]string `json:"fields"`
+}
+
+// responseKey matches the "Key:" tokens of the responses, a key starts the text or follows a space
+// (so "...,LIC:" stays in the GPS firmware value)
+var responseKey = regexp.MustCompile(`(?:^|\s)([A-Za-z]+):`)
+
+// responseFields splits a free-text response into its key/value fields
+func responseFields(text string) map[string]string {
+	fields := make(map[string]string)
+	matches := responseKey.FindAllStringSubmatchIndex(text, -1)
+	for i, match := range matches {
+		end := len(text)
+		if i+1 < len(matches) {
+			end = matches[i+1][0]
+		}
+		fields[text[match[2]:match[3]]] = strings.TrimSpace(text[match[1]:end])
+	}
+	return fields
+}
+
+func fieldInt(fields map[string]string, key string) int64 {
+	v, _ := strconv.ParseInt(strings.TrimSuffix(fields[key], "s"), 10, 64)
+	return v
+}
+
+func fieldFloat(fields map[string]string, key string) float64 {
+	v, _ := strconv.ParseFloat(fields[key], 64)
+	return v
+}
+
+// fieldTime parses the device dates ("2018/11/22 7:44", "2018-11-22 7:13", seconds optional), nil if missing
+func fieldTime(value string) *time.Time {
+	value = strings.ReplaceAll(strings.TrimSpace(value), "-", "/")
+	for _, layout := range []string{"2006/1/2 15:4:5", "2006/1/2 15:4"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return &t
+		}
+	}
+	return nil
+}
+
+func ParseGetInfoResponse(text string) (*DeviceInfo, error) {
+	fields := responseFields(text)
+	if _, ok := fields["RTC"]; !ok {
+		return nil, fmt.Errorf("unexpected getinfo response '%s'", text)
+	}
+	return &DeviceInfo{
+		Rtc:           fieldTime(fields["RTC"]),
+		Init:          fieldTime(fields["Init"]),
+		UptimeSeconds: fieldInt(fields, "UpTime"),
+		Power:         fields["PWR"],
+		GpsState:      fieldInt(fields, "GPS"),
+		Satellites:    fieldInt(fields, "SAT"),
+		Records:       fieldInt(fields, "REC"),
+		Fields:        fields,
+	}, nil
+}
+
+func ParseGetVerResponse(text string) (*VersionInfo, error) {
+	fields := responseFields(text)
+	if _, ok := fields["Ver"]; !ok {
+		return nil, fmt.Errorf("unexpected getver response '%s'", text)
+	}
+	return &VersionInfo{
+		Firmware:      fields["Ver"],
+		GnssFirmware:  fields["GPS"],
+		Hardware:      fields["Hw"],
+		Modification:  fields["Mod"],
+		Imei:          fields["IMEI"],
+		Init:          fieldTime(fields["Init"]),
+		UptimeSeconds: fieldInt(fields, "Uptime"),
+		Mac:           fields["MAC"],
+		Fields:        fields,
+	}, nil
+}
+
+func ParseGetGpsResponse(text string) (*GpsInfo, error) {
+	fields := responseFields(text)
+	if _, ok := fields["Lat"]; !ok {
+		return nil, fmt.Errorf("unexpected getgps response '%s'", text)
+	}
+	info := &GpsInfo{
+		Fix:        fields["GPS"] == "1",
+		Satellites: fieldInt(fields, "Sat"),
+		Lat:        fieldFloat(fields, "Lat"),
+		Lng:        fieldFloat(fields, "Long"),
+		Altitude:   fieldFloat(fields, "Alt"),
+		Speed:      fieldFloat(fields, "Speed"),
+		Angle:      fieldFloat(fields, "Dir"),
+	}
+	if fields["Date"] != "" {
+		info.Time = fieldTime(fields["Date"] + " " + fields["Time"])
+	}
+	return info, nil
+}
+
+func ParseBatteryResponse(text string) (*BatteryInfo, error) {
+	fields := responseFields(text)
+	if _, ok := fields["BatV"]; !ok {
+		return nil, fmt.Errorf("unexpected battery response '%s'", text)
+	}
+	return &BatteryInfo{
+		State:           fields["FSMState"],
+		Charger:         fields["ChargerIC"],
+		ExternalVoltage: fieldFloat(fields, "ExtV"),
+		BatteryVoltage:  fieldFloat(fields, "BatV"),
+		BatteryCurrent:  fieldFloat(fields, "BatI"),
+		Fields:          fields,
+	}, nil
+}
+
+// ParseCommandResponse parses the response of the catalog commands with a structured response,
+// nil for the others
+func ParseCommandResponse(name string, text string) (any, error) {
+	switch name {
+	case "getinfo":
+		return ParseGetInfoResponse(text)
+	case "getver":
+		return ParseGetVerResponse(text)
+	case "getgps":
+		return ParseGetGpsResponse(text)
+	case "battery":
+		return ParseBatteryResponse(text)
+	case "getparam":
+		return ParseGetParamResponse(text)
+	}
+	return nil, nil
+}
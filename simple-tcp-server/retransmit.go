@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/binary"
+	"expvar"
+	"sync"
+)
+
+var retransmitMetrics = expvar.NewMap("retransmissions")
+
+// RetransmissionFilter recognizes the data packets a device sends again because it missed the ack (the write
+// failed or the connection dropped before the ack arrived): same CRC, record count and first and last record
+// timestamps as one of the last packets of the device. The devices are remembered across reconnects
+type RetransmissionFilter struct {
+	size    int
+	mutex   sync.Mutex
+	devices map[string][]packetSignature
+}
+
+type packetSignature struct {
+	crc     uint32
+	records int
+	first   uint64
+	last    uint64
+}
+
+// NewRetransmissionFilter remembers the last size packets of every device
+func NewRetransmissionFilter(size int) *RetransmissionFilter {
+	retransmitMetrics.Set("rate", expvar.Func(func() any {
+		packets, _ := retransmitMetrics.Get("packets").(*expvar.Int)
+		retransmitted, _ := retransmitMetrics.Get("retransmitted").(*expvar.Int)
+		if packets == nil || retransmitted == nil || packets.Value() == 0 {
+			return 0.0
+		}
+		return float64(retransmitted.Value()) / float64(packets.Value())
+	}))
+	return &RetransmissionFilter{size: size, devices: make(map[string][]packetSignature)}
+}
+
+// Seen tells if the data packet is a retransmission of a recent packet of the device. Packets without records are
+// never retransmissions
+func (f *RetransmissionFilter) Seen(imei string, frame []byte, packet *teltonika.Packet) bool {
+	signature, ok := newPacketSignature(frame, packet)
+	if !ok {
+		return false
+	}
+	retransmitMetrics.Add("packets", 1)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, s := range f.devices[imei] {
+		if s == signature {
+			retransmitMetrics.Add("retransmitted", 1)
+			return true
+		}
+	}
+	return false
+}
+
+// Remember adds the packet to the recent packets of the device once it's handled, a packet that failed (and wasn't
+// acked) must be handled again when the device resends it
+func (f *RetransmissionFilter) Remember(imei string, frame []byte, packet *teltonika.Packet) {
+	signature, ok := newPacketSignature(frame, packet)
+	if !ok {
+		return
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	recent := f.devices[imei]
+	if len(recent) >= f.size {
+		recent = append(recent[:0], recent[1:]...)
+	}
+	f.devices[imei] = append(recent, signature)
+}
+
+func newPacketSignature(frame []byte, packet *teltonika.Packet) (packetSignature, bool) {
+	if len(packet.Data) == 0 || len(frame) < 4 {
+		return packetSignature{}, false
+	}
+	return packetSignature{
+		crc:     binary.BigEndian.Uint32(frame[len(frame)-4:]),
+		records: len(packet.Data),
+		first:   packet.Data[0].TimestampMs,
+		last:    packet.Data[len(packet.Data)-1].TimestampMs,
+	}, true
+}
+
+// Purge forgets the recent packets of the device (a Purger)
+func (f *RetransmissionFilter) Purge(imei string) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	n := len(f.devices[imei])
+	delete(f.devices, imei)
+	return n, nil
+}
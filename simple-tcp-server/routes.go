@@ -0,0 +1,199 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"time"
+)
+
+var routeMetrics = expvar.NewMap("routes")
+
+// RouteConfig: a routing rule, the records matching Filter (devices, groups, record fields, event types) go to the
+// hooks named in Hooks. With Template (or TemplateFile) the hooks render the routed records with it instead of their
+// own template. The rules are applied in order, a record matching a Final rule isn't routed by the later rules.
+// The hooks named by a rule only get what the rules route to them, the other hooks get everything
+type RouteConfig struct {
+	Name         string        `json:"name"`
+	Filter       *FilterConfig `json:"filter"`
+	Hooks        []string      `json:"hooks"`
+	Template     string        `json:"template"`
+	TemplateFile string        `json:"templateFile"`
+	Final        bool          `json:"final"`
+}
+
+// Router is the Sink of the routed hooks
+type Router struct {
+	routes []*route
+	sinks  []Sink
+}
+
+// route is a rule, sinks are indexes in Router.sinks
+type route struct {
+	name   string
+	filter *FilterConfig
+	sinks  []int
+	final  bool
+}
+
+// NewRouter builds the hooks of the rules, a hook is built once, and once more for every rule with a template
+func NewRouter(configs []*RouteConfig, hooks []*HookConfig, defaults WebhookConfig, logger *Logger) (*Router, error) {
+	named := make(map[string]*HookConfig, len(hooks))
+	for _, hook := range hooks {
+		if hook.Name != "" {
+			named[hook.Name] = hook
+		}
+	}
+	built := make(map[string]int)
+	r := &Router{}
+	for i, config := range configs {
+		name := config.Name
+		if name == "" {
+			name = fmt.Sprintf("route%d", i+1)
+		}
+		if len(config.Hooks) == 0 {
+			return nil, fmt.Errorf("route '%s' has no hooks", name)
+		}
+		rt := &route{name: name, filter: config.Filter, final: config.Final}
+		if rt.filter == nil {
+			rt.filter = &FilterConfig{}
+		}
+		if err := rt.filter.Compile(); err != nil {
+			return nil, fmt.Errorf("route '%s': %v", name, err)
+		}
+		for _, hookName := range config.Hooks {
+			hook, ok := named[hookName]
+			if !ok {
+				return nil, fmt.Errorf("route '%s': unknown hook '%s'", name, hookName)
+			}
+			key := hookName
+			if config.Template != "" || config.TemplateFile != "" {
+				key = hookName + "@" + name
+			}
+			sink, ok := built[key]
+			if !ok {
+				sink = len(r.sinks)
+				h := *hook
+				if key != hookName {
+					h.Name, h.Template, h.TemplateFile = key, config.Template, config.TemplateFile
+					if h.QueueDir != "" {
+						h.QueueDir += "-" + name
+					}
+				}
+				hookSink, err := h.Sink(defaults, logger)
+				if err != nil {
+					return nil, fmt.Errorf("route '%s': %v", name, err)
+				}
+				built[key] = sink
+				r.sinks = append(r.sinks, hookSink)
+			}
+			rt.sinks = append(rt.sinks, sink)
+		}
+		r.routes = append(r.routes, rt)
+	}
+	return r, nil
+}
+
+// routedHooks returns the names of the hooks the rules route to
+func routedHooks(configs []*RouteConfig) map[string]bool {
+	routed := make(map[string]bool)
+	for _, config := range configs {
+		for _, hook := range config.Hooks {
+			routed[hook] = true
+		}
+	}
+	return routed
+}
+
+// Send routes every record to the sinks of the rules it matches, a sink gets a record once even if several rules
+// route it there. A packet without records (command responses) goes to the rules of the device without field
+// conditions or expression
+func (r *Router) Send(imei string, pkt *AnnotatedPacket) error {
+	matched := make([][]int, len(r.sinks))
+	for i := range pkt.Data {
+		marked := make([]bool, len(r.sinks))
+		for _, rt := range r.routes {
+			if !rt.filter.MatchDevice(imei, pkt.CodecID) || !rt.filter.MatchRecord(&pkt.Data[i]) {
+				continue
+			}
+			routeMetrics.Add(rt.name, 1)
+			for _, sink := range rt.sinks {
+				if !marked[sink] {
+					marked[sink] = true
+					matched[sink] = append(matched[sink], i)
+				}
+			}
+			if rt.final {
+				break
+			}
+		}
+	}
+	whole := make([]bool, len(r.sinks))
+	if len(pkt.Data) == 0 {
+		for _, rt := range r.routes {
+			if rt.filter.HasRecordConditions() || !rt.filter.MatchDevice(imei, pkt.CodecID) {
+				continue
+			}
+			for _, sink := range rt.sinks {
+				whole[sink] = true
+			}
+			if rt.final {
+				break
+			}
+		}
+	}
+
+	var firstErr error
+	for n, sink := range r.sinks {
+		routed := pkt
+		if !whole[n] {
+			if len(matched[n]) == 0 {
+				continue
+			}
+			records := make([]teltonika.Data, len(matched[n]))
+			for i, index := range matched[n] {
+				records[i] = pkt.Data[index]
+			}
+			routed = pkt.Derive(records, matched[n])
+		}
+		if err := sink.Send(imei, routed); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// SendEvent routes the event to the sinks of the rules matching its device and type
+func (r *Router) SendEvent(event *Event) error {
+	marked := make([]bool, len(r.sinks))
+	for _, rt := range r.routes {
+		if !rt.filter.MatchImei(event.Imei) || !rt.filter.MatchEventType(event.Type) {
+			continue
+		}
+		for _, sink := range rt.sinks {
+			marked[sink] = true
+		}
+		if rt.final {
+			break
+		}
+	}
+	var firstErr error
+	for n, sink := range r.sinks {
+		eventSink, ok := sink.(EventSink)
+		if !ok || !marked[n] {
+			continue
+		}
+		if err := eventSink.SendEvent(event); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Sinks returns the hook sinks of the router, for the reprocessing
+func (r *Router) Sinks() []Sink {
+	return r.sinks
+}
+
+func (r *Router) Drain(timeout time.Duration) bool {
+	return drainSinks(r.sinks, timeout)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var s3KeyUnsafe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// S3DeadLetterQueue stores every letter as an object, requests are signed with AWS Signature V4,
+// S3_ENDPOINT can point to any S3 compatible storage (path style addressing is used)
+type S3DeadLetterQueue struct {
+	endpoint     string
+	bucket       string
+	prefix       string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	client       *http.Client
+}
+
+func NewS3DeadLetterQueue(spec string) (*S3DeadLetterQueue, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("s3 dead letter spec parse error (%v)", err)
+	}
+	q := &S3DeadLetterQueue{
+		endpoint:     strings.TrimSuffix(os.Getenv("S3_ENDPOINT"), "/"),
+		bucket:       u.Host,
+		prefix:       strings.Trim(u.Path, "/"),
+		region:       os.Getenv("AWS_REGION"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		client:       &http.Client{Timeout: time.Second * 30},
+	}
+	if q.bucket == "" {
+		return nil, errors.New("s3 dead letter spec has no bucket")
+	}
+	if q.accessKey == "" || q.secretKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set for the s3 dead letter queue")
+	}
+	if q.region == "" {
+		q.region = "us-east-1"
+	}
+	if q.endpoint == "" {
+		q.endpoint = "https://s3." + q.region + ".amazonaws.com"
+	}
+	return q, nil
+}
+
+func (q *S3DeadLetterQueue) Put(letter *DeadLetter) error {
+	key := letter.Time.Format("2006/01/02/") + strconv.FormatInt(letter.Time.UnixNano(), 10) + "-" +
+		s3KeyUnsafe.ReplaceAllString(letter.Sink, "_") + ".json"
+	if q.prefix != "" {
+		key = q.prefix + "/" + key
+	}
+	return q.put(key, letter)
+}
+
+func (q *S3DeadLetterQueue) put(key string, letter *DeadLetter) error {
+	body, err := json.Marshal(letter)
+	if err != nil {
+		return fmt.Errorf("dead letter marshaling error (%v)", err)
+	}
+	if _, err = q.do(http.MethodPut, key, nil, body); err != nil {
+		return fmt.Errorf("s3 put error (%v)", err)
+	}
+	return nil
+}
+
+// s3ListResult is the response of ListObjectsV2
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// Reprocess lists the letters under the prefix, delivered letters are deleted, the ones that fail
+// again are rewritten in place
+func (q *S3DeadLetterQueue) Reprocess(redeliver func(letter *DeadLetter) error) error {
+	prefix := ""
+	if q.prefix != "" {
+		prefix = q.prefix + "/"
+	}
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		data, err := q.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return fmt.Errorf("s3 list error (%v)", err)
+		}
+		list := &s3ListResult{}
+		if err = xml.Unmarshal(data, list); err != nil {
+			return fmt.Errorf("s3 list parse error (%v)", err)
+		}
+		for _, object := range list.Contents {
+			if err = q.reprocess(object.Key, redeliver); err != nil {
+				return err
+			}
+		}
+		if !list.IsTruncated || list.NextContinuationToken == "" {
+			return nil
+		}
+		token = list.NextContinuationToken
+	}
+}
+
+func (q *S3DeadLetterQueue) reprocess(key string, redeliver func(letter *DeadLetter) error) error {
+	data, err := q.do(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return fmt.Errorf("s3 get error (%v)", err)
+	}
+	letter := &DeadLetter{}
+	if err = json.Unmarshal(data, letter); err != nil {
+		return fmt.Errorf("dead letter '%s' parse error (%v)", key, err)
+	}
+	if err = redeliver(letter); err != nil {
+		letter.Attempts++
+		letter.Error = err.Error()
+		return q.put(key, letter)
+	}
+	if _, err = q.do(http.MethodDelete, key, nil, nil); err != nil {
+		return fmt.Errorf("s3 delete error (%v)", err)
+	}
+	return nil
+}
+
+// do sends a signed request for the object key (the bucket if key is empty) and returns the response body
+func (q *S3DeadLetterQueue) do(method string, key string, query url.Values, body []byte) ([]byte, error) {
+	target := q.endpoint + "/" + q.bucket
+	if key != "" {
+		target += "/" + key
+	}
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	// the canonical query of the signature encodes spaces as %20
+	req.URL.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	q.sign(req, body, time.Now().UTC())
+
+	res, err := q.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	data, err := io.ReadAll(io.LimitReader(res.Body, 64*1024*1024))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		if len(data) > 1024 {
+			data = data[:1024]
+		}
+		return nil, fmt.Errorf("status: %s, response: %s", res.Status, string(data))
+	}
+	return data, nil
+}
+
+func (q *S3DeadLetterQueue) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	headers := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	values := map[string]string{"host": req.URL.Host, "x-amz-content-sha256": payloadHash, "x-amz-date": amzDate}
+	if q.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", q.sessionToken)
+		headers = append(headers, "x-amz-security-token")
+		values["x-amz-security-token"] = q.sessionToken
+	}
+
+	canonicalHeaders := strings.Builder{}
+	for _, h := range headers {
+		canonicalHeaders.WriteString(h + ":" + values[h] + "\n")
+	}
+	signedHeaders := strings.Join(headers, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method, req.URL.EscapedPath(), req.URL.RawQuery, canonicalHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+
+	scope := date + "/" + q.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSha256([]byte("AWS4"+q.secretKey), date)
+	key = hmacSha256(key, q.region)
+	key = hmacSha256(key, "s3")
+	key = hmacSha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+q.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
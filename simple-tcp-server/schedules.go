@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SchedulesConfig: Schedules are the initial schedules, the ones created through the api are kept in File
+// (with the initial ones) if set
+type SchedulesConfig struct {
+	File      string             `json:"file"`
+	Schedules []*CommandSchedule `json:"schedules"`
+}
+
+// CommandSchedule sends the command to the selected devices at the Cron times (minute hour day month weekday,
+// UTC, e.g. "0 3 * * *" nightly, "0 4 * * 0" weekly) and, with OnConnect, when a device connects. Devices offline
+// at a cron time are skipped. The commands are sent on behalf of Operator, the operator who created the schedule
+// through the api ("system" for the configured schedules)
+type CommandSchedule struct {
+	DeviceSelector
+	Id        string          `json:"id"`
+	Command   CampaignCommand `json:"command"`
+	Cron      string          `json:"cron"`
+	OnConnect bool            `json:"onConnect"`
+	Operator  string          `json:"operator"`
+	LastRun   *time.Time      `json:"lastRun,omitempty"`
+	cron      *cronSchedule
+	text      string
+}
+
+// cronSchedule holds the allowed values of the 5 cron fields
+type cronSchedule struct {
+	fields [5]map[int]bool
+}
+
+// cronRanges are the ranges of the fields, 7 is sunday too in the day of the week
+var cronRanges = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+// parseCron parses "*", values, ranges (1-5), lists (1,3) and steps (*/15, 0-30/10)
+func parseCron(spec string) (*cronSchedule, error) {
+	parts := strings.Fields(spec)
+	if len(parts) != 5 {
+		return nil, fmt.Errorf("cron '%s' must have 5 fields", spec)
+	}
+	c := &cronSchedule{}
+	for i, part := range parts {
+		c.fields[i] = make(map[int]bool)
+		low, high := cronRanges[i][0], cronRanges[i][1]
+		for _, item := range strings.Split(part, ",") {
+			rangePart, stepPart, hasStep := strings.Cut(item, "/")
+			step := 1
+			if hasStep {
+				var err error
+				if step, err = strconv.Atoi(stepPart); err != nil || step <= 0 {
+					return nil, fmt.Errorf("cron '%s': invalid step '%s'", spec, stepPart)
+				}
+			}
+			from, to := low, high
+			if rangePart != "*" {
+				a, b, isRange := strings.Cut(rangePart, "-")
+				var err error
+				if from, err = strconv.Atoi(a); err != nil {
+					return nil, fmt.Errorf("cron '%s': invalid value '%s'", spec, a)
+				}
+				to = from
+				if isRange {
+					if to, err = strconv.Atoi(b); err != nil {
+						return nil, fmt.Errorf("cron '%s': invalid value '%s'", spec, b)
+					}
+				} else if hasStep {
+					to = high
+				}
+			}
+			if from < low || to > high || from > to {
+				return nil, fmt.Errorf("cron '%s': '%s' out of range %d-%d", spec, item, low, high)
+			}
+			for v := from; v <= to; v += step {
+				if i == 4 {
+					// sunday is 0 for time.Weekday
+					c.fields[i][v%7] = true
+				} else {
+					c.fields[i][v] = true
+				}
+			}
+		}
+	}
+	return c, nil
+}
+
+func (c *cronSchedule) match(t time.Time) bool {
+	return c.fields[0][t.Minute()] && c.fields[1][t.Hour()] && c.fields[2][t.Day()] &&
+		c.fields[3][int(t.Month())] && c.fields[4][int(t.Weekday())]
+}
+
+func (s *CommandSchedule) compile() error {
+	command, err := NewCommand(s.Command.Name, s.Command.Args...)
+	if err != nil {
+		return err
+	}
+	s.text = command.Text()
+	if s.Cron == "" && !s.OnConnect {
+		return fmt.Errorf("schedule has no cron and isn't on connect")
+	}
+	if s.Cron != "" {
+		if s.cron, err = parseCron(s.Cron); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CommandScheduler sends the scheduled commands, Execute sends a command and waits for the response,
+// Devices lists the connected devices, Authorize returns the operator of an api request (set by the caller)
+type CommandScheduler struct {
+	Execute   func(imei string, cmd string, timeout time.Duration, operator string) (string, error)
+	Devices   func() []string
+	Authorize func(r *http.Request) (string, bool)
+	file      string
+	logger    *Logger
+	mutex     sync.Mutex
+	schedules map[string]*CommandSchedule
+	nextId    int
+}
+
+func NewCommandScheduler(config *SchedulesConfig, logger *Logger) (*CommandScheduler, error) {
+	if config == nil {
+		config = &SchedulesConfig{}
+	}
+	s := &CommandScheduler{file: config.File, logger: logger, schedules: make(map[string]*CommandSchedule)}
+	schedules := config.Schedules
+	if s.file != "" {
+		data, err := os.ReadFile(s.file)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("schedules read error (%v)", err)
+		}
+		if err == nil {
+			schedules = nil
+			if err = json.Unmarshal(data, &schedules); err != nil {
+				return nil, fmt.Errorf("schedules parse error (%v)", err)
+			}
+		}
+	}
+	for _, schedule := range schedules {
+		if schedule.Operator == "" {
+			schedule.Operator = "system"
+		}
+		if err := s.add(schedule); err != nil {
+			return nil, err
+		}
+	}
+	go func() {
+		for {
+			// run at the start of every minute
+			now := time.Now()
+			time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+			s.tick(time.Now().UTC())
+		}
+	}()
+	return s, nil
+}
+
+// add compiles the schedule and adds it, the mutex must not be held
+func (s *CommandScheduler) add(schedule *CommandSchedule) error {
+	if err := schedule.compile(); err != nil {
+		if schedule.Id == "" {
+			return fmt.Errorf("schedule: %v", err)
+		}
+		return fmt.Errorf("schedule '%s': %v", schedule.Id, err)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if schedule.Id == "" {
+		s.nextId++
+		schedule.Id = strconv.Itoa(s.nextId)
+	} else if n, err := strconv.Atoi(schedule.Id); err == nil && n > s.nextId {
+		s.nextId = n
+	}
+	if _, ok := s.schedules[schedule.Id]; ok {
+		return fmt.Errorf("schedule '%s' already exists", schedule.Id)
+	}
+	s.schedules[schedule.Id] = schedule
+	return nil
+}
+
+func (s *CommandScheduler) list() []*CommandSchedule {
+	list := make([]*CommandSchedule, 0, len(s.schedules))
+	for _, schedule := range s.schedules {
+		list = append(list, schedule)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	return list
+}
+
+// saveLocked writes the schedules to the file, the mutex must be held
+func (s *CommandScheduler) saveLocked() {
+	if s.file == "" {
+		return
+	}
+	data, err := json.Marshal(s.list())
+	if err == nil {
+		err = os.WriteFile(s.file, data, 0o644)
+	}
+	if err != nil {
+		s.logger.Error.Printf("schedules save error (%v)", err)
+	}
+}
+
+func (s *CommandScheduler) tick(now time.Time) {
+	var devices []string
+	s.mutex.Lock()
+	for _, schedule := range s.schedules {
+		if schedule.cron == nil || !schedule.cron.match(now) {
+			continue
+		}
+		if devices == nil && s.Devices != nil {
+			devices = s.Devices()
+		}
+		run := now
+		schedule.LastRun = &run
+		for _, imei := range devices {
+			if schedule.Match(imei) {
+				go s.send(imei, schedule)
+			}
+		}
+		s.saveLocked()
+	}
+	s.mutex.Unlock()
+}
+
+// Connected sends the on connect commands to a device that just connected (TCPServer.OnConnect),
+// after the login completes
+func (s *CommandScheduler) Connected(imei string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, schedule := range s.schedules {
+		if schedule.OnConnect && schedule.Match(imei) {
+			schedule := schedule
+			go func() {
+				time.Sleep(time.Second * 10)
+				s.send(imei, schedule)
+			}()
+		}
+	}
+}
+
+// send runs the command of the schedule, the fields read are set before the schedule is added
+func (s *CommandScheduler) send(imei string, schedule *CommandSchedule) {
+	response, err := s.Execute(imei, schedule.text, time.Minute, schedule.Operator)
+	if err != nil {
+		s.logger.Error.Printf("[%s]: schedule '%s' command error (%v)", imei, schedule.Id, err)
+		return
+	}
+	s.logger.Info.Printf("[%s]: schedule '%s' response: %s", imei, schedule.Id, response)
+}
+
+// ServeHTTP handles /schedules: GET lists the schedules, POST creates one ({"command": {"name": "getinfo"},
+// "cron": "0 3 * * *", "imeiPrefixes": ["3520"]}), DELETE /schedules/{id} removes one
+func (s *CommandScheduler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	operator, ok := authorize(w, r, s.Authorize)
+	if !ok {
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/schedules"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		writeJson(w, http.StatusOK, s.list())
+	case id == "" && r.Method == http.MethodPost:
+		schedule := &CommandSchedule{}
+		if err := json.NewDecoder(r.Body).Decode(schedule); err != nil {
+			http.Error(w, "invalid schedule ("+err.Error()+")", http.StatusBadRequest)
+			return
+		}
+		schedule.Id, schedule.LastRun, schedule.Operator = "", nil, operator
+		if err := s.add(schedule); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.saveLocked()
+		writeJson(w, http.StatusCreated, schedule)
+	case id != "" && r.Method == http.MethodDelete:
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if _, ok := s.schedules[id]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		delete(s.schedules, id)
+		s.saveLocked()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
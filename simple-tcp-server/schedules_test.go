@@ -0,0 +1,113 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// cronValues returns the allowed values of the field, sorted
+func cronValues(c *cronSchedule, field int) []int {
+	values := make([]int, 0, len(c.fields[field]))
+	for v := range c.fields[field] {
+		values = append(values, v)
+	}
+	sort.Ints(values)
+	return values
+}
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		spec   string
+		field  int
+		values []int
+	}{
+		{"0 3 * * *", 0, []int{0}},
+		{"0 3 * * *", 1, []int{3}},
+		{"*/15 * * * *", 0, []int{0, 15, 30, 45}},
+		{"0-30/10 * * * *", 0, []int{0, 10, 20, 30}},
+		{"5/20 * * * *", 0, []int{5, 25, 45}},
+		{"0 8,12,18 * * *", 1, []int{8, 12, 18}},
+		{"0 9-11,14 * * *", 1, []int{9, 10, 11, 14}},
+		{"0 0 1,15 * *", 2, []int{1, 15}},
+		{"0 0 * */6 *", 3, []int{1, 7}},
+		{"0 0 * * 1-5", 4, []int{1, 2, 3, 4, 5}},
+		{"0 0 * * 7", 4, []int{0}},
+		{"0 0 * * 5-7", 4, []int{0, 5, 6}},
+		{"0 0 * * 2-7/2", 4, []int{2, 4, 6}},
+		{"0 0 * * *", 4, []int{0, 1, 2, 3, 4, 5, 6}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			c, err := parseCron(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := cronValues(c, tt.field); !reflect.DeepEqual(got, tt.values) {
+				t.Errorf("field %d = %v, want %v", tt.field, got, tt.values)
+			}
+		})
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	tests := []struct {
+		spec string
+		err  string
+	}{
+		{"* * * *", "must have 5 fields"},
+		{"* * * * * *", "must have 5 fields"},
+		{"60 * * * *", "out of range 0-59"},
+		{"* 24 * * *", "out of range 0-23"},
+		{"* * 0 * *", "out of range 1-31"},
+		{"* * * 13 *", "out of range 1-12"},
+		{"* * * * 8", "out of range 0-7"},
+		{"* 10-5 * * *", "out of range"},
+		{"*/0 * * * *", "invalid step '0'"},
+		{"*/x * * * *", "invalid step 'x'"},
+		{"a * * * *", "invalid value 'a'"},
+		{"1-b * * * *", "invalid value 'b'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			_, err := parseCron(tt.spec)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error %v, want %s", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCronMatch(t *testing.T) {
+	// 2024-03-03 is a sunday
+	sunday := time.Date(2024, 3, 3, 3, 0, 0, 0, time.UTC)
+	tests := []struct {
+		spec string
+		time time.Time
+		want bool
+	}{
+		{"0 3 * * *", sunday, true},
+		{"0 3 * * *", sunday.Add(time.Minute), false},
+		{"0 3 * * 0", sunday, true},
+		{"0 3 * * 7", sunday, true},
+		{"0 3 * * 1-5", sunday, false},
+		{"0 3 * * 1-5", sunday.AddDate(0, 0, 1), true},
+		{"0 3 3 3 *", sunday, true},
+		{"0 3 3 4 *", sunday, false},
+		{"*/20 */3 * * *", sunday.Add(time.Minute * 40), true},
+		{"*/20 */3 * * *", sunday.Add(time.Hour), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec+" "+tt.time.Format(time.RFC3339), func(t *testing.T) {
+			c, err := parseCron(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := c.match(tt.time); got != tt.want {
+				t.Errorf("match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var scriptMetrics = expvar.NewMap("script")
+
+// ScriptConfig: File is a record script applied to every record before the sinks, reloaded when the file changes
+// (checked every ReloadSeconds, default 5). A script that doesn't compile is logged and the previous one stays.
+// There's no WASM or Lua runtime, the server has no dependencies besides the codec: the statements use the
+// expressions of the conditions (see Condition), one statement per line, # starts a comment:
+//
+//	drop if speed == 0 && io.ignition == 0
+//	keep if satellites >= 4
+//	set speedMph = speed * 0.621371
+//	set speed = 0 if satellites < 3
+//	remove io.iccid1
+//
+// drop removes the records matching the condition, keep the records not matching it. set assigns a record field
+// (lat, lng, altitude, angle, speed, satellites) or, for any other name, attaches the value as a record attribute,
+// it's skipped when an IO element of the expression is missing. remove deletes an IO element from the record
+type ScriptConfig struct {
+	File          string `json:"file"`
+	ReloadSeconds int    `json:"reloadSeconds"`
+}
+
+// RecordScript is a compiled script
+type RecordScript struct {
+	statements []*scriptStatement
+}
+
+type scriptStatement struct {
+	kind      string
+	target    string
+	value     *Condition
+	condition *Condition
+	io        uint16
+}
+
+var scriptFields = map[string]bool{"lat": true, "lng": true, "altitude": true, "angle": true, "speed": true,
+	"satellites": true}
+
+func CompileRecordScript(source string) (*RecordScript, error) {
+	script := &RecordScript{}
+	scanner := bufio.NewScanner(strings.NewReader(source))
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		statement, err := compileScriptStatement(text)
+		if err != nil {
+			return nil, fmt.Errorf("script line %d: %v", line, err)
+		}
+		script.statements = append(script.statements, statement)
+	}
+	return script, nil
+}
+
+func compileScriptStatement(text string) (*scriptStatement, error) {
+	kind, rest, _ := strings.Cut(text, " ")
+	rest = strings.TrimSpace(rest)
+	statement := &scriptStatement{kind: kind}
+	var err error
+	switch kind {
+	case "drop", "keep":
+		if !strings.HasPrefix(rest, "if ") {
+			return nil, fmt.Errorf("%s requires 'if <condition>'", kind)
+		}
+		statement.condition, err = CompileCondition(strings.TrimPrefix(rest, "if "))
+	case "set":
+		assignment, condition, conditional := strings.Cut(rest, " if ")
+		target, expression, ok := strings.Cut(assignment, "=")
+		statement.target = strings.TrimSpace(target)
+		if !ok || statement.target == "" || strings.ContainsAny(statement.target, " .") {
+			return nil, fmt.Errorf("set requires '<name> = <expression>'")
+		}
+		if statement.value, err = CompileCondition(strings.TrimSpace(expression)); err != nil {
+			return nil, err
+		}
+		if conditional {
+			statement.condition, err = CompileCondition(condition)
+		}
+	case "remove":
+		if !strings.HasPrefix(rest, "io.") {
+			return nil, fmt.Errorf("remove requires 'io.<name>'")
+		}
+		name := strings.TrimPrefix(rest, "io.")
+		id, ok := ioIdByName(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown io element '%s'", name)
+		}
+		statement.io = id
+	default:
+		return nil, fmt.Errorf("unknown statement '%s'", kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return statement, nil
+}
+
+// Run applies the script to the record (a copy the script may change), false if the record is dropped
+func (s *RecordScript) Run(record *teltonika.Data) (map[string]any, bool) {
+	var attributes map[string]any
+	for _, statement := range s.statements {
+		switch statement.kind {
+		case "drop":
+			if statement.condition.Eval(record) {
+				return nil, false
+			}
+		case "keep":
+			if !statement.condition.Eval(record) {
+				return nil, false
+			}
+		case "set":
+			if statement.condition != nil && !statement.condition.Eval(record) {
+				continue
+			}
+			value, ok := statement.value.Value(record)
+			if !ok {
+				continue
+			}
+			if !scriptFields[statement.target] {
+				if attributes == nil {
+					attributes = make(map[string]any)
+				}
+				attributes[statement.target] = value
+				continue
+			}
+			setScriptField(record, statement.target, value)
+		case "remove":
+			elements := make([]teltonika.IOElement, 0, len(record.Elements))
+			for _, el := range record.Elements {
+				if el.Id != statement.io {
+					elements = append(elements, el)
+				}
+			}
+			record.Elements = elements
+		}
+	}
+	return attributes, true
+}
+
+func setScriptField(record *teltonika.Data, name string, value float64) {
+	switch name {
+	case "lat":
+		record.Lat = value
+	case "lng":
+		record.Lng = value
+	case "altitude":
+		record.Altitude = int16(value)
+	case "angle":
+		record.Angle = uint16(value)
+	case "speed":
+		record.Speed = uint16(value)
+	case "satellites":
+		record.Satellites = uint8(value)
+	}
+}
+
+// ScriptStage runs the script of the config on the records (Stage)
+type ScriptStage struct {
+	path     string
+	logger   *Logger
+	mutex    sync.RWMutex
+	script   *RecordScript
+	modified time.Time
+}
+
+func NewScriptStage(config *ScriptConfig, logger *Logger) (*ScriptStage, error) {
+	if config.File == "" {
+		return nil, fmt.Errorf("script requires file")
+	}
+	s := &ScriptStage{path: config.File, logger: logger}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	interval := time.Duration(config.ReloadSeconds) * time.Second
+	if interval <= 0 {
+		interval = time.Second * 5
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if err := s.load(); err != nil {
+				scriptMetrics.Add("reloadErrors", 1)
+				s.logger.Error.Printf("%v, the previous script stays", err)
+			}
+		}
+	}()
+	return s, nil
+}
+
+// load compiles the file if it changed since the last load
+func (s *ScriptStage) load() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return fmt.Errorf("script read error (%v)", err)
+	}
+	s.mutex.RLock()
+	unchanged := info.ModTime().Equal(s.modified)
+	s.mutex.RUnlock()
+	if unchanged {
+		return nil
+	}
+	source, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("script read error (%v)", err)
+	}
+	script, err := CompileRecordScript(string(source))
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// a broken script isn't compiled again until the file changes
+	s.modified = info.ModTime()
+	if err != nil {
+		return err
+	}
+	if s.script != nil {
+		s.logger.Info.Printf("script %s reloaded", s.path)
+		scriptMetrics.Add("reloads", 1)
+	}
+	s.script = script
+	return nil
+}
+
+func (s *ScriptStage) Apply(imei string, pkt *AnnotatedPacket) *AnnotatedPacket {
+	if len(pkt.Data) == 0 {
+		return pkt
+	}
+	s.mutex.RLock()
+	script := s.script
+	s.mutex.RUnlock()
+
+	records := make([]teltonika.Data, 0, len(pkt.Data))
+	indexes := make([]int, 0, len(pkt.Data))
+	attributes := make([]map[string]any, 0, len(pkt.Data))
+	for i := range pkt.Data {
+		record := pkt.Data[i]
+		values, keep := script.Run(&record)
+		if !keep {
+			continue
+		}
+		records = append(records, record)
+		indexes = append(indexes, i)
+		attributes = append(attributes, values)
+	}
+	scriptMetrics.Add("dropped", int64(len(pkt.Data)-len(records)))
+	if len(records) == 0 && len(pkt.Messages) == 0 {
+		return nil
+	}
+	derived := pkt.Derive(records, indexes)
+	for i, values := range attributes {
+		if len(values) == 0 {
+			continue
+		}
+		if derived.Attributes == nil {
+			derived.Attributes = make([]map[string]any, len(records))
+		}
+		// the attributes of the packet may be shared with other sinks
+		merged := make(map[string]any, len(derived.Attributes[i])+len(values))
+		for k, v := range derived.Attributes[i] {
+			merged[k] = v
+		}
+		for k, v := range values {
+			merged[k] = v
+		}
+		derived.Attributes[i] = merged
+	}
+	return derived
+}
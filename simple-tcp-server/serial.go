@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var serialMetrics = expvar.NewMap("serialBridge")
+
+// SerialBridgeConfig: Address is the tcp address of the bridge (default 127.0.0.1:8082), a client opens a session
+// with a line holding the imei, the bytes it writes then go to the serial port (RS232/RS485 in TCP binary mode) of
+// the device and the serial data of the device comes back on the connection
+type SerialBridgeConfig struct {
+	Address string `json:"address"`
+}
+
+// serialReplyTimeout is how long a bridge write waits for its reply, later replies go to the command path
+const serialReplyTimeout = time.Second * 30
+
+// SerialBridge tunnels Codec 12 binary payloads between a tcp client and the serial port of a device,
+// a device has at most one session. Send sends a packet to the device, Connected tells if the device is
+// connected (both set by the caller)
+type SerialBridge struct {
+	Send      func(imei string, packet *teltonika.Packet) error
+	Connected func(imei string) bool
+	address   string
+	logger    *Logger
+	sessions  sync.Map
+}
+
+// serialSession is the client connection of a device, sent holds the times of the bridge writes waiting
+// for their reply
+type serialSession struct {
+	conn  net.Conn
+	mutex sync.Mutex
+	sent  []time.Time
+}
+
+func (s *serialSession) sending() {
+	s.mutex.Lock()
+	s.sent = append(s.sent, time.Now())
+	s.mutex.Unlock()
+}
+
+// cancel drops the last write, its send failed
+func (s *serialSession) cancel() {
+	s.mutex.Lock()
+	if len(s.sent) > 0 {
+		s.sent = s.sent[:len(s.sent)-1]
+	}
+	s.mutex.Unlock()
+}
+
+// reply takes the oldest write waiting for its reply, false if there's none (writes that waited longer than
+// serialReplyTimeout are dropped)
+func (s *serialSession) reply() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for len(s.sent) > 0 && time.Since(s.sent[0]) > serialReplyTimeout {
+		s.sent = s.sent[1:]
+		serialMetrics.Add("unanswered", 1)
+	}
+	if len(s.sent) == 0 {
+		return false
+	}
+	s.sent = s.sent[1:]
+	return true
+}
+
+func NewSerialBridge(config *SerialBridgeConfig, logger *Logger) *SerialBridge {
+	address := config.Address
+	if address == "" {
+		address = "127.0.0.1:8082"
+	}
+	return &SerialBridge{address: address, logger: logger}
+}
+
+func (b *SerialBridge) Run() error {
+	listener, err := net.Listen("tcp", b.address)
+	if err != nil {
+		return fmt.Errorf("serial bridge listen error (%v)", err)
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+	b.logger.Info.Println("serial bridge listening at " + b.address)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return fmt.Errorf("serial bridge accept error (%v)", err)
+		}
+		go b.handle(conn)
+	}
+}
+
+func (b *SerialBridge) handle(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+	}()
+	addr := conn.RemoteAddr().String()
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 10))
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		b.logger.Error.Printf("[%s]: serial bridge imei read error (%v)", addr, err)
+		return
+	}
+	imei := strings.TrimSpace(line)
+	if !b.Connected(imei) {
+		_, _ = conn.Write([]byte("device not connected\n"))
+		return
+	}
+	session := &serialSession{conn: conn}
+	if _, loaded := b.sessions.LoadOrStore(imei, session); loaded {
+		_, _ = conn.Write([]byte("session already open\n"))
+		return
+	}
+	defer b.sessions.Delete(imei)
+	serialMetrics.Add("sessions", 1)
+	b.logger.Info.Printf("[%s]: serial bridge session opened by %s", imei, addr)
+	_ = conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, 512)
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			packet := &teltonika.Packet{
+				CodecID:  teltonika.Codec12,
+				Messages: []teltonika.Message{{Type: teltonika.TypeCommand, Text: string(buf[:n])}},
+			}
+			session.sending()
+			if err := b.Send(imei, packet); err != nil {
+				session.cancel()
+				b.logger.Error.Printf("[%s]: serial bridge send error (%v)", imei, err)
+				return
+			}
+			serialMetrics.Add("bytesToDevice", int64(n))
+		}
+		if err != nil {
+			b.logger.Info.Printf("[%s]: serial bridge session closed (%v)", imei, err)
+			return
+		}
+	}
+}
+
+// Deliver writes the payload of a Codec 12 response to the session of the device if a bridge write waits
+// for it, false otherwise (the message is a command response then)
+func (b *SerialBridge) Deliver(imei string, message *teltonika.Message) bool {
+	value, ok := b.sessions.Load(imei)
+	if !ok {
+		return false
+	}
+	session := value.(*serialSession)
+	if !session.reply() {
+		return false
+	}
+	conn := session.conn
+	if _, err := conn.Write([]byte(message.Text)); err != nil {
+		b.logger.Error.Printf("[%s]: serial bridge write error (%v)", imei, err)
+		_ = conn.Close()
+		return true
+	}
+	serialMetrics.Add("bytesFromDevice", int64(len(message.Text)))
+	return true
+}
+
+// Close ends the session of a disconnected device (TCPServer.OnClose)
+func (b *SerialBridge) Close(imei string) {
+	if value, ok := b.sessions.Load(imei); ok {
+		_ = value.(*serialSession).conn.Close()
+	}
+}
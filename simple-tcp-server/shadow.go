@@ -0,0 +1,405 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ShadowConfig: Profiles are the desired parameter sets (names or ids to values), for every device the first
+// profile matching its imei applies, a desired set put through the api replaces it for the device (kept in
+// File if set). The reported configuration is read with getparam DelaySeconds (default 10) after the device
+// connects, with AutoPush the drifted parameters are set and read again
+type ShadowConfig struct {
+	Profiles     []*ShadowProfile `json:"profiles"`
+	AutoPush     bool             `json:"autoPush"`
+	File         string           `json:"file"`
+	DelaySeconds int              `json:"delaySeconds"`
+}
+
+type ShadowProfile struct {
+	DeviceSelector
+	Parameters map[string]any `json:"parameters"`
+}
+
+// ParameterDrift is a parameter whose reported value differs from the desired one
+type ParameterDrift struct {
+	Desired  string `json:"desired"`
+	Reported string `json:"reported"`
+}
+
+// DeviceShadow is the desired and the reported configuration of a device, keyed by parameter id
+type DeviceShadow struct {
+	Desired  map[string]string          `json:"desired"`
+	Reported map[string]string          `json:"reported"`
+	Drift    map[string]*ParameterDrift `json:"drift"`
+	Checked  *time.Time                 `json:"checked,omitempty"`
+	Pushed   *time.Time                 `json:"pushed,omitempty"`
+	Error    string                     `json:"error,omitempty"`
+}
+
+// getparam/setparam commands carry a few parameters each (the command length is limited)
+const shadowBatchSize = 10
+
+// ShadowService keeps the device shadows, Execute sends a command and waits for the response, Authorize returns
+// the operator of an api request (both set by the caller)
+type ShadowService struct {
+	Execute     func(imei string, cmd string, timeout time.Duration, operator string) (string, error)
+	Authorize   func(r *http.Request) (string, bool)
+	config      *ShadowConfig
+	delay       time.Duration
+	logger      *Logger
+	mutex       sync.Mutex
+	desired     map[string]map[string]string
+	reported    map[string]*DeviceShadow
+	syncing     map[string]bool
+	provisioned map[string]bool
+}
+
+func NewShadowService(config *ShadowConfig, logger *Logger) (*ShadowService, error) {
+	if config == nil {
+		config = &ShadowConfig{}
+	}
+	s := &ShadowService{
+		config:      config,
+		delay:       time.Second * 10,
+		logger:      logger,
+		desired:     make(map[string]map[string]string),
+		reported:    make(map[string]*DeviceShadow),
+		syncing:     make(map[string]bool),
+		provisioned: make(map[string]bool),
+	}
+	if config.DelaySeconds > 0 {
+		s.delay = time.Duration(config.DelaySeconds) * time.Second
+	}
+	for _, profile := range config.Profiles {
+		if _, err := desiredParameters(profile.Parameters); err != nil {
+			return nil, fmt.Errorf("shadow profile: %v", err)
+		}
+	}
+	if config.File != "" {
+		data, err := os.ReadFile(config.File)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("shadow read error (%v)", err)
+		}
+		if err == nil {
+			if err = json.Unmarshal(data, &s.desired); err != nil {
+				return nil, fmt.Errorf("shadow parse error (%v)", err)
+			}
+		}
+	}
+	return s, nil
+}
+
+// desiredParameters validates the parameter values and keys them by id
+func desiredParameters(values map[string]any) (map[string]string, error) {
+	desired := make(map[string]string, len(values))
+	for key, value := range values {
+		id, err := parameterId(key)
+		if err != nil {
+			return nil, err
+		}
+		spec, ok := parametersById[id]
+		if !ok {
+			spec = &ParameterSpec{Id: id, Name: key, Type: "string", Max: 255}
+		}
+		if desired[strconv.Itoa(int(id))], err = spec.Format(value); err != nil {
+			return nil, err
+		}
+	}
+	return desired, nil
+}
+
+// Desired returns the desired parameters of the device (by id), nil if none
+func (s *ShadowService) Desired(imei string) map[string]string {
+	s.mutex.Lock()
+	desired, ok := s.desired[imei]
+	s.mutex.Unlock()
+	if ok {
+		return desired
+	}
+	for _, profile := range s.config.Profiles {
+		if profile.Match(imei) {
+			desired, _ = desiredParameters(profile.Parameters)
+			return desired
+		}
+	}
+	return nil
+}
+
+// SetDesired replaces the desired parameters of the device
+func (s *ShadowService) SetDesired(imei string, values map[string]any) error {
+	desired, err := desiredParameters(values)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.desired[imei] = desired
+	if s.config.File == "" {
+		return nil
+	}
+	data, err := json.Marshal(s.desired)
+	if err != nil {
+		return fmt.Errorf("shadow marshaling error (%v)", err)
+	}
+	if err = os.WriteFile(s.config.File, data, 0o644); err != nil {
+		return fmt.Errorf("shadow write error (%v)", err)
+	}
+	return nil
+}
+
+// Provision sets the desired parameters of a new device, they're pushed when it connects (even without AutoPush)
+func (s *ShadowService) Provision(imei string, values map[string]any) error {
+	if err := s.SetDesired(imei, values); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	s.provisioned[imei] = true
+	s.mutex.Unlock()
+	return nil
+}
+
+// Connected reads the configuration of a device that just connected (TCPServer.OnConnect)
+func (s *ShadowService) Connected(imei string) {
+	if s.Desired(imei) == nil {
+		return
+	}
+	s.mutex.Lock()
+	push := s.config.AutoPush || s.provisioned[imei]
+	s.mutex.Unlock()
+	go func() {
+		time.Sleep(s.delay)
+		if err := s.Sync(imei, push, "system"); err != nil {
+			s.logger.Error.Printf("[%s]: %v", imei, err)
+			return
+		}
+		s.mutex.Lock()
+		delete(s.provisioned, imei)
+		s.mutex.Unlock()
+	}()
+}
+
+// Sync reads the desired parameters from the device and computes the drift, with push the drifted
+// parameters are set and read again, the commands are sent on behalf of the operator
+func (s *ShadowService) Sync(imei string, push bool, operator string) error {
+	desired := s.Desired(imei)
+	if desired == nil {
+		return fmt.Errorf("shadow: no desired configuration")
+	}
+	s.mutex.Lock()
+	if s.syncing[imei] {
+		s.mutex.Unlock()
+		return fmt.Errorf("shadow: sync in progress")
+	}
+	s.syncing[imei] = true
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.syncing, imei)
+		s.mutex.Unlock()
+	}()
+
+	shadow, err := s.read(imei, desired, operator)
+	if err == nil && push && len(shadow.Drift) > 0 {
+		if err = s.push(imei, shadow.Drift, operator); err == nil {
+			pushed := time.Now().UTC()
+			if shadow, err = s.read(imei, desired, operator); shadow != nil {
+				shadow.Pushed = &pushed
+			}
+		}
+	}
+	if shadow == nil {
+		now := time.Now().UTC()
+		shadow = &DeviceShadow{Desired: desired, Checked: &now}
+	}
+	if err != nil {
+		shadow.Error = err.Error()
+	}
+	s.mutex.Lock()
+	s.reported[imei] = shadow
+	s.mutex.Unlock()
+	return err
+}
+
+func sortedIds(parameters map[string]string) []string {
+	ids := make([]string, 0, len(parameters))
+	for id := range parameters {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, _ := strconv.Atoi(ids[i])
+		b, _ := strconv.Atoi(ids[j])
+		return a < b
+	})
+	return ids
+}
+
+func idBatches(ids []string) [][]string {
+	batches := make([][]string, 0, len(ids)/shadowBatchSize+1)
+	for len(ids) > shadowBatchSize {
+		batches = append(batches, ids[:shadowBatchSize])
+		ids = ids[shadowBatchSize:]
+	}
+	if len(ids) > 0 {
+		batches = append(batches, ids)
+	}
+	return batches
+}
+
+func (s *ShadowService) read(imei string, desired map[string]string, operator string) (*DeviceShadow, error) {
+	now := time.Now().UTC()
+	shadow := &DeviceShadow{
+		Desired:  desired,
+		Reported: make(map[string]string),
+		Drift:    make(map[string]*ParameterDrift),
+		Checked:  &now,
+	}
+	for _, batch := range idBatches(sortedIds(desired)) {
+		command, err := NewCommand("getparam", batch...)
+		if err != nil {
+			return nil, err
+		}
+		response, err := s.Execute(imei, command.Text(), time.Minute, operator)
+		if err != nil {
+			return shadow, fmt.Errorf("shadow getparam error (%v)", err)
+		}
+		values, err := ParseGetParamResponse(response)
+		if err != nil {
+			return shadow, err
+		}
+		for _, value := range values {
+			shadow.Reported[strconv.Itoa(int(value.Id))] = fmt.Sprint(value.Value)
+		}
+	}
+	for id, value := range desired {
+		if reported, ok := shadow.Reported[id]; !ok || reported != value {
+			shadow.Drift[id] = &ParameterDrift{Desired: value, Reported: reported}
+		}
+	}
+	return shadow, nil
+}
+
+func (s *ShadowService) push(imei string, drift map[string]*ParameterDrift, operator string) error {
+	values := make(map[string]string, len(drift))
+	for id, d := range drift {
+		values[id] = d.Desired
+	}
+	for _, batch := range idBatches(sortedIds(values)) {
+		params := make(map[uint16]string, len(batch))
+		for _, id := range batch {
+			n, _ := strconv.Atoi(id)
+			params[uint16(n)] = values[id]
+		}
+		command, err := SetParamCommand(params)
+		if err != nil {
+			return err
+		}
+		if _, err = s.Execute(imei, command.Text(), time.Minute, operator); err != nil {
+			return fmt.Errorf("shadow setparam error (%v)", err)
+		}
+	}
+	s.logger.Info.Printf("[%s]: shadow pushed %d parameters", imei, len(values))
+	return nil
+}
+
+// Shadow returns the last synced shadow of the device, or the desired configuration if it wasn't synced yet
+func (s *ShadowService) Shadow(imei string) *DeviceShadow {
+	s.mutex.Lock()
+	shadow, ok := s.reported[imei]
+	s.mutex.Unlock()
+	if ok {
+		return shadow
+	}
+	desired := s.Desired(imei)
+	if desired == nil {
+		return nil
+	}
+	return &DeviceShadow{Desired: desired}
+}
+
+// ServeHTTP handles /devices/{imei}/shadow: GET returns the shadow, PUT replaces the desired parameters
+// ({"apn": "internet", "2005": 5027}), POST syncs now (?push=true sets the drifted parameters)
+func (s *ShadowService) ServeHTTP(w http.ResponseWriter, r *http.Request, imei string) {
+	switch r.Method {
+	case http.MethodGet:
+		shadow := s.Shadow(imei)
+		if shadow == nil {
+			http.NotFound(w, r)
+			return
+		}
+		writeJson(w, http.StatusOK, shadow)
+	case http.MethodPut:
+		if _, ok := authorize(w, r, s.Authorize); !ok {
+			return
+		}
+		var values map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&values); err != nil {
+			http.Error(w, "invalid shadow ("+err.Error()+")", http.StatusBadRequest)
+			return
+		}
+		if err := s.SetDesired(imei, values); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJson(w, http.StatusOK, s.Shadow(imei))
+	case http.MethodPost:
+		operator, ok := authorize(w, r, s.Authorize)
+		if !ok {
+			return
+		}
+		if err := s.Sync(imei, r.URL.Query().Get("push") == "true", operator); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		writeJson(w, http.StatusOK, s.Shadow(imei))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// shadowSnapshot is the snapshot of the shadows, the desired sets and the provisioned devices waiting for their push
+type shadowSnapshot struct {
+	Desired     map[string]map[string]string `json:"desired"`
+	Provisioned []string                     `json:"provisioned,omitempty"`
+}
+
+// Snapshot returns the desired configurations (a Snapshotter), the reported ones are read again at connect
+func (s *ShadowService) Snapshot() ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	snapshot := &shadowSnapshot{Desired: s.desired}
+	for imei := range s.provisioned {
+		snapshot.Provisioned = append(snapshot.Provisioned, imei)
+	}
+	sort.Strings(snapshot.Provisioned)
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("shadow marshaling error (%v)", err)
+	}
+	return data, nil
+}
+
+// Restore replaces the desired configurations and the provisioned devices with the ones of a snapshot
+func (s *ShadowService) Restore(data []byte) error {
+	snapshot := &shadowSnapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return fmt.Errorf("shadow parse error (%v)", err)
+	}
+	if snapshot.Desired == nil {
+		snapshot.Desired = make(map[string]map[string]string)
+	}
+	provisioned := make(map[string]bool, len(snapshot.Provisioned))
+	for _, imei := range snapshot.Provisioned {
+		provisioned[imei] = true
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.desired, s.provisioned = snapshot.Desired, provisioned
+	return nil
+}
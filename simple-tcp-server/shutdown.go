@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// shutdownStep is a step of the termination, run with the remaining grace period
+type shutdownStep struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// Shutdown is the termination sequence on SIGTERM (a Kubernetes pod or a systemd service stopping) and interrupt:
+// the steps run in their order (stop accepting, flush the queues to the sinks, persist the state), then the final
+// metrics are logged and the process exits. The steps left when the grace period ends are skipped, the process
+// exits with 1 then
+type Shutdown struct {
+	grace  time.Duration
+	logger *Logger
+	steps  []*shutdownStep
+}
+
+func NewShutdown(grace time.Duration, logger *Logger) *Shutdown {
+	return &Shutdown{grace: grace, logger: logger}
+}
+
+// Add appends a step, the error of a step is logged and the next steps still run
+func (s *Shutdown) Add(name string, run func(ctx context.Context) error) {
+	s.steps = append(s.steps, &shutdownStep{name: name, run: run})
+}
+
+// Notify runs the sequence and exits when the process gets SIGTERM or interrupt, a second signal exits at once
+func (s *Shutdown) Notify() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-signals
+		s.logger.Info.Printf("%v received, stopping (grace period %v)", sig, s.grace)
+		go func() {
+			sig := <-signals
+			s.logger.Error.Printf("%v received again, exiting", sig)
+			os.Exit(1)
+		}()
+		if s.Run() {
+			os.Exit(0)
+		}
+		os.Exit(1)
+	}()
+}
+
+// Run runs the steps within the grace period, false if a step failed or the grace period ended
+func (s *Shutdown) Run() bool {
+	if _, err := sdNotify("STOPPING=1"); err != nil {
+		s.logger.Error.Printf("%v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.grace)
+	defer cancel()
+	ok := true
+	for _, step := range s.steps {
+		if ctx.Err() != nil {
+			s.logger.Error.Printf("shutdown grace period ended, %s skipped", step.name)
+			ok = false
+			continue
+		}
+		start := time.Now()
+		if err := s.runStep(ctx, step); err != nil {
+			s.logger.Error.Printf("shutdown %s error (%v)", step.name, err)
+			ok = false
+			continue
+		}
+		s.logger.Info.Printf("shutdown %s done in %v", step.name, time.Since(start).Round(time.Millisecond))
+	}
+	s.logger.Info.Printf("final metrics %s", finalMetrics())
+	return ok
+}
+
+// runStep returns when the step is done or ctx is done, a step ignoring ctx doesn't hold the exit
+func (s *Shutdown) runStep(ctx context.Context, step *shutdownStep) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- step.run(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// finalMetrics renders the metrics of the server (expvar without the runtime ones) for the last log line
+func finalMetrics() string {
+	var b strings.Builder
+	b.WriteString("{")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if kv.Key == "memstats" || kv.Key == "cmdline" {
+			return
+		}
+		if !first {
+			b.WriteString(", ")
+		}
+		first = false
+		_, _ = fmt.Fprintf(&b, "%q: %s", kv.Key, kv.Value.String())
+	})
+	b.WriteString("}")
+	return b.String()
+}
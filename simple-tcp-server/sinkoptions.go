@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"time"
+)
+
+// SinkOptions are the command line options of the sinks, shared by the tcp server and teltonika-reprocess so both
+// deliver to the same sinks with the same config
+type SinkOptions struct {
+	Hook            string
+	HookConfig      WebhookConfig
+	HookEncoding    string
+	HookTemplate    string
+	HookCloudEvents bool
+	WialonAddress   string
+	WialonPassword  string
+	DeadLetter      string
+	ConfigPath      string
+}
+
+// SinkSet is what Build makes of the options: the config, the sinks and the components the server also serves
+type SinkSet struct {
+	Config      *Config
+	DeadLetters DeadLetterQueue
+	Pseudonyms  *Pseudonymizer
+	Records     *RecordStore
+	Stats       *StatsService
+	Sinks       []Sink
+}
+
+// Register defines the flags of the options
+func (o *SinkOptions) Register(flags *flag.FlagSet) {
+	flags.StringVar(&o.Hook, "hook", "http://localhost:5000/api/v1/metric", "output hook (disabled if empty)")
+	flags.StringVar(&o.HookConfig.QueueDir, "hook-queue", "", "hook queue directory (in-memory queue if empty)")
+	flags.IntVar(&o.HookConfig.QueueSize, "hook-queue-size", 10000, "max number of queued hook posts")
+	flags.IntVar(&o.HookConfig.MaxAttempts, "hook-attempts", 10, "max hook post attempts")
+	flags.DurationVar(&o.HookConfig.MinBackoff, "hook-min-backoff", time.Second, "initial retry backoff")
+	flags.DurationVar(&o.HookConfig.MaxBackoff, "hook-max-backoff", time.Minute*5, "max retry backoff")
+	flags.StringVar(&o.HookConfig.BearerToken, "hook-token", "", "bearer token sent to the hook (optional)")
+	flags.StringVar(&o.HookConfig.Secret, "hook-secret", "", "hmac-sha256 key for the X-Signature header (optional)")
+	flags.StringVar(&o.HookEncoding, "hook-encoding", "json", "hook payload encoding (json, protobuf, msgpack, cbor)")
+	flags.BoolVar(&o.HookCloudEvents, "hook-cloudevents", false, "wrap hook payloads in CloudEvents 1.0 envelopes")
+	flags.StringVar(&o.HookTemplate, "hook-template", "", "hook payload template file (optional, overrides encoding)")
+	flags.IntVar(&o.HookConfig.BatchSize, "hook-batch-size", 0, "post records in batches of this size (disabled if 0)")
+	flags.DurationVar(&o.HookConfig.BatchWait, "hook-batch-wait", 0, "max time a record waits for its batch (disabled if 0)")
+	flags.BoolVar(&o.HookConfig.Gzip, "hook-gzip", false, "gzip hook posts")
+	flags.BoolVar(&o.HookConfig.Events, "hook-events", false, "post events (geofences, ...) to the hook")
+	flags.StringVar(&o.WialonAddress, "wialon", "", "wialon ips server address for retranslation (disabled if empty)")
+	flags.StringVar(&o.WialonPassword, "wialon-password", "NA", "wialon ips device password")
+	flags.StringVar(&o.DeadLetter, "dead-letter", "dead-letter.jsonl", "dead letter file or s3://bucket/prefix for payloads that exhausted retries (discarded if empty)")
+	flags.StringVar(&o.ConfigPath, "config", "", "json config file with hooks and tenant sinks (optional)")
+}
+
+// Build loads the config and makes the sinks, HookConfig is completed with the hook, the dead letters, the breaker
+// and the pseudonyms of the config (the defaults of the sinks of the config). The log lines of logger get the
+// pseudonyms when they are set
+func (o *SinkOptions) Build(logger *Logger) (*SinkSet, error) {
+	set := &SinkSet{Config: &Config{}}
+	var err error
+	if set.DeadLetters, err = NewDeadLetterQueue(o.DeadLetter); err != nil {
+		return nil, err
+	}
+	o.HookConfig.DeadLetters = set.DeadLetters
+	if o.ConfigPath != "" {
+		if set.Config, err = LoadConfig(o.ConfigPath); err != nil {
+			return nil, err
+		}
+	}
+	config := set.Config
+	if deviceGroups, err = NewDeviceGroups(config.Groups, logger); err != nil {
+		return nil, err
+	}
+	o.HookConfig.Breaker = config.Breaker
+	if config.Pseudonyms != nil {
+		if set.Pseudonyms, err = NewPseudonymizer(config.Pseudonyms); err != nil {
+			return nil, err
+		}
+		set.Pseudonyms.Tenant = config.Tenant
+		o.HookConfig.Pseudonyms = set.Pseudonyms
+		logger.Info.SetOutput(set.Pseudonyms.Writer(logger.Info.Writer()))
+		logger.Error.SetOutput(set.Pseudonyms.Writer(logger.Error.Writer()))
+	}
+
+	if o.Hook != "" {
+		o.HookConfig.Url = o.Hook
+		if o.HookConfig.Encoder, err = packetEncoder(o.HookEncoding); err != nil {
+			return nil, err
+		}
+		if o.HookTemplate != "" {
+			template, err := LoadPayloadTemplate(o.HookTemplate)
+			if err != nil {
+				return nil, err
+			}
+			o.HookConfig.Encoder = template.Encoder()
+		}
+		if o.HookCloudEvents {
+			o.HookConfig.Encoder = CloudEventsEncoder(o.HookConfig.Encoder)
+		}
+		hook, err := NewWebhookSink(o.HookConfig, logger)
+		if err != nil {
+			return nil, err
+		}
+		set.Sinks = append(set.Sinks, hook)
+	}
+	if o.WialonAddress != "" {
+		wialon := NewWialonRetranslator(o.WialonAddress, o.WialonPassword, logger)
+		wialon.DeadLetters = set.DeadLetters
+		wialon.Pseudonyms = set.Pseudonyms
+		wialon.Breaker = NewCircuitBreaker(wialon.Name(), config.Breaker, logger)
+		set.Sinks = append(set.Sinks, wialon)
+	}
+	configSinks, err := config.Sinks(o.HookConfig, set.DeadLetters, logger)
+	if err != nil {
+		return nil, err
+	}
+	set.Sinks = append(set.Sinks, configSinks...)
+	if config.Records != nil {
+		if set.Records, err = NewRecordStore(config.Records); err != nil {
+			return nil, err
+		}
+		set.Sinks = append(set.Sinks, set.Records)
+	}
+	if config.Stats != nil {
+		if set.Stats, err = NewStatsService(config.Stats, logger); err != nil {
+			return nil, err
+		}
+		set.Sinks = append(set.Sinks, set.Stats)
+	}
+	return set, nil
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Sink receives decoded packets. IO element values may point into the connection
+// read buffer (teltonika.OnReadBuffer) and the records into a pooled copy (see
+// AnnotatedPacket.Release), so Send must not retain pkt after returning
+type Sink interface {
+	Send(imei string, pkt *AnnotatedPacket) error
+}
+
+type TenantSink struct {
+	tenant string
+	imeis  map[string]bool
+	sink   Sink
+}
+
+func NewTenantSink(tenant string, imeis []string, sink Sink) *TenantSink {
+	var set map[string]bool
+	if len(imeis) > 0 {
+		set = make(map[string]bool, len(imeis))
+		for _, imei := range imeis {
+			set[imei] = true
+		}
+	}
+	return &TenantSink{tenant: tenant, imeis: set, sink: sink}
+}
+
+func (t *TenantSink) Unwrap() Sink {
+	return t.sink
+}
+
+func (t *TenantSink) Send(imei string, pkt *AnnotatedPacket) error {
+	if t.imeis != nil && !t.imeis[imei] {
+		return nil
+	}
+	if err := t.sink.Send(imei, pkt); err != nil {
+		return fmt.Errorf("tenant '%s': %v", t.tenant, err)
+	}
+	return nil
+}
+
+func (t *TenantSink) SendEvent(event *Event) error {
+	eventSink, ok := t.sink.(EventSink)
+	if !ok || t.imeis != nil && !t.imeis[event.Imei] {
+		return nil
+	}
+	if err := eventSink.SendEvent(event); err != nil {
+		return fmt.Errorf("tenant '%s': %v", t.tenant, err)
+	}
+	return nil
+}
+
+// NewFlespiSink posts the records as flespi messages through a webhook worker, so the posts keep their order,
+// are retried with backoff and dead lettered like the hook posts
+func NewFlespiSink(url string, token string, defaults WebhookConfig, logger *Logger) (*WebhookSink, error) {
+	config := retryConfig(defaults)
+	config.Name = "flespi:" + url
+	config.Url = url
+	config.Headers = map[string]string{"Authorization": "FlespiToken " + token}
+	config.Encoder = flespiEncoder
+	return NewWebhookSink(config, logger)
+}
+
+var flespiEncoder = &PacketEncoder{
+	ContentType: "application/json",
+	Encode: func(imei string, pkt *AnnotatedPacket) ([]byte, error) {
+		messages := make([]map[string]any, 0, len(pkt.Data))
+		for i, record := range pkt.Data {
+			msg := map[string]any{
+				"ident":               imei,
+				"timestamp":           float64(record.TimestampMs) / 1000.0,
+				"position.latitude":   record.Lat,
+				"position.longitude":  record.Lng,
+				"position.altitude":   record.Altitude,
+				"position.direction":  record.Angle,
+				"position.speed":      record.Speed,
+				"position.satellites": record.Satellites,
+				"position.valid":      record.Satellites > 0,
+				"event.enum":          record.EventID,
+				"record.priority":     record.Priority,
+			}
+			for _, el := range record.Elements {
+				msg["io."+strconv.Itoa(int(el.Id))] = ioElementValue(el.Value)
+			}
+			for k, v := range pkt.RecordAttributes(i) {
+				msg[k] = v
+			}
+			messages = append(messages, msg)
+		}
+		body, err := json.Marshal(messages)
+		if err != nil {
+			return nil, fmt.Errorf("flespi message marshaling error (%v)", err)
+		}
+		return body, nil
+	},
+}
+
+// ThingsBoardSink posts the telemetry with the access token of the device, every device gets its own webhook
+// worker (started with its first packet) so a rejected token doesn't hold back the other devices
+type ThingsBoardSink struct {
+	url     string
+	tokens  map[string]string
+	config  WebhookConfig
+	logger  *Logger
+	mutex   sync.Mutex
+	devices map[string]*WebhookSink
+}
+
+func NewThingsBoardSink(url string, tokens map[string]string, defaults WebhookConfig, logger *Logger) *ThingsBoardSink {
+	config := retryConfig(defaults)
+	config.Encoder = thingsBoardEncoder
+	return &ThingsBoardSink{url: url, tokens: tokens, config: config, logger: logger, devices: make(map[string]*WebhookSink)}
+}
+
+func (t *ThingsBoardSink) Send(imei string, pkt *AnnotatedPacket) error {
+	device, err := t.device(imei)
+	if device == nil {
+		return err
+	}
+	return device.Send(imei, pkt)
+}
+
+// device returns the worker of the device, nil if the device has no token
+func (t *ThingsBoardSink) device(imei string) (*WebhookSink, error) {
+	token, ok := t.tokens[imei]
+	if !ok {
+		return nil, nil
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if device, ok := t.devices[imei]; ok {
+		return device, nil
+	}
+	config := t.config
+	config.Name = t.Name() + "/" + imei
+	config.Url = t.url + "/api/v1/" + token + "/telemetry"
+	if config.DeadLetters != nil {
+		config.DeadLetters = &deviceDeadLetters{queue: config.DeadLetters, sink: t.Name(), imei: imei, target: t.url}
+	}
+	device, err := NewWebhookSink(config, t.logger)
+	if err != nil {
+		return nil, fmt.Errorf("thingsboard '%s': %v", imei, err)
+	}
+	t.devices[imei] = device
+	return device, nil
+}
+
+// Drain drains the workers of the devices
+func (t *ThingsBoardSink) Drain(timeout time.Duration) bool {
+	t.mutex.Lock()
+	devices := make([]*WebhookSink, 0, len(t.devices))
+	for _, device := range t.devices {
+		devices = append(devices, device)
+	}
+	t.mutex.Unlock()
+	deadline := time.Now().Add(timeout)
+	for _, device := range devices {
+		if !device.Drain(time.Until(deadline)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *ThingsBoardSink) Name() string {
+	return "thingsboard:" + t.url
+}
+
+func (t *ThingsBoardSink) Redeliver(letter *DeadLetter) error {
+	device, err := t.device(letter.Imei)
+	if err != nil {
+		return err
+	}
+	if device == nil {
+		return fmt.Errorf("no thingsboard token for imei '%s'", letter.Imei)
+	}
+	return device.Redeliver(letter)
+}
+
+var thingsBoardEncoder = &PacketEncoder{
+	ContentType: "application/json",
+	Encode: func(imei string, pkt *AnnotatedPacket) ([]byte, error) {
+		telemetry := make([]map[string]any, 0, len(pkt.Data))
+		for i, record := range pkt.Data {
+			values := map[string]any{
+				"latitude":   record.Lat,
+				"longitude":  record.Lng,
+				"altitude":   record.Altitude,
+				"angle":      record.Angle,
+				"speed":      record.Speed,
+				"satellites": record.Satellites,
+				"priority":   record.Priority,
+				"event_id":   record.EventID,
+			}
+			for _, el := range record.Elements {
+				values["io_"+strconv.Itoa(int(el.Id))] = ioElementValue(el.Value)
+			}
+			for k, v := range pkt.RecordAttributes(i) {
+				values[k] = v
+			}
+			telemetry = append(telemetry, map[string]any{"ts": record.TimestampMs, "values": values})
+		}
+		body, err := json.Marshal(telemetry)
+		if err != nil {
+			return nil, fmt.Errorf("thingsboard telemetry marshaling error (%v)", err)
+		}
+		return body, nil
+	},
+}
+
+// deviceDeadLetters files the letters of a per-device worker under its sink and device (the url of the
+// worker holds the access token), so they are reprocessed through the sink
+type deviceDeadLetters struct {
+	queue  DeadLetterQueue
+	sink   string
+	imei   string
+	target string
+}
+
+func (d *deviceDeadLetters) Put(letter *DeadLetter) error {
+	letter.Sink, letter.Imei, letter.Target = d.sink, d.imei, d.target
+	return d.queue.Put(letter)
+}
+
+// retryConfig keeps the queue and retry settings of the hook defaults, the auth, batching and
+// encoding of the hook flags don't apply to the other http sinks
+func retryConfig(defaults WebhookConfig) WebhookConfig {
+	return WebhookConfig{
+		QueueSize:   defaults.QueueSize,
+		DeadLetters: defaults.DeadLetters,
+		MaxAttempts: defaults.MaxAttempts,
+		MinBackoff:  defaults.MinBackoff,
+		MaxBackoff:  defaults.MaxBackoff,
+		Breaker:     defaults.Breaker,
+		Pseudonyms:  defaults.Pseudonyms,
+	}
+}
+
+// publish sends the packet to every sink and returns the first error, a sink panic (recovered, see PanicError) is
+// returned rather than an error of another sink
+func publish(sinks []Sink, imei string, pkt *AnnotatedPacket, logger *Logger) error {
+	var first error
+	for _, sink := range sinks {
+		err := safeCall("sink", func() error {
+			return sink.Send(imei, pkt)
+		})
+		if err == nil {
+			continue
+		}
+		var panicErr *PanicError
+		if errors.As(err, &panicErr) {
+			logger.Error.Printf("[%s]: %T %v\n%s", imei, sink, err, panicErr.Stack)
+			first = err
+			continue
+		}
+		logger.Error.Printf("[%s]: sink error (%v)", imei, err)
+		if first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func postJSON(client *http.Client, url string, headers map[string]string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	_, _ = io.Copy(io.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return nil
+}
+
+func ioElementValue(value []byte) any {
+	if v, ok := ioElementUint(value); ok {
+		return v
+	}
+	return hex.EncodeToString(value)
+}
+
+func ioElementUint(value []byte) (uint64, bool) {
+	if len(value) > 8 {
+		return 0, false
+	}
+	var buf [8]byte
+	copy(buf[8-len(value):], value)
+	return binary.BigEndian.Uint64(buf[:]), true
+}
+
+// ioElementInt reads the value as a two's complement integer of its size
+func ioElementInt(value []byte) (int64, bool) {
+	v, ok := ioElementUint(value)
+	if !ok || len(value) == 0 {
+		return 0, ok
+	}
+	shift := 64 - 8*uint(len(value))
+	return int64(v<<shift) >> shift, true
+}
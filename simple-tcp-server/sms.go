@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var smsMetrics = expvar.NewMap("sms")
+
+// SmsConfig: one gateway (Http, Twilio or Smpp) sends the commands to the Phones of the devices (imei -> number)
+// as Teltonika sms commands, "<Login> <Password> <command>" (the device sms login and password, empty by default).
+// A command without a response times out after TimeoutMinutes (default 10), InboundSecret authenticates the
+// incoming sms webhook of a gateway without signatures
+type SmsConfig struct {
+	Http           *HttpSmsConfig    `json:"http"`
+	Twilio         *TwilioConfig     `json:"twilio"`
+	Smpp           *SmppConfig       `json:"smpp"`
+	Login          string            `json:"login"`
+	Password       string            `json:"password"`
+	Phones         map[string]string `json:"phones"`
+	TimeoutMinutes int               `json:"timeoutMinutes"`
+	InboundSecret  string            `json:"inboundSecret"`
+}
+
+// HttpSmsConfig: the message is posted to Url as {"to": "+370...", "text": "..."}
+type HttpSmsConfig struct {
+	Url         string `json:"url"`
+	BearerToken string `json:"bearerToken"`
+}
+
+// TwilioConfig: WebhookUrl is the public url of /sms/inbound as set in Twilio, the X-Twilio-Signature of the
+// incoming sms is validated against it
+type TwilioConfig struct {
+	AccountSid string `json:"accountSid"`
+	AuthToken  string `json:"authToken"`
+	From       string `json:"from"`
+	WebhookUrl string `json:"webhookUrl"`
+}
+
+// SmppConfig: Address is the SMSC host:port, the message is submitted from SourceAddr
+type SmppConfig struct {
+	Address    string `json:"address"`
+	SystemId   string `json:"systemId"`
+	Password   string `json:"password"`
+	SourceAddr string `json:"sourceAddr"`
+}
+
+// SmsGateway sends a text message to a phone number
+type SmsGateway interface {
+	SendSms(phone string, text string) error
+}
+
+func (c *SmsConfig) Gateway() (SmsGateway, error) {
+	client := &http.Client{Timeout: time.Second * 30}
+	switch {
+	case c.Http != nil:
+		if c.Http.Url == "" {
+			return nil, fmt.Errorf("sms http gateway requires url")
+		}
+		return &HttpSmsGateway{config: c.Http, client: client}, nil
+	case c.Twilio != nil:
+		if c.Twilio.AccountSid == "" || c.Twilio.From == "" {
+			return nil, fmt.Errorf("sms twilio gateway requires accountSid and from")
+		}
+		return &TwilioSmsGateway{config: c.Twilio, client: client}, nil
+	case c.Smpp != nil:
+		if c.Smpp.Address == "" {
+			return nil, fmt.Errorf("sms smpp gateway requires address")
+		}
+		return &SmppSmsGateway{config: c.Smpp}, nil
+	}
+	return nil, fmt.Errorf("sms requires a gateway (http, twilio or smpp)")
+}
+
+type HttpSmsGateway struct {
+	config *HttpSmsConfig
+	client *http.Client
+}
+
+func (g *HttpSmsGateway) SendSms(phone string, text string) error {
+	body, err := json.Marshal(map[string]string{"to": phone, "text": text})
+	if err != nil {
+		return fmt.Errorf("sms marshaling error (%v)", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, g.config.Url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("sms request error (%v)", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if g.config.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+g.config.BearerToken)
+	}
+	return smsDo(g.client, req)
+}
+
+type TwilioSmsGateway struct {
+	config *TwilioConfig
+	client *http.Client
+}
+
+func (g *TwilioSmsGateway) SendSms(phone string, text string) error {
+	form := url.Values{"To": {phone}, "From": {g.config.From}, "Body": {text}}
+	endpoint := "https://api.twilio.com/2010-04-01/Accounts/" + url.PathEscape(g.config.AccountSid) + "/Messages.json"
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("sms request error (%v)", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(g.config.AccountSid, g.config.AuthToken)
+	return smsDo(g.client, req)
+}
+
+func smsDo(client *http.Client, req *http.Request) error {
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sms gateway error (%v)", err)
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("sms gateway error (status %d)", res.StatusCode)
+	}
+	return nil
+}
+
+// SmppSmsGateway is a minimal SMPP 3.4 transmitter, every message binds a new session
+type SmppSmsGateway struct {
+	config *SmppConfig
+	mutex  sync.Mutex
+	seq    uint32
+}
+
+const (
+	smppBindTransmitter = 0x00000002
+	smppSubmitSm        = 0x00000004
+	smppUnbind          = 0x00000006
+	smppResponse        = 0x80000000
+)
+
+func (g *SmppSmsGateway) SendSms(phone string, text string) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if len(text) > 160 {
+		return fmt.Errorf("sms text longer than 160 characters")
+	}
+	conn, err := net.DialTimeout("tcp", g.config.Address, time.Second*10)
+	if err != nil {
+		return fmt.Errorf("smpp connect error (%v)", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(time.Second * 30))
+
+	bind := smppCString(nil, g.config.SystemId)
+	bind = smppCString(bind, g.config.Password)
+	bind = smppCString(bind, "")    // system_type
+	bind = append(bind, 0x34, 0, 0) // interface_version, addr_ton, addr_npi
+	bind = smppCString(bind, "")    // address_range
+	if err = g.call(conn, smppBindTransmitter, bind); err != nil {
+		return fmt.Errorf("smpp bind error (%v)", err)
+	}
+
+	submit := smppCString(nil, "")                    // service_type
+	submit = append(submit, 0, 0)                     // source_addr_ton, source_addr_npi
+	submit = smppCString(submit, g.config.SourceAddr) // source_addr
+	submit = append(submit, 1, 1)                     // dest_addr_ton international, dest_addr_npi isdn
+	submit = smppCString(submit, normalizePhone(phone))
+	submit = append(submit, 0, 0, 0)                     // esm_class, protocol_id, priority_flag
+	submit = smppCString(submit, "")                     // schedule_delivery_time
+	submit = smppCString(submit, "")                     // validity_period
+	submit = append(submit, 0, 0, 0, 0, byte(len(text))) // registered_delivery, replace_if_present, data_coding, sm_default_msg_id, sm_length
+	submit = append(submit, text...)
+	if err = g.call(conn, smppSubmitSm, submit); err != nil {
+		return fmt.Errorf("smpp submit error (%v)", err)
+	}
+	_ = g.call(conn, smppUnbind, nil)
+	return nil
+}
+
+// call writes the request pdu and reads its response, the command status must be 0 (ESME_ROK)
+func (g *SmppSmsGateway) call(conn net.Conn, commandId uint32, body []byte) error {
+	g.seq++
+	pdu := make([]byte, 16, 16+len(body))
+	binary.BigEndian.PutUint32(pdu[0:], uint32(16+len(body)))
+	binary.BigEndian.PutUint32(pdu[4:], commandId)
+	binary.BigEndian.PutUint32(pdu[12:], g.seq)
+	pdu = append(pdu, body...)
+	if _, err := conn.Write(pdu); err != nil {
+		return err
+	}
+	for {
+		header := make([]byte, 16)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return err
+		}
+		length := binary.BigEndian.Uint32(header[0:])
+		if length < 16 || length > 4096 {
+			return fmt.Errorf("invalid pdu length %d", length)
+		}
+		if _, err := io.CopyN(io.Discard, conn, int64(length-16)); err != nil {
+			return err
+		}
+		// skip other pdus (e.g. enquire_link) until the response
+		if binary.BigEndian.Uint32(header[4:]) != commandId|smppResponse || binary.BigEndian.Uint32(header[12:]) != g.seq {
+			continue
+		}
+		if status := binary.BigEndian.Uint32(header[8:]); status != 0 {
+			return fmt.Errorf("command status 0x%08x", status)
+		}
+		return nil
+	}
+}
+
+func smppCString(buf []byte, s string) []byte {
+	return append(append(buf, s...), 0)
+}
+
+// SmsCommands sends commands to the devices as sms and matches the sms responses (received through the
+// gateway webhook, see ServeInbound) to them
+type SmsCommands struct {
+	gateway SmsGateway
+	config  *SmsConfig
+	tracker *CommandTracker
+	logger  *Logger
+	numbers map[string]string
+	timeout time.Duration
+}
+
+func NewSmsCommands(config *SmsConfig, tracker *CommandTracker, logger *Logger) (*SmsCommands, error) {
+	gateway, err := config.Gateway()
+	if err != nil {
+		return nil, err
+	}
+	numbers := make(map[string]string, len(config.Phones))
+	for imei, phone := range config.Phones {
+		numbers[normalizePhone(phone)] = imei
+	}
+	timeout := time.Minute * 10
+	if config.TimeoutMinutes > 0 {
+		timeout = time.Minute * time.Duration(config.TimeoutMinutes)
+	}
+	if config.InboundSecret == "" && (config.Twilio == nil || config.Twilio.WebhookUrl == "") {
+		logger.Error.Println("sms: no inboundSecret or twilio webhookUrl, the incoming sms webhook is disabled")
+	}
+	return &SmsCommands{gateway: gateway, config: config, tracker: tracker, logger: logger, numbers: numbers,
+		timeout: timeout}, nil
+}
+
+func normalizePhone(phone string) string {
+	return strings.TrimPrefix(strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' || r == '(' || r == ')' {
+			return -1
+		}
+		return r
+	}, phone), "+")
+}
+
+// CanSend tells if the phone number of the device is known
+func (s *SmsCommands) CanSend(imei string) bool {
+	return s.config.Phones[imei] != ""
+}
+
+// Send sends the command text of the operator as a sms and tracks it, the response arrives later through ServeInbound
+func (s *SmsCommands) Send(imei string, text string, operator string) (*CommandStatus, error) {
+	phone := s.config.Phones[imei]
+	if phone == "" {
+		return nil, fmt.Errorf("no phone number of '%s'", imei)
+	}
+	status := s.tracker.Start(imei, "sms", text, "sent", operator)
+	if err := s.gateway.SendSms(phone, s.config.Login+" "+s.config.Password+" "+text); err != nil {
+		s.tracker.Finish(status, "", err)
+		return status, err
+	}
+	s.logger.Info.Printf("command '%s' sent to '%s' by sms", text, imei)
+	time.AfterFunc(s.timeout, func() {
+		s.tracker.Expire(status)
+	})
+	return status, nil
+}
+
+// ServeInbound handles POST /sms/inbound, the incoming sms webhook of the gateway: form fields From and Body
+// (twilio) or {"from": "+370...", "text": "..."}, the sms completes the oldest sms command of the device.
+// The request carries a valid X-Twilio-Signature or the inbound secret (X-Sms-Secret header or secret query param)
+func (s *SmsCommands) ServeInbound(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.inboundAuthorized(r) {
+		smsMetrics.Add("unauthorized", 1)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var from, text string
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var req struct {
+			From string `json:"from"`
+			Text string `json:"text"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid sms ("+err.Error()+")", http.StatusBadRequest)
+			return
+		}
+		from, text = req.From, req.Text
+	} else {
+		from, text = r.FormValue("From"), r.FormValue("Body")
+	}
+	imei, ok := s.numbers[normalizePhone(from)]
+	if !ok {
+		s.logger.Error.Printf("sms from unknown number '%s'", from)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if !s.tracker.Respond(imei, "sms", text) {
+		s.logger.Info.Printf("[%s]: unsolicited sms: %s", imei, text)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// inboundAuthorized checks the inbound secret or the twilio signature, base64 HMAC-SHA1 keyed with the auth
+// token of the webhook url followed by the sorted form fields (name and value)
+func (s *SmsCommands) inboundAuthorized(r *http.Request) bool {
+	if secret := s.config.InboundSecret; secret != "" {
+		given := r.Header.Get("X-Sms-Secret")
+		if given == "" {
+			given = r.URL.Query().Get("secret")
+		}
+		if subtle.ConstantTimeCompare([]byte(given), []byte(secret)) == 1 {
+			return true
+		}
+	}
+	twilio := s.config.Twilio
+	signature := r.Header.Get("X-Twilio-Signature")
+	if twilio == nil || twilio.WebhookUrl == "" || signature == "" {
+		return false
+	}
+	if err := r.ParseForm(); err != nil {
+		return false
+	}
+	names := make([]string, 0, len(r.PostForm))
+	for name := range r.PostForm {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	mac := hmac.New(sha1.New, []byte(twilio.AuthToken))
+	mac.Write([]byte(twilio.WebhookUrl))
+	for _, name := range names {
+		for _, value := range r.PostForm[name] {
+			mac.Write([]byte(name + value))
+		}
+	}
+	expected := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(signature), []byte(expected))
+}
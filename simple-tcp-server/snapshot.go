@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var snapshotMetrics = expvar.NewMap("snapshots")
+
+const snapshotName = "snapshot.json.gz"
+
+// SnapshotConfig: the in-memory state of the gateway (device states of the memory and file backends, tracked
+// commands, dedup fingerprints) is saved every IntervalSeconds (default 300) to Target, a directory or
+// s3://bucket/prefix (credentials from the AWS_* env vars like the dead letters), as a gzipped json
+// (snapshot.json.gz) replaced on every save. The snapshot is restored at start before the devices connect
+type SnapshotConfig struct {
+	Target          string `json:"target"`
+	IntervalSeconds int    `json:"intervalSeconds"`
+}
+
+// Snapshotter is a part of the state saved in the snapshots
+type Snapshotter interface {
+	Snapshot() ([]byte, error)
+	Restore(data []byte) error
+}
+
+// snapshot is the saved document, the parts by name
+type snapshot struct {
+	Time  time.Time                  `json:"time"`
+	Parts map[string]json.RawMessage `json:"parts"`
+}
+
+// SnapshotService saves and restores the registered parts
+type SnapshotService struct {
+	dir      string
+	s3       *S3DeadLetterQueue
+	interval time.Duration
+	logger   *Logger
+	mutex    sync.Mutex
+	names    []string
+	parts    map[string]Snapshotter
+	size     int
+	saved    time.Time
+}
+
+func NewSnapshotService(config *SnapshotConfig, logger *Logger) (*SnapshotService, error) {
+	s := &SnapshotService{interval: time.Minute * 5, logger: logger, parts: make(map[string]Snapshotter)}
+	if config.IntervalSeconds > 0 {
+		s.interval = time.Duration(config.IntervalSeconds) * time.Second
+	}
+	snapshotMetrics.Set("last", expvar.Func(func() any {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		return map[string]any{"bytes": s.size, "time": s.saved}
+	}))
+	switch {
+	case config.Target == "":
+		return nil, fmt.Errorf("snapshots require target")
+	case strings.HasPrefix(config.Target, "s3://"):
+		// the s3 client of the dead letters, the snapshot is an object under its prefix
+		store, err := NewS3DeadLetterQueue(config.Target)
+		if err != nil {
+			return nil, err
+		}
+		s.s3 = store
+	default:
+		if err := os.MkdirAll(config.Target, 0o755); err != nil {
+			return nil, fmt.Errorf("snapshot dir error (%v)", err)
+		}
+		s.dir = config.Target
+	}
+	return s, nil
+}
+
+// Register adds a part of the state, before Restore
+func (s *SnapshotService) Register(name string, part Snapshotter) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.names = append(s.names, name)
+	s.parts[name] = part
+}
+
+// Start saves a snapshot every interval
+func (s *SnapshotService) Start() {
+	go func() {
+		for range time.Tick(s.interval) {
+			if err := s.Save(); err != nil {
+				s.logger.Error.Printf("%v", err)
+			}
+		}
+	}()
+}
+
+// Save writes a snapshot of all parts
+func (s *SnapshotService) Save() error {
+	start := time.Now()
+	s.mutex.Lock()
+	parts := make(map[string]Snapshotter, len(s.parts))
+	for name, part := range s.parts {
+		parts[name] = part
+	}
+	s.mutex.Unlock()
+	doc := &snapshot{Time: start.UTC(), Parts: make(map[string]json.RawMessage, len(parts))}
+	for name, part := range parts {
+		data, err := part.Snapshot()
+		if err != nil {
+			snapshotMetrics.Add("errors", 1)
+			return fmt.Errorf("snapshot of %s error (%v)", name, err)
+		}
+		doc.Parts[name] = data
+	}
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	err := json.NewEncoder(writer).Encode(doc)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err == nil {
+		err = s.write(buf.Bytes())
+	}
+	if err != nil {
+		snapshotMetrics.Add("errors", 1)
+		return fmt.Errorf("snapshot write error (%v)", err)
+	}
+	snapshotMetrics.Add("saved", 1)
+	snapshotMetrics.Add("durationMs", time.Since(start).Milliseconds())
+	s.mutex.Lock()
+	s.size, s.saved = buf.Len(), doc.Time
+	s.mutex.Unlock()
+	return nil
+}
+
+// Restore loads the last snapshot into the parts, the parts missing in the snapshot are left as they are
+func (s *SnapshotService) Restore() error {
+	data, err := s.read()
+	if err != nil {
+		return fmt.Errorf("snapshot read error (%v)", err)
+	}
+	if data == nil {
+		return nil
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("snapshot read error (%v)", err)
+	}
+	doc := &snapshot{}
+	if err = json.NewDecoder(reader).Decode(doc); err != nil {
+		return fmt.Errorf("snapshot parse error (%v)", err)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	restored := 0
+	for _, name := range s.names {
+		part, ok := doc.Parts[name]
+		if !ok {
+			continue
+		}
+		if err = s.parts[name].Restore(part); err != nil {
+			return fmt.Errorf("snapshot of %s: %v", name, err)
+		}
+		restored++
+	}
+	s.logger.Info.Printf("snapshot of %s restored (%d parts)", doc.Time.Format(time.RFC3339), restored)
+	return nil
+}
+
+func (s *SnapshotService) write(data []byte) error {
+	if s.s3 != nil {
+		_, err := s.s3.do("PUT", s.s3Key(), nil, data)
+		return err
+	}
+	path := filepath.Join(s.dir, snapshotName)
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// read returns the saved snapshot, nil if there's none
+func (s *SnapshotService) read() ([]byte, error) {
+	if s.s3 != nil {
+		data, err := s.s3.do("GET", s.s3Key(), nil, nil)
+		if err != nil && strings.Contains(err.Error(), "404") {
+			return nil, nil
+		}
+		return data, err
+	}
+	file, err := os.Open(filepath.Join(s.dir, snapshotName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	return io.ReadAll(file)
+}
+
+func (s *SnapshotService) s3Key() string {
+	if s.s3.prefix == "" {
+		return snapshotName
+	}
+	return s.s3.prefix + "/" + snapshotName
+}
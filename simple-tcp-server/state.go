@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// StateConfig: Backend is "memory" (default), "file" (memory saved to File every SaveSeconds, default 60,
+// and loaded at start) or "redis". There's no Bolt backend, the server has no dependencies besides the codec
+// and the file backend covers a single instance
+type StateConfig struct {
+	Backend     string       `json:"backend"`
+	File        string       `json:"file"`
+	SaveSeconds int          `json:"saveSeconds"`
+	Redis       *RedisConfig `json:"redis"`
+}
+
+// DeviceState is the latest merged view of a device: the newest position, the last value
+// of every IO element (keyed by the element id) and the codec of the last data packet
+type DeviceState struct {
+	Imei        string            `json:"imei"`
+	Updated     time.Time         `json:"updated"`
+	TimestampMs uint64            `json:"timestampMs"`
+	Lat         float64           `json:"lat"`
+	Lng         float64           `json:"lng"`
+	Altitude    int16             `json:"altitude"`
+	Angle       uint16            `json:"angle"`
+	Speed       uint16            `json:"speed"`
+	Satellites  uint8             `json:"satellites"`
+	EventID     uint16            `json:"eventId"`
+	Codec       string            `json:"codec,omitempty"`
+	IO          map[string]any    `json:"io"`
+	IOTimes     map[string]uint64 `json:"ioTimestampsMs"`
+}
+
+// Merge applies a record to the state and returns the fields that changed (position fields by name,
+// IO elements as io_<id>). A record older than the state only fills in the IO elements it has newer values of
+func (s *DeviceState) Merge(record *teltonika.Data) map[string]any {
+	changed := make(map[string]any)
+	if s.IO == nil {
+		s.IO = make(map[string]any)
+	}
+	if s.IOTimes == nil {
+		s.IOTimes = make(map[string]uint64)
+	}
+	if record.TimestampMs >= s.TimestampMs {
+		set := func(name string, changedValue bool, value any) {
+			if changedValue || s.TimestampMs == 0 {
+				changed[name] = value
+			}
+		}
+		set("lat", s.Lat != record.Lat, record.Lat)
+		set("lng", s.Lng != record.Lng, record.Lng)
+		set("altitude", s.Altitude != record.Altitude, record.Altitude)
+		set("angle", s.Angle != record.Angle, record.Angle)
+		set("speed", s.Speed != record.Speed, record.Speed)
+		set("satellites", s.Satellites != record.Satellites, record.Satellites)
+		s.TimestampMs, s.Lat, s.Lng, s.Altitude = record.TimestampMs, record.Lat, record.Lng, record.Altitude
+		s.Angle, s.Speed, s.Satellites, s.EventID = record.Angle, record.Speed, record.Satellites, record.EventID
+	}
+	for _, el := range record.Elements {
+		id := strconv.Itoa(int(el.Id))
+		if record.TimestampMs < s.IOTimes[id] {
+			continue
+		}
+		value := ioElementValue(el.Value)
+		previous, ok := s.IO[id]
+		// values loaded from json are float64
+		if !ok || fmt.Sprint(previous) != fmt.Sprint(value) {
+			changed["io_"+id] = value
+		}
+		s.IO[id] = value
+		s.IOTimes[id] = record.TimestampMs
+	}
+	s.Updated = time.Now().UTC()
+	return changed
+}
+
+// StateStore keeps the device states, Get returns nil for an unknown device
+type StateStore interface {
+	Get(imei string) (*DeviceState, error)
+	Put(state *DeviceState) error
+}
+
+func NewStateStore(config *StateConfig, logger *Logger) (StateStore, error) {
+	if config == nil {
+		config = &StateConfig{}
+	}
+	switch config.Backend {
+	case "", "memory":
+		return NewMemoryStateStore(), nil
+	case "file":
+		if config.File == "" {
+			return nil, fmt.Errorf("state file backend requires file")
+		}
+		store := NewMemoryStateStore()
+		if err := store.Load(config.File); err != nil {
+			return nil, err
+		}
+		interval := time.Duration(config.SaveSeconds) * time.Second
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		go func() {
+			for range time.Tick(interval) {
+				if err := store.Save(config.File); err != nil {
+					logger.Error.Printf("%v", err)
+				}
+			}
+		}()
+		return store, nil
+	case "redis":
+		if config.Redis == nil {
+			return nil, fmt.Errorf("state redis backend requires redis")
+		}
+		return NewRedisStateStore(config.Redis), nil
+	}
+	return nil, fmt.Errorf("unknown state backend '%s'", config.Backend)
+}
+
+type MemoryStateStore struct {
+	mutex  sync.RWMutex
+	states map[string]*DeviceState
+}
+
+func NewMemoryStateStore() *MemoryStateStore {
+	return &MemoryStateStore{states: make(map[string]*DeviceState)}
+}
+
+func (m *MemoryStateStore) Get(imei string) (*DeviceState, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	state, ok := m.states[imei]
+	if !ok {
+		return nil, nil
+	}
+	return copyState(state), nil
+}
+
+func (m *MemoryStateStore) Put(state *DeviceState) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.states[state.Imei] = copyState(state)
+	return nil
+}
+
+// Purge removes the state of the device (a Purger), the file backend drops it at the next save
+func (m *MemoryStateStore) Purge(imei string) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.states[imei]; !ok {
+		return 0, nil
+	}
+	delete(m.states, imei)
+	return 1, nil
+}
+
+// Snapshot returns all states (a Snapshotter)
+func (m *MemoryStateStore) Snapshot() ([]byte, error) {
+	m.mutex.RLock()
+	data, err := json.Marshal(m.states)
+	m.mutex.RUnlock()
+	if err != nil {
+		return nil, fmt.Errorf("state marshaling error (%v)", err)
+	}
+	return data, nil
+}
+
+// Restore replaces the states with the ones of a snapshot
+func (m *MemoryStateStore) Restore(data []byte) error {
+	states := make(map[string]*DeviceState)
+	if err := json.Unmarshal(data, &states); err != nil {
+		return fmt.Errorf("state parse error (%v)", err)
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.states = states
+	return nil
+}
+
+// Save writes all states to the file
+func (m *MemoryStateStore) Save(path string) error {
+	data, err := m.Snapshot()
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return fmt.Errorf("state write error (%v)", err)
+	}
+	if err = os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("state write error (%v)", err)
+	}
+	return nil
+}
+
+func (m *MemoryStateStore) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("state read error (%v)", err)
+	}
+	return m.Restore(data)
+}
+
+func copyState(state *DeviceState) *DeviceState {
+	c := *state
+	c.IO = make(map[string]any, len(state.IO))
+	for k, v := range state.IO {
+		c.IO[k] = v
+	}
+	c.IOTimes = make(map[string]uint64, len(state.IOTimes))
+	for k, v := range state.IOTimes {
+		c.IOTimes[k] = v
+	}
+	return &c
+}
+
+// StateService maintains the device states from the records (Stage), the packet carries the fields every
+// record changed (AnnotatedPacket.Changes) to the change-only sinks
+type StateService struct {
+	store  StateStore
+	locks  sync.Map
+	logger *Logger
+}
+
+func NewStateService(store StateStore, logger *Logger) *StateService {
+	return &StateService{store: store, logger: logger}
+}
+
+// Update merges the records into the device state and returns the changes per record
+func (s *StateService) Update(imei string, pkt *teltonika.Packet) ([]map[string]any, error) {
+	if len(pkt.Data) == 0 {
+		return nil, nil
+	}
+	lock, _ := s.locks.LoadOrStore(imei, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	state, err := s.store.Get(imei)
+	if err != nil {
+		return nil, fmt.Errorf("state get error (%v)", err)
+	}
+	if state == nil {
+		state = &DeviceState{Imei: imei}
+	}
+	changes := make([]map[string]any, len(pkt.Data))
+	for i := range pkt.Data {
+		changes[i] = state.Merge(&pkt.Data[i])
+	}
+	state.Codec = codecName(pkt.CodecID)
+	if err = s.store.Put(state); err != nil {
+		return nil, fmt.Errorf("state put error (%v)", err)
+	}
+	return changes, nil
+}
+
+func (s *StateService) Apply(imei string, pkt *AnnotatedPacket) *AnnotatedPacket {
+	changes, err := s.Update(imei, pkt.Packet)
+	if err != nil {
+		s.logger.Error.Printf("[%s]: %v", imei, err)
+		return pkt
+	}
+	pkt.Changes = changes
+	return pkt
+}
+
+// State returns the device state, nil for an unknown device
+func (s *StateService) State(imei string) (*DeviceState, error) {
+	return s.store.Get(imei)
+}
+
+// ServeHTTP serves GET /devices/{imei}/state
+func (s *StateService) ServeHTTP(w http.ResponseWriter, r *http.Request, imei string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	state, err := s.store.Get(imei)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if state == nil {
+		http.NotFound(w, r)
+		return
+	}
+	writeJson(w, http.StatusOK, state)
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	statsHourLayout = "2006-01-02T15"
+	statsDayLayout  = "2006-01-02"
+)
+
+// StatsConfig: the records of every device are rolled up by hour (the last Hours, default 48) and by day (the last
+// Days, default 92): distance, drive time (ignition or movement on and moving), idle time (on and standing),
+// max speed, records and started alerts. The time between two records over MaxGapSeconds (default 300) apart
+// isn't counted. With File the rollups are saved every SaveSeconds (default 60) and loaded at start, like the
+// file state backend
+type StatsConfig struct {
+	File          string `json:"file"`
+	SaveSeconds   int    `json:"saveSeconds"`
+	Hours         int    `json:"hours"`
+	Days          int    `json:"days"`
+	MaxGapSeconds int    `json:"maxGapSeconds"`
+}
+
+// Rollup is the activity of a device (or of the fleet) over an hour or a day, Alerts are counted by alert name
+type Rollup struct {
+	Start          time.Time      `json:"start"`
+	Devices        int            `json:"devices,omitempty"`
+	DistanceMeters float64        `json:"distanceMeters"`
+	DriveSeconds   float64        `json:"driveSeconds"`
+	IdleSeconds    float64        `json:"idleSeconds"`
+	MaxSpeed       uint16         `json:"maxSpeed"`
+	Records        int            `json:"records"`
+	Alerts         map[string]int `json:"alerts,omitempty"`
+}
+
+// StatsService is the Sink (and EventSink, for the alerts) keeping the rollups of the devices
+type StatsService struct {
+	hours   int
+	days    int
+	maxGap  uint64
+	mutex   sync.Mutex
+	devices map[string]*deviceStats
+}
+
+// deviceStats is saved to the file, Last is the previous record of the device
+type deviceStats struct {
+	Hours map[string]*Rollup `json:"hours"`
+	Days  map[string]*Rollup `json:"days"`
+	Last  *statsPoint        `json:"last,omitempty"`
+}
+
+type statsPoint struct {
+	TimestampMs uint64  `json:"timestampMs"`
+	Lat         float64 `json:"lat"`
+	Lng         float64 `json:"lng"`
+	Fix         bool    `json:"fix"`
+	Speed       uint16  `json:"speed"`
+	Active      bool    `json:"active"`
+	Known       bool    `json:"known"`
+}
+
+func NewStatsService(config *StatsConfig, logger *Logger) (*StatsService, error) {
+	s := &StatsService{hours: 48, days: 92, maxGap: 300 * 1000, devices: make(map[string]*deviceStats)}
+	if config.Hours > 0 {
+		s.hours = config.Hours
+	}
+	if config.Days > 0 {
+		s.days = config.Days
+	}
+	if config.MaxGapSeconds > 0 {
+		s.maxGap = uint64(config.MaxGapSeconds) * 1000
+	}
+	if config.File == "" {
+		return s, nil
+	}
+	if err := s.Load(config.File); err != nil {
+		return nil, err
+	}
+	interval := time.Duration(config.SaveSeconds) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if err := s.Save(config.File); err != nil {
+				logger.Error.Printf("%v", err)
+			}
+		}
+	}()
+	return s, nil
+}
+
+func (s *StatsService) device(imei string) *deviceStats {
+	device, ok := s.devices[imei]
+	if !ok {
+		device = &deviceStats{Hours: make(map[string]*Rollup), Days: make(map[string]*Rollup)}
+		s.devices[imei] = device
+	}
+	return device
+}
+
+// rollups returns the hour and the day rollups of the time
+func (d *deviceStats) rollups(t time.Time) []*Rollup {
+	t = t.UTC()
+	rollups := make([]*Rollup, 0, 2)
+	for _, bucket := range []struct {
+		rollups map[string]*Rollup
+		layout  string
+		start   time.Time
+	}{
+		{d.Hours, statsHourLayout, t.Truncate(time.Hour)},
+		{d.Days, statsDayLayout, t.Truncate(time.Hour * 24)},
+	} {
+		key := t.Format(bucket.layout)
+		rollup, ok := bucket.rollups[key]
+		if !ok {
+			rollup = &Rollup{Start: bucket.start}
+			bucket.rollups[key] = rollup
+		}
+		rollups = append(rollups, rollup)
+	}
+	return rollups
+}
+
+// Send rolls up the records of the packet, the records older than the previous record of the device (history
+// uploaded after newer records) only count as records and for the max speed
+func (s *StatsService) Send(imei string, pkt *AnnotatedPacket) error {
+	if len(pkt.Data) == 0 {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	device := s.device(imei)
+	for i := range pkt.Data {
+		record := &pkt.Data[i]
+		rollups := device.rollups(time.UnixMilli(int64(record.TimestampMs)))
+		for _, rollup := range rollups {
+			rollup.Records++
+			if record.Speed > rollup.MaxSpeed {
+				rollup.MaxSpeed = record.Speed
+			}
+		}
+		last := device.Last
+		if last != nil && record.TimestampMs <= last.TimestampMs {
+			continue
+		}
+		point := &statsPoint{TimestampMs: record.TimestampMs, Lat: record.Lat, Lng: record.Lng, Fix: hasFix(record),
+			Speed: record.Speed}
+		point.Active, point.Known = tripActive(record)
+		device.Last = point
+		if last == nil || record.TimestampMs-last.TimestampMs > s.maxGap {
+			continue
+		}
+		seconds := float64(record.TimestampMs-last.TimestampMs) / 1000
+		meters := 0.0
+		if last.Fix && point.Fix {
+			meters = haversine(last.Lat, last.Lng, point.Lat, point.Lng)
+			if meters/seconds*3.6 > 250 {
+				// a jump, not a distance
+				meters = 0
+			}
+		}
+		moving := last.Speed > 0 || point.Speed > 0
+		active := last.Active || !last.Known && moving
+		for _, rollup := range rollups {
+			rollup.DistanceMeters += meters
+			if active && moving {
+				rollup.DriveSeconds += seconds
+			} else if active {
+				rollup.IdleSeconds += seconds
+			}
+		}
+	}
+	s.prune(device)
+	return nil
+}
+
+// SendEvent counts the started alerts of the device
+func (s *StatsService) SendEvent(event *Event) error {
+	if !strings.HasPrefix(event.Type, "alert.") || !strings.HasSuffix(event.Type, ".start") {
+		return nil
+	}
+	name := strings.TrimSuffix(strings.TrimPrefix(event.Type, "alert."), ".start")
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, rollup := range s.device(event.Imei).rollups(event.Time) {
+		if rollup.Alerts == nil {
+			rollup.Alerts = make(map[string]int)
+		}
+		rollup.Alerts[name]++
+	}
+	return nil
+}
+
+func (s *StatsService) prune(device *deviceStats) {
+	pruneRollups(device.Hours, s.hours)
+	pruneRollups(device.Days, s.days)
+}
+
+// pruneRollups keeps the newest rollups
+func pruneRollups(rollups map[string]*Rollup, keep int) {
+	if len(rollups) <= keep {
+		return
+	}
+	keys := make([]string, 0, len(rollups))
+	for key := range rollups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys[:len(keys)-keep] {
+		delete(rollups, key)
+	}
+}
+
+// Stats returns copies of the rollups of the device by hour or day starting from (included) to (excluded),
+// oldest first
+func (s *StatsService) Stats(imei string, period string, from time.Time, to time.Time) []*Rollup {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	result := make([]*Rollup, 0)
+	device, ok := s.devices[imei]
+	if !ok {
+		return result
+	}
+	rollups := device.Days
+	if period == "hour" {
+		rollups = device.Hours
+	}
+	for _, rollup := range rollups {
+		if !rollup.Start.Before(from) && rollup.Start.Before(to) {
+			result = append(result, copyRollup(rollup))
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Start.Before(result[j].Start) })
+	return result
+}
+
+// FleetStats sums the rollups of all devices by hour or day, Devices is the number of devices with records
+func (s *StatsService) FleetStats(period string, from time.Time, to time.Time) []*Rollup {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	fleet := make(map[time.Time]*Rollup)
+	for _, device := range s.devices {
+		rollups := device.Days
+		if period == "hour" {
+			rollups = device.Hours
+		}
+		for _, rollup := range rollups {
+			if rollup.Start.Before(from) || !rollup.Start.Before(to) {
+				continue
+			}
+			sum, ok := fleet[rollup.Start]
+			if !ok {
+				sum = &Rollup{Start: rollup.Start}
+				fleet[rollup.Start] = sum
+			}
+			if rollup.Records > 0 {
+				sum.Devices++
+			}
+			sum.DistanceMeters += rollup.DistanceMeters
+			sum.DriveSeconds += rollup.DriveSeconds
+			sum.IdleSeconds += rollup.IdleSeconds
+			sum.Records += rollup.Records
+			if rollup.MaxSpeed > sum.MaxSpeed {
+				sum.MaxSpeed = rollup.MaxSpeed
+			}
+			for name, count := range rollup.Alerts {
+				if sum.Alerts == nil {
+					sum.Alerts = make(map[string]int)
+				}
+				sum.Alerts[name] += count
+			}
+		}
+	}
+	result := make([]*Rollup, 0, len(fleet))
+	for _, rollup := range fleet {
+		result = append(result, rollup)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Start.Before(result[j].Start) })
+	return result
+}
+
+func copyRollup(rollup *Rollup) *Rollup {
+	c := *rollup
+	if rollup.Alerts != nil {
+		c.Alerts = make(map[string]int, len(rollup.Alerts))
+		for name, count := range rollup.Alerts {
+			c.Alerts[name] = count
+		}
+	}
+	return &c
+}
+
+// statsQuery reads period (hour or day, default day), from and to (RFC 3339, the last 7 days by default)
+func statsQuery(w http.ResponseWriter, r *http.Request) (string, time.Time, time.Time, bool) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return "", time.Time{}, time.Time{}, false
+	}
+	params := r.URL.Query()
+	period := params.Get("period")
+	if period == "" {
+		period = "day"
+	}
+	if period != "hour" && period != "day" {
+		http.Error(w, "invalid period", http.StatusBadRequest)
+		return "", time.Time{}, time.Time{}, false
+	}
+	to, from := time.Now(), time.Time{}
+	for name, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		if value := params.Get(name); value != "" {
+			var err error
+			if *t, err = time.Parse(time.RFC3339, value); err != nil {
+				http.Error(w, "invalid "+name+" ("+err.Error()+")", http.StatusBadRequest)
+				return "", time.Time{}, time.Time{}, false
+			}
+		}
+	}
+	if from.IsZero() {
+		from = to.Add(-time.Hour * 24 * 7)
+	}
+	return period, from, to, true
+}
+
+// ServeHTTP handles GET /devices/{imei}/stats?period=hour|day&from=...&to=...
+func (s *StatsService) ServeHTTP(w http.ResponseWriter, r *http.Request, imei string) {
+	period, from, to, ok := statsQuery(w, r)
+	if !ok {
+		return
+	}
+	writeJson(w, http.StatusOK, map[string]any{"imei": imei, "period": period,
+		"rollups": s.Stats(imei, period, from, to)})
+}
+
+// ServeFleet handles GET /stats?period=hour|day&from=...&to=...
+func (s *StatsService) ServeFleet(w http.ResponseWriter, r *http.Request) {
+	period, from, to, ok := statsQuery(w, r)
+	if !ok {
+		return
+	}
+	writeJson(w, http.StatusOK, map[string]any{"period": period, "rollups": s.FleetStats(period, from, to)})
+}
+
+// Purge forgets the rollups of the device (a Purger), the file drops them at the next save
+func (s *StatsService) Purge(imei string) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	device, ok := s.devices[imei]
+	if !ok {
+		return 0, nil
+	}
+	delete(s.devices, imei)
+	return len(device.Hours) + len(device.Days), nil
+}
+
+// Save writes the rollups of all devices to the file
+func (s *StatsService) Save(path string) error {
+	s.mutex.Lock()
+	data, err := json.Marshal(s.devices)
+	s.mutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("stats marshaling error (%v)", err)
+	}
+	if err = os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return fmt.Errorf("stats write error (%v)", err)
+	}
+	if err = os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("stats write error (%v)", err)
+	}
+	return nil
+}
+
+func (s *StatsService) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("stats read error (%v)", err)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err = json.Unmarshal(data, &s.devices); err != nil {
+		return fmt.Errorf("stats parse error (%v)", err)
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var streamMetrics = expvar.NewMap("stream")
+
+// LiveEvent is an event of the live stream: a device connecting or disconnecting (with the reason), a record (the
+// latest of a packet, with the number of records of the packet) or a device error. stream.schema.json is the
+// definition the clients (teltonika-top, the dashboard) follow, keep it in step with the fields
+type LiveEvent struct {
+	Type       string    `json:"type"`
+	Imei       string    `json:"imei"`
+	Time       time.Time `json:"time"`
+	Records    int       `json:"records,omitempty"`
+	Timestamp  int64     `json:"timestamp,omitempty"`
+	Lat        float64   `json:"lat,omitempty"`
+	Lng        float64   `json:"lng,omitempty"`
+	Speed      uint16    `json:"speed,omitempty"`
+	Angle      uint16    `json:"angle,omitempty"`
+	Satellites uint8     `json:"satellites,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+}
+
+// LiveStream serves the live events over a WebSocket or as server-sent events (GET /stream), a subscriber first
+// gets a connect event and the last record of every connected device. A subscriber too slow to take the events loses them
+type LiveStream struct {
+	mutex       sync.Mutex
+	subscribers map[chan *LiveEvent]bool
+	connected   map[string]*LiveEvent
+	last        map[string]*LiveEvent
+}
+
+func NewLiveStream() *LiveStream {
+	return &LiveStream{
+		subscribers: make(map[chan *LiveEvent]bool),
+		connected:   make(map[string]*LiveEvent),
+		last:        make(map[string]*LiveEvent),
+	}
+}
+
+func (s *LiveStream) publish(event *LiveEvent) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch event.Type {
+	case "connect":
+		s.connected[event.Imei] = event
+	case "disconnect":
+		delete(s.connected, event.Imei)
+		delete(s.last, event.Imei)
+	case "record":
+		s.last[event.Imei] = event
+	}
+	for ch := range s.subscribers {
+		select {
+		case ch <- event:
+		default:
+			streamMetrics.Add("dropped", 1)
+		}
+	}
+}
+
+// Connected is called when a device logs in (TCPServer.OnConnect)
+func (s *LiveStream) Connected(imei string) {
+	s.publish(&LiveEvent{Type: "connect", Imei: imei, Time: time.Now()})
+}
+
+// Disconnected is called when a device disconnects (TCPServer.OnClose)
+func (s *LiveStream) Disconnected(imei string, reason string) {
+	s.publish(&LiveEvent{Type: "disconnect", Imei: imei, Time: time.Now(), Reason: reason})
+}
+
+// Error is called for the errors of a device (TCPServer.OnError)
+func (s *LiveStream) Error(imei string, err error) {
+	s.publish(&LiveEvent{Type: "error", Imei: imei, Time: time.Now(), Error: err.Error()})
+}
+
+// Packet publishes the latest record of a data packet
+func (s *LiveStream) Packet(imei string, pkt *teltonika.Packet) {
+	if len(pkt.Data) == 0 {
+		return
+	}
+	latest := &pkt.Data[0]
+	for i := range pkt.Data {
+		if pkt.Data[i].TimestampMs > latest.TimestampMs {
+			latest = &pkt.Data[i]
+		}
+	}
+	s.publish(&LiveEvent{
+		Type:       "record",
+		Imei:       imei,
+		Time:       time.Now(),
+		Records:    len(pkt.Data),
+		Timestamp:  int64(latest.TimestampMs),
+		Lat:        latest.Lat,
+		Lng:        latest.Lng,
+		Speed:      latest.Speed,
+		Angle:      latest.Angle,
+		Satellites: latest.Satellites,
+	})
+}
+
+func (s *LiveStream) subscribe() (chan *LiveEvent, []*LiveEvent) {
+	ch := make(chan *LiveEvent, 256)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.subscribers[ch] = true
+	streamMetrics.Add("subscribers", 1)
+	snapshot := make([]*LiveEvent, 0, len(s.connected)*2)
+	for imei, event := range s.connected {
+		snapshot = append(snapshot, event)
+		if last, ok := s.last[imei]; ok {
+			snapshot = append(snapshot, last)
+		}
+	}
+	sort.SliceStable(snapshot, func(i, j int) bool { return snapshot[i].Imei < snapshot[j].Imei })
+	return ch, snapshot
+}
+
+func (s *LiveStream) unsubscribe(ch chan *LiveEvent) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.subscribers, ch)
+	streamMetrics.Add("subscribers", -1)
+}
+
+// ServeHTTP streams the events as WebSocket text frames (a json event per frame) when the request asks for an
+// upgrade, as server-sent events otherwise (curl)
+func (s *LiveStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if isWebSocket(r) {
+		s.serveWebSocket(w, r)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ch, snapshot := s.subscribe()
+	defer s.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	write := func(event *LiveEvent) bool {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return true
+		}
+		_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		return err == nil
+	}
+	for _, event := range snapshot {
+		if !write(event) {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(time.Second * 30)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event := <-ch:
+			if !write(event) {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// serveWebSocket streams the events over an upgraded connection, pinging the client every 30 seconds
+func (s *LiveStream) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = ws.Close()
+	}()
+	ch, snapshot := s.subscribe()
+	defer s.unsubscribe(ch)
+	done := make(chan struct{})
+	go ws.Serve(done)
+
+	write := func(event *LiveEvent) bool {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return true
+		}
+		return ws.WriteFrame(wsText, data) == nil
+	}
+	for _, event := range snapshot {
+		if !write(event) {
+			return
+		}
+	}
+	keepAlive := time.NewTicker(time.Second * 30)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event := <-ch:
+			if !write(event) {
+				return
+			}
+		case <-keepAlive.C:
+			if ws.WriteFrame(wsPing, nil) != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// Purge forgets the last packet of the device (a Purger), a connected device stays in the connected list
+func (s *LiveStream) Purge(imei string) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.last[imei]; !ok {
+		return 0, nil
+	}
+	delete(s.last, imei)
+	return 1, nil
+}
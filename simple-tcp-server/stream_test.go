@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLiveEventSchema keeps LiveEvent in step with stream.schema.json, the definition of the clients
+func TestLiveEventSchema(t *testing.T) {
+	data, err := os.ReadFile("stream.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema struct {
+		Required   []string                   `json:"required"`
+		Properties map[string]json.RawMessage `json:"properties"`
+	}
+	if err = json.Unmarshal(data, &schema); err != nil {
+		t.Fatal(err)
+	}
+	var properties, required []string
+	for name := range schema.Properties {
+		properties = append(properties, name)
+	}
+	var fields, mandatory []string
+	typ := reflect.TypeOf(LiveEvent{})
+	for i := 0; i < typ.NumField(); i++ {
+		name, options, _ := strings.Cut(typ.Field(i).Tag.Get("json"), ",")
+		fields = append(fields, name)
+		if options != "omitempty" {
+			mandatory = append(mandatory, name)
+		}
+	}
+	required = append(required, schema.Required...)
+	for _, list := range [][]string{properties, required, fields, mandatory} {
+		sort.Strings(list)
+	}
+	if !reflect.DeepEqual(fields, properties) {
+		t.Errorf("LiveEvent fields %v, schema properties %v", fields, properties)
+	}
+	if !reflect.DeepEqual(mandatory, required) {
+		t.Errorf("LiveEvent fields without omitempty %v, schema required %v", mandatory, required)
+	}
+}
+
+func TestWebSocketAccept(t *testing.T) {
+	// example of RFC 6455 section 1.3
+	if got := webSocketAccept("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("webSocketAccept() = %s", got)
+	}
+}
+
+func TestWebSocketFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		opcode  byte
+		payload []byte
+		mask    []byte
+		want    string
+	}{
+		// examples of RFC 6455 section 5.7
+		{"unmasked text", wsText, []byte("Hello"), nil, "81 05 48 65 6c 6c 6f"},
+		{"masked text", wsText, []byte("Hello"), []byte{0x37, 0xfa, 0x21, 0x3d}, "81 85 37 fa 21 3d 7f 9f 4d 51 58"},
+		{"unmasked ping", wsPing, []byte("Hello"), nil, "89 05 48 65 6c 6c 6f"},
+		{"empty close", wsClose, nil, nil, "88 00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame := appendWebSocketFrame(nil, tt.opcode, tt.payload, tt.mask)
+			if want := unhex(t, tt.want); !bytes.Equal(frame, want) {
+				t.Errorf("appendWebSocketFrame() = % x, want % x", frame, want)
+			}
+			opcode, payload, err := readWebSocketFrame(bytes.NewReader(frame))
+			if err != nil || opcode != tt.opcode || !bytes.Equal(payload, tt.payload) {
+				t.Errorf("readWebSocketFrame() = %x %q %v", opcode, payload, err)
+			}
+		})
+	}
+}
+
+func TestWebSocketFrameLength(t *testing.T) {
+	tests := []struct {
+		length int
+		header int
+		err    bool
+	}{
+		{125, 2, false},
+		{126, 4, false},
+		{0xffff, 4, false},
+		{wsMaxFrame, 10, false},
+		{wsMaxFrame + 1, 10, true},
+	}
+	for _, tt := range tests {
+		payload := bytes.Repeat([]byte{'a'}, tt.length)
+		frame := appendWebSocketFrame(nil, wsText, payload, nil)
+		if len(frame) != tt.header+tt.length {
+			t.Errorf("%d bytes: frame of %d bytes, want %d", tt.length, len(frame), tt.header+tt.length)
+		}
+		_, got, err := readWebSocketFrame(bytes.NewReader(frame))
+		if (err != nil) != tt.err || (err == nil && !bytes.Equal(got, payload)) {
+			t.Errorf("%d bytes: readWebSocketFrame() = %d bytes, %v", tt.length, len(got), err)
+		}
+	}
+}
+
+func TestLiveStreamWebSocket(t *testing.T) {
+	stream := NewLiveStream()
+	stream.Connected("352093081452251")
+	server := httptest.NewServer(stream)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Now().Add(time.Second * 5))
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols || res.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("handshake %s %v", res.Status, res.Header)
+	}
+
+	read := func() *LiveEvent {
+		t.Helper()
+		opcode, payload, err := readWebSocketFrame(reader)
+		if err != nil || opcode != wsText {
+			t.Fatalf("readWebSocketFrame() = %x %v", opcode, err)
+		}
+		event := &LiveEvent{}
+		if err = json.Unmarshal(payload, event); err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+	if event := read(); event.Type != "connect" || event.Imei != "352093081452251" {
+		t.Errorf("snapshot %+v", event)
+	}
+	stream.Disconnected("352093081452251", "eof")
+	if event := read(); event.Type != "disconnect" || event.Reason != "eof" {
+		t.Errorf("event %+v", event)
+	}
+
+	mask := []byte{1, 2, 3, 4}
+	if _, err = conn.Write(appendWebSocketFrame(nil, wsPing, []byte("hi"), mask)); err != nil {
+		t.Fatal(err)
+	}
+	if opcode, payload, err := readWebSocketFrame(reader); err != nil || opcode != wsPong || string(payload) != "hi" {
+		t.Errorf("pong = %x %q %v", opcode, payload, err)
+	}
+	if _, err = conn.Write(appendWebSocketFrame(nil, wsClose, []byte{0x03, 0xe8}, mask)); err != nil {
+		t.Fatal(err)
+	}
+	if opcode, payload, err := readWebSocketFrame(reader); err != nil || opcode != wsClose || !bytes.Equal(payload, []byte{0x03, 0xe8}) {
+		t.Errorf("close = %x % x %v", opcode, payload, err)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// systemdSocket is a socket passed by systemd (socket activation), name is its FileDescriptorName
+type systemdSocket struct {
+	name       string
+	listener   net.Listener
+	packetConn net.PacketConn
+}
+
+var (
+	systemdOnce    sync.Once
+	systemdMutex   sync.Mutex
+	systemdSockets []*systemdSocket
+)
+
+// systemdInherit reads the sockets passed with LISTEN_FDS (from fd 3) once, the variables are unset so the child
+// processes don't take them too
+func systemdInherit() {
+	systemdOnce.Do(func() {
+		defer func() {
+			_ = os.Unsetenv("LISTEN_PID")
+			_ = os.Unsetenv("LISTEN_FDS")
+			_ = os.Unsetenv("LISTEN_FDNAMES")
+		}()
+		if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+			return
+		}
+		count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil || count <= 0 {
+			return
+		}
+		names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+		for i := 0; i < count; i++ {
+			socket := &systemdSocket{}
+			if i < len(names) {
+				socket.name = names[i]
+			}
+			file := os.NewFile(uintptr(3+i), "LISTEN_FD_"+strconv.Itoa(3+i))
+			// both dup the descriptor, the file is closed either way
+			if listener, err := net.FileListener(file); err == nil {
+				socket.listener = listener
+			} else if packetConn, err := net.FilePacketConn(file); err == nil {
+				socket.packetConn = packetConn
+			}
+			_ = file.Close()
+			if socket.listener != nil || socket.packetConn != nil {
+				systemdSockets = append(systemdSockets, socket)
+			}
+		}
+	})
+}
+
+// systemdTake returns the inherited socket named name (FileDescriptorName= of the socket unit) or else listening on
+// the port of address, nil if there's none. A socket is taken once
+func systemdTake(name string, address string, packet bool) *systemdSocket {
+	systemdInherit()
+	systemdMutex.Lock()
+	defer systemdMutex.Unlock()
+	_, port, _ := net.SplitHostPort(address)
+	match := -1
+	for i, socket := range systemdSockets {
+		if (socket.packetConn != nil) != packet {
+			continue
+		}
+		if socket.name == name {
+			match = i
+			break
+		}
+		addr := ""
+		if socket.listener != nil {
+			addr = socket.listener.Addr().String()
+		} else {
+			addr = socket.packetConn.LocalAddr().String()
+		}
+		if _, socketPort, err := net.SplitHostPort(addr); err == nil && socketPort == port && match < 0 {
+			match = i
+		}
+	}
+	if match < 0 {
+		return nil
+	}
+	socket := systemdSockets[match]
+	systemdSockets = append(systemdSockets[:match], systemdSockets[match+1:]...)
+	return socket
+}
+
+// systemdListener returns the inherited stream socket of the server, nil if systemd passed none
+func systemdListener(name string, address string) net.Listener {
+	if socket := systemdTake(name, address, false); socket != nil {
+		return socket.listener
+	}
+	return nil
+}
+
+// systemdPacketConn returns the inherited datagram socket of the server, nil if systemd passed none
+func systemdPacketConn(name string, address string) net.PacketConn {
+	if socket := systemdTake(name, address, true); socket != nil {
+		return socket.packetConn
+	}
+	return nil
+}
+
+// sdNotify sends the state (READY=1, STOPPING=1, WATCHDOG=1, STATUS=...) to the NOTIFY_SOCKET of systemd, false if
+// the server doesn't run under a notify service
+func sdNotify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	if strings.HasPrefix(socket, "@") {
+		// abstract namespace
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, fmt.Errorf("sd_notify error (%v)", err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return false, fmt.Errorf("sd_notify error (%v)", err)
+	}
+	return true, nil
+}
+
+// sdWatchdog pings the systemd watchdog (WatchdogSec= of the service) at half its timeout, systemd restarts the
+// service when the pings stop. It does nothing without WATCHDOG_USEC
+func sdWatchdog(logger *Logger) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	go func() {
+		for range time.Tick(time.Duration(usec) * time.Microsecond / 2) {
+			if _, err := sdNotify("WATCHDOG=1"); err != nil {
+				logger.Error.Printf("%v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"text/template"
+	"time"
+)
+
+// PayloadTemplate renders hook bodies with text/template, the template gets a templatePacket (the named IO values in
+// the units of the unit profile of the device, Units is nil without profile), e.g. {"id": {{json .Imei}}, "points": [{{range $i, $r := .Records}}{{if $i}},{{end}}{"lat": {{$r.Lat}}, "ign": {{default 0 (index $r.IO "ignition")}}}{{end}}]}
+type PayloadTemplate struct {
+	tmpl *template.Template
+}
+
+type templatePacket struct {
+	Imei       string
+	Codec      string
+	ReceivedAt time.Time
+	Backfill   bool
+	Key        string
+	Units      map[string]string
+	Records    []templateRecord
+}
+
+type templateRecord struct {
+	Time        time.Time
+	TimestampMs uint64
+	Lat         float64
+	Lng         float64
+	Altitude    int16
+	Angle       uint16
+	Speed       uint16
+	Satellites  uint8
+	Priority    string
+	EventID     uint16
+	IO          map[string]any
+	Attributes  map[string]any
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"default": func(def any, v any) any {
+		if v == nil {
+			return def
+		}
+		return v
+	},
+	"unix": func(t time.Time) int64 {
+		return t.Unix()
+	},
+	"rfc3339": func(t time.Time) string {
+		return t.UTC().Format(time.RFC3339)
+	},
+}
+
+func NewPayloadTemplate(text string) (*PayloadTemplate, error) {
+	tmpl, err := template.New("payload").Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("payload template parse error (%v)", err)
+	}
+	return &PayloadTemplate{tmpl: tmpl}, nil
+}
+
+func LoadPayloadTemplate(path string) (*PayloadTemplate, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("payload template read error (%v)", err)
+	}
+	return NewPayloadTemplate(string(text))
+}
+
+func (p *PayloadTemplate) Render(imei string, pkt *AnnotatedPacket) ([]byte, error) {
+	data := templatePacket{
+		Imei:       imei,
+		Codec:      codecName(pkt.CodecID),
+		ReceivedAt: time.Now(),
+		Backfill:   pkt.Backfill,
+		Key:        pkt.Key,
+		Records:    make([]templateRecord, 0, len(pkt.Data)),
+	}
+	profile := unitProfiles.Profile(imei)
+	if profile != nil {
+		data.Units = profile.Units()
+	}
+	for i, record := range pkt.Data {
+		r := newTemplateRecord(&record)
+		if profile != nil {
+			profile.ConvertIO(&record, r.IO)
+		}
+		r.Attributes = pkt.RecordAttributes(i)
+		data.Records = append(data.Records, r)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := p.tmpl.Execute(buf, data); err != nil {
+		return nil, fmt.Errorf("payload template execute error (%v)", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (p *PayloadTemplate) Encoder() *PacketEncoder {
+	return &PacketEncoder{ContentType: "application/json", Encode: p.Render, EncodeEvent: encodeJsonEvent, Join: joinJson}
+}
+
+func newTemplateRecord(record *teltonika.Data) templateRecord {
+	io := make(map[string]any, len(record.Elements)*2)
+	for _, el := range record.Elements {
+		io["io_"+strconv.Itoa(int(el.Id))] = ioElementValue(el.Value)
+	}
+	for name, id := range ioNames {
+		if value, ok := io["io_"+strconv.Itoa(int(id))]; ok {
+			io[name] = value
+		}
+	}
+	return templateRecord{
+		Time:        time.UnixMilli(int64(record.TimestampMs)).UTC(),
+		TimestampMs: record.TimestampMs,
+		Lat:         record.Lat,
+		Lng:         record.Lng,
+		Altitude:    record.Altitude,
+		Angle:       record.Angle,
+		Speed:       record.Speed,
+		Satellites:  record.Satellites,
+		Priority:    priorityName(record.Priority),
+		EventID:     record.EventID,
+		IO:          io,
+	}
+}
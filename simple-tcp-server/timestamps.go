@@ -0,0 +1,116 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"time"
+)
+
+var timestampsMetrics = expvar.NewMap("timestamps")
+
+// TimestampsConfig: a record timestamp more than MaxFutureSeconds (default 300) ahead of the server clock
+// or before MinTime (RFC 3339, default 2015-01-01) is invalid (GPS glitches, RTC reset to its epoch).
+// Action decides what happens with invalid records: "drop" (default), "flag" (kept, a record.invalid_timestamp
+// event is published) or "replace" (the timestamp is replaced with the receive time, the event is published too)
+type TimestampsConfig struct {
+	MaxFutureSeconds int    `json:"maxFutureSeconds"`
+	MinTime          string `json:"minTime"`
+	Action           string `json:"action"`
+}
+
+// TimestampFilter is a Stage checking record timestamps, Publish delivers the events of flagged records
+type TimestampFilter struct {
+	maxFuture time.Duration
+	minTime   time.Time
+	action    string
+	Publish   func(events ...*Event)
+}
+
+func NewTimestampFilter(config *TimestampsConfig) (*TimestampFilter, error) {
+	f := &TimestampFilter{
+		maxFuture: time.Minute * 5,
+		minTime:   time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC),
+		action:    "drop",
+	}
+	if config.MaxFutureSeconds > 0 {
+		f.maxFuture = time.Duration(config.MaxFutureSeconds) * time.Second
+	}
+	if config.MinTime != "" {
+		minTime, err := time.Parse(time.RFC3339, config.MinTime)
+		if err != nil {
+			return nil, fmt.Errorf("timestamps minTime parse error (%v)", err)
+		}
+		f.minTime = minTime
+	}
+	switch config.Action {
+	case "":
+	case "drop", "flag", "replace":
+		f.action = config.Action
+	default:
+		return nil, fmt.Errorf("unknown timestamps action '%s'", config.Action)
+	}
+	return f, nil
+}
+
+func (f *TimestampFilter) Apply(imei string, pkt *AnnotatedPacket) *AnnotatedPacket {
+	now := time.Now()
+	var records []teltonika.Data
+	var indexes []int
+	var events []*Event
+	for i := range pkt.Data {
+		record := pkt.Data[i]
+		reason := f.check(time.UnixMilli(int64(record.TimestampMs)), now)
+		if reason == "" {
+			if records != nil {
+				records = append(records, record)
+				indexes = append(indexes, i)
+			}
+			continue
+		}
+		timestampsMetrics.Add(reason, 1)
+		timestampsMetrics.Add(f.action, 1)
+		if records == nil {
+			records = append(make([]teltonika.Data, 0, len(pkt.Data)), pkt.Data[:i]...)
+			indexes = make([]int, i, len(pkt.Data))
+			for j := range indexes {
+				indexes[j] = j
+			}
+		}
+		if f.action == "drop" {
+			continue
+		}
+		data := map[string]any{
+			"reason":      reason,
+			"timestampMs": record.TimestampMs,
+			"receivedAt":  now.UTC().Format(time.RFC3339),
+			"action":      f.action,
+		}
+		if f.action == "replace" {
+			record.TimestampMs = uint64(now.UnixMilli())
+		}
+		records = append(records, record)
+		indexes = append(indexes, i)
+		events = append(events, NewEvent("record.invalid_timestamp", imei, &record, data))
+	}
+	if len(events) > 0 && f.Publish != nil {
+		f.Publish(events...)
+	}
+	if records == nil {
+		return pkt
+	}
+	if len(records) == 0 && len(pkt.Messages) == 0 {
+		return nil
+	}
+	return pkt.Derive(records, indexes)
+}
+
+// check returns why the timestamp is invalid ("future" or "past"), "" if it's plausible
+func (f *TimestampFilter) check(t time.Time, now time.Time) string {
+	if t.Sub(now) > f.maxFuture {
+		return "future"
+	}
+	if t.Before(f.minTime) {
+		return "past"
+	}
+	return ""
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// TlsConfig enables TLS on the device port (CertFile and KeyFile). With ClientCaFile the client certificates are
+// verified against the CA and a certificate identifies the device: the imei the device presents must be the
+// subject common name (or serial number) of its certificate, or the imei Identities maps the common name or the
+// sha256 fingerprint ("sha256:<hex>") of the certificate to. RequireClientCert rejects devices without certificate
+type TlsConfig struct {
+	CertFile          string            `json:"certFile"`
+	KeyFile           string            `json:"keyFile"`
+	ClientCaFile      string            `json:"clientCaFile"`
+	RequireClientCert bool              `json:"requireClientCert"`
+	Identities        map[string]string `json:"identities"`
+}
+
+// ServerConfig returns the tls config of the listener and the identity check of the devices (nil without ClientCaFile)
+func (c *TlsConfig) ServerConfig() (*tls.Config, *DeviceIdentity, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("tls certificate load error (%v)", err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if c.ClientCaFile == "" {
+		if c.RequireClientCert || len(c.Identities) > 0 {
+			return nil, nil, fmt.Errorf("tls client certificates require clientCaFile")
+		}
+		return config, nil, nil
+	}
+	data, err := os.ReadFile(c.ClientCaFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("tls client ca read error (%v)", err)
+	}
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(data) {
+		return nil, nil, fmt.Errorf("tls client ca '%s' has no certificates", c.ClientCaFile)
+	}
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	if c.RequireClientCert {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, &DeviceIdentity{identities: c.Identities, require: c.RequireClientCert}, nil
+}
+
+// DeviceIdentity checks the imei presented by a device against its client certificate
+type DeviceIdentity struct {
+	identities map[string]string
+	require    bool
+}
+
+// Verify returns an error if the (verified) certificate of the connection doesn't belong to the imei
+func (d *DeviceIdentity) Verify(imei string, state *tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		if d.require {
+			return fmt.Errorf("no client certificate")
+		}
+		return nil
+	}
+	cert := state.PeerCertificates[0]
+	sum := sha256.Sum256(cert.Raw)
+	fingerprint := "sha256:" + hex.EncodeToString(sum[:])
+	if expected, ok := d.identities[fingerprint]; ok {
+		return certificateMatch(expected == imei, cert, imei)
+	}
+	if expected, ok := d.identities[cert.Subject.CommonName]; ok {
+		return certificateMatch(expected == imei, cert, imei)
+	}
+	return certificateMatch(cert.Subject.CommonName == imei || strings.TrimSpace(cert.Subject.SerialNumber) == imei, cert, imei)
+}
+
+func certificateMatch(match bool, cert *x509.Certificate, imei string) error {
+	if !match {
+		return fmt.Errorf("certificate '%s' doesn't belong to imei %s", cert.Subject.CommonName, imei)
+	}
+	return nil
+}
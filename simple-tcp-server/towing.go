@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TowingConfig: with the ignition off, movement (movement IO or speed of at least MinSpeedKmh, default 5)
+// lasting MinSeconds (default 60) that takes the vehicle MinMeters (default 100) from where it was parked
+// starts a towing alarm, it ends when the movement stops or the ignition turns on. Without a GPS fix
+// the distance isn't checked (tow trucks and jammers block the antenna)
+type TowingConfig struct {
+	MinSeconds  int     `json:"minSeconds"`
+	MinMeters   float64 `json:"minMeters"`
+	MinSpeedKmh uint16  `json:"minSpeedKmh"`
+}
+
+// TowingStatus is the towing state of a device, served by the api
+type TowingStatus struct {
+	Active       bool      `json:"active"`
+	Since        time.Time `json:"since,omitempty"`
+	Parked       bool      `json:"parked"`
+	ParkedLat    float64   `json:"parkedLat,omitempty"`
+	ParkedLng    float64   `json:"parkedLng,omitempty"`
+	Acknowledged bool      `json:"acknowledged"`
+	SnoozedUntil time.Time `json:"snoozedUntil,omitempty"`
+}
+
+// TowingDetector emits security.towing.start / security.towing.end events, an acknowledged alarm or a snoozed
+// device doesn't emit start events (the alarm state is still tracked)
+type TowingDetector struct {
+	delay    time.Duration
+	meters   float64
+	minSpeed uint16
+	devices  sync.Map
+}
+
+type towingDevice struct {
+	mutex       sync.Mutex
+	status      TowingStatus
+	fix         bool
+	movingSince time.Time
+	quiet       bool
+}
+
+func NewTowingDetector(config *TowingConfig) *TowingDetector {
+	t := &TowingDetector{delay: time.Minute, meters: 100, minSpeed: 5}
+	if config == nil {
+		return t
+	}
+	if config.MinSeconds > 0 {
+		t.delay = time.Duration(config.MinSeconds) * time.Second
+	}
+	if config.MinMeters > 0 {
+		t.meters = config.MinMeters
+	}
+	if config.MinSpeedKmh > 0 {
+		t.minSpeed = config.MinSpeedKmh
+	}
+	return t
+}
+
+func (t *TowingDetector) device(imei string) *towingDevice {
+	value, _ := t.devices.LoadOrStore(imei, &towingDevice{})
+	return value.(*towingDevice)
+}
+
+func (t *TowingDetector) Process(imei string, pkt *teltonika.Packet) []*Event {
+	device := t.device(imei)
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	var events []*Event
+	for i := range pkt.Data {
+		record := &pkt.Data[i]
+		ignition, ok := ioUint(record, ioNames["ignition"])
+		if !ok {
+			continue
+		}
+		recordTime := time.UnixMilli(int64(record.TimestampMs))
+		status := &device.status
+		if ignition != 0 {
+			if status.Active {
+				events = t.appendEnd(events, imei, record, device, "ignition_on")
+			}
+			device.movingSince = time.Time{}
+			status.Parked, status.Acknowledged = false, false
+			continue
+		}
+
+		if !status.Parked {
+			status.Parked, device.fix = true, hasFix(record)
+			status.ParkedLat, status.ParkedLng = record.Lat, record.Lng
+		} else if !device.fix && hasFix(record) {
+			// parked without a fix, the first fix is the park position
+			device.fix = true
+			status.ParkedLat, status.ParkedLng = record.Lat, record.Lng
+		}
+		movement, known := ioUint(record, ioNames["movement"])
+		moving := (known && movement != 0) || record.Speed >= t.minSpeed
+		away := !device.fix || !hasFix(record) ||
+			haversine(status.ParkedLat, status.ParkedLng, record.Lat, record.Lng) >= t.meters
+
+		if !moving {
+			device.movingSince = time.Time{}
+		} else if device.movingSince.IsZero() {
+			device.movingSince = recordTime
+		}
+		if !status.Active && moving && away && recordTime.Sub(device.movingSince) >= t.delay {
+			status.Active, status.Since = true, device.movingSince.UTC()
+			device.quiet = status.Acknowledged || recordTime.Before(status.SnoozedUntil)
+			if !device.quiet {
+				events = append(events, NewEvent("security.towing.start", imei, record, map[string]any{
+					"since":     status.Since.Format(time.RFC3339),
+					"parkedLat": status.ParkedLat,
+					"parkedLng": status.ParkedLng,
+				}))
+			}
+		}
+		if status.Active && !moving {
+			events = t.appendEnd(events, imei, record, device, "stopped")
+			// the vehicle may have been moved, it's parked where it stopped
+			status.Parked = false
+		}
+	}
+	return events
+}
+
+// appendEnd ends the alarm, the end event is appended unless the start was silenced
+func (t *TowingDetector) appendEnd(events []*Event, imei string, record *teltonika.Data, device *towingDevice, reason string) []*Event {
+	status := &device.status
+	status.Active = false
+	if device.quiet {
+		return events
+	}
+	data := map[string]any{
+		"since":           status.Since.Format(time.RFC3339),
+		"durationSeconds": int64(time.UnixMilli(int64(record.TimestampMs)).Sub(status.Since).Seconds()),
+		"reason":          reason,
+	}
+	if hasFix(record) && device.fix {
+		data["distanceMeters"] = haversine(status.ParkedLat, status.ParkedLng, record.Lat, record.Lng)
+	}
+	return append(events, NewEvent("security.towing.end", imei, record, data))
+}
+
+// Status returns the towing state of the device
+func (t *TowingDetector) Status(imei string) TowingStatus {
+	device := t.device(imei)
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+	return device.status
+}
+
+// Acknowledge silences the alarm of the device until the ignition turns on
+func (t *TowingDetector) Acknowledge(imei string) {
+	device := t.device(imei)
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+	device.status.Acknowledged = true
+}
+
+// Snooze silences the device for the duration (0 ends the snooze)
+func (t *TowingDetector) Snooze(imei string, duration time.Duration) {
+	device := t.device(imei)
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+	device.status.SnoozedUntil = time.Time{}
+	if duration > 0 {
+		device.status.SnoozedUntil = time.Now().Add(duration).UTC()
+	}
+}
+
+// ServeHTTP handles /devices/{imei}/towing: GET returns the status, POST {"action": "ack"}
+// acknowledges the alarm, POST {"action": "snooze", "minutes": 60} snoozes the device
+func (t *TowingDetector) ServeHTTP(w http.ResponseWriter, r *http.Request, imei string) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJson(w, http.StatusOK, t.Status(imei))
+	case http.MethodPost:
+		request := struct {
+			Action  string `json:"action"`
+			Minutes int    `json:"minutes"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch request.Action {
+		case "ack":
+			t.Acknowledge(imei)
+		case "snooze":
+			t.Snooze(imei, time.Duration(request.Minutes)*time.Minute)
+		default:
+			http.Error(w, "unknown action '"+request.Action+"'", http.StatusBadRequest)
+			return
+		}
+		writeJson(w, http.StatusOK, t.Status(imei))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Purge forgets the device (a Purger)
+func (t *TowingDetector) Purge(imei string) (int, error) {
+	return purgeSyncMap(&t.devices, imei), nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TripsConfig: StopSeconds is how long a device without ignition/movement IO must stand still
+// to end the trip, History is the number of finished trips kept per device for the api
+type TripsConfig struct {
+	StopSeconds int `json:"stopSeconds"`
+	History     int `json:"history"`
+}
+
+type Trip struct {
+	Active          bool      `json:"active"`
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	StartLat        float64   `json:"startLat"`
+	StartLng        float64   `json:"startLng"`
+	EndLat          float64   `json:"endLat"`
+	EndLng          float64   `json:"endLng"`
+	DistanceMeters  float64   `json:"distanceMeters"`
+	DurationSeconds int64     `json:"durationSeconds"`
+	IdleSeconds     int64     `json:"idleSeconds"`
+	MaxSpeed        uint16    `json:"maxSpeed"`
+	StartOdometer   float64   `json:"startOdometer,omitempty"`
+	EndOdometer     float64   `json:"endOdometer,omitempty"`
+}
+
+// TripDetector starts a trip when the ignition (or movement IO, or GPS speed if the device sends neither)
+// turns on and ends it when it turns off, emitting trip.start and trip.end events,
+// with Odometer set (it must process the records first) trips have the odometer readings
+type TripDetector struct {
+	stop     time.Duration
+	history  int
+	devices  sync.Map
+	Odometer *OdometerService
+}
+
+type tripDevice struct {
+	mutex      sync.Mutex
+	current    *Trip
+	trips      []Trip
+	last       *teltonika.Data
+	lastFix    *teltonika.Data
+	stillSince time.Time
+}
+
+func NewTripDetector(config *TripsConfig) *TripDetector {
+	t := &TripDetector{stop: time.Minute * 5, history: 100}
+	if config != nil && config.StopSeconds > 0 {
+		t.stop = time.Duration(config.StopSeconds) * time.Second
+	}
+	if config != nil && config.History > 0 {
+		t.history = config.History
+	}
+	return t
+}
+
+func (t *TripDetector) device(imei string) *tripDevice {
+	value, _ := t.devices.LoadOrStore(imei, &tripDevice{})
+	return value.(*tripDevice)
+}
+
+func (t *TripDetector) Process(imei string, pkt *teltonika.Packet) []*Event {
+	device := t.device(imei)
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	var events []*Event
+	for i := range pkt.Data {
+		record := pkt.Data[i]
+		record.Elements = nil
+		recordTime := time.UnixMilli(int64(record.TimestampMs)).UTC()
+
+		on, known := tripActive(&pkt.Data[i])
+		if !known {
+			// speed based, the trip ends after standing still for the stop duration
+			on = record.Speed > 0
+			if on || device.current == nil {
+				device.stillSince = time.Time{}
+			} else if device.stillSince.IsZero() {
+				device.stillSince = recordTime
+				on = true
+			} else {
+				on = recordTime.Sub(device.stillSince) < t.stop
+			}
+		}
+
+		if device.current == nil && on {
+			device.current = &Trip{Active: true, Start: recordTime, StartLat: record.Lat, StartLng: record.Lng}
+			if t.Odometer != nil {
+				device.current.StartOdometer = t.Odometer.TotalMeters(imei)
+			}
+			device.lastFix = nil
+			events = append(events, NewEvent("trip.start", imei, &record, nil))
+		}
+		if trip := device.current; trip != nil {
+			if hasFix(&record) {
+				if device.lastFix != nil {
+					trip.DistanceMeters += haversine(device.lastFix.Lat, device.lastFix.Lng, record.Lat, record.Lng)
+				}
+				device.lastFix = &record
+				trip.EndLat, trip.EndLng = record.Lat, record.Lng
+			}
+			if record.Speed > trip.MaxSpeed {
+				trip.MaxSpeed = record.Speed
+			}
+			// idling needs the ignition/movement IO, without it standing still ends the trip
+			if known && on && device.last != nil && device.last.Speed == 0 && record.Speed == 0 &&
+				record.TimestampMs > device.last.TimestampMs {
+				trip.IdleSeconds += int64(record.TimestampMs-device.last.TimestampMs) / 1000
+			}
+			trip.End = recordTime
+			if t.Odometer != nil {
+				trip.EndOdometer = t.Odometer.TotalMeters(imei)
+			}
+			if !on && !known {
+				// the trip ended when the device stopped, not when the stop was confirmed
+				trip.End = device.stillSince
+			}
+			trip.DurationSeconds = int64(trip.End.Sub(trip.Start).Seconds())
+			if !on {
+				trip.Active = false
+				device.trips = append(device.trips, *trip)
+				if len(device.trips) > t.history {
+					device.trips = device.trips[len(device.trips)-t.history:]
+				}
+				device.current = nil
+				events = append(events, NewEvent("trip.end", imei, &record, trip.eventData()))
+			}
+		}
+		device.last = &record
+	}
+	return events
+}
+
+// Trips returns the finished trips of the device and the current one (last, active)
+func (t *TripDetector) Trips(imei string) []Trip {
+	device := t.device(imei)
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+	trips := append(make([]Trip, 0, len(device.trips)+1), device.trips...)
+	if device.current != nil {
+		trips = append(trips, *device.current)
+	}
+	return trips
+}
+
+// ServeHTTP handles GET /devices/{imei}/trips
+func (t *TripDetector) ServeHTTP(w http.ResponseWriter, r *http.Request, imei string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJson(w, http.StatusOK, t.Trips(imei))
+}
+
+func (trip *Trip) eventData() map[string]any {
+	return map[string]any{
+		"start":           trip.Start.Format(time.RFC3339),
+		"startLat":        trip.StartLat,
+		"startLng":        trip.StartLng,
+		"distanceMeters":  trip.DistanceMeters,
+		"durationSeconds": trip.DurationSeconds,
+		"idleSeconds":     trip.IdleSeconds,
+		"maxSpeed":        trip.MaxSpeed,
+		"startOdometer":   trip.StartOdometer,
+		"endOdometer":     trip.EndOdometer,
+	}
+}
+
+// tripActive reads the ignition or movement IO, known is false if the record has neither
+func tripActive(record *teltonika.Data) (on bool, known bool) {
+	if value, ok := ioUint(record, ioNames["ignition"]); ok {
+		return value != 0, true
+	}
+	if value, ok := ioUint(record, ioNames["movement"]); ok {
+		return value != 0, true
+	}
+	return false, false
+}
+
+// Purge forgets the device (a Purger)
+func (t *TripDetector) Purge(imei string) (int, error) {
+	return purgeSyncMap(&t.devices, imei), nil
+}
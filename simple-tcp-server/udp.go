@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"sync"
+)
+
+var udpMetrics = expvar.NewMap("udp")
+
+// UDPServer receives the Teltonika UDP packets (devices with the UDP data protocol) and acks them,
+// OnPacket gets the packets like TCPServer.OnPacket so they go through the same pipeline and sinks
+type UDPServer struct {
+	address     string
+	logger      *Logger
+	workerCount int
+	// Limits bound the records and IO elements of the packets (the packet size is bounded by the read buffer)
+	Limits   LimitsConfig
+	OnPacket func(imei string, pkt *teltonika.Packet)
+	// OnListen is called once the server listens (optional)
+	OnListen func()
+	mutex    sync.Mutex
+	conn     *net.UDPConn
+	closing  bool
+}
+
+func NewUDPServer(address string, workerCount int, logger *Logger) *UDPServer {
+	return &UDPServer{address: address, workerCount: workerCount, logger: logger}
+}
+
+func (s *UDPServer) Run() error {
+	conn, ok := systemdPacketConn("udp", s.address).(*net.UDPConn)
+	if !ok {
+		addr, err := net.ResolveUDPAddr("udp", s.address)
+		if err != nil {
+			return fmt.Errorf("udp address error (%v)", err)
+		}
+		if conn, err = net.ListenUDP("udp", addr); err != nil {
+			return fmt.Errorf("listen udp error (%v)", err)
+		}
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	s.mutex.Lock()
+	if s.closing {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.conn = conn
+	s.mutex.Unlock()
+	s.logger.Info.Printf("udp listening at %s", conn.LocalAddr())
+	if s.OnListen != nil {
+		s.OnListen()
+	}
+
+	type job struct {
+		packet []byte
+		addr   *net.UDPAddr
+	}
+	jobs := make(chan job, s.workerCount)
+	defer close(jobs)
+	for i := 0; i < s.workerCount; i++ {
+		go func() {
+			for j := range jobs {
+				s.handle(conn, j.addr, j.packet)
+			}
+		}()
+	}
+
+	buf := make([]byte, 1300)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if s.isClosing() {
+				return nil
+			}
+			return fmt.Errorf("udp read packet error (%v)", err)
+		}
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+		jobs <- job{packet, addr}
+	}
+}
+
+// Shutdown stops receiving packets, Run returns nil then. The packets being handled aren't waited for, they go to
+// the pipeline like the tcp ones (see Pipeline.Drain)
+func (s *UDPServer) Shutdown() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closing = true
+	if s.conn != nil {
+		_ = s.conn.Close()
+	}
+}
+
+func (s *UDPServer) isClosing() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closing
+}
+
+func (s *UDPServer) handle(conn *net.UDPConn, addr *net.UDPAddr, packet []byte) {
+	client := addr.String()
+	udpMetrics.Add("packets", 1)
+	_, res, err := teltonika.DecodeUDPFromSlice(packet, decodeConfig)
+	if err != nil {
+		udpMetrics.Add("decode_errors", 1)
+		s.logger.Error.Printf("[%s]: udp packet decode error (%v)", client, err)
+		return
+	}
+	if err = s.Limits.CheckPacket(res.Packet); err != nil {
+		s.logger.Error.Printf("[%s]: udp packet dropped (%v)", res.Imei, err)
+		return
+	}
+	if res.Response != nil {
+		if _, err = conn.WriteToUDP(res.Response, addr); err != nil {
+			s.logger.Error.Printf("[%s]: udp response write error (%v)", res.Imei, err)
+			return
+		}
+	}
+	if s.OnPacket != nil {
+		err = safeCall("OnPacket", func() error {
+			s.OnPacket(res.Imei, res.Packet)
+			return nil
+		})
+		var panicErr *PanicError
+		if errors.As(err, &panicErr) {
+			s.logger.Error.Printf("[%s]: %v\n%s", res.Imei, err, panicErr.Stack)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
+// UnitsConfig: Profiles are the units the named IO values are rendered in (the IO of the payload templates, the io
+// parsers with a quantity), the first profile matching a device applies: its selector and, if set, the tenant of the
+// device in the directory (Tenants). Distance is "km" or "mi", Volume "l" or "gal" (US), Temperature "c" or "f",
+// the values of the devices without a profile stay as the devices send them
+type UnitsConfig struct {
+	Profiles []*UnitProfile `json:"profiles"`
+}
+
+type UnitProfile struct {
+	DeviceSelector
+	Tenants     []string `json:"tenants"`
+	Distance    string   `json:"distance"`
+	Volume      string   `json:"volume"`
+	Temperature string   `json:"temperature"`
+}
+
+// ioQuantity is the quantity of a named IO element, scale converts its raw value (signed or not) to km, l or °C,
+// invalid are the error codes of the sensor left as they are
+type ioQuantity struct {
+	kind    string
+	scale   float64
+	signed  bool
+	invalid []int64
+}
+
+// bleTemperatureErrors are the error codes of the BLE temperature sensors (see bleTemperature)
+var bleTemperatureErrors = []int64{2000, 3000, 4000}
+
+var ioQuantities = map[string]ioQuantity{
+	"totalOdometer":      {"distance", 0.001, false, nil},
+	"tripOdometer":       {"distance", 0.001, false, nil},
+	"fuelUsedGps":        {"volume", 0.001, false, nil},
+	"bleTemperature1":    {"temperature", 0.01, true, bleTemperatureErrors},
+	"bleTemperature2":    {"temperature", 0.01, true, bleTemperatureErrors},
+	"bleTemperature3":    {"temperature", 0.01, true, bleTemperatureErrors},
+	"bleTemperature4":    {"temperature", 0.01, true, bleTemperatureErrors},
+	"fuelTemperatureLls": {"temperature", 1, true, nil},
+}
+
+// unitNames are the allowed units of the quantities, the first one is the unit of the values converted
+var unitNames = map[string][]string{"distance": {"km", "mi"}, "volume": {"l", "gal"}, "temperature": {"c", "f"}}
+
+func (p *UnitProfile) validate() error {
+	for kind, unit := range map[string]string{"distance": p.Distance, "volume": p.Volume, "temperature": p.Temperature} {
+		if unit != "" && !containsString(unitNames[kind], unit) {
+			return fmt.Errorf("unit profile: unknown %s unit '%s'", kind, unit)
+		}
+	}
+	return nil
+}
+
+// Units returns the units of the quantities, km, l and c if the profile doesn't set them
+func (p *UnitProfile) Units() map[string]string {
+	units := map[string]string{"distance": p.Distance, "volume": p.Volume, "temperature": p.Temperature}
+	for kind, unit := range units {
+		if unit == "" {
+			units[kind] = unitNames[kind][0]
+		}
+	}
+	return units
+}
+
+// Convert converts a value in km, l or °C to the unit of the profile, rounded to 3 decimals
+func (p *UnitProfile) Convert(kind string, value float64) float64 {
+	switch {
+	case kind == "distance" && p.Distance == "mi":
+		value *= 0.621371
+	case kind == "volume" && p.Volume == "gal":
+		value *= 0.264172
+	case kind == "temperature" && p.Temperature == "f":
+		value = value*9/5 + 32
+	}
+	return math.Round(value*1000) / 1000
+}
+
+// ConvertIO replaces the named IO values of the record with a quantity in io (see newTemplateRecord) by the
+// converted ones, the io_<id> values stay raw
+func (p *UnitProfile) ConvertIO(record *teltonika.Data, io map[string]any) {
+	for name, quantity := range ioQuantities {
+		value, ok := findElement(record, ioNames[name])
+		if !ok || len(value) == 0 || len(value) > 8 {
+			continue
+		}
+		raw, _ := ioElementUint(value)
+		number := float64(raw)
+		if quantity.signed {
+			signed, _ := ioElementInt(value)
+			if containsInt64(quantity.invalid, signed) {
+				continue
+			}
+			number = float64(signed)
+		}
+		io[name] = p.Convert(quantity.kind, number*quantity.scale)
+	}
+}
+
+func containsInt64(values []int64, value int64) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func numberValue(v any) (float64, bool) {
+	switch n := v.(type) {
+	case uint64:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// UnitProfiles holds the profiles of the server, Tenant returns the tenant of a device (the directory, optional)
+type UnitProfiles struct {
+	Tenant   func(imei string) string
+	mutex    sync.RWMutex
+	profiles []*UnitProfile
+}
+
+// unitProfiles is the registry of the server, configured at start
+var unitProfiles = &UnitProfiles{}
+
+func (u *UnitProfiles) Configure(config *UnitsConfig) error {
+	for _, profile := range config.Profiles {
+		if err := profile.validate(); err != nil {
+			return err
+		}
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.profiles = config.Profiles
+	return nil
+}
+
+// Profile returns the profile of the device, nil if none matches
+func (u *UnitProfiles) Profile(imei string) *UnitProfile {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	tenant, looked := "", false
+	for _, profile := range u.profiles {
+		if !profile.Match(imei) {
+			continue
+		}
+		if len(profile.Tenants) > 0 {
+			if !looked && u.Tenant != nil {
+				tenant, looked = u.Tenant(imei), true
+			}
+			if !containsString(profile.Tenants, tenant) {
+				continue
+			}
+		}
+		return profile
+	}
+	return nil
+}
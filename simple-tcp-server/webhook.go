@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var hooksMetrics = expvar.NewMap("hooks")
+
+type WebhookConfig struct {
+	Name        string
+	Url         string
+	QueueDir    string
+	QueueSize   int
+	DeadLetters DeadLetterQueue
+	MaxAttempts int
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+	Headers     map[string]string
+	BearerToken string
+	Secret      string
+	Encoder     *PacketEncoder
+	BatchSize   int
+	BatchWait   time.Duration
+	Gzip        bool
+	Events      bool
+	Breaker     *BreakerConfig
+	Pseudonyms  *Pseudonymizer
+}
+
+// WebhookSink posts packets to the hook from a single worker, so the order is kept,
+// failed posts are retried with exponential backoff and after MaxAttempts
+// the body goes to the dead letter queue
+type WebhookSink struct {
+	config  WebhookConfig
+	client  *http.Client
+	queue   Queue
+	metrics *expvar.Map
+	logger  *Logger
+	batch   webhookBatch
+	breaker *CircuitBreaker
+}
+
+// webhookBatch accumulates bodies until BatchSize records or BatchWait,
+// batched bodies are joined by the encoder (json array, protobuf PacketBatch)
+type webhookBatch struct {
+	mutex   sync.Mutex
+	bodies  [][]byte
+	records int
+	timer   *time.Timer
+}
+
+func NewWebhookSink(config WebhookConfig, logger *Logger) (*WebhookSink, error) {
+	if config.Name == "" {
+		config.Name = config.Url
+	}
+	breaker := NewCircuitBreaker("hook:"+config.Name, config.Breaker, logger)
+	var queue Queue = NewMemoryQueue(config.QueueSize)
+	if config.QueueDir != "" {
+		diskQueue, err := NewDiskQueue(config.QueueDir, config.QueueSize)
+		if err != nil {
+			return nil, err
+		}
+		queue = diskQueue
+	} else if breaker != nil && config.Breaker.SpillDir != "" {
+		spill, err := NewDiskQueue(filepath.Join(config.Breaker.SpillDir, url.PathEscape(config.Name)), config.QueueSize)
+		if err != nil {
+			return nil, err
+		}
+		queue = NewSpillQueue(queue, spill, breaker.Open)
+	}
+
+	metrics := new(expvar.Map).Init()
+	metrics.Set("queued", expvar.Func(func() any { return queue.Len() }))
+	if config.Encoder == nil {
+		config.Encoder = jsonEncoder
+	}
+	hooksMetrics.Set(config.Name, metrics)
+
+	w := &WebhookSink{
+		config:  config,
+		client:  &http.Client{Timeout: time.Second * 10},
+		queue:   queue,
+		metrics: metrics,
+		logger:  logger,
+		breaker: breaker,
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *WebhookSink) Send(imei string, pkt *AnnotatedPacket) error {
+	if len(pkt.Data) == 0 {
+		return nil
+	}
+	imei, pkt = w.config.Pseudonyms.Packet(imei, pkt)
+	body, err := w.config.Encoder.Encode(imei, pkt)
+	if err != nil {
+		return fmt.Errorf("hook '%s': %v", w.config.Name, err)
+	}
+	if body == nil {
+		return nil
+	}
+	if !w.batched() {
+		return w.enqueue(body)
+	}
+
+	w.batch.mutex.Lock()
+	defer w.batch.mutex.Unlock()
+
+	w.batch.bodies = append(w.batch.bodies, body)
+	w.batch.records += len(pkt.Data)
+	if w.config.BatchSize > 0 && w.batch.records >= w.config.BatchSize {
+		return w.flushBatch()
+	}
+	if w.batch.timer == nil && w.config.BatchWait > 0 {
+		w.batch.timer = time.AfterFunc(w.config.BatchWait, func() {
+			w.batch.mutex.Lock()
+			defer w.batch.mutex.Unlock()
+			if err := w.flushBatch(); err != nil {
+				w.logger.Error.Printf("%v", err)
+			}
+		})
+	}
+	return nil
+}
+
+// SendEvent posts the event if events are enabled for the hook, events aren't batched
+// (a single event is still joined when batching is on, so receivers always get the same payload shape)
+func (w *WebhookSink) SendEvent(event *Event) error {
+	if !w.config.Events || w.config.Encoder.EncodeEvent == nil {
+		return nil
+	}
+	event = w.config.Pseudonyms.Event(event)
+	body, err := w.config.Encoder.EncodeEvent(event)
+	if err != nil {
+		return fmt.Errorf("hook '%s': %v", w.config.Name, err)
+	}
+	if w.batched() {
+		body = w.config.Encoder.Join([][]byte{body})
+	}
+	return w.enqueue(body)
+}
+
+func (w *WebhookSink) batched() bool {
+	return w.config.BatchSize > 1 || w.config.BatchWait > 0
+}
+
+func (w *WebhookSink) flushBatch() error {
+	if w.batch.timer != nil {
+		w.batch.timer.Stop()
+		w.batch.timer = nil
+	}
+	if len(w.batch.bodies) == 0 {
+		return nil
+	}
+	body := w.config.Encoder.Join(w.batch.bodies)
+	w.batch.bodies = nil
+	w.batch.records = 0
+	return w.enqueue(body)
+}
+
+func (w *WebhookSink) enqueue(body []byte) error {
+	if err := w.queue.Push(body); err != nil {
+		w.metrics.Add("dropped", 1)
+		return fmt.Errorf("hook '%s' enqueue error (%v)", w.config.Name, err)
+	}
+	return nil
+}
+
+func (w *WebhookSink) run() {
+	logger := w.logger
+	for {
+		body, err := w.queue.Peek()
+		if err != nil {
+			logger.Error.Printf("hook '%s' queue error (%v)", w.config.Name, err)
+			time.Sleep(w.config.MinBackoff)
+			continue
+		}
+
+		payload, headers := w.prepare(body)
+
+		backoff := w.config.MinBackoff
+		for attempt := 1; ; attempt++ {
+			w.breaker.Wait()
+			err = postJSON(w.client, w.config.Url, headers, payload)
+			w.breaker.Done(err)
+			if err == nil {
+				w.metrics.Add("delivered", 1)
+				break
+			}
+			w.metrics.Add("failed_attempts", 1)
+			// the payload waits for the circuit to close, it's attempted again from the start
+			if w.breaker.Open() {
+				attempt, backoff = 0, w.config.MinBackoff
+				continue
+			}
+			if attempt >= w.config.MaxAttempts {
+				logger.Error.Printf("hook '%s' delivery failed after %d attempts (%v)", w.config.Name, attempt, err)
+				w.metrics.Add("dead_lettered", 1)
+				letter := NewDeadLetter(w.Name(), "", w.config.Url, body, attempt, err)
+				letter.ContentType = headers["Content-Type"]
+				putDeadLetter(w.config.DeadLetters, letter, logger)
+				break
+			}
+			logger.Error.Printf("hook '%s' post error, retry in %s (%v)", w.config.Name, backoff, err)
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > w.config.MaxBackoff {
+				backoff = w.config.MaxBackoff
+			}
+		}
+
+		if err = w.queue.Pop(); err != nil {
+			logger.Error.Printf("hook '%s' queue error (%v)", w.config.Name, err)
+		}
+	}
+}
+
+func (w *WebhookSink) Name() string {
+	return w.config.Name
+}
+
+// Drain posts the pending batch and waits until the queue is empty (posted or dead lettered)
+func (w *WebhookSink) Drain(timeout time.Duration) bool {
+	if w.batched() {
+		w.batch.mutex.Lock()
+		err := w.flushBatch()
+		w.batch.mutex.Unlock()
+		if err != nil {
+			w.logger.Error.Printf("hook '%s': %v", w.config.Name, err)
+		}
+	}
+	return waitDrained(timeout, func() bool { return w.queue.Len() == 0 })
+}
+
+// Redeliver posts the letter with an Idempotency-Key header (hash of the payload), the same for every redelivery
+func (w *WebhookSink) Redeliver(letter *DeadLetter) error {
+	payload, headers := w.prepare(letter.Bytes())
+	headers["Idempotency-Key"] = idempotencyKey(letter.Bytes())
+	return postJSON(w.client, w.config.Url, headers, payload)
+}
+
+// prepare compresses the body if enabled and builds the request headers
+func (w *WebhookSink) prepare(body []byte) ([]byte, map[string]string) {
+	payload, compressed := body, false
+	if w.config.Gzip {
+		if gz, err := gzipBody(body); err != nil {
+			w.logger.Error.Printf("hook '%s' compression error (%v)", w.config.Name, err)
+		} else {
+			payload, compressed = gz, true
+		}
+	}
+	headers := w.headers(payload)
+	if compressed {
+		headers["Content-Encoding"] = "gzip"
+	}
+	return payload, headers
+}
+
+// headers adds the auth headers, X-Signature is hex HMAC-SHA256 of the posted (compressed if enabled) body keyed with Secret
+func (w *WebhookSink) headers(body []byte) map[string]string {
+	headers := make(map[string]string, len(w.config.Headers)+3)
+	headers["Content-Type"] = w.config.Encoder.ContentType
+	if w.batched() && w.config.Encoder.BatchContentType != "" {
+		headers["Content-Type"] = w.config.Encoder.BatchContentType
+	}
+	for k, v := range w.config.Headers {
+		headers[k] = v
+	}
+	if w.config.BearerToken != "" {
+		headers["Authorization"] = "Bearer " + w.config.BearerToken
+	}
+	if w.config.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.config.Secret))
+		mac.Write(body)
+		headers["X-Signature"] = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	return headers
+}
+
+func gzipBody(body []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	if _, err := zw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the opcodes of the WebSocket frames (RFC 6455 section 5.2)
+const (
+	wsText         = 0x1
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+	wsGuid         = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsMaxFrame     = 1 << 16
+	wsWriteTimeout = time.Second * 10
+)
+
+// webSocketConn is the server side of a WebSocket connection upgraded from an http request (RFC 6455, text
+// frames written unfragmented, the frames of the client are masked). Writes are safe for concurrent use
+type webSocketConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	mutex  sync.Mutex
+}
+
+// isWebSocket tells whether the request asks for a WebSocket upgrade
+func isWebSocket(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, token := range strings.Split(r.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+			return true
+		}
+	}
+	return false
+}
+
+// webSocketAccept is the Sec-WebSocket-Accept of a Sec-WebSocket-Key
+func webSocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGuid))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// upgradeWebSocket answers the handshake and takes over the connection, the error is already answered
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*webSocketConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("unsupported websocket version '%s'", r.Header.Get("Sec-WebSocket-Version"))
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket unsupported", http.StatusInternalServerError)
+		return nil, fmt.Errorf("websocket unsupported")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("websocket hijack error (%v)", err)
+	}
+	// the deadlines of the http server don't apply to the stream
+	_ = conn.SetReadDeadline(time.Time{})
+	ws := &webSocketConn{conn: conn, reader: rw.Reader}
+	handshake := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + webSocketAccept(key) + "\r\n\r\n"
+	_ = conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if _, err = conn.Write([]byte(handshake)); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("websocket handshake error (%v)", err)
+	}
+	return ws, nil
+}
+
+// appendWebSocketFrame appends a final frame, mask is nil for the frames of the server
+func appendWebSocketFrame(buf []byte, opcode byte, payload []byte, mask []byte) []byte {
+	buf = append(buf, 0x80|opcode)
+	maskBit := byte(0)
+	if mask != nil {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		buf = append(buf, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		buf = append(buf, maskBit|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(payload)))
+	default:
+		buf = append(buf, maskBit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(len(payload)))
+	}
+	if mask == nil {
+		return append(buf, payload...)
+	}
+	buf = append(buf, mask[:4]...)
+	for i, b := range payload {
+		buf = append(buf, b^mask[i%4])
+	}
+	return buf
+}
+
+// readWebSocketFrame reads a frame and unmasks its payload, the frames longer than wsMaxFrame are refused
+func readWebSocketFrame(reader io.Reader) (byte, []byte, error) {
+	header := make([]byte, 2, 8)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, nil, err
+	}
+	opcode := header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		if _, err := io.ReadFull(reader, header[:2]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(header[:2]))
+	case 127:
+		header = header[:8]
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(header)
+	}
+	if length > wsMaxFrame {
+		return 0, nil, fmt.Errorf("websocket frame of %d bytes", length)
+	}
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(reader, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return opcode, payload, nil
+}
+
+// WriteFrame writes a frame, an error closes the connection for the caller
+func (c *webSocketConn) WriteFrame(opcode byte, payload []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	_, err := c.conn.Write(appendWebSocketFrame(nil, opcode, payload, nil))
+	return err
+}
+
+// ReadFrame reads a frame of the client
+func (c *webSocketConn) ReadFrame() (byte, []byte, error) {
+	return readWebSocketFrame(c.reader)
+}
+
+// Serve answers the pings and the close of the client until the connection is closed, done is closed then
+func (c *webSocketConn) Serve(done chan<- struct{}) {
+	defer close(done)
+	for {
+		opcode, payload, err := c.ReadFrame()
+		if err != nil {
+			return
+		}
+		switch opcode {
+		case wsPing:
+			if c.WriteFrame(wsPong, payload) != nil {
+				return
+			}
+		case wsClose:
+			// echo the status code of the client
+			_ = c.WriteFrame(wsClose, payload)
+			return
+		}
+	}
+}
+
+func (c *webSocketConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WialonRetranslator mirrors decoded records to a Wialon IPS 2.0 server,
+// every tracker gets its own outbound TCP session (IPS logs in per device),
+// a session idle for idleTimeout is closed and removed with its goroutine
+type WialonRetranslator struct {
+	address       string
+	password      string
+	logger        *Logger
+	mutex         sync.Mutex
+	sessions      map[string]*wialonSession
+	queueSize     int
+	idleTimeout   time.Duration
+	maxAttempts   int
+	retryInterval time.Duration
+	DeadLetters   DeadLetterQueue
+	Breaker       *CircuitBreaker
+	Pseudonyms    *Pseudonymizer
+}
+
+type wialonSession struct {
+	imei   string
+	queue  chan []byte
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func NewWialonRetranslator(address string, password string, logger *Logger) *WialonRetranslator {
+	return &WialonRetranslator{
+		address:       address,
+		password:      password,
+		logger:        logger,
+		sessions:      make(map[string]*wialonSession),
+		queueSize:     100,
+		idleTimeout:   time.Minute * 10,
+		maxAttempts:   10,
+		retryInterval: time.Second * 5,
+	}
+}
+
+func (w *WialonRetranslator) Send(imei string, pkt *AnnotatedPacket) error {
+	if len(pkt.Data) == 0 {
+		return nil
+	}
+	imei = w.Pseudonyms.Pseudonym(imei)
+	msg := encodeWialonBlackBox(pkt.Data)
+
+	// enqueued under the lock, an idle session is removed only with an empty queue
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	session, ok := w.sessions[imei]
+	if !ok {
+		session = &wialonSession{imei: imei, queue: make(chan []byte, w.queueSize)}
+		w.sessions[imei] = session
+		go w.runSession(session)
+	}
+	select {
+	case session.queue <- msg:
+		return nil
+	default:
+		return fmt.Errorf("wialon queue for '%s' is full, %d records dropped", imei, len(pkt.Data))
+	}
+}
+
+func (w *WialonRetranslator) Name() string {
+	return "wialon:" + w.address
+}
+
+func (w *WialonRetranslator) Redeliver(letter *DeadLetter) error {
+	s := &wialonSession{imei: letter.Imei}
+	defer s.close()
+	return w.deliver(s, letter.Bytes())
+}
+
+// Sessions returns the number of open sessions
+func (w *WialonRetranslator) Sessions() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return len(w.sessions)
+}
+
+func (w *WialonRetranslator) runSession(s *wialonSession) {
+	idle := time.NewTimer(w.idleTimeout)
+	defer idle.Stop()
+
+	for {
+		select {
+		case msg := <-s.queue:
+			w.deliverRetrying(s, msg)
+			if !idle.Stop() {
+				select {
+				case <-idle.C:
+				default:
+				}
+			}
+			idle.Reset(w.idleTimeout)
+		case <-idle.C:
+			if w.expire(s) {
+				return
+			}
+			idle.Reset(w.idleTimeout)
+		}
+	}
+}
+
+// expire removes the idle session and closes its connection, false if records were queued meanwhile
+func (w *WialonRetranslator) expire(s *wialonSession) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if len(s.queue) > 0 {
+		return false
+	}
+	delete(w.sessions, s.imei)
+	if s.conn != nil {
+		w.logger.Info.Printf("[%s]: wialon session idle, closing", s.imei)
+		s.close()
+	}
+	return true
+}
+
+// deliverRetrying makes up to maxAttempts attempts, the attempts waiting for an open circuit count too (the breaker
+// paces them), then the records go to the dead letters
+func (w *WialonRetranslator) deliverRetrying(s *wialonSession, msg []byte) {
+	for attempt := 1; ; attempt++ {
+		w.Breaker.Wait()
+		err := w.deliver(s, msg)
+		w.Breaker.Done(err)
+		if err == nil {
+			return
+		}
+		w.logger.Error.Printf("[%s]: wialon delivery error (%v)", s.imei, err)
+		s.close()
+		if attempt >= w.maxAttempts {
+			putDeadLetter(w.DeadLetters, NewDeadLetter(w.Name(), s.imei, w.address, msg, attempt, err), w.logger)
+			return
+		}
+		if !w.Breaker.Open() {
+			time.Sleep(w.retryInterval)
+		}
+	}
+}
+
+func (w *WialonRetranslator) deliver(s *wialonSession, msg []byte) error {
+	if s.conn == nil {
+		if err := w.login(s); err != nil {
+			return err
+		}
+	}
+	if err := s.conn.SetDeadline(time.Now().Add(time.Second * 30)); err != nil {
+		return err
+	}
+	if _, err := s.conn.Write(msg); err != nil {
+		return fmt.Errorf("write error (%v)", err)
+	}
+	ack, err := s.readAck("#AB#")
+	if err != nil {
+		return err
+	}
+	if ack == "" || ack == "0" {
+		return fmt.Errorf("records rejected (response: %s)", ack)
+	}
+	return nil
+}
+
+func (w *WialonRetranslator) login(s *wialonSession) error {
+	conn, err := net.DialTimeout("tcp", w.address, time.Second*10)
+	if err != nil {
+		return fmt.Errorf("dial error (%v)", err)
+	}
+	s.conn = conn
+	s.reader = bufio.NewReader(conn)
+
+	if err = conn.SetDeadline(time.Now().Add(time.Second * 30)); err != nil {
+		return err
+	}
+	body := "2.0;" + s.imei + ";" + w.password + ";"
+	if _, err = conn.Write([]byte("#L#" + body + wialonCrc(body) + "\r\n")); err != nil {
+		return fmt.Errorf("login write error (%v)", err)
+	}
+	ack, err := s.readAck("#AL#")
+	if err != nil {
+		return err
+	}
+	switch ack {
+	case "1":
+		w.logger.Info.Printf("[%s]: wialon session established with %s", s.imei, w.address)
+		return nil
+	case "01":
+		return fmt.Errorf("login rejected, invalid password")
+	case "10":
+		return fmt.Errorf("login rejected, checksum error")
+	default:
+		return fmt.Errorf("login rejected (response: %s)", ack)
+	}
+}
+
+func (s *wialonSession) readAck(prefix string) (string, error) {
+	line, err := s.reader.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("read error (%v)", err)
+	}
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, prefix) {
+		return "", fmt.Errorf("unexpected response '%s'", line)
+	}
+	return strings.TrimPrefix(line, prefix), nil
+}
+
+func (s *wialonSession) close() {
+	if s.conn != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+		s.reader = nil
+	}
+}
+
+func encodeWialonBlackBox(records []teltonika.Data) []byte {
+	sb := strings.Builder{}
+	for _, record := range records {
+		sb.WriteString(encodeWialonRecord(&record))
+		sb.WriteByte('|')
+	}
+	body := sb.String()
+	return []byte("#B#" + body + wialonCrc(body) + "\r\n")
+}
+
+func encodeWialonRecord(record *teltonika.Data) string {
+	ts := time.UnixMilli(int64(record.TimestampMs)).UTC()
+	fields := []string{ts.Format("020106"), ts.Format("150405")}
+
+	if record.Satellites == 0 && record.Lat == 0 && record.Lng == 0 {
+		fields = append(fields, "NA", "NA", "NA", "NA", "NA", "NA", "NA", "NA")
+	} else {
+		lat, latHemisphere := wialonCoordinate(record.Lat, 2), "N"
+		if record.Lat < 0 {
+			latHemisphere = "S"
+		}
+		lng, lngHemisphere := wialonCoordinate(record.Lng, 3), "E"
+		if record.Lng < 0 {
+			lngHemisphere = "W"
+		}
+		fields = append(fields,
+			lat, latHemisphere, lng, lngHemisphere,
+			strconv.Itoa(int(record.Speed)),
+			strconv.Itoa(int(record.Angle)),
+			strconv.Itoa(int(record.Altitude)),
+			strconv.Itoa(int(record.Satellites)),
+		)
+	}
+
+	// hdop, inputs, outputs, adc, ibutton
+	fields = append(fields, "NA", "NA", "NA", "", "NA")
+
+	params := []string{
+		"priority:1:" + strconv.Itoa(int(record.Priority)),
+		"event_io:1:" + strconv.Itoa(int(record.EventID)),
+	}
+	for _, el := range record.Elements {
+		name := "io_" + strconv.Itoa(int(el.Id))
+		if v, ok := ioElementUint(el.Value); ok {
+			params = append(params, name+":1:"+strconv.FormatUint(v, 10))
+		} else {
+			params = append(params, name+":3:"+hex.EncodeToString(el.Value))
+		}
+	}
+	fields = append(fields, strings.Join(params, ","))
+
+	return strings.Join(fields, ";")
+}
+
+func wialonCoordinate(value float64, degreeDigits int) string {
+	value = math.Abs(value)
+	degrees := math.Floor(value)
+	minutes := (value - degrees) * 60
+	return fmt.Sprintf("%0*d%07.4f", degreeDigits, int(degrees), minutes)
+}
+
+func wialonCrc(body string) string {
+	return fmt.Sprintf("%X", crc16([]byte(body)))
+}
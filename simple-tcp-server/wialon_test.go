@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncodeWialonRecord(t *testing.T) {
+	tests := []struct {
+		name   string
+		record teltonika.Data
+		want   string
+	}{
+		{
+			name: "north east",
+			record: teltonika.Data{TimestampMs: 1700000000000, Lat: 54.6872, Lng: 25.2797, Altitude: 120, Angle: 90,
+				Speed: 50, Satellites: 9, Priority: 1, Elements: []teltonika.IOElement{{Id: 239, Value: []byte{1}}}},
+			want: "141123;221320;5441.2320;N;02516.7820;E;50;90;120;9;NA;NA;NA;;NA;priority:1:1,event_io:1:0,io_239:1:1",
+		},
+		{
+			name: "south west",
+			record: teltonika.Data{TimestampMs: 1700000000000, Lat: -33.8688, Lng: -70.5, Altitude: -5,
+				Satellites: 4, EventID: 240},
+			want: "141123;221320;3352.1280;S;07030.0000;W;0;0;-5;4;NA;NA;NA;;NA;priority:1:0,event_io:1:240",
+		},
+		{
+			name:   "no fix",
+			record: teltonika.Data{TimestampMs: 1700000000000},
+			want:   "141123;221320;NA;NA;NA;NA;NA;NA;NA;NA;NA;NA;NA;;NA;priority:1:0,event_io:1:0",
+		},
+		{
+			name: "variable size element",
+			record: teltonika.Data{TimestampMs: 1700000000000, Elements: []teltonika.IOElement{
+				{Id: 66, Value: []byte{0x2e, 0xe0}},
+				{Id: 385, Value: []byte{1, 2, 3, 4, 5, 6, 7, 8, 9}},
+			}},
+			want: "141123;221320;NA;NA;NA;NA;NA;NA;NA;NA;NA;NA;NA;;NA;priority:1:0,event_io:1:0,io_66:1:12000," +
+				"io_385:3:010203040506070809",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := encodeWialonRecord(&tt.record); got != tt.want {
+				t.Errorf("encodeWialonRecord() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWialonCrc(t *testing.T) {
+	tests := []struct {
+		body string
+		want string
+	}{
+		{"", "0"},
+		// check value of CRC-16/ARC
+		{"123456789", "BB3D"},
+	}
+	for _, tt := range tests {
+		if got := wialonCrc(tt.body); got != tt.want {
+			t.Errorf("wialonCrc(%q) = %s, want %s", tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeWialonBlackBox(t *testing.T) {
+	records := []teltonika.Data{{TimestampMs: 1700000000000}, {TimestampMs: 1700000001000}}
+	msg := string(encodeWialonBlackBox(records))
+	if !strings.HasPrefix(msg, "#B#") || !strings.HasSuffix(msg, "\r\n") {
+		t.Fatalf("framing of %q", msg)
+	}
+	body := strings.TrimSuffix(strings.TrimPrefix(msg, "#B#"), "\r\n")
+	split := strings.LastIndexByte(body, '|') + 1
+	if crc := wialonCrc(body[:split]); body[split:] != crc {
+		t.Errorf("crc %s, want %s", body[split:], crc)
+	}
+	if n := strings.Count(body[:split], "|"); n != len(records) {
+		t.Errorf("%d records, want %d", n, len(records))
+	}
+}
+
+// wialonServer accepts the sessions and acks the logins and the black boxes, the received lines go to lines
+func wialonServer(t *testing.T) (string, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	lines := make(chan string, 100)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						lines <- "closed"
+						return
+					}
+					lines <- strings.TrimSpace(line)
+					if strings.HasPrefix(line, "#L#") {
+						_, _ = conn.Write([]byte("#AL#1\r\n"))
+					} else {
+						_, _ = conn.Write([]byte("#AB#1\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), lines
+}
+
+func expectLine(t *testing.T, lines chan string, prefix string) {
+	t.Helper()
+	select {
+	case line := <-lines:
+		if !strings.HasPrefix(line, prefix) {
+			t.Fatalf("received %q, want %s...", line, prefix)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("nothing received, want %s...", prefix)
+	}
+}
+
+func TestWialonSessionExpires(t *testing.T) {
+	address, lines := wialonServer(t)
+	w := NewWialonRetranslator(address, "NA", testLogger())
+	w.idleTimeout = time.Millisecond * 50
+
+	pkt := &AnnotatedPacket{Packet: &teltonika.Packet{Data: []teltonika.Data{{TimestampMs: 1700000000000}}}}
+	if err := w.Send("352093081452251", pkt); err != nil {
+		t.Fatal(err)
+	}
+	expectLine(t, lines, "#L#2.0;352093081452251;NA;")
+	expectLine(t, lines, "#B#")
+	expectLine(t, lines, "closed")
+	deadline := time.Now().Add(time.Second * 5)
+	for w.Sessions() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle session not removed")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// a new session logs in again
+	if err := w.Send("352093081452251", pkt); err != nil {
+		t.Fatal(err)
+	}
+	expectLine(t, lines, "#L#")
+}
+
+type testDeadLetters chan *DeadLetter
+
+func (q testDeadLetters) Put(letter *DeadLetter) error {
+	q <- letter
+	return nil
+}
+
+func TestWialonDeadLetterAfterAttempts(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	_ = listener.Close()
+
+	letters := make(testDeadLetters, 1)
+	w := NewWialonRetranslator(address, "NA", testLogger())
+	w.maxAttempts, w.retryInterval, w.DeadLetters = 3, time.Millisecond, letters
+	pkt := &AnnotatedPacket{Packet: &teltonika.Packet{Data: []teltonika.Data{{TimestampMs: 1700000000000}}}}
+	if err = w.Send("352093081452251", pkt); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case letter := <-letters:
+		if letter.Attempts != 3 || letter.Imei != "352093081452251" || !strings.HasPrefix(string(letter.Bytes()), "#B#") {
+			t.Errorf("dead letter %+v", letter)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("no dead letter")
+	}
+}
@@ -168,6 +168,7 @@ func buildJsonPacket(imei string, pkt *teltonika.Packet) []byte {
 	return jsonValue
 }
 
+// hookSend is a single best-effort post, the tcp server (-udp) delivers udp packets with retries and dead letters
 func hookSend(outHook string, imei string, pkt *teltonika.Packet, logger *Logger) {
 	jsonValue := buildJsonPacket(imei, pkt)
 	if jsonValue == nil {
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Logger struct {
+	Info  *log.Logger
+	Error *log.Logger
+}
+
+// BenchConfig: each of the Connections sends Rate packets of Records records a second and waits for the ack,
+// the connections are opened over RampUp and the benchmark runs for Duration after the ramp up
+type BenchConfig struct {
+	Address     string
+	Connections int
+	Rate        float64
+	Records     int
+	Codec       teltonika.CodecId
+	Duration    time.Duration
+	RampUp      time.Duration
+	Timeout     time.Duration
+	FirstImei   uint64
+}
+
+// Recorder collects the latencies and the errors of the connections
+type Recorder struct {
+	mu          sync.Mutex
+	ack         []time.Duration
+	login       []time.Duration
+	errors      map[string]int64
+	sent        int64
+	acked       int64
+	connections int64
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{errors: make(map[string]int64)}
+}
+
+func (r *Recorder) Error(kind string) {
+	r.mu.Lock()
+	r.errors[kind]++
+	r.mu.Unlock()
+}
+
+func (r *Recorder) Login(latency time.Duration) {
+	r.mu.Lock()
+	r.login = append(r.login, latency)
+	r.mu.Unlock()
+}
+
+func (r *Recorder) Ack(latencies []time.Duration) {
+	r.mu.Lock()
+	r.ack = append(r.ack, latencies...)
+	r.mu.Unlock()
+}
+
+// Latency is a latency summary in milliseconds
+type Latency struct {
+	Count int64   `json:"count"`
+	Min   float64 `json:"min"`
+	Mean  float64 `json:"mean"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P95   float64 `json:"p95"`
+	P99   float64 `json:"p99"`
+	P999  float64 `json:"p999"`
+	Max   float64 `json:"max"`
+}
+
+type Report struct {
+	Address        string           `json:"address"`
+	Connections    int              `json:"connections"`
+	Rate           float64          `json:"rate"`
+	Records        int              `json:"records"`
+	Duration       float64          `json:"duration"`
+	Sent           int64            `json:"sent"`
+	Acked          int64            `json:"acked"`
+	PacketsPerSec  float64          `json:"packetsPerSec"`
+	RecordsPerSec  float64          `json:"recordsPerSec"`
+	ErrorRate      float64          `json:"errorRate"`
+	Errors         map[string]int64 `json:"errors"`
+	AckLatency     *Latency         `json:"ackLatency"`
+	LoginLatency   *Latency         `json:"loginLatency"`
+	MaxConnections int64            `json:"maxConnections"`
+}
+
+func summarize(samples []time.Duration) *Latency {
+	if len(samples) == 0 {
+		return &Latency{}
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	ms := func(d time.Duration) float64 { return math.Round(float64(d)/float64(time.Microsecond)) / 1000 }
+	percentile := func(p float64) float64 {
+		return ms(samples[int(math.Ceil(p*float64(len(samples))))-1])
+	}
+	var sum time.Duration
+	for _, s := range samples {
+		sum += s
+	}
+	return &Latency{
+		Count: int64(len(samples)),
+		Min:   ms(samples[0]),
+		Mean:  ms(sum / time.Duration(len(samples))),
+		P50:   percentile(0.50),
+		P90:   percentile(0.90),
+		P95:   percentile(0.95),
+		P99:   percentile(0.99),
+		P999:  percentile(0.999),
+		Max:   ms(samples[len(samples)-1]),
+	}
+}
+
+func (r *Recorder) Report(config *BenchConfig, maxConnections int64, elapsed time.Duration) *Report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	report := &Report{
+		Address:        config.Address,
+		Connections:    config.Connections,
+		Rate:           config.Rate,
+		Records:        config.Records,
+		Duration:       elapsed.Seconds(),
+		Sent:           atomic.LoadInt64(&r.sent),
+		Acked:          atomic.LoadInt64(&r.acked),
+		Errors:         r.errors,
+		AckLatency:     summarize(r.ack),
+		LoginLatency:   summarize(r.login),
+		MaxConnections: maxConnections,
+	}
+	report.PacketsPerSec = float64(report.Acked) / elapsed.Seconds()
+	report.RecordsPerSec = report.PacketsPerSec * float64(config.Records)
+	var errorCount int64
+	for _, n := range r.errors {
+		errorCount += n
+	}
+	if report.Sent+errorCount > 0 {
+		report.ErrorRate = float64(errorCount) / float64(report.Sent+errorCount)
+	}
+	return report
+}
+
+func (report *Report) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "target:        %s\n", report.Address)
+	fmt.Fprintf(w, "load:          %d connections x %g packets/s x %d records\n",
+		report.Connections, report.Rate, report.Records)
+	fmt.Fprintf(w, "duration:      %.1fs (max %d connections open)\n", report.Duration, report.MaxConnections)
+	fmt.Fprintf(w, "packets:       %d sent, %d acked\n", report.Sent, report.Acked)
+	fmt.Fprintf(w, "throughput:    %.1f packets/s, %.1f records/s\n", report.PacketsPerSec, report.RecordsPerSec)
+	fmt.Fprintf(w, "error rate:    %.3f%%\n", report.ErrorRate*100)
+	kinds := make([]string, 0, len(report.Errors))
+	for kind := range report.Errors {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Fprintf(w, "  %-12s %d\n", kind+":", report.Errors[kind])
+	}
+	for _, l := range []struct {
+		name    string
+		latency *Latency
+	}{{"ack latency", report.AckLatency}, {"login latency", report.LoginLatency}} {
+		fmt.Fprintf(w, "%-14s n=%d min=%.3fms mean=%.3fms p50=%.3fms p90=%.3fms p95=%.3fms p99=%.3fms p99.9=%.3fms max=%.3fms\n",
+			l.name+":", l.latency.Count, l.latency.Min, l.latency.Mean, l.latency.P50, l.latency.P90, l.latency.P95,
+			l.latency.P99, l.latency.P999, l.latency.Max)
+	}
+}
+
+// connection keeps one device connection streaming until the deadline, reconnecting after errors
+func connection(imei string, config *BenchConfig, recorder *Recorder, deadline time.Time, logger *Logger) {
+	interval := time.Duration(float64(time.Second) / config.Rate)
+	for time.Now().Before(deadline) {
+		err := session(imei, config, recorder, interval, deadline)
+		if err == nil {
+			return
+		}
+		logger.Error.Printf("[%s]: %v", imei, err)
+		time.Sleep(time.Second)
+	}
+}
+
+type benchError struct {
+	kind string
+	err  error
+}
+
+func (e *benchError) Error() string {
+	return e.kind + " error (" + e.err.Error() + ")"
+}
+
+func session(imei string, config *BenchConfig, recorder *Recorder, interval time.Duration, deadline time.Time) (err error) {
+	defer func() {
+		var be *benchError
+		if errors.As(err, &be) {
+			recorder.Error(be.kind)
+		}
+	}()
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", config.Address, config.Timeout)
+	if err != nil {
+		return &benchError{"dial", err}
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	login := make([]byte, 2+len(imei))
+	binary.BigEndian.PutUint16(login, uint16(len(imei)))
+	copy(login[2:], imei)
+	_ = conn.SetDeadline(time.Now().Add(config.Timeout))
+	if _, err = conn.Write(login); err != nil {
+		return &benchError{"login", err}
+	}
+	reader := bufio.NewReader(conn)
+	ack, err := reader.ReadByte()
+	if err != nil {
+		return &benchError{"login", err}
+	}
+	if ack != 1 {
+		return &benchError{"rejected", errors.New("login rejected")}
+	}
+	recorder.Login(time.Since(start))
+	atomic.AddInt64(&recorder.connections, 1)
+	defer atomic.AddInt64(&recorder.connections, -1)
+
+	// the latencies are buffered per connection and flushed to the recorder at the end of the session
+	latencies := make([]time.Duration, 0, 1024)
+	defer func() {
+		recorder.Ack(latencies)
+	}()
+	counts := make([]byte, 4)
+	// the first packet of each connection is delayed randomly so the connections don't send in bursts
+	next := time.Now().Add(time.Duration(uint64(time.Now().UnixNano()) % uint64(interval)))
+	for {
+		time.Sleep(time.Until(next))
+		if !time.Now().Before(deadline) {
+			return nil
+		}
+		next = next.Add(interval)
+		buf, err := teltonika.EncodePacket(&teltonika.Packet{CodecID: config.Codec, Data: records(config.Records)})
+		if err != nil {
+			return err
+		}
+		sent := time.Now()
+		_ = conn.SetDeadline(sent.Add(config.Timeout))
+		if _, err = conn.Write(buf); err != nil {
+			return &benchError{"write", err}
+		}
+		atomic.AddInt64(&recorder.sent, 1)
+		if _, err = io.ReadFull(reader, counts); err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return &benchError{"timeout", err}
+			}
+			return &benchError{"read", err}
+		}
+		latencies = append(latencies, time.Since(sent))
+		if n := binary.BigEndian.Uint32(counts); n != uint32(config.Records) {
+			return &benchError{"ack", fmt.Errorf("ack %d, expected %d", n, config.Records)}
+		}
+		atomic.AddInt64(&recorder.acked, 1)
+	}
+}
+
+func records(n int) []teltonika.Data {
+	now := uint64(time.Now().UnixMilli())
+	data := make([]teltonika.Data, n)
+	for i := range data {
+		data[i] = teltonika.Data{
+			TimestampMs: now - uint64(n-1-i)*1000,
+			Lat:         54.6872,
+			Lng:         25.2797,
+			Altitude:    120,
+			Satellites:  10,
+			Speed:       50,
+			Elements: []teltonika.IOElement{
+				{Id: 239, Value: []byte{1}},
+				{Id: 66, Value: []byte{0x30, 0xD4}},
+			},
+		}
+	}
+	return data
+}
+
+func main() {
+	config := &BenchConfig{}
+	var codec string
+	var firstImei string
+	var format string
+	var output string
+	flag.StringVar(&config.Address, "address", "127.0.0.1:8080", "server address")
+	flag.IntVar(&config.Connections, "connections", 1000, "number of device connections")
+	flag.Float64Var(&config.Rate, "rate", 1, "packets per second of a connection")
+	flag.IntVar(&config.Records, "records", 1, "records per packet")
+	flag.StringVar(&codec, "codec", "8e", "codec of the records: 8 or 8e")
+	flag.DurationVar(&config.Duration, "duration", time.Minute, "benchmark duration after the ramp up")
+	flag.DurationVar(&config.RampUp, "ramp-up", time.Second*10, "time to open the connections")
+	flag.DurationVar(&config.Timeout, "timeout", time.Second*10, "connect and ack timeout")
+	flag.StringVar(&firstImei, "imei", "350000000000000", "imei of the first connection, the next connections count up")
+	flag.StringVar(&format, "format", "text", "report format: text or json")
+	flag.StringVar(&output, "out", "", "write the report to this file (stdout if empty)")
+	flag.Parse()
+
+	logger := &Logger{
+		Info:  log.New(os.Stderr, "INFO: ", log.Ldate|log.Ltime),
+		Error: log.New(os.Stderr, "ERROR: ", log.Ldate|log.Ltime),
+	}
+
+	switch strings.ToLower(codec) {
+	case "8":
+		config.Codec = teltonika.Codec8
+	case "8e":
+		config.Codec = teltonika.Codec8E
+	default:
+		logger.Error.Fatalf("unknown codec '%s'", codec)
+	}
+	if format != "text" && format != "json" {
+		logger.Error.Fatalf("unknown format '%s'", format)
+	}
+	if config.Records < 1 || config.Records > 255 || config.Rate <= 0 || config.Connections < 1 {
+		logger.Error.Fatalf("connections and rate must be positive, records between 1 and 255")
+	}
+	var err error
+	if config.FirstImei, err = strconv.ParseUint(firstImei, 10, 64); err != nil || len(firstImei) != 15 {
+		logger.Error.Fatalf("invalid imei '%s'", firstImei)
+	}
+
+	recorder := NewRecorder()
+	start := time.Now()
+	deadline := start.Add(config.RampUp + config.Duration)
+	var wg sync.WaitGroup
+	for i := 0; i < config.Connections; i++ {
+		wg.Add(1)
+		imei := fmt.Sprintf("%015d", config.FirstImei+uint64(i))
+		delay := config.RampUp * time.Duration(i) / time.Duration(config.Connections)
+		time.AfterFunc(delay, func() {
+			defer wg.Done()
+			connection(imei, config, recorder, deadline, logger)
+		})
+	}
+
+	var maxConnections int64
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for running := true; running; {
+		select {
+		case <-ticker.C:
+			open := atomic.LoadInt64(&recorder.connections)
+			if open > maxConnections {
+				maxConnections = open
+			}
+			if elapsed := time.Since(start); elapsed.Round(time.Second)%(time.Second*10) == 0 {
+				logger.Info.Printf("%s: %d connections, %d packets sent, %d acked", elapsed.Round(time.Second),
+					open, atomic.LoadInt64(&recorder.sent), atomic.LoadInt64(&recorder.acked))
+			}
+		case <-done:
+			running = false
+		}
+	}
+
+	// the throughput is measured over the whole run, ramp up included
+	report := recorder.Report(config, maxConnections, time.Since(start))
+	w := io.Writer(os.Stdout)
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			logger.Error.Fatalf("report file error (%v)", err)
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		w = f
+	}
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err = encoder.Encode(report); err != nil {
+			logger.Error.Fatalf("report write error (%v)", err)
+		}
+		return
+	}
+	report.WriteText(w)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// benchConfigs are the decoder configurations compared by the benchmarks: the IO element values copied to the
+// heap or referenced from the read buffer (the buffer must outlive the packet then). The library has no lazy IO
+// element decoding, referencing the values from the read buffer is the closest: nothing is copied until the
+// consumer copies it
+var benchConfigs = []struct {
+	name   string
+	config *teltonika.DecodeConfig
+}{
+	{"copy", &teltonika.DecodeConfig{IoElementsAlloc: teltonika.OnHeap}},
+	{"readbuffer", &teltonika.DecodeConfig{IoElementsAlloc: teltonika.OnReadBuffer}},
+}
+
+var benchCodecs = []teltonika.CodecId{teltonika.Codec8, teltonika.Codec8E, teltonika.Codec16}
+
+// benchPacket builds a packet of records typical records (a dozen IO elements), always the same for a codec
+func benchPacket(b *testing.B, codec teltonika.CodecId, records int) (*teltonika.Packet, []byte) {
+	rnd := rand.New(rand.NewSource(1))
+	packet := &teltonika.Packet{CodecID: codec}
+	for i := 0; i < records; i++ {
+		record := randomRecord(rnd, codec)
+		if len(record.Elements) > 12 {
+			record.Elements = record.Elements[:12]
+		}
+		packet.Data = append(packet.Data, record)
+	}
+	encoded, err := teltonika.EncodePacket(packet)
+	if err != nil {
+		b.Fatalf("%s packet encode error (%v)", codecLabel(byte(codec)), err)
+	}
+	return packet, encoded
+}
+
+// benchCases runs fn for the single record, 10 record (typical) and 50 record packets of every codec
+func benchCases(b *testing.B, fn func(b *testing.B, packet *teltonika.Packet, encoded []byte)) {
+	for _, codec := range benchCodecs {
+		for _, records := range []int{1, 10, 50} {
+			b.Run(fmt.Sprintf("codec%x/%d", byte(codec), records), func(b *testing.B) {
+				packet, encoded := benchPacket(b, codec, records)
+				fn(b, packet, encoded)
+			})
+		}
+	}
+}
+
+func BenchmarkDecodeTCPFromSlice(b *testing.B) {
+	benchCases(b, func(b *testing.B, _ *teltonika.Packet, encoded []byte) {
+		for _, bc := range benchConfigs {
+			b.Run(bc.name, func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(int64(len(encoded)))
+				for i := 0; i < b.N; i++ {
+					if _, _, err := teltonika.DecodeTCPFromSlice(encoded, bc.config); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	})
+}
+
+// BenchmarkDecodeTCPFromReaderBuf is the decoding of the tcp server, from the connection with a reused read buffer
+func BenchmarkDecodeTCPFromReaderBuf(b *testing.B) {
+	benchCases(b, func(b *testing.B, _ *teltonika.Packet, encoded []byte) {
+		for _, bc := range benchConfigs {
+			b.Run(bc.name, func(b *testing.B) {
+				// the buffer of the server, or the packet size for the 50 record packets
+				buf := make([]byte, 1300)
+				if len(encoded) > len(buf) {
+					buf = make([]byte, len(encoded))
+				}
+				r := bytes.NewReader(encoded)
+				b.ReportAllocs()
+				b.SetBytes(int64(len(encoded)))
+				for i := 0; i < b.N; i++ {
+					r.Reset(encoded)
+					if _, _, err := teltonika.DecodeTCPFromReaderBuf(r, buf, bc.config); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	})
+}
+
+func BenchmarkEncodePacket(b *testing.B) {
+	benchCases(b, func(b *testing.B, packet *teltonika.Packet, encoded []byte) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(encoded)))
+		for i := 0; i < b.N; i++ {
+			if _, err := teltonika.EncodePacket(packet); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// explainer walks the fields of a packet and prints each of them with its offset, raw bytes and meaning,
+// the walk stops at the first field that doesn't fit in the packet
+type explainer struct {
+	w      io.Writer
+	bs     []byte
+	off    int
+	indent string
+	failed bool
+}
+
+// field reads n bytes, interpret is the meaning of the bytes (optional)
+func (e *explainer) field(n int, name string, interpret func(b []byte) string) []byte {
+	if e.failed {
+		return nil
+	}
+	if n < 0 || e.off+n > len(e.bs) {
+		e.failed = true
+		fmt.Fprintf(e.w, "%06d  %-24s  %s%s: truncated, need %d bytes, %d left\n", e.off,
+			hexPreview(e.bs[e.off:]), e.indent, name, n, len(e.bs)-e.off)
+		return nil
+	}
+	b := e.bs[e.off : e.off+n]
+	line := fmt.Sprintf("%06d  %-24s  %s%s", e.off, hexPreview(b), e.indent, name)
+	if interpret != nil {
+		line += ": " + interpret(b)
+	}
+	fmt.Fprintln(e.w, line)
+	e.off += n
+	return b
+}
+
+func (e *explainer) uint(n int, name string) (uint64, bool) {
+	b := e.field(n, name, func(b []byte) string { return fmt.Sprint(beUint(b)) })
+	if b == nil {
+		return 0, false
+	}
+	return beUint(b), true
+}
+
+func (e *explainer) section(name string) {
+	if !e.failed {
+		fmt.Fprintf(e.w, "%6s  %-24s  %s%s\n", "", "", e.indent, name)
+	}
+}
+
+func (e *explainer) note(format string, args ...interface{}) {
+	fmt.Fprintf(e.w, "%6s  %-24s  %s%s\n", "", "", e.indent, fmt.Sprintf(format, args...))
+}
+
+func beUint(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+func hexPreview(b []byte) string {
+	if len(b) > 11 {
+		return hex.EncodeToString(b[:9]) + fmt.Sprintf("..+%d", len(b)-9)
+	}
+	return hex.EncodeToString(b)
+}
+
+func explainTimestamp(b []byte) string {
+	return time.UnixMilli(int64(beUint(b))).UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+func explainCoordinate(b []byte) string {
+	return fmt.Sprintf("%.7f", float64(int32(binary.BigEndian.Uint32(b)))/1e7)
+}
+
+func explainSigned(b []byte) string {
+	return fmt.Sprint(int16(binary.BigEndian.Uint16(b)))
+}
+
+func explainText(b []byte) string {
+	return fmt.Sprintf("%q", string(b))
+}
+
+// explainPacket prints the fields of a tcp, udp or imei login packet
+func explainPacket(w io.Writer, bs []byte) {
+	e := &explainer{w: w, bs: bs}
+	if _, ok := decodeImei(bs); ok {
+		e.uint(2, "imei length")
+		e.field(len(bs)-2, "imei", explainText)
+		return
+	}
+	if len(bs) >= 4 && binary.BigEndian.Uint32(bs[:4]) == 0 {
+		e.field(4, "preamble", nil)
+		length, _ := e.uint(4, "data length")
+		start := e.off
+		explainData(e)
+		if !e.failed && e.off-start != int(length) {
+			e.note("data length %d, the data is %d bytes", length, e.off-start)
+		}
+		if crc := e.field(4, "crc", nil); crc != nil {
+			actual := crc16(bs[start:minInt(start+int(length), len(bs)-4)])
+			if uint16(beUint(crc)) == actual {
+				e.note("crc %04x ok", actual)
+			} else {
+				e.note("crc %04x invalid, computed %04x", uint16(beUint(crc)), actual)
+			}
+		}
+		explainTrailing(e)
+		return
+	}
+	e.uint(2, "length")
+	e.uint(2, "packet id")
+	e.field(1, "not usable byte", nil)
+	e.uint(1, "avl packet id")
+	imeiLength, _ := e.uint(2, "imei length")
+	e.field(int(imeiLength), "imei", explainText)
+	explainData(e)
+	explainTrailing(e)
+}
+
+func explainTrailing(e *explainer) {
+	if !e.failed && e.off < len(e.bs) {
+		e.field(len(e.bs)-e.off, "unexpected trailing bytes", nil)
+	}
+}
+
+// explainData prints the codec id, the records or messages of the codec and the numbers of data
+func explainData(e *explainer) {
+	id := e.field(1, "codec id", func(b []byte) string { return codecLabel(b[0]) })
+	if id == nil {
+		return
+	}
+	count, ok := e.uint(1, "number of data 1")
+	if !ok {
+		return
+	}
+	for i := uint64(0); i < count && !e.failed; i++ {
+		switch id[0] {
+		case 0x08, 0x8E, 0x10:
+			e.section(fmt.Sprintf("record %d", i+1))
+			e.indent = "  "
+			explainRecord(e, id[0])
+		case 0x0C, 0x0D, 0x0E, 0x0F:
+			e.section(fmt.Sprintf("message %d", i+1))
+			e.indent = "  "
+			explainMessage(e, id[0])
+		default:
+			e.note("unknown codec, the data is not explained")
+			e.failed = true
+		}
+		e.indent = ""
+	}
+	if count2, ok := e.uint(1, "number of data 2"); ok && count2 != count {
+		e.note("number of data 1 is %d, number of data 2 is %d", count, count2)
+	}
+}
+
+func explainRecord(e *explainer, codec byte) {
+	e.field(8, "timestamp", explainTimestamp)
+	e.uint(1, "priority")
+	e.field(4, "longitude", explainCoordinate)
+	e.field(4, "latitude", explainCoordinate)
+	e.field(2, "altitude", explainSigned)
+	e.uint(2, "angle")
+	e.uint(1, "satellites")
+	e.uint(2, "speed")
+
+	// codec 8: 1 byte ids and counts, codec 8E: 2 byte ids and counts, codec 16: 2 byte ids, 1 byte counts
+	idSize, countSize := 1, 1
+	switch codec {
+	case 0x8E:
+		idSize, countSize = 2, 2
+	case 0x10:
+		idSize = 2
+	}
+	e.uint(idSize, "event io id")
+	if codec == 0x10 {
+		e.uint(1, "generation type")
+	}
+	total, _ := e.uint(countSize, "total io count")
+	var found uint64
+	for _, size := range []int{1, 2, 4, 8} {
+		n, ok := e.uint(countSize, fmt.Sprintf("%d byte io count", size))
+		if !ok {
+			return
+		}
+		for j := uint64(0); j < n && !e.failed; j++ {
+			id, _ := e.uint(idSize, "  io id")
+			e.field(size, fmt.Sprintf("  io %d value", id), func(b []byte) string { return fmt.Sprint(beUint(b)) })
+		}
+		found += n
+	}
+	if codec == 0x8E {
+		n, ok := e.uint(2, "variable size io count")
+		if !ok {
+			return
+		}
+		for j := uint64(0); j < n && !e.failed; j++ {
+			id, _ := e.uint(2, "  io id")
+			length, _ := e.uint(2, fmt.Sprintf("  io %d length", id))
+			e.field(int(length), fmt.Sprintf("  io %d value", id), nil)
+		}
+		found += n
+	}
+	if !e.failed && found != total {
+		e.note("total io count %d, found %d", total, found)
+	}
+}
+
+func explainMessage(e *explainer, codec byte) {
+	e.field(1, "type", func(b []byte) string {
+		switch b[0] {
+		case 0x05:
+			return "command"
+		case 0x06:
+			return "response"
+		case 0x11:
+			return "imei mismatch (nack)"
+		}
+		return "unknown"
+	})
+	size, ok := e.uint(4, "size")
+	if !ok {
+		return
+	}
+	rest := int(size)
+	if codec == 0x0D || codec == 0x0F {
+		e.field(4, "timestamp", func(b []byte) string {
+			return time.Unix(int64(beUint(b)), 0).UTC().Format(time.RFC3339)
+		})
+		rest -= 4
+	}
+	if codec == 0x0E || codec == 0x0F {
+		e.field(8, "imei", func(b []byte) string { return strings.TrimLeft(hex.EncodeToString(b), "0") })
+		rest -= 8
+	}
+	e.field(rest, "text", explainText)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
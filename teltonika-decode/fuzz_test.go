@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// allocations of a decode above allocLimitBase + allocLimitFactor * input size break the bounded allocation invariant
+const (
+	allocLimitBase   = 64
+	allocLimitFactor = 1
+)
+
+type fixture struct {
+	name string
+	data []byte
+}
+
+// readFixtures reads the fixture corpus of testdata, <name>.hex files of one hex packet
+func readFixtures(tb testing.TB) []fixture {
+	paths, err := filepath.Glob(filepath.Join("testdata", "*.hex"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if len(paths) == 0 {
+		tb.Fatal("no fixtures in testdata")
+	}
+	fixtures := make([]fixture, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		bs, err := parseHex(string(data))
+		if err != nil {
+			tb.Fatalf("%s: hex decode error (%v)", path, err)
+		}
+		fixtures = append(fixtures, fixture{strings.TrimSuffix(filepath.Base(path), ".hex"), bs})
+	}
+	return fixtures
+}
+
+// checkAllocs fails if run allocates more than the bounded allocation invariant allows for the input
+func checkAllocs(t *testing.T, input []byte, run func(bs []byte)) {
+	allocs := testing.AllocsPerRun(1, func() {
+		run(append([]byte(nil), input...))
+	})
+	// the copy of the input is one allocation
+	if limit := float64(allocLimitBase + allocLimitFactor*len(input) + 1); allocs > limit {
+		t.Fatalf("%.0f allocations for a %d bytes input, limit %.0f", allocs, len(input), limit)
+	}
+}
+
+// FuzzDecodeTCP fuzzes DecodeTCPFromSlice, with fixCrc the input gets a valid length and CRC to reach the codecs
+// (most mutations break the CRC). A decoded packet must encode, decode and encode again to the same bytes
+func FuzzDecodeTCP(f *testing.F) {
+	for _, fx := range readFixtures(f) {
+		f.Add(fx.data, false)
+	}
+	f.Fuzz(func(t *testing.T, input []byte, fixCrc bool) {
+		if fixCrc && len(input) >= 13 && binary.BigEndian.Uint32(input[:4]) == 0 {
+			binary.BigEndian.PutUint32(input[4:8], uint32(len(input)-12))
+			binary.BigEndian.PutUint32(input[len(input)-4:], uint32(crc16(input[8:len(input)-4])))
+		}
+		checkAllocs(t, input, func(bs []byte) {
+			_, _, _ = teltonika.DecodeTCPFromSlice(bs, decodeConfig)
+		})
+		if err := checkRoundTrip(append([]byte(nil), input...)); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func FuzzDecodeUDP(f *testing.F) {
+	for _, fx := range readFixtures(f) {
+		f.Add(fx.data)
+	}
+	f.Fuzz(func(t *testing.T, input []byte) {
+		checkAllocs(t, input, func(bs []byte) {
+			_, _, _ = teltonika.DecodeUDPFromSlice(bs, decodeConfig)
+		})
+	})
+}
+
+// FuzzDecode fuzzes the framing detection and CRC check of the tool and the annotated hexdump
+func FuzzDecode(f *testing.F) {
+	for _, fx := range readFixtures(f) {
+		f.Add(fx.data)
+	}
+	f.Fuzz(func(t *testing.T, input []byte) {
+		checkAllocs(t, input, func(bs []byte) {
+			decode("fuzz", bs)
+		})
+		explainPacket(io.Discard, input)
+	})
+}
+
+// checkRoundTrip checks the encode(decode(x)) stability of a tcp packet
+func checkRoundTrip(bs []byte) error {
+	_, packet, err := teltonika.DecodeTCPFromSlice(bs, decodeConfig)
+	if err != nil {
+		return nil
+	}
+	encoded, err := teltonika.EncodePacket(packet)
+	if err != nil {
+		// the decoder accepts packets the encoder can't build (unknown codecs), not a round trip failure
+		return nil
+	}
+	_, decoded, err := teltonika.DecodeTCPFromSlice(append([]byte(nil), encoded...), decodeConfig)
+	if err != nil {
+		return fmt.Errorf("encoded packet decode error (%v), encoded %x", err, encoded)
+	}
+	reencoded, err := teltonika.EncodePacket(decoded)
+	if err != nil {
+		return fmt.Errorf("decoded packet encode error (%v)", err)
+	}
+	if !bytes.Equal(encoded, reencoded) {
+		return fmt.Errorf("unstable encoding, %x then %x", encoded, reencoded)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// checkFixtures checks the fixture corpus of dir: each <name>.hex packet must decode (fail to decode if the name
+// starts with "malformed") and its annotated hexdump must match <name>.golden, update rewrites the golden files.
+// It returns the number of failed fixtures
+func checkFixtures(dir string, update bool, w io.Writer) (int, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.hex"))
+	if err != nil {
+		return 0, err
+	}
+	if len(paths) == 0 {
+		return 0, fmt.Errorf("no fixtures in %s", dir)
+	}
+	failed := 0
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".hex")
+		if err := checkFixture(path, name, update); err != nil {
+			failed++
+			fmt.Fprintf(w, "FAIL %s: %v\n", name, err)
+			continue
+		}
+		fmt.Fprintf(w, "ok   %s\n", name)
+	}
+	fmt.Fprintf(w, "%d fixtures, %d failed\n", len(paths), failed)
+	return failed, nil
+}
+
+func checkFixture(path string, name string, update bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	bs, err := parseHex(string(data))
+	if err != nil {
+		return fmt.Errorf("hex decode error (%v)", err)
+	}
+	res := decode(name, bs)
+	if malformed := strings.HasPrefix(name, "malformed"); malformed && res.Error == "" {
+		return fmt.Errorf("decoded, expected a decode error")
+	} else if !malformed && res.Error != "" {
+		return fmt.Errorf("decode error (%s)", res.Error)
+	}
+
+	var actual bytes.Buffer
+	explainPacket(&actual, bs)
+	goldenPath := strings.TrimSuffix(path, ".hex") + ".golden"
+	if update {
+		return os.WriteFile(goldenPath, actual.Bytes(), 0644)
+	}
+	expected, err := os.ReadFile(goldenPath)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(expected, actual.Bytes()) {
+		return nil
+	}
+	expectedLines := strings.Split(string(expected), "\n")
+	actualLines := strings.Split(actual.String(), "\n")
+	for i := 0; i < len(expectedLines) || i < len(actualLines); i++ {
+		var e, a string
+		if i < len(expectedLines) {
+			e = expectedLines[i]
+		}
+		if i < len(actualLines) {
+			a = actualLines[i]
+		}
+		if e != a {
+			return fmt.Errorf("line %d differs\n  expected: %s\n  actual:   %s", i+1, e, a)
+		}
+	}
+	return nil
+}
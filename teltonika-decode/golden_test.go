@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the expected json and golden hexdumps of the fixtures")
+
+// TestFixtures decodes every fixture of testdata with the library and compares the json of the packet with
+// <name>.json, the malformed fixtures must fail to decode. The annotated hexdump is compared with <name>.golden
+func TestFixtures(t *testing.T) {
+	for _, fx := range readFixtures(t) {
+		fx := fx
+		t.Run(fx.name, func(t *testing.T) {
+			path := filepath.Join("testdata", fx.name+".hex")
+			if err := checkFixture(path, fx.name, *update); err != nil {
+				t.Fatal(err)
+			}
+			res := decode(fx.name, fx.data)
+			if strings.HasPrefix(fx.name, "malformed") || res.Transport == "imei" {
+				return
+			}
+
+			var packet *teltonika.Packet
+			switch res.Transport {
+			case "tcp":
+				_, decoded, err := teltonika.DecodeTCPFromSlice(append([]byte(nil), fx.data...), decodeConfig)
+				if err != nil {
+					t.Fatalf("decode error (%v)", err)
+				}
+				packet = decoded
+			case "udp":
+				_, decoded, err := teltonika.DecodeUDPFromSlice(append([]byte(nil), fx.data...), decodeConfig)
+				if err != nil {
+					t.Fatalf("decode error (%v)", err)
+				}
+				packet = decoded.Packet
+			}
+			if label := codecLabel(byte(packet.CodecID)); res.Codec != label {
+				t.Errorf("detected codec %s, decoded %s", res.Codec, label)
+			}
+
+			jsonPath := filepath.Join("testdata", fx.name+".json")
+			if *update {
+				data, err := json.MarshalIndent(packet, "", "  ")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err = os.WriteFile(jsonPath, append(data, '\n'), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			data, err := json.Marshal(packet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectedJson, err := os.ReadFile(jsonPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var actual, expected interface{}
+			if err = json.Unmarshal(data, &actual); err != nil {
+				t.Fatal(err)
+			}
+			if err = json.Unmarshal(expectedJson, &expected); err != nil {
+				t.Fatalf("%s: %v", jsonPath, err)
+			}
+			if !reflect.DeepEqual(actual, expected) {
+				t.Errorf("packet json differs\n  expected: %s\n  actual:   %s", compactJson(expectedJson), data)
+			}
+		})
+	}
+}
+
+func compactJson(data []byte) string {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return string(data)
+	}
+	compact, _ := json.Marshal(v)
+	return string(compact)
+}
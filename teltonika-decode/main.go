@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var decodeConfig = &teltonika.DecodeConfig{IoElementsAlloc: teltonika.OnReadBuffer}
+
+var codecNames = map[byte]string{
+	0x08: "Codec 8",
+	0x8E: "Codec 8E",
+	0x10: "Codec 16",
+	0x0C: "Codec 12",
+	0x0D: "Codec 13",
+	0x0E: "Codec 14",
+	0x0F: "Codec 15",
+}
+
+// Decoded is the result of decoding one input, Transport is "tcp", "udp" or "imei" (the login packet)
+type Decoded struct {
+	Source    string            `json:"source"`
+	Transport string            `json:"transport"`
+	Codec     string            `json:"codec,omitempty"`
+	Crc       *Crc              `json:"crc,omitempty"`
+	Imei      string            `json:"imei,omitempty"`
+	Packet    *teltonika.Packet `json:"packet,omitempty"`
+	Error     string            `json:"error,omitempty"`
+	Raw       []byte            `json:"-"`
+}
+
+// Crc is the CRC-16/IBM of a tcp packet, Expected is the value in the packet
+type Crc struct {
+	Expected uint16 `json:"expected"`
+	Actual   uint16 `json:"actual"`
+	Valid    bool   `json:"valid"`
+}
+
+// decode detects the framing of the packet (tcp packets start with four zero bytes, the login packet is the
+// length of the ascii imei followed by the imei, udp otherwise), checks the crc and decodes it
+func decode(source string, bs []byte) *Decoded {
+	res := &Decoded{Source: source, Raw: bs}
+	if imei, ok := decodeImei(bs); ok {
+		res.Transport = "imei"
+		res.Imei = imei
+		return res
+	}
+	if len(bs) >= 12 && binary.BigEndian.Uint32(bs[:4]) == 0 {
+		res.Transport = "tcp"
+		res.Codec = codecLabel(bs[8])
+		length := int(binary.BigEndian.Uint32(bs[4:8]))
+		if len(bs) < 8+length+4 {
+			res.Error = fmt.Sprintf("packet too short, data length %d, got %d bytes", length, len(bs)-12)
+			return res
+		}
+		expected := uint16(binary.BigEndian.Uint32(bs[8+length : 8+length+4]))
+		actual := crc16(bs[8 : 8+length])
+		res.Crc = &Crc{Expected: expected, Actual: actual, Valid: expected == actual}
+		if !res.Crc.Valid {
+			res.Error = fmt.Sprintf("crc mismatch, expected %04x, computed %04x", expected, actual)
+			return res
+		}
+		_, packet, err := teltonika.DecodeTCPFromSlice(bs, decodeConfig)
+		if err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		res.Packet = packet
+		return res
+	}
+	res.Transport = "udp"
+	if len(bs) >= 8 {
+		imeiLength := int(binary.BigEndian.Uint16(bs[6:8]))
+		if len(bs) > 8+imeiLength {
+			res.Codec = codecLabel(bs[8+imeiLength])
+		}
+	}
+	_, packet, err := teltonika.DecodeUDPFromSlice(bs, decodeConfig)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.Imei = packet.Imei
+	res.Packet = packet.Packet
+	return res
+}
+
+func decodeImei(bs []byte) (string, bool) {
+	if len(bs) < 3 || int(binary.BigEndian.Uint16(bs[:2])) != len(bs)-2 {
+		return "", false
+	}
+	for _, c := range bs[2:] {
+		if c < '0' || c > '9' {
+			return "", false
+		}
+	}
+	return string(bs[2:]), true
+}
+
+func codecLabel(id byte) string {
+	if name, ok := codecNames[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown (0x%02x)", id)
+}
+
+// crc16Table holds the CRC-16/IBM of every byte value, crc16 processes a byte per lookup instead of a bit per step
+// (the same table as the tcp server). CRC-16/IBM has no hardware instruction, the CRC32 instructions Go uses are for
+// other polynomials, so the table is the fast path
+var crc16Table = makeCrc16Table()
+
+func makeCrc16Table() *[256]uint16 {
+	table := new([256]uint16)
+	for i := range table {
+		crc := uint16(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 != 0 {
+				crc = (crc >> 1) ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}
+
+// crc16 is CRC-16/IBM (polynomial 0xA001 reflected) of the tcp packet data
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc = (crc >> 8) ^ crc16Table[byte(crc)^b]
+	}
+	return crc
+}
+
+// parseHex accepts hex with spaces, colons or a 0x prefix
+func parseHex(s string) ([]byte, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "0x")
+	s = strings.NewReplacer(" ", "", ":", "", "\t", "").Replace(s)
+	return hex.DecodeString(s)
+}
+
+// readInputs reads a file as hex lines if it is hex text, as a single binary packet otherwise
+func readInputs(name string, r io.Reader) ([]input, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var inputs []input
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		bs, err := parseHex(text)
+		if err != nil {
+			return []input{{name, data}}, nil
+		}
+		inputs = append(inputs, input{fmt.Sprintf("%s:%d", name, line), bs})
+	}
+	if err := scanner.Err(); err != nil {
+		return []input{{name, data}}, nil
+	}
+	return inputs, nil
+}
+
+type input struct {
+	source string
+	data   []byte
+}
+
+func printJson(w io.Writer, res *Decoded) error {
+	data, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(data))
+	return err
+}
+
+func printHeader(w io.Writer, res *Decoded) {
+	fmt.Fprintf(w, "%s: %s", res.Source, res.Transport)
+	if res.Codec != "" {
+		fmt.Fprintf(w, ", %s", res.Codec)
+	}
+	if res.Crc != nil {
+		fmt.Fprintf(w, ", crc %04x", res.Crc.Expected)
+		if res.Crc.Valid {
+			fmt.Fprint(w, " ok")
+		} else {
+			fmt.Fprintf(w, " invalid (computed %04x)", res.Crc.Actual)
+		}
+	}
+	if res.Imei != "" {
+		fmt.Fprintf(w, ", imei %s", res.Imei)
+	}
+	fmt.Fprintln(w)
+}
+
+func printTable(w io.Writer, res *Decoded) error {
+	printHeader(w, res)
+	if res.Error != "" {
+		_, err := fmt.Fprintf(w, "  error: %s\n\n", res.Error)
+		return err
+	}
+	if res.Packet == nil {
+		_, err := fmt.Fprintln(w)
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	if len(res.Packet.Data) > 0 {
+		fmt.Fprintln(tw, "  TIME\tLAT\tLNG\tALT\tANGLE\tSATS\tSPEED\tPRIO\tEVENT\tIO")
+		for _, d := range res.Packet.Data {
+			ts := time.UnixMilli(int64(d.TimestampMs)).UTC().Format(time.RFC3339)
+			elements := make([]string, 0, len(d.Elements))
+			for _, el := range d.Elements {
+				elements = append(elements, fmt.Sprintf("%d=%s", el.Id, hex.EncodeToString(el.Value)))
+			}
+			fmt.Fprintf(tw, "  %s\t%.7f\t%.7f\t%d\t%d\t%d\t%d\t%d\t%d\t%s\n", ts, d.Lat, d.Lng, d.Altitude,
+				d.Angle, d.Satellites, d.Speed, d.Priority, d.EventID, strings.Join(elements, " "))
+		}
+	}
+	if len(res.Packet.Messages) > 0 {
+		fmt.Fprintln(tw, "  TYPE\tTEXT")
+		for _, m := range res.Packet.Messages {
+			fmt.Fprintf(tw, "  %d\t%q\n", m.Type, m.Text)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+// printExplain prints the annotated hexdump of the packet, the fields are explained up to the malformed one
+func printExplain(w io.Writer, res *Decoded) error {
+	printHeader(w, res)
+	if res.Error != "" {
+		fmt.Fprintf(w, "error: %s\n", res.Error)
+	}
+	explainPacket(w, res.Raw)
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+func main() {
+	var format string
+	var files bool
+	var check string
+	var update bool
+	flag.StringVar(&format, "format", "json", "output format: json, table or explain (annotated hexdump)")
+	flag.BoolVar(&files, "f", false, "arguments are files (hex lines or binary) instead of hex strings")
+	flag.StringVar(&check, "check", "", "check the fixture corpus of this directory against the golden files")
+	flag.BoolVar(&update, "update", false, "with -check, rewrite the golden files")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-format json|table|explain] [-f] [hex|file ...]\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "reads hex lines from stdin without arguments or with '-'")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if check != "" {
+		failed, err := checkFixtures(check, update, os.Stdout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "check error (%v)\n", err)
+			os.Exit(2)
+		}
+		if failed > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	var output func(io.Writer, *Decoded) error
+	switch format {
+	case "json":
+		output = printJson
+	case "table":
+		output = printTable
+	case "explain":
+		output = printExplain
+	default:
+		fmt.Fprintf(os.Stderr, "unknown format %q\n", format)
+		os.Exit(2)
+	}
+
+	var inputs []input
+	args := flag.Args()
+	if len(args) == 0 {
+		args = []string{"-"}
+	}
+	for i, arg := range args {
+		var err error
+		var read []input
+		switch {
+		case arg == "-":
+			read, err = readInputs("stdin", os.Stdin)
+		case files:
+			var f *os.File
+			if f, err = os.Open(arg); err == nil {
+				read, err = readInputs(arg, f)
+				_ = f.Close()
+			}
+		default:
+			var bs []byte
+			if bs, err = parseHex(arg); err == nil {
+				read = []input{{fmt.Sprintf("arg%d", i+1), bs}}
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: read error (%v)\n", arg, err)
+			os.Exit(2)
+		}
+		inputs = append(inputs, read...)
+	}
+
+	failed := false
+	for _, in := range inputs {
+		res := decode(in.source, in.data)
+		if res.Error != "" {
+			failed = true
+		}
+		if err := output(os.Stdout, res); err != nil {
+			fmt.Fprintf(os.Stderr, "write error (%v)\n", err)
+			os.Exit(2)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	roundTrips    = flag.Int("roundtrips", 1000, "random packets of every codec of TestRoundTrip")
+	roundTripSeed = flag.Int64("seed", 0, "seed of the random packets of TestRoundTrip, random if 0")
+)
+
+// roundTripCodecs are the codecs of the generated packets, the records of Codec 8, 8E and 16 have IO elements of
+// every size class (1, 2, 4, 8 bytes and variable size for Codec 8E)
+var roundTripCodecs = []teltonika.CodecId{
+	teltonika.Codec8, teltonika.Codec8E, teltonika.Codec16,
+	teltonika.Codec12, teltonika.Codec13, teltonika.Codec14,
+}
+
+// TestRoundTrip generates random valid packets of every codec, encodes, decodes and compares them, a failure is
+// reproduced with the logged -seed
+func TestRoundTrip(t *testing.T) {
+	seed := *roundTripSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	n := *roundTrips
+	if testing.Short() {
+		n /= 10
+	}
+	for _, codec := range roundTripCodecs {
+		codec := codec
+		t.Run(fmt.Sprintf("codec%x", byte(codec)), func(t *testing.T) {
+			rnd := rand.New(rand.NewSource(seed))
+			for i := 0; i < n; i++ {
+				packet := randomPacket(rnd, codec)
+				if err := checkPacketRoundTrip(packet); err != nil {
+					t.Fatalf("packet %d: %v (-seed %d)", i, err, seed)
+				}
+			}
+		})
+	}
+}
+
+func checkPacketRoundTrip(packet *teltonika.Packet) error {
+	encoded, err := teltonika.EncodePacket(packet)
+	if err != nil {
+		return fmt.Errorf("encode error (%v)", err)
+	}
+	_, decoded, err := teltonika.DecodeTCPFromSlice(append([]byte(nil), encoded...), decodeConfig)
+	if err != nil {
+		return fmt.Errorf("decode error (%v), packet %x", err, encoded)
+	}
+	if err = comparePackets(packet, decoded); err != nil {
+		return fmt.Errorf("%v, packet %x", err, encoded)
+	}
+	return nil
+}
+
+func comparePackets(expected *teltonika.Packet, actual *teltonika.Packet) error {
+	if expected.CodecID != actual.CodecID {
+		return fmt.Errorf("codec %d, expected %d", actual.CodecID, expected.CodecID)
+	}
+	if len(expected.Data) != len(actual.Data) {
+		return fmt.Errorf("%d records, expected %d", len(actual.Data), len(expected.Data))
+	}
+	for i := range expected.Data {
+		e, a := &expected.Data[i], &actual.Data[i]
+		// the coordinates are encoded as 1e-7 degrees
+		if e.TimestampMs != a.TimestampMs || e.Priority != a.Priority || math.Abs(e.Lat-a.Lat) > 1e-7 ||
+			math.Abs(e.Lng-a.Lng) > 1e-7 || e.Altitude != a.Altitude || e.Angle != a.Angle ||
+			e.Satellites != a.Satellites || e.Speed != a.Speed || e.EventID != a.EventID {
+			return fmt.Errorf("record %d is %+v, expected %+v", i, *a, *e)
+		}
+		if expected.CodecID == teltonika.Codec16 && e.GenerationType != a.GenerationType {
+			return fmt.Errorf("record %d generation type %d, expected %d", i, a.GenerationType, e.GenerationType)
+		}
+		if len(e.Elements) != len(a.Elements) {
+			return fmt.Errorf("record %d has %d IO elements, expected %d", i, len(a.Elements), len(e.Elements))
+		}
+		for j := range e.Elements {
+			if e.Elements[j].Id != a.Elements[j].Id || !bytes.Equal(e.Elements[j].Value, a.Elements[j].Value) {
+				return fmt.Errorf("record %d IO element %d is %d=%x, expected %d=%x", i, j,
+					a.Elements[j].Id, a.Elements[j].Value, e.Elements[j].Id, e.Elements[j].Value)
+			}
+		}
+	}
+	if len(expected.Messages) != len(actual.Messages) {
+		return fmt.Errorf("%d messages, expected %d", len(actual.Messages), len(expected.Messages))
+	}
+	for i := range expected.Messages {
+		e, a := &expected.Messages[i], &actual.Messages[i]
+		if e.Type != a.Type || e.Text != a.Text || e.Timestamp != a.Timestamp ||
+			strings.TrimLeft(e.Imei, "0") != strings.TrimLeft(a.Imei, "0") {
+			return fmt.Errorf("message %d is %+v, expected %+v", i, *a, *e)
+		}
+	}
+	return nil
+}
+
+func randomPacket(rnd *rand.Rand, codec teltonika.CodecId) *teltonika.Packet {
+	packet := &teltonika.Packet{CodecID: codec}
+	count := 1 + rnd.Intn(10)
+	// a few packets have the maximum number of records
+	if rnd.Intn(50) == 0 {
+		count = 255
+	}
+	switch codec {
+	case teltonika.Codec8, teltonika.Codec8E, teltonika.Codec16:
+		for i := 0; i < count; i++ {
+			packet.Data = append(packet.Data, randomRecord(rnd, codec))
+		}
+	default:
+		for i := 0; i < 1+rnd.Intn(3); i++ {
+			packet.Messages = append(packet.Messages, randomMessage(rnd, codec))
+		}
+	}
+	return packet
+}
+
+func randomRecord(rnd *rand.Rand, codec teltonika.CodecId) teltonika.Data {
+	record := teltonika.Data{
+		TimestampMs: uint64(1e12 + rnd.Int63n(1e12)),
+		Priority:    uint8(rnd.Intn(3)),
+		Lat:         float64(rnd.Int31n(180e7)-90e7) / 1e7,
+		Lng:         float64(rnd.Int63n(360e7)-180e7) / 1e7,
+		Altitude:    int16(rnd.Intn(1<<16) - 1<<15),
+		Angle:       uint16(rnd.Intn(360)),
+		Satellites:  uint8(rnd.Intn(256)),
+		Speed:       uint16(rnd.Intn(1 << 16)),
+	}
+	if rnd.Intn(10) == 0 {
+		record.Satellites = 0
+	}
+	maxId := 1 << 16
+	if codec == teltonika.Codec8 {
+		maxId = 1 << 8
+	}
+	record.EventID = uint16(rnd.Intn(maxId))
+	if codec == teltonika.Codec16 {
+		record.GenerationType = teltonika.GenerationType(rnd.Intn(8))
+	}
+
+	// the elements are generated in the encoding order, by size class
+	sizes := []int{1, 2, 4, 8}
+	if codec == teltonika.Codec8E {
+		sizes = append(sizes, -1)
+	}
+	// the total IO count of Codec 8 and 16 is one byte
+	budget := 255
+	if codec == teltonika.Codec8E {
+		budget = 1000
+	}
+	for _, size := range sizes {
+		n := rnd.Intn(6)
+		if rnd.Intn(20) == 0 {
+			n = rnd.Intn(budget + 1)
+		}
+		if n > budget {
+			n = budget
+		}
+		budget -= n
+		for j := 0; j < n; j++ {
+			valueSize := size
+			if size < 0 {
+				// the variable size values don't have a fixed size class length
+				if valueSize = rnd.Intn(64); valueSize == 1 || valueSize == 2 || valueSize == 4 || valueSize == 8 {
+					valueSize += 9
+				}
+			}
+			value := make([]byte, valueSize)
+			rnd.Read(value)
+			record.Elements = append(record.Elements, teltonika.IOElement{Id: uint16(rnd.Intn(maxId)), Value: value})
+		}
+	}
+	return record
+}
+
+func randomMessage(rnd *rand.Rand, codec teltonika.CodecId) teltonika.Message {
+	message := teltonika.Message{Type: teltonika.TypeCommand}
+	if rnd.Intn(2) == 0 {
+		message.Type = teltonika.TypeResponse
+	}
+	text := make([]byte, rnd.Intn(200))
+	for i := range text {
+		text[i] = byte(' ' + rnd.Intn(95))
+	}
+	message.Text = string(text)
+	if codec == teltonika.Codec13 {
+		message.Timestamp = rnd.Uint32()
+	}
+	if codec == teltonika.Codec14 {
+		message.Imei = fmt.Sprintf("%015d", 3e14+rnd.Int63n(1e14))
+	}
+	return message
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var decodeConfig = &teltonika.DecodeConfig{IoElementsAlloc: teltonika.OnReadBuffer}
+
+type Logger struct {
+	Info  *log.Logger
+	Error *log.Logger
+}
+
+// ExtractedPacket is a json line of the extract output
+type ExtractedPacket struct {
+	Time   time.Time         `json:"time"`
+	Flow   string            `json:"flow"`
+	Imei   string            `json:"imei"`
+	Hex    string            `json:"hex"`
+	Packet *teltonika.Packet `json:"packet,omitempty"`
+	Error  string            `json:"error,omitempty"`
+}
+
+func readCapture(path string, port int, logger *Logger) ([]*AvlPacket, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	reader, err := NewCaptureReader(f)
+	if err != nil {
+		return nil, err
+	}
+	ra := NewReassembler()
+	ra.Warn = logger.Error.Printf
+	suffix := ":" + strconv.Itoa(port)
+	for {
+		frame, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		seg := parseSegment(frame)
+		if seg == nil {
+			continue
+		}
+		if port != 0 && !strings.HasSuffix(seg.Dst, suffix) {
+			continue
+		}
+		ra.Add(seg)
+	}
+	return ra.Finish(), nil
+}
+
+func extract(packets []*AvlPacket, w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	for _, p := range packets {
+		res := &ExtractedPacket{Time: p.Time, Flow: p.Flow, Imei: p.Imei, Hex: hex.EncodeToString(p.Raw)}
+		_, packet, err := teltonika.DecodeTCPFromSlice(p.Raw, decodeConfig)
+		if err != nil {
+			res.Error = err.Error()
+		} else {
+			res.Packet = packet
+		}
+		if err := encoder.Encode(res); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replay sends the packets of each device over its own connection, the delays between the packets are the
+// capture delays divided by speed (no delay if speed is 0), the data packets wait for the server ack
+func replay(packets []*AvlPacket, address string, speed float64, logger *Logger) {
+	devices := make(map[string][]*AvlPacket)
+	var order []string
+	for _, p := range packets {
+		if _, ok := devices[p.Imei]; !ok {
+			order = append(order, p.Imei)
+		}
+		devices[p.Imei] = append(devices[p.Imei], p)
+	}
+	if len(packets) == 0 {
+		return
+	}
+	start := time.Now()
+	first := packets[0].Time
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	sent, failed := 0, 0
+	for _, imei := range order {
+		wg.Add(1)
+		go func(imei string, list []*AvlPacket) {
+			defer wg.Done()
+			n, err := replayDevice(imei, list, address, func(t time.Time) {
+				if speed > 0 {
+					time.Sleep(time.Until(start.Add(time.Duration(float64(t.Sub(first)) / speed))))
+				}
+			})
+			mu.Lock()
+			sent += n
+			if err != nil {
+				failed++
+				logger.Error.Printf("[%s]: replay error after %d packets (%v)", imei, n, err)
+			} else {
+				logger.Info.Printf("[%s]: %d packets replayed", imei, n)
+			}
+			mu.Unlock()
+		}(imei, devices[imei])
+	}
+	wg.Wait()
+	logger.Info.Printf("%d packets of %d devices replayed in %s, %d devices failed",
+		sent, len(order), time.Since(start).Round(time.Millisecond), failed)
+}
+
+func replayDevice(imei string, packets []*AvlPacket, address string, wait func(t time.Time)) (int, error) {
+	wait(packets[0].Time)
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	login := make([]byte, 2+len(imei))
+	binary.BigEndian.PutUint16(login, uint16(len(imei)))
+	copy(login[2:], imei)
+	if _, err = conn.Write(login); err != nil {
+		return 0, err
+	}
+	ack := make([]byte, 4)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 10))
+	if _, err = io.ReadFull(conn, ack[:1]); err != nil {
+		return 0, fmt.Errorf("login ack read error (%v)", err)
+	}
+	if ack[0] != 1 {
+		return 0, fmt.Errorf("login rejected")
+	}
+	for i, p := range packets {
+		wait(p.Time)
+		if _, err = conn.Write(p.Raw); err != nil {
+			return i, err
+		}
+		// codec 8, 8E and 16 packets are acked with the number of records
+		if codec := p.Raw[8]; codec == 0x08 || codec == 0x8E || codec == 0x10 {
+			_ = conn.SetReadDeadline(time.Now().Add(time.Second * 10))
+			if _, err = io.ReadFull(conn, ack); err != nil {
+				return i, fmt.Errorf("ack read error (%v)", err)
+			}
+			if expected := uint32(p.Raw[9]); binary.BigEndian.Uint32(ack) != expected {
+				return i + 1, fmt.Errorf("ack %d, expected %d", binary.BigEndian.Uint32(ack), expected)
+			}
+		}
+	}
+	return len(packets), nil
+}
+
+func main() {
+	var address string
+	var port int
+	var speed float64
+	flag.StringVar(&address, "replay", "", "replay the packets to the server at this address (extract to stdout if empty)")
+	flag.IntVar(&port, "port", 0, "server port of the device streams (any port if 0)")
+	flag.Float64Var(&speed, "speed", 1, "replay speed factor, 1 is the original speed, 0 sends without delays")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-port port] [-replay address [-speed factor]] capture.pcap\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	logger := &Logger{
+		Info:  log.New(os.Stderr, "INFO: ", log.Ldate|log.Ltime),
+		Error: log.New(os.Stderr, "ERROR: ", log.Ldate|log.Ltime),
+	}
+
+	packets, err := readCapture(flag.Arg(0), port, logger)
+	if err != nil {
+		logger.Error.Fatalf("capture read error (%v)", err)
+	}
+	logger.Info.Printf("%d packets extracted", len(packets))
+
+	if address == "" {
+		if err = extract(packets, os.Stdout); err != nil {
+			logger.Error.Fatalf("write error (%v)", err)
+		}
+		return
+	}
+	replay(packets, address, speed, logger)
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	linkNull     = 0
+	linkEthernet = 1
+	linkRaw      = 101
+	linkLinuxSll = 113
+	linkIPv4     = 228
+	linkIPv6     = 229
+)
+
+// Frame is a captured link layer frame
+type Frame struct {
+	Time     time.Time
+	LinkType uint32
+	Data     []byte
+}
+
+// CaptureReader reads the frames of a pcap or pcapng capture (the format is detected from the magic number)
+type CaptureReader struct {
+	r      *bufio.Reader
+	ng     bool
+	order  binary.ByteOrder
+	nano   bool
+	link   uint32
+	ifaces []iface
+}
+
+type iface struct {
+	link uint32
+	// resolution of the timestamps in units per second
+	resolution uint64
+}
+
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	cr := &CaptureReader{r: bufio.NewReaderSize(r, 1<<16)}
+	magic, err := cr.r.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("capture header read error (%v)", err)
+	}
+	switch {
+	case binary.LittleEndian.Uint32(magic) == 0x0A0D0D0A:
+		cr.ng = true
+		return cr, nil
+	case binary.LittleEndian.Uint32(magic) == 0xA1B2C3D4:
+		cr.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(magic) == 0xA1B2C3D4:
+		cr.order = binary.BigEndian
+	case binary.LittleEndian.Uint32(magic) == 0xA1B23C4D:
+		cr.order, cr.nano = binary.LittleEndian, true
+	case binary.BigEndian.Uint32(magic) == 0xA1B23C4D:
+		cr.order, cr.nano = binary.BigEndian, true
+	default:
+		return nil, fmt.Errorf("unknown capture format (magic %x)", magic)
+	}
+	header := make([]byte, 24)
+	if _, err = io.ReadFull(cr.r, header); err != nil {
+		return nil, fmt.Errorf("pcap header read error (%v)", err)
+	}
+	cr.link = cr.order.Uint32(header[20:24]) & 0x0FFFFFFF
+	return cr, nil
+}
+
+// Next returns the next frame, io.EOF at the end of the capture
+func (cr *CaptureReader) Next() (*Frame, error) {
+	if cr.ng {
+		return cr.nextBlock()
+	}
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(cr.r, header); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	sec := int64(cr.order.Uint32(header[0:4]))
+	frac := int64(cr.order.Uint32(header[4:8]))
+	if !cr.nano {
+		frac *= 1000
+	}
+	data := make([]byte, cr.order.Uint32(header[8:12]))
+	if _, err := io.ReadFull(cr.r, data); err != nil {
+		return nil, fmt.Errorf("pcap record read error (%v)", err)
+	}
+	return &Frame{Time: time.Unix(sec, frac), LinkType: cr.link, Data: data}, nil
+}
+
+func (cr *CaptureReader) nextBlock() (*Frame, error) {
+	for {
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(cr.r, header); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, io.EOF
+			}
+			return nil, err
+		}
+		blockType := binary.LittleEndian.Uint32(header[0:4])
+		if blockType == 0x0A0D0D0A {
+			// the section header defines the byte order of the section
+			bom, err := cr.r.Peek(4)
+			if err != nil {
+				return nil, fmt.Errorf("pcapng section header read error (%v)", err)
+			}
+			if binary.LittleEndian.Uint32(bom) == 0x1A2B3C4D {
+				cr.order = binary.LittleEndian
+			} else {
+				cr.order = binary.BigEndian
+			}
+			cr.ifaces = nil
+		}
+		length := cr.order.Uint32(header[4:8])
+		if length < 12 {
+			return nil, fmt.Errorf("pcapng invalid block length %d", length)
+		}
+		body := make([]byte, length-8)
+		if _, err := io.ReadFull(cr.r, body); err != nil {
+			return nil, fmt.Errorf("pcapng block read error (%v)", err)
+		}
+		body = body[:len(body)-4]
+		switch cr.order.Uint32(header[0:4]) {
+		case 1: // interface description
+			if len(body) < 8 {
+				return nil, fmt.Errorf("pcapng invalid interface block")
+			}
+			cr.ifaces = append(cr.ifaces, iface{
+				link:       uint32(cr.order.Uint16(body[0:2])),
+				resolution: cr.tsResolution(body[8:]),
+			})
+		case 6: // enhanced packet
+			if len(body) < 20 {
+				return nil, fmt.Errorf("pcapng invalid packet block")
+			}
+			id := cr.order.Uint32(body[0:4])
+			if int(id) >= len(cr.ifaces) {
+				return nil, fmt.Errorf("pcapng packet of unknown interface %d", id)
+			}
+			ts := uint64(cr.order.Uint32(body[4:8]))<<32 | uint64(cr.order.Uint32(body[8:12]))
+			captured := cr.order.Uint32(body[12:16])
+			if int(captured) > len(body)-20 {
+				return nil, fmt.Errorf("pcapng invalid packet length %d", captured)
+			}
+			res := cr.ifaces[id].resolution
+			t := time.Unix(int64(ts/res), int64((ts%res)*uint64(time.Second)/res))
+			return &Frame{Time: t, LinkType: cr.ifaces[id].link, Data: body[20 : 20+captured]}, nil
+		case 3: // simple packet, no timestamp
+			if len(body) < 4 || len(cr.ifaces) == 0 {
+				return nil, fmt.Errorf("pcapng invalid simple packet block")
+			}
+			return &Frame{LinkType: cr.ifaces[0].link, Data: body[4:]}, nil
+		}
+	}
+}
+
+// tsResolution reads the if_tsresol option of an interface, microseconds by default
+func (cr *CaptureReader) tsResolution(options []byte) uint64 {
+	for len(options) >= 4 {
+		code := cr.order.Uint16(options[0:2])
+		length := int(cr.order.Uint16(options[2:4]))
+		if code == 0 || len(options) < 4+length {
+			break
+		}
+		if code == 9 && length >= 1 {
+			value := options[4]
+			var res uint64 = 1
+			if value&0x80 != 0 {
+				for i := byte(0); i < value&0x7F; i++ {
+					res *= 2
+				}
+			} else {
+				for i := byte(0); i < value; i++ {
+					res *= 10
+				}
+			}
+			return res
+		}
+		options = options[4+(length+3)/4*4:]
+	}
+	return 1000000
+}
+
+// Segment is the payload of a tcp segment
+type Segment struct {
+	Time    time.Time
+	Src     string
+	Dst     string
+	Seq     uint32
+	Syn     bool
+	Fin     bool
+	Payload []byte
+}
+
+// parseSegment extracts the tcp segment of a frame, nil if it is not a tcp frame
+func parseSegment(frame *Frame) *Segment {
+	data := frame.Data
+	var proto uint16
+	switch frame.LinkType {
+	case linkEthernet:
+		if len(data) < 14 {
+			return nil
+		}
+		proto = binary.BigEndian.Uint16(data[12:14])
+		data = data[14:]
+		for proto == 0x8100 && len(data) >= 4 { // vlan
+			proto = binary.BigEndian.Uint16(data[2:4])
+			data = data[4:]
+		}
+	case linkLinuxSll:
+		if len(data) < 16 {
+			return nil
+		}
+		proto = binary.BigEndian.Uint16(data[14:16])
+		data = data[16:]
+	case linkNull:
+		if len(data) < 4 {
+			return nil
+		}
+		family := binary.LittleEndian.Uint32(data[0:4])
+		if family > 0xFFFF {
+			family = binary.BigEndian.Uint32(data[0:4])
+		}
+		proto = 0x86DD
+		if family == 2 {
+			proto = 0x0800
+		}
+		data = data[4:]
+	case linkRaw, linkIPv4, linkIPv6:
+		if len(data) < 1 {
+			return nil
+		}
+		proto = 0x0800
+		if data[0]>>4 == 6 {
+			proto = 0x86DD
+		}
+	default:
+		return nil
+	}
+
+	var src, dst string
+	switch proto {
+	case 0x0800:
+		if len(data) < 20 || data[9] != 6 {
+			return nil
+		}
+		headerLength := int(data[0]&0x0F) * 4
+		total := int(binary.BigEndian.Uint16(data[2:4]))
+		if total < headerLength || len(data) < headerLength {
+			return nil
+		}
+		if total <= len(data) {
+			data = data[:total]
+		}
+		src = net.IP(data[12:16]).String()
+		dst = net.IP(data[16:20]).String()
+		data = data[headerLength:]
+	case 0x86DD:
+		if len(data) < 40 || data[6] != 6 {
+			return nil
+		}
+		payload := int(binary.BigEndian.Uint16(data[4:6]))
+		src = "[" + net.IP(data[8:24]).String() + "]"
+		dst = "[" + net.IP(data[24:40]).String() + "]"
+		data = data[40:]
+		if payload <= len(data) {
+			data = data[:payload]
+		}
+	default:
+		return nil
+	}
+
+	if len(data) < 20 {
+		return nil
+	}
+	offset := int(data[12]>>4) * 4
+	if offset < 20 || len(data) < offset {
+		return nil
+	}
+	flags := data[13]
+	return &Segment{
+		Time:    frame.Time,
+		Src:     fmt.Sprintf("%s:%d", src, binary.BigEndian.Uint16(data[0:2])),
+		Dst:     fmt.Sprintf("%s:%d", dst, binary.BigEndian.Uint16(data[2:4])),
+		Seq:     binary.BigEndian.Uint32(data[4:8]),
+		Syn:     flags&0x02 != 0,
+		Fin:     flags&0x01 != 0,
+		Payload: data[offset:],
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/binary"
+	"sort"
+	"time"
+)
+
+// AvlPacket is a Teltonika tcp packet of a device stream, Time is the capture time of its last segment
+type AvlPacket struct {
+	Time time.Time
+	Flow string
+	Imei string
+	Raw  []byte
+}
+
+// stream reassembles one direction of a tcp connection and splits it into the imei login and the tcp packets,
+// a direction not starting with an imei login (server responses, captures started mid-session) is ignored
+type stream struct {
+	flow    string
+	started bool
+	next    uint32
+	pending map[uint32]*Segment
+	buf     []byte
+	imei    string
+	ignored bool
+}
+
+// Reassembler collects the Teltonika tcp packets of all the streams of a capture
+type Reassembler struct {
+	streams map[string]*stream
+	Packets []*AvlPacket
+	// Warn is called for the dropped streams and data (optional)
+	Warn func(format string, args ...interface{})
+}
+
+func NewReassembler() *Reassembler {
+	return &Reassembler{streams: make(map[string]*stream)}
+}
+
+func (ra *Reassembler) warn(format string, args ...interface{}) {
+	if ra.Warn != nil {
+		ra.Warn(format, args...)
+	}
+}
+
+func (ra *Reassembler) Add(seg *Segment) {
+	flow := seg.Src + " > " + seg.Dst
+	s, ok := ra.streams[flow]
+	if !ok || (seg.Syn && s.started) {
+		s = &stream{flow: flow, pending: make(map[uint32]*Segment)}
+		ra.streams[flow] = s
+	}
+	if s.ignored {
+		return
+	}
+	seq := seg.Seq
+	if seg.Syn {
+		seq++
+		s.started = true
+		s.next = seq
+	} else if !s.started {
+		s.started = true
+		s.next = seq
+	}
+	if len(seg.Payload) == 0 {
+		return
+	}
+	seg.Seq = seq
+	s.pending[seq] = seg
+	ra.drain(s, seg.Time)
+}
+
+// drain appends the in order pending segments to the stream, the retransmitted bytes are skipped
+func (ra *Reassembler) drain(s *stream, t time.Time) {
+	for progress := true; progress; {
+		progress = false
+		for seq, seg := range s.pending {
+			diff := int32(seq - s.next)
+			end := int32(seq + uint32(len(seg.Payload)) - s.next)
+			if diff > 0 {
+				continue
+			}
+			delete(s.pending, seq)
+			if end <= 0 {
+				continue
+			}
+			s.buf = append(s.buf, seg.Payload[-diff:]...)
+			s.next += uint32(end)
+			progress = true
+		}
+	}
+	ra.split(s, t)
+}
+
+func (ra *Reassembler) split(s *stream, t time.Time) {
+	for !s.ignored {
+		if s.imei == "" {
+			if len(s.buf) < 2 {
+				return
+			}
+			length := int(binary.BigEndian.Uint16(s.buf[:2]))
+			if length == 0 || length > 32 {
+				ra.ignore(s, "no imei login")
+				return
+			}
+			if len(s.buf) < 2+length {
+				return
+			}
+			for _, c := range s.buf[2 : 2+length] {
+				if c < '0' || c > '9' {
+					ra.ignore(s, "no imei login")
+					return
+				}
+			}
+			s.imei = string(s.buf[2 : 2+length])
+			s.buf = s.buf[2+length:]
+			continue
+		}
+		if len(s.buf) < 8 {
+			return
+		}
+		if binary.BigEndian.Uint32(s.buf[:4]) != 0 {
+			ra.ignore(s, "invalid packet preamble")
+			return
+		}
+		length := int(binary.BigEndian.Uint32(s.buf[4:8]))
+		if len(s.buf) < 12+length {
+			return
+		}
+		raw := make([]byte, 12+length)
+		copy(raw, s.buf)
+		s.buf = s.buf[12+length:]
+		ra.Packets = append(ra.Packets, &AvlPacket{Time: t, Flow: s.flow, Imei: s.imei, Raw: raw})
+	}
+}
+
+func (ra *Reassembler) ignore(s *stream, reason string) {
+	if s.imei != "" {
+		ra.warn("%s: imei %s, stream dropped (%s)", s.flow, s.imei, reason)
+	}
+	s.ignored = true
+	s.buf = nil
+	s.pending = nil
+}
+
+// Finish reports the streams with missing segments or incomplete packets and sorts the packets by time
+func (ra *Reassembler) Finish() []*AvlPacket {
+	for _, s := range ra.streams {
+		if s.ignored || s.imei == "" {
+			continue
+		}
+		if len(s.pending) > 0 {
+			ra.warn("%s: imei %s, %d segments after a gap dropped", s.flow, s.imei, len(s.pending))
+		}
+		if len(s.buf) > 0 {
+			ra.warn("%s: imei %s, %d bytes of an incomplete packet dropped", s.flow, s.imei, len(s.buf))
+		}
+	}
+	sort.SliceStable(ra.Packets, func(i, j int) bool {
+		return ra.Packets[i].Time.Before(ra.Packets[j].Time)
+	})
+	return ra.Packets
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Logger struct {
+	Info  *log.Logger
+	Error *log.Logger
+}
+
+// RecordedFrame is a json line of the recorder files of the tcp server, KeyId is set for the encrypted frames
+type RecordedFrame struct {
+	Time  time.Time `json:"time"`
+	Imei  string    `json:"imei"`
+	Hex   string    `json:"hex"`
+	KeyId string    `json:"keyId,omitempty"`
+	Raw   []byte    `json:"-"`
+}
+
+// readKeys reads the recorder encryption keys, a json object of the key ids and the hex AES-256 keys (the keys of
+// the recorder encryption section of the server)
+func readKeys(path string) (map[string]cipher.AEAD, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config map[string]string
+	if err = json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("keys parse error (%v)", err)
+	}
+	keys := make(map[string]cipher.AEAD, len(config))
+	for keyId, value := range config {
+		key, err := hex.DecodeString(value)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("key '%s' must be 32 bytes (64 hex digits)", keyId)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		if keys[keyId], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// open decrypts an encrypted frame: the nonce followed by the ciphertext, the imei is the additional data
+func open(keys map[string]cipher.AEAD, frame *RecordedFrame) error {
+	aead, ok := keys[frame.KeyId]
+	if !ok {
+		return fmt.Errorf("key '%s' not found (-keys)", frame.KeyId)
+	}
+	if len(frame.Raw) < aead.NonceSize() {
+		return fmt.Errorf("encrypted frame too short")
+	}
+	raw, err := aead.Open(nil, frame.Raw[:aead.NonceSize()], frame.Raw[aead.NonceSize():], []byte(frame.Imei))
+	if err != nil {
+		return fmt.Errorf("decryption error (%v)", err)
+	}
+	frame.Raw = raw
+	return nil
+}
+
+// readFrames reads the recorder files (a directory stands for its raw-*.jsonl files), the frames of the devices
+// in the filter only if it isn't empty, sorted by time. The encrypted frames are decrypted with keys
+func readFrames(paths []string, imeis map[string]bool, keys map[string]cipher.AEAD) ([]*RecordedFrame, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(path, "raw-*.jsonl"))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+
+	var frames []*RecordedFrame
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+		line := 0
+		for scanner.Scan() {
+			line++
+			frame := &RecordedFrame{}
+			if err = json.Unmarshal(scanner.Bytes(), frame); err != nil {
+				_ = f.Close()
+				return nil, fmt.Errorf("%s:%d: parse error (%v)", name, line, err)
+			}
+			if len(imeis) > 0 && !imeis[frame.Imei] {
+				continue
+			}
+			if frame.Raw, err = hex.DecodeString(frame.Hex); err != nil {
+				_ = f.Close()
+				return nil, fmt.Errorf("%s:%d: invalid frame", name, line)
+			}
+			if frame.KeyId != "" {
+				if err = open(keys, frame); err != nil {
+					_ = f.Close()
+					return nil, fmt.Errorf("%s:%d: %v", name, line, err)
+				}
+			}
+			if len(frame.Raw) < 10 {
+				_ = f.Close()
+				return nil, fmt.Errorf("%s:%d: invalid frame", name, line)
+			}
+			frames = append(frames, frame)
+		}
+		err = scanner.Err()
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: read error (%v)", name, err)
+		}
+	}
+	sort.SliceStable(frames, func(i, j int) bool { return frames[i].Time.Before(frames[j].Time) })
+	return frames, nil
+}
+
+// replay sends the frames of each device over its own connection, the delays between the frames are the
+// recorded delays divided by speed (no delay if speed is 0), the data packets wait for the server ack
+func replay(frames []*RecordedFrame, address string, speed float64, logger *Logger) {
+	devices := make(map[string][]*RecordedFrame)
+	var order []string
+	for _, f := range frames {
+		if _, ok := devices[f.Imei]; !ok {
+			order = append(order, f.Imei)
+		}
+		devices[f.Imei] = append(devices[f.Imei], f)
+	}
+	if len(frames) == 0 {
+		return
+	}
+	start := time.Now()
+	first := frames[0].Time
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	sent, failed := 0, 0
+	for _, imei := range order {
+		wg.Add(1)
+		go func(imei string, list []*RecordedFrame) {
+			defer wg.Done()
+			n, err := replayDevice(imei, list, address, func(t time.Time) {
+				if speed > 0 {
+					time.Sleep(time.Until(start.Add(time.Duration(float64(t.Sub(first)) / speed))))
+				}
+			})
+			mu.Lock()
+			sent += n
+			if err != nil {
+				failed++
+				logger.Error.Printf("[%s]: replay error after %d frames (%v)", imei, n, err)
+			} else {
+				logger.Info.Printf("[%s]: %d frames replayed", imei, n)
+			}
+			mu.Unlock()
+		}(imei, devices[imei])
+	}
+	wg.Wait()
+	logger.Info.Printf("%d frames of %d devices replayed in %s, %d devices failed",
+		sent, len(order), time.Since(start).Round(time.Millisecond), failed)
+}
+
+func replayDevice(imei string, frames []*RecordedFrame, address string, wait func(t time.Time)) (int, error) {
+	wait(frames[0].Time)
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	login := make([]byte, 2+len(imei))
+	binary.BigEndian.PutUint16(login, uint16(len(imei)))
+	copy(login[2:], imei)
+	if _, err = conn.Write(login); err != nil {
+		return 0, err
+	}
+	ack := make([]byte, 4)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 10))
+	if _, err = io.ReadFull(conn, ack[:1]); err != nil {
+		return 0, fmt.Errorf("login ack read error (%v)", err)
+	}
+	if ack[0] != 1 {
+		return 0, fmt.Errorf("login rejected")
+	}
+	for i, f := range frames {
+		wait(f.Time)
+		if _, err = conn.Write(f.Raw); err != nil {
+			return i, err
+		}
+		// codec 8, 8E and 16 packets are acked with the number of records
+		if codec := f.Raw[8]; codec == 0x08 || codec == 0x8E || codec == 0x10 {
+			_ = conn.SetReadDeadline(time.Now().Add(time.Second * 10))
+			if _, err = io.ReadFull(conn, ack); err != nil {
+				return i, fmt.Errorf("ack read error (%v)", err)
+			}
+			if expected := uint32(f.Raw[9]); binary.BigEndian.Uint32(ack) != expected {
+				return i + 1, fmt.Errorf("ack %d, expected %d", binary.BigEndian.Uint32(ack), expected)
+			}
+		}
+	}
+	return len(frames), nil
+}
+
+func main() {
+	var address string
+	var speed float64
+	var imeiList string
+	var keysPath string
+	flag.StringVar(&address, "address", "127.0.0.1:8080", "tcp server address")
+	flag.Float64Var(&speed, "speed", 1, "replay speed factor, 1 is the original speed, 0 sends without delays")
+	flag.StringVar(&imeiList, "imei", "", "comma separated imeis to replay (all devices if empty)")
+	flag.StringVar(&keysPath, "keys", "", "json file of the recorder encryption keys (key id to hex key) for encrypted recordings")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-address address] [-speed factor] [-imei imeis] [-keys file] file|dir ...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	logger := &Logger{
+		Info:  log.New(os.Stderr, "INFO: ", log.Ldate|log.Ltime),
+		Error: log.New(os.Stderr, "ERROR: ", log.Ldate|log.Ltime),
+	}
+
+	imeis := make(map[string]bool)
+	for _, imei := range strings.Split(imeiList, ",") {
+		if imei = strings.TrimSpace(imei); imei != "" {
+			imeis[imei] = true
+		}
+	}
+	var keys map[string]cipher.AEAD
+	if keysPath != "" {
+		var err error
+		if keys, err = readKeys(keysPath); err != nil {
+			logger.Error.Fatalf("keys read error (%v)", err)
+		}
+	}
+	frames, err := readFrames(flag.Args(), imeis, keys)
+	if err != nil {
+		logger.Error.Fatalf("recording read error (%v)", err)
+	}
+	logger.Info.Printf("%d frames read", len(frames))
+	replay(frames, address, speed, logger)
+}
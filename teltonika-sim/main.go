@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var decodeConfig = &teltonika.DecodeConfig{IoElementsAlloc: teltonika.OnReadBuffer}
+
+type Logger struct {
+	Info  *log.Logger
+	Error *log.Logger
+}
+
+// SimConfig: the devices send a packet of Records generated records (Codec 8 or 8E) every Interval,
+// or the packets of Packets (tcp packets read from a file) in a loop
+type SimConfig struct {
+	Address  string
+	Codec    teltonika.CodecId
+	Interval time.Duration
+	Records  int
+	Packets  [][]byte
+	Lat      float64
+	Lng      float64
+}
+
+type Stats struct {
+	connected int64
+	sent      int64
+	acked     int64
+	errors    int64
+	commands  int64
+}
+
+// Device is a simulated device, one connection to the server at a time
+type Device struct {
+	imei   string
+	config *SimConfig
+	stats  *Stats
+	logger *Logger
+	rnd    *rand.Rand
+	lat    float64
+	lng    float64
+	angle  float64
+	speed  float64
+	next   int
+}
+
+func NewDevice(imei string, config *SimConfig, stats *Stats, logger *Logger) *Device {
+	seed, _ := strconv.ParseInt(imei[len(imei)-9:], 10, 64)
+	rnd := rand.New(rand.NewSource(seed))
+	return &Device{
+		imei:   imei,
+		config: config,
+		stats:  stats,
+		logger: logger,
+		rnd:    rnd,
+		lat:    config.Lat + (rnd.Float64()-0.5)*0.1,
+		lng:    config.Lng + (rnd.Float64()-0.5)*0.1,
+		angle:  rnd.Float64() * 360,
+	}
+}
+
+// Run keeps the device connected until stop is closed, reconnecting after errors
+func (d *Device) Run(stop <-chan struct{}) {
+	for {
+		err := d.session(stop)
+		if err == nil {
+			return
+		}
+		atomic.AddInt64(&d.stats.errors, 1)
+		d.logger.Error.Printf("[%s]: %v, reconnecting", d.imei, err)
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Second * 5):
+		}
+	}
+}
+
+func (d *Device) session(stop <-chan struct{}) error {
+	conn, err := net.Dial("tcp", d.config.Address)
+	if err != nil {
+		return fmt.Errorf("dial error (%v)", err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	login := make([]byte, 2+len(d.imei))
+	binary.BigEndian.PutUint16(login, uint16(len(d.imei)))
+	copy(login[2:], d.imei)
+	if _, err = conn.Write(login); err != nil {
+		return fmt.Errorf("login write error (%v)", err)
+	}
+	reader := bufio.NewReader(conn)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 10))
+	ack, err := reader.ReadByte()
+	if err != nil {
+		return fmt.Errorf("login ack read error (%v)", err)
+	}
+	if ack != 1 {
+		return fmt.Errorf("login rejected")
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	atomic.AddInt64(&d.stats.connected, 1)
+	defer atomic.AddInt64(&d.stats.connected, -1)
+
+	var writeMu sync.Mutex
+	write := func(buf []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		_ = conn.SetWriteDeadline(time.Now().Add(time.Second * 10))
+		_, err := conn.Write(buf)
+		return err
+	}
+	acks := make(chan uint32, 16)
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- d.read(reader, acks, write)
+	}()
+
+	ticker := time.NewTicker(d.config.Interval)
+	defer ticker.Stop()
+	for {
+		buf, records, err := d.packet()
+		if err != nil {
+			return err
+		}
+		if err = write(buf); err != nil {
+			return fmt.Errorf("packet write error (%v)", err)
+		}
+		atomic.AddInt64(&d.stats.sent, 1)
+		select {
+		case n := <-acks:
+			if n != records {
+				return fmt.Errorf("ack %d, expected %d", n, records)
+			}
+			atomic.AddInt64(&d.stats.acked, 1)
+		case err = <-readErr:
+			return err
+		case <-time.After(time.Second * 30):
+			return errors.New("ack timeout")
+		case <-stop:
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case err = <-readErr:
+			return err
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// read receives the acks and answers the Codec 12 commands of the server
+func (d *Device) read(reader *bufio.Reader, acks chan<- uint32, write func([]byte) error) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(reader, header[:4]); err != nil {
+			return fmt.Errorf("read error (%v)", err)
+		}
+		if binary.BigEndian.Uint32(header[:4]) != 0 {
+			acks <- binary.BigEndian.Uint32(header[:4])
+			continue
+		}
+		if _, err := io.ReadFull(reader, header[4:8]); err != nil {
+			return fmt.Errorf("read error (%v)", err)
+		}
+		length := binary.BigEndian.Uint32(header[4:8])
+		if length > 64*1024 {
+			return fmt.Errorf("invalid packet length %d", length)
+		}
+		buf := make([]byte, 12+length)
+		copy(buf, header)
+		if _, err := io.ReadFull(reader, buf[8:]); err != nil {
+			return fmt.Errorf("read error (%v)", err)
+		}
+		_, packet, err := teltonika.DecodeTCPFromSlice(buf, decodeConfig)
+		if err != nil {
+			return fmt.Errorf("packet decode error (%v)", err)
+		}
+		for _, msg := range packet.Messages {
+			if msg.Type != teltonika.TypeCommand {
+				continue
+			}
+			atomic.AddInt64(&d.stats.commands, 1)
+			response := d.respond(strings.TrimSpace(msg.Text))
+			d.logger.Info.Printf("[%s]: command '%s', response '%s'", d.imei, msg.Text, response)
+			out, err := teltonika.EncodePacket(&teltonika.Packet{
+				CodecID:  teltonika.Codec12,
+				Messages: []teltonika.Message{{Type: teltonika.TypeResponse, Text: response}},
+			})
+			if err != nil {
+				return err
+			}
+			if err = write(out); err != nil {
+				return fmt.Errorf("response write error (%v)", err)
+			}
+		}
+	}
+}
+
+func (d *Device) respond(command string) string {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return "Command not found"
+	}
+	switch strings.ToLower(fields[0]) {
+	case "getver":
+		return fmt.Sprintf("Ver:03.28.07_00 GPS:AXN_5.10_3333 Hw:FMB920 Mod:15 IMEI:%s Init:2026-1-1 0:0 Uptime:3600 MAC:000000000000 SPC:1(0) AXL:0 OBD:0 BL:1.10 BT:4", d.imei)
+	case "getgps":
+		return fmt.Sprintf("GPS:1 Sat:10 Lat:%.6f Long:%.6f Alt:120 Speed:%d Dir:%d Date: %s Time: %s",
+			d.lat, d.lng, int(d.speed), int(d.angle), time.Now().UTC().Format("2006/1/2"), time.Now().UTC().Format("15:04:05"))
+	case "getstatus":
+		return "Data Link: 1 GPRS: 1 Phone: 0 SIM: 0 OP: 24602 Signal: 5 NewSMS: 0 Roaming: 0 SMSFull: 0 LAC: 1 Cell ID: 1 NetType: 1 FwUpd:-"
+	case "getinfo":
+		return "RTC:2026/1/1 0:0 Init:2026/1/1 0:0 UpTime:3600s PWR:PwrVoltage RST:0 GPS:3 SAT:10 TTFF:30 TTLF:1 NOGPS: 0:0 SR:0 FG:0 FL:0 SMS:0 REC:0 MD:0 DB:0"
+	case "setdigout":
+		return "DOUT1:" + strings.Join(fields[1:], " ")
+	case "cpureset":
+		return "Reset"
+	}
+	return "Command accepted: " + command
+}
+
+// packet builds the next packet and returns the number of records the server must ack
+func (d *Device) packet() ([]byte, uint32, error) {
+	if len(d.config.Packets) > 0 {
+		buf := d.config.Packets[d.next%len(d.config.Packets)]
+		d.next++
+		return buf, uint32(buf[9]), nil
+	}
+	now := time.Now()
+	data := make([]teltonika.Data, d.config.Records)
+	for i := range data {
+		data[i] = d.record(now.Add(-d.config.Interval * time.Duration(d.config.Records-1-i) / time.Duration(d.config.Records)))
+	}
+	buf, err := teltonika.EncodePacket(&teltonika.Packet{CodecID: d.config.Codec, Data: data})
+	if err != nil {
+		return nil, 0, fmt.Errorf("packet encode error (%v)", err)
+	}
+	return buf, uint32(len(data)), nil
+}
+
+// record moves the device a step of a random walk
+func (d *Device) record(t time.Time) teltonika.Data {
+	d.speed = math.Max(0, math.Min(110, d.speed+(d.rnd.Float64()-0.4)*10))
+	d.angle = math.Mod(d.angle+(d.rnd.Float64()-0.5)*30+360, 360)
+	// km travelled since the previous record, 111 km a degree
+	step := d.speed * d.config.Interval.Hours() / float64(d.config.Records) / 111
+	d.lat += step * math.Cos(d.angle*math.Pi/180)
+	d.lng += step * math.Sin(d.angle*math.Pi/180) / math.Cos(d.lat*math.Pi/180)
+	ignition := byte(0)
+	if d.speed > 0 {
+		ignition = 1
+	}
+	voltage := make([]byte, 2)
+	binary.BigEndian.PutUint16(voltage, uint16(12000+d.rnd.Intn(2000)))
+	return teltonika.Data{
+		TimestampMs: uint64(t.UnixMilli()),
+		Lat:         d.lat,
+		Lng:         d.lng,
+		Altitude:    int16(100 + d.rnd.Intn(50)),
+		Angle:       uint16(d.angle),
+		Satellites:  uint8(6 + d.rnd.Intn(8)),
+		Speed:       uint16(d.speed),
+		Elements: []teltonika.IOElement{
+			{Id: 239, Value: []byte{ignition}},
+			{Id: 240, Value: []byte{ignition}},
+			{Id: 21, Value: []byte{byte(1 + d.rnd.Intn(5))}},
+			{Id: 66, Value: voltage},
+		},
+	}
+}
+
+// readPackets reads the tcp packets of a file, one hex packet per line
+func readPackets(path string) ([][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	var packets [][]byte
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		buf, err := hex.DecodeString(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: hex decode error (%v)", line, err)
+		}
+		_, packet, err := teltonika.DecodeTCPFromSlice(buf, decodeConfig)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: packet decode error (%v)", line, err)
+		}
+		if len(packet.Data) == 0 {
+			return nil, fmt.Errorf("line %d: not an avl data packet", line)
+		}
+		packets = append(packets, buf)
+	}
+	return packets, scanner.Err()
+}
+
+func main() {
+	config := &SimConfig{}
+	var devices int
+	var firstImei string
+	var codec string
+	var file string
+	var ramp time.Duration
+	var duration time.Duration
+	flag.StringVar(&config.Address, "address", "127.0.0.1:8080", "server address")
+	flag.IntVar(&devices, "devices", 10, "number of devices")
+	flag.StringVar(&firstImei, "imei", "350000000000000", "imei of the first device, the next devices count up")
+	flag.StringVar(&codec, "codec", "8e", "codec of the generated records: 8 or 8e")
+	flag.DurationVar(&config.Interval, "interval", time.Second*10, "interval between the packets of a device")
+	flag.IntVar(&config.Records, "records", 1, "records per generated packet")
+	flag.StringVar(&file, "file", "", "send the packets of this file (hex tcp packets, one per line) instead of generated records")
+	flag.Float64Var(&config.Lat, "lat", 54.6872, "latitude of the area of the generated records")
+	flag.Float64Var(&config.Lng, "lng", 25.2797, "longitude of the area of the generated records")
+	flag.DurationVar(&ramp, "ramp", time.Millisecond*10, "delay between the device connections")
+	flag.DurationVar(&duration, "duration", 0, "run duration (until interrupted if 0)")
+	flag.Parse()
+
+	logger := &Logger{
+		Info:  log.New(os.Stdout, "INFO: ", log.Ldate|log.Ltime),
+		Error: log.New(os.Stdout, "ERROR: ", log.Ldate|log.Ltime),
+	}
+
+	switch strings.ToLower(codec) {
+	case "8":
+		config.Codec = teltonika.Codec8
+	case "8e":
+		config.Codec = teltonika.Codec8E
+	default:
+		logger.Error.Fatalf("unknown codec '%s'", codec)
+	}
+	if config.Records < 1 || config.Records > 255 {
+		logger.Error.Fatalf("records must be between 1 and 255")
+	}
+	base, err := strconv.ParseUint(firstImei, 10, 64)
+	if err != nil || len(firstImei) != 15 {
+		logger.Error.Fatalf("invalid imei '%s'", firstImei)
+	}
+	if file != "" {
+		if config.Packets, err = readPackets(file); err != nil {
+			logger.Error.Fatalf("%s: %v", file, err)
+		}
+		if len(config.Packets) == 0 {
+			logger.Error.Fatalf("%s: no packets", file)
+		}
+	}
+
+	stats := &Stats{}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < devices; i++ {
+			device := NewDevice(fmt.Sprintf("%015d", base+uint64(i)), config, stats, logger)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				device.Run(stop)
+			}()
+			select {
+			case <-stop:
+				return
+			case <-time.After(ramp):
+			}
+		}
+	}()
+
+	var deadline <-chan time.Time
+	if duration > 0 {
+		deadline = time.After(duration)
+	}
+	ticker := time.NewTicker(time.Second * 10)
+	defer ticker.Stop()
+	for running := true; running; {
+		select {
+		case <-ticker.C:
+			logger.Info.Printf("connected %d, packets sent %d, acked %d, commands %d, errors %d",
+				atomic.LoadInt64(&stats.connected), atomic.LoadInt64(&stats.sent), atomic.LoadInt64(&stats.acked),
+				atomic.LoadInt64(&stats.commands), atomic.LoadInt64(&stats.errors))
+		case <-deadline:
+			running = false
+		}
+	}
+	close(stop)
+	wg.Wait()
+	logger.Info.Printf("done, packets sent %d, acked %d, commands %d, errors %d", atomic.LoadInt64(&stats.sent),
+		atomic.LoadInt64(&stats.acked), atomic.LoadInt64(&stats.commands), atomic.LoadInt64(&stats.errors))
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LiveEvent is an event of the /stream endpoint of the tcp server, its fields are the properties of
+// simple-tcp-server/stream.schema.json (the test checks them)
+type LiveEvent struct {
+	Type       string    `json:"type"`
+	Imei       string    `json:"imei"`
+	Time       time.Time `json:"time"`
+	Records    int       `json:"records"`
+	Timestamp  int64     `json:"timestamp"`
+	Lat        float64   `json:"lat"`
+	Lng        float64   `json:"lng"`
+	Speed      uint16    `json:"speed"`
+	Angle      uint16    `json:"angle"`
+	Satellites uint8     `json:"satellites"`
+	Error      string    `json:"error"`
+	Reason     string    `json:"reason"`
+}
+
+type device struct {
+	imei      string
+	lastSeen  time.Time
+	last      *LiveEvent
+	records   int
+	arrivals  []time.Time
+	connected bool
+}
+
+// Dashboard keeps the state of the devices built from the live events
+type Dashboard struct {
+	mutex     sync.Mutex
+	devices   map[string]*device
+	errors    []*LiveEvent
+	arrivals  []time.Time
+	records   int
+	status    string
+	maxErrors int
+}
+
+// rateWindow is the window of the message rates
+const rateWindow = time.Minute
+
+func NewDashboard(maxErrors int) *Dashboard {
+	return &Dashboard{devices: make(map[string]*device), maxErrors: maxErrors, status: "connecting"}
+}
+
+func (d *Dashboard) Handle(event *LiveEvent) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if event.Type == "error" {
+		d.errors = append(d.errors, event)
+		if len(d.errors) > d.maxErrors {
+			d.errors = d.errors[len(d.errors)-d.maxErrors:]
+		}
+		return
+	}
+	dev, ok := d.devices[event.Imei]
+	if !ok {
+		dev = &device{imei: event.Imei}
+		d.devices[event.Imei] = dev
+	}
+	switch event.Type {
+	case "connect":
+		dev.connected = true
+	case "disconnect":
+		dev.connected = false
+	case "record":
+		dev.connected = true
+		dev.last = event
+		dev.lastSeen = event.Time
+		dev.records += event.Records
+		dev.arrivals = append(dev.arrivals, event.Time)
+		d.arrivals = append(d.arrivals, event.Time)
+		d.records += event.Records
+	}
+}
+
+// Reset marks all the devices disconnected, the stream starts with the connected devices
+func (d *Dashboard) Reset() {
+	d.mutex.Lock()
+	for _, dev := range d.devices {
+		dev.connected = false
+	}
+	d.mutex.Unlock()
+}
+
+func (d *Dashboard) SetStatus(status string) {
+	d.mutex.Lock()
+	d.status = status
+	d.mutex.Unlock()
+}
+
+// prune drops the arrivals out of the rate window
+func prune(arrivals []time.Time, now time.Time) []time.Time {
+	i := 0
+	for i < len(arrivals) && now.Sub(arrivals[i]) > rateWindow {
+		i++
+	}
+	return arrivals[i:]
+}
+
+// Render draws the dashboard for a terminal of rows lines
+func (d *Dashboard) Render(server string, rows int) string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	now := time.Now()
+	d.arrivals = prune(d.arrivals, now)
+
+	list := make([]*device, 0, len(d.devices))
+	connected := 0
+	for _, dev := range d.devices {
+		dev.arrivals = prune(dev.arrivals, now)
+		if dev.connected {
+			connected++
+		}
+		list = append(list, dev)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].connected != list[j].connected {
+			return list[i].connected
+		}
+		return list[i].lastSeen.After(list[j].lastSeen)
+	})
+
+	var b strings.Builder
+	// home the cursor and clear the screen
+	b.WriteString("\x1b[H\x1b[2J")
+	fmt.Fprintf(&b, "\x1b[1mteltonika-top\x1b[0m  %s  %s  %s\n", server, d.status, now.Format("15:04:05"))
+	fmt.Fprintf(&b, "devices: %d connected, %d seen   packets: %.1f/min   records: %d total\n\n",
+		connected, len(d.devices), float64(len(d.arrivals))*float64(time.Minute)/float64(rateWindow), d.records)
+	fmt.Fprintf(&b, "\x1b[7m%-16s %-5s %8s %9s %11s %12s %5s %5s %4s %19s\x1b[0m\n",
+		"IMEI", "STATE", "PKT/MIN", "RECORDS", "LAT", "LNG", "SPEED", "ANGLE", "SAT", "LAST RECORD")
+
+	errorRows := len(d.errors)
+	if errorRows > 0 {
+		errorRows += 2
+	}
+	available := rows - 5 - errorRows
+	if available < 1 {
+		available = 1
+	}
+	for i, dev := range list {
+		if i == available-1 && len(list) > available {
+			fmt.Fprintf(&b, "... %d more devices\n", len(list)-i)
+			break
+		}
+		state := "\x1b[32mon \x1b[0m  "
+		if !dev.connected {
+			state = "\x1b[31moff\x1b[0m  "
+		}
+		fmt.Fprintf(&b, "%-16s %s %8d %9d", dev.imei, state, len(dev.arrivals), dev.records)
+		if dev.last != nil {
+			fmt.Fprintf(&b, " %11.6f %12.6f %5d %5d %4d %19s", dev.last.Lat, dev.last.Lng, dev.last.Speed,
+				dev.last.Angle, dev.last.Satellites, time.UnixMilli(dev.last.Timestamp).Format("2006-01-02 15:04:05"))
+		}
+		b.WriteString("\n")
+	}
+	if len(d.errors) > 0 {
+		b.WriteString("\n\x1b[1mrecent errors\x1b[0m\n")
+		for i := len(d.errors) - 1; i >= 0; i-- {
+			e := d.errors[i]
+			fmt.Fprintf(&b, "\x1b[31m%s %-16s %s\x1b[0m\n", e.Time.Local().Format("15:04:05"), e.Imei, e.Error)
+		}
+	}
+	return b.String()
+}
+
+// follow reads the event stream, reconnecting after errors
+func follow(stream *url.URL, dashboard *Dashboard) {
+	for {
+		err := read(stream, dashboard)
+		dashboard.SetStatus(fmt.Sprintf("\x1b[31mdisconnected (%v)\x1b[0m", err))
+		time.Sleep(time.Second * 3)
+	}
+}
+
+// the opcodes of the WebSocket frames (RFC 6455 section 5.2)
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xa
+	wsGuid  = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	// the server pings every 30 seconds, a silent connection is dead
+	readTimeout = time.Second * 90
+	maxFrame    = 1 << 16
+)
+
+// dial opens the WebSocket of the stream, the frames of the server are read from the returned reader
+func dial(stream *url.URL) (net.Conn, *bufio.Reader, error) {
+	address := stream.Host
+	if stream.Port() == "" {
+		address = net.JoinHostPort(stream.Hostname(), map[string]string{"ws": "80", "wss": "443"}[stream.Scheme])
+	}
+	dialer := &net.Dialer{Timeout: time.Second * 10}
+	var conn net.Conn
+	var err error
+	if stream.Scheme == "wss" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, &tls.Config{ServerName: stream.Hostname()})
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, 16)
+	if _, err = rand.Read(nonce); err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	_ = conn.SetDeadline(time.Now().Add(time.Second * 10))
+	_, err = fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", stream.RequestURI(), stream.Host, key)
+	reader := bufio.NewReader(conn)
+	var res *http.Response
+	if err == nil {
+		res, err = http.ReadResponse(reader, nil)
+	}
+	if err == nil && res.StatusCode != http.StatusSwitchingProtocols {
+		err = fmt.Errorf("status %s", res.Status)
+	}
+	sum := sha1.Sum([]byte(key + wsGuid))
+	if err == nil && res.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+		err = fmt.Errorf("bad websocket handshake")
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, reader, nil
+}
+
+// readFrame reads a frame of the server (unmasked)
+func readFrame(reader io.Reader) (byte, []byte, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(reader, header[:2]); err != nil {
+		return 0, nil, err
+	}
+	opcode := header[0] & 0x0f
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		if _, err := io.ReadFull(reader, header[:2]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(header[:2]))
+	case 127:
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(header)
+	}
+	if length > maxFrame {
+		return 0, nil, fmt.Errorf("frame of %d bytes", length)
+	}
+	payload := make([]byte, length)
+	_, err := io.ReadFull(reader, payload)
+	return opcode, payload, err
+}
+
+// writeFrame writes a control frame of the client, masked as RFC 6455 requires
+func writeFrame(conn net.Conn, opcode byte, payload []byte) error {
+	mask := make([]byte, 4)
+	if _, err := rand.Read(mask); err != nil {
+		return err
+	}
+	frame := append([]byte{0x80 | opcode, 0x80 | byte(len(payload))}, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(time.Second * 10))
+	_, err := conn.Write(frame)
+	return err
+}
+
+func read(stream *url.URL, dashboard *Dashboard) error {
+	conn, reader, err := dial(stream)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	dashboard.Reset()
+	dashboard.SetStatus("\x1b[32mlive\x1b[0m")
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(readTimeout))
+		opcode, payload, err := readFrame(reader)
+		if err != nil {
+			return err
+		}
+		switch opcode {
+		case wsText:
+			event := &LiveEvent{}
+			if err := json.Unmarshal(payload, event); err != nil {
+				continue
+			}
+			dashboard.Handle(event)
+		case wsPing:
+			// control frames carry at most 125 bytes
+			if err := writeFrame(conn, wsPong, payload); err != nil {
+				return err
+			}
+		case wsClose:
+			_ = writeFrame(conn, wsClose, nil)
+			return fmt.Errorf("stream closed")
+		}
+	}
+}
+
+func main() {
+	var server string
+	var rows int
+	var errors int
+	var refresh time.Duration
+	flag.StringVar(&server, "http", "127.0.0.1:8081", "http address of the tcp server")
+	flag.IntVar(&rows, "rows", 0, "terminal rows (the LINES environment variable or 40 if 0)")
+	flag.IntVar(&errors, "errors", 5, "number of recent errors shown")
+	flag.DurationVar(&refresh, "refresh", time.Second, "refresh interval")
+	flag.Parse()
+
+	if rows <= 0 {
+		if _, err := fmt.Sscan(os.Getenv("LINES"), &rows); err != nil || rows <= 0 {
+			rows = 40
+		}
+	}
+	address := server
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	stream, err := url.Parse(strings.TrimSuffix(address, "/") + "/stream")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bad server address (%v)\n", err)
+		os.Exit(2)
+	}
+	// the stream is a websocket, an http address tells where the server is
+	stream.Scheme = map[string]string{"http": "ws", "https": "wss", "ws": "ws", "wss": "wss"}[stream.Scheme]
+	if stream.Scheme == "" {
+		fmt.Fprintf(os.Stderr, "unsupported server address '%s'\n", server)
+		os.Exit(2)
+	}
+
+	dashboard := NewDashboard(errors)
+	go follow(stream, dashboard)
+	for range time.Tick(refresh) {
+		fmt.Print(dashboard.Render(server, rows))
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// TestLiveEventSchema keeps LiveEvent in step with the schema of the events of the tcp server
+func TestLiveEventSchema(t *testing.T) {
+	data, err := os.ReadFile("../simple-tcp-server/stream.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema struct {
+		Properties map[string]json.RawMessage `json:"properties"`
+	}
+	if err = json.Unmarshal(data, &schema); err != nil {
+		t.Fatal(err)
+	}
+	var properties, fields []string
+	for name := range schema.Properties {
+		properties = append(properties, name)
+	}
+	typ := reflect.TypeOf(LiveEvent{})
+	for i := 0; i < typ.NumField(); i++ {
+		fields = append(fields, typ.Field(i).Tag.Get("json"))
+	}
+	sort.Strings(properties)
+	sort.Strings(fields)
+	if !reflect.DeepEqual(fields, properties) {
+		t.Errorf("LiveEvent fields %v, schema properties %v", fields, properties)
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		frame   []byte
+		opcode  byte
+		payload []byte
+		err     bool
+	}{
+		// example of RFC 6455 section 5.7
+		{"text", []byte{0x81, 0x05, 'H', 'e', 'l', 'l', 'o'}, wsText, []byte("Hello"), false},
+		{"ping", []byte{0x89, 0x00}, wsPing, []byte{}, false},
+		{"16 bit length", append([]byte{0x81, 126, 0x01, 0x00}, bytes.Repeat([]byte{'a'}, 256)...), wsText,
+			bytes.Repeat([]byte{'a'}, 256), false},
+		{"too long", []byte{0x81, 127, 0, 0, 0, 0, 0x10, 0, 0, 0}, 0, nil, true},
+		{"truncated", []byte{0x81, 0x05, 'H'}, 0, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opcode, payload, err := readFrame(bytes.NewReader(tt.frame))
+			if (err != nil) != tt.err {
+				t.Fatalf("readFrame() error %v", err)
+			}
+			if err == nil && (opcode != tt.opcode || !bytes.Equal(payload, tt.payload)) {
+				t.Errorf("readFrame() = %x %q, want %x %q", opcode, payload, tt.opcode, tt.payload)
+			}
+		})
+	}
+}
+
+func TestRead(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/stream" || r.Header.Get("Upgrade") != "websocket" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+		sum := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + wsGuid))
+		event := `{"type":"record","imei":"352093081452251","time":"2024-01-01T00:00:00Z","records":3,"lat":54.5}`
+		response := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n" +
+			string([]byte{0x80 | wsText, byte(len(event))}) + event + string([]byte{0x80 | wsClose, 0})
+		_, _ = conn.Write([]byte(response))
+		// the close answer of the client
+		_, _, _ = readFrame(conn)
+	}))
+	defer server.Close()
+
+	stream, _ := url.Parse(strings.Replace(server.URL, "http://", "ws://", 1) + "/stream")
+	dashboard := NewDashboard(5)
+	if err := read(stream, dashboard); err == nil || err.Error() != "stream closed" {
+		t.Errorf("read() error %v, want stream closed", err)
+	}
+	dev, ok := dashboard.devices["352093081452251"]
+	if !ok || !dev.connected || dev.records != 3 || dev.last.Lat != 54.5 {
+		t.Errorf("device %+v", dev)
+	}
+}